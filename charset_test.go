@@ -0,0 +1,47 @@
+package main
+
+// Tests of the charset decoding of message bodies and headers. Like protocol_test.go
+// they are run with one of the two builds named explicitly:
+//
+//     go test main.go privdrop_unix.go charset_test.go
+//     go test sc_debian.go privdrop_unix.go charset_test.go
+
+import "testing"
+
+func TestDecodeCharset(t *testing.T) {
+    tests := []struct {
+        text, charset, want string
+    }{
+        {"\x80 5 \x93ok\x94 caf\xe9", "windows-1252", "€ 5 “ok” café"},
+        {"\x80 5 \x93ok\x94 caf\xe9", "Windows-1252", "€ 5 “ok” café"},
+        {"caf\xe9", "iso-8859-1", "café"},
+        {"\xa4", "iso-8859-15", "€"},
+        {"\xf0\xd2\xc9\xd7\xc5\xd4", "koi8-r", "Привет"},
+        {"caf\xe9 ok", "", "café ok"},
+        {"caf\xe9 ok", "us-ascii", "café ok"},
+        {"café", "", "café"},
+        {"café", "utf-8", "café"},
+        {"caf\xe9", "x-unknown", "caf\xe9"},
+    }
+    for _, test := range tests {
+        if got := decodeCharset([]byte(test.text), test.charset); got != test.want {
+            t.Errorf("decodeCharset(%q, %q) = %q, want %q", test.text, test.charset, got, test.want)
+        }
+    }
+}
+
+func TestDecodeHeader(t *testing.T) {
+    tests := []struct {
+        value, want string
+    }{
+        {"=?windows-1252?Q?=80_Alarm_=93Hof=94?=", "€ Alarm “Hof”"},
+        {"=?ISO-8859-1?Q?Bewegung_erkannt_=E4?=", "Bewegung erkannt ä"},
+        {"=?UTF-8?B?QmV3ZWd1bmcgw6Q=?=", "Bewegung ä"},
+        {"Bewegung \xe4 erkannt", "Bewegung ä erkannt"},
+    }
+    for _, test := range tests {
+        if got := decodeHeader(test.value); got != test.want {
+            t.Errorf("decodeHeader(%q) = %q, want %q", test.value, got, test.want)
+        }
+    }
+}
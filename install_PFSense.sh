@@ -13,6 +13,8 @@ INSTALL_DIR="/opt/smtp-to-gotify"
 SOURCE_DIR="/tmp/smtp-to-gotify-src"
 MAIN_GO_URL="https://raw.githubusercontent.com/NeoMetra/STG/main/main.go"
 MAIN_GO_FILE="${SOURCE_DIR}/main.go"
+PRIVDROP_GO_URL="https://raw.githubusercontent.com/NeoMetra/STG/main/privdrop_unix.go"
+PRIVDROP_GO_FILE="${SOURCE_DIR}/privdrop_unix.go"
 BINARY_DEST="${INSTALL_DIR}/${BINARY_NAME}"
 SERVICE_SCRIPT="/usr/local/etc/rc.d/smtp_to_gotify"
 CONFIG_DIR="${INSTALL_DIR}"
@@ -211,6 +213,17 @@ else
     echo "${GREEN}Source code downloaded to ${MAIN_GO_FILE}. ${CHECKMARK}${NC}"
 fi
 
+# Download the privilege drop helper used by run_as_user
+echo "${YELLOW}Downloading source code from ${PRIVDROP_GO_URL}...${NC}"
+fetch -o "${PRIVDROP_GO_FILE}" "${PRIVDROP_GO_URL}"
+if [ $? -ne 0 ]; then
+    echo "${RED}Error: Failed to download source code from ${PRIVDROP_GO_URL}. Please check internet connectivity.${NC}"
+    rm -rf "${SOURCE_DIR}"
+    exit 1
+else
+    echo "${GREEN}Source code downloaded to ${PRIVDROP_GO_FILE}. ${CHECKMARK}${NC}"
+fi
+
 # Initialize Go module in the source directory
 echo "${YELLOW}Initializing Go module in ${SOURCE_DIR}...${NC}"
 cd "${SOURCE_DIR}"
@@ -236,7 +249,7 @@ fi
 
 # Compile the source code into a binary
 echo "${YELLOW}Compiling source code to binary with ${GO_CMD} build...${NC}"
-${GO_CMD} build -o "${BINARY_DEST}" "${MAIN_GO_FILE}"
+${GO_CMD} build -o "${BINARY_DEST}" "${MAIN_GO_FILE}" "${PRIVDROP_GO_FILE}"
 if [ $? -ne 0 ]; then
     echo "${RED}Error: Failed to compile source code. Please ensure ${GO_CMD} is installed correctly and dependencies are resolved.${NC}"
     rm -rf "${SOURCE_DIR}"
@@ -326,6 +339,8 @@ command_args="start"
 start_cmd="${name}_start"
 stop_cmd="${name}_stop"
 status_cmd="${name}_status"
+reload_cmd="${name}_reload"
+extra_commands="reload"
 
 smtp_to_gotify_start()
 {
@@ -353,6 +368,18 @@ smtp_to_gotify_stop()
     fi
 }
 
+smtp_to_gotify_reload()
+{
+    if [ -f "${pidfile}" ]; then
+        pid=$(cat "${pidfile}")
+        echo "Reloading ${name} configuration (PID: ${pid})..."
+        kill -HUP "${pid}"
+    else
+        echo "${name} is not running."
+        return 1
+    fi
+}
+
 smtp_to_gotify_status()
 {
     if [ -f "${pidfile}" ]; then
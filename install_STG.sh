@@ -17,6 +17,8 @@ CONFIG_FILE="${CONFIG_DIR}/config.yaml"
 PFSENSE_MAIN_GO_URL="https://raw.githubusercontent.com/NeoMetra/STG/main/main.go"
 DEBIAN_MAIN_GO_URL="https://raw.githubusercontent.com/NeoMetra/STG/main/sc_debian.go"
 MAIN_GO_FILE="${SOURCE_DIR}/main.go"
+PRIVDROP_GO_URL="https://raw.githubusercontent.com/NeoMetra/STG/main/privdrop_unix.go"
+PRIVDROP_GO_FILE="${SOURCE_DIR}/privdrop_unix.go"
 GO_VERSION="go"
 
 # Check if tput is available and terminal supports colors
@@ -298,6 +300,16 @@ install_pfsense() {
     else
         echo "${GREEN}Source code downloaded to ${MAIN_GO_FILE}. ${CHECKMARK}${NC}"
     fi
+    # Download the privilege drop helper used by run_as_user
+    echo "${YELLOW}Downloading source code from ${PRIVDROP_GO_URL}...${NC}"
+    fetch -o "${PRIVDROP_GO_FILE}" "${PRIVDROP_GO_URL}"
+    if [ $? -ne 0 ]; then
+        echo "${RED}Error: Failed to download source code from ${PRIVDROP_GO_URL}. Please check internet connectivity.${NC}"
+        rm -rf "${SOURCE_DIR}"
+        exit 1
+    else
+        echo "${GREEN}Source code downloaded to ${PRIVDROP_GO_FILE}. ${CHECKMARK}${NC}"
+    fi
     # Initialize Go module in the source directory
     echo "${YELLOW}Initializing Go module in ${SOURCE_DIR}...${NC}"
     cd "${SOURCE_DIR}"
@@ -321,7 +333,7 @@ install_pfsense() {
     fi
     # Compile the source code into a binary
     echo "${YELLOW}Compiling source code to binary with ${GO_CMD} build...${NC}"
-    ${GO_CMD} build -o "${BINARY_DEST}" "${MAIN_GO_FILE}"
+    ${GO_CMD} build -o "${BINARY_DEST}" "${MAIN_GO_FILE}" "${PRIVDROP_GO_FILE}"
     if [ $? -ne 0 ]; then
         echo "${RED}Error: Failed to compile source code. Please ensure ${GO_CMD} is installed correctly and dependencies are resolved.${NC}"
         rm -rf "${SOURCE_DIR}"
@@ -618,6 +630,16 @@ install_debian() {
     else
         echo "${GREEN}Source code downloaded to ${MAIN_GO_FILE}. ${CHECKMARK}${NC}"
     fi
+    # Download the privilege drop helper used by run_as_user
+    echo "${YELLOW}Downloading source code from ${PRIVDROP_GO_URL}...${NC}"
+    wget -O "${PRIVDROP_GO_FILE}" "${PRIVDROP_GO_URL}"
+    if [ $? -ne 0 ]; then
+        echo "${RED}Error: Failed to download source code from ${PRIVDROP_GO_URL}. Please check internet connectivity.${NC}"
+        rm -rf "${SOURCE_DIR}"
+        exit 1
+    else
+        echo "${GREEN}Source code downloaded to ${PRIVDROP_GO_FILE}. ${CHECKMARK}${NC}"
+    fi
     # Initialize Go module in the source directory
     echo "${YELLOW}Initializing Go module in ${SOURCE_DIR}...${NC}"
     cd "${SOURCE_DIR}"
@@ -641,7 +663,7 @@ install_debian() {
     fi
     # Compile the source code into a binary
     echo "${YELLOW}Compiling source code to binary with ${GO_CMD} build...${NC}"
-    ${GO_CMD} build -o "${BINARY_DEST}" "${MAIN_GO_FILE}"
+    ${GO_CMD} build -o "${BINARY_DEST}" "${MAIN_GO_FILE}" "${PRIVDROP_GO_FILE}"
     if [ $? -ne 0 ]; then
         echo "${RED}Error: Failed to compile source code. Please ensure ${GO_CMD} is installed correctly and dependencies are resolved.${NC}"
         rm -rf "${SOURCE_DIR}"
@@ -703,6 +725,21 @@ install_debian() {
     else
         echo "${GREEN}Directory permissions and ownership set. ${CHECKMARK}${NC}"
     fi
+    # Create systemd credential files so secrets stay out of config.yaml and the environment
+    CREDENTIALS_DIR="${INSTALL_DIR}/credentials"
+    echo "${YELLOW}Creating credential files in ${CREDENTIALS_DIR}...${NC}"
+    mkdir -p "${CREDENTIALS_DIR}"
+    chmod 700 "${CREDENTIALS_DIR}"
+    [ -f "${CREDENTIALS_DIR}/smtp_password" ] || printf '%s' "password" > "${CREDENTIALS_DIR}/smtp_password"
+    [ -f "${CREDENTIALS_DIR}/gotify_token" ] || : > "${CREDENTIALS_DIR}/gotify_token"
+    chmod 600 "${CREDENTIALS_DIR}/smtp_password" "${CREDENTIALS_DIR}/gotify_token"
+    chown -R root:root "${CREDENTIALS_DIR}"
+    if [ $? -ne 0 ]; then
+        echo "${RED}Error: Failed to create credential files in ${CREDENTIALS_DIR}${NC}"
+        exit 1
+    else
+        echo "${GREEN}Credential files created. ${CHECKMARK}${NC}"
+    fi
     # Create the systemd service file for Debian
     SERVICE_FILE="/etc/systemd/system/smtp-to-gotify.service"
     echo "${YELLOW}Creating systemd service file at ${SERVICE_FILE}...${NC}"
@@ -717,6 +754,8 @@ User=root
 Group=root
 WorkingDirectory=/opt/smtp-to-gotify
 Environment=RUN_AS_SERVICE=true
+LoadCredential=smtp_password:/opt/smtp-to-gotify/credentials/smtp_password
+LoadCredential=gotify_token:/opt/smtp-to-gotify/credentials/gotify_token
 ExecStart=/opt/smtp-to-gotify/smtp-to-gotify start
 Restart=always
 RestartSec=10
@@ -775,6 +814,7 @@ EOF
     echo "The ${BINARY_NAME} binary has been installed to ${INSTALL_DIR}."
     echo "The systemd service file has been created at ${SERVICE_FILE} and enabled."
     echo "A placeholder config file has been created at ${CONFIG_FILE}. Please edit it with your settings."
+    echo "The SMTP password and Gotify token are loaded from ${CREDENTIALS_DIR} and override config.yaml."
     echo "To start the service now, run:"
     echo "  ${GREEN}systemctl start smtp-to-gotify${NC}"
     echo "The service will start automatically on boot."
@@ -0,0 +1,27 @@
+//go:build unix
+
+package main
+
+import (
+    "fmt"
+    "syscall"
+)
+
+// Switching the process identity needs Unix-only system calls, so it is kept out of
+// main.go and sc_debian.go, which must still build on Windows. Build this file
+// together with either of them to enable run_as_user.
+func init() {
+    setProcessIdentity = func(uid, gid int, groups []int) error {
+        // Groups first: once the uid is dropped the process may no longer change them
+        if err := syscall.Setgroups(groups); err != nil {
+            return fmt.Errorf("failed to set supplementary groups: %v", err)
+        }
+        if err := syscall.Setgid(gid); err != nil {
+            return fmt.Errorf("failed to set group ID %d: %v", gid, err)
+        }
+        if err := syscall.Setuid(uid); err != nil {
+            return fmt.Errorf("failed to set user ID %d: %v", uid, err)
+        }
+        return nil
+    }
+}
@@ -0,0 +1,443 @@
+package main
+
+// Tests of the SMTP command parsing and sequencing. main.go and sc_debian.go are
+// alternative builds of the same program, so the files are named explicitly:
+//
+//     go test main.go privdrop_unix.go protocol_test.go
+//     go test sc_debian.go privdrop_unix.go protocol_test.go
+
+import (
+    "bufio"
+    "encoding/json"
+    "fmt"
+    "io"
+    "net"
+    "net/http"
+    "net/http/httptest"
+    "path/filepath"
+    "reflect"
+    "strings"
+    "testing"
+    "time"
+
+    "github.com/spf13/viper"
+)
+
+func TestCheckSequence(t *testing.T) {
+    tests := []struct {
+        state smtpState
+        verb  string
+        want  string
+    }{
+        {stateConnected, "HELO", ""},
+        {stateConnected, "EHLO", ""},
+        {stateConnected, "NOOP", ""},
+        {stateConnected, "RSET", ""},
+        {stateConnected, "QUIT", ""},
+        {stateConnected, "STARTTLS", "503 5.5.1 Send EHLO first"},
+        {stateConnected, "AUTH", "503 5.5.1 Send EHLO first"},
+        // handleConnection greets implicitly unless smtp.strict_sequence is set
+        {stateConnected, "MAIL", "503 5.5.1 Send HELO/EHLO first"},
+        {stateConnected, "RCPT", "503 5.5.1 Need MAIL command first"},
+        {stateConnected, "DATA", "503 5.5.1 Need MAIL command first"},
+        {stateConnected, "XCLIENT", ""},
+        {stateGreeted, "STARTTLS", ""},
+        {stateGreeted, "AUTH", ""},
+        {stateGreeted, "MAIL", ""},
+        {stateGreeted, "RCPT", "503 5.5.1 Need MAIL command first"},
+        {stateGreeted, "DATA", "503 5.5.1 Need MAIL command first"},
+        {stateGreeted, "BDAT", "503 5.5.1 Need MAIL command first"},
+        {stateGreeted, "XCLIENT", ""},
+        {stateMail, "MAIL", "503 5.5.1 Sender already specified"},
+        {stateMail, "AUTH", "503 5.5.1 AUTH not permitted during a mail transaction"},
+        {stateMail, "STARTTLS", "503 5.5.1 STARTTLS not permitted during a mail transaction"},
+        {stateMail, "RCPT", ""},
+        {stateMail, "DATA", "554 5.5.1 No valid recipients"},
+        {stateMail, "BDAT", "554 5.5.1 No valid recipients"},
+        {stateMail, "XCLIENT", "503 5.5.1 Mail transaction in progress"},
+        {stateMail, "RSET", ""},
+        {stateRcpt, "RCPT", ""},
+        {stateRcpt, "DATA", ""},
+        {stateRcpt, "BDAT", ""},
+        {stateRcpt, "MAIL", "503 5.5.1 Sender already specified"},
+        {stateRcpt, "XCLIENT", "503 5.5.1 Mail transaction in progress"},
+        {stateData, "BDAT", ""},
+        {stateData, "DATA", "503 5.5.1 DATA not allowed during a BDAT transfer"},
+        {stateData, "RCPT", "503 5.5.1 Need MAIL command first"},
+        {stateData, "MAIL", "503 5.5.1 Sender already specified"},
+    }
+    for _, test := range tests {
+        if got := checkSequence(test.state, test.verb); got != test.want {
+            t.Errorf("checkSequence(%s, %s) = %q, want %q", test.state, test.verb, got, test.want)
+        }
+    }
+}
+
+func TestParseAddressArg(t *testing.T) {
+    tests := []struct {
+        arg    string
+        path   string
+        params map[string]string
+    }{
+        {"<user@example.com>", "user@example.com", map[string]string{}},
+        {" <user@example.com> SIZE=1234 body=8BITMIME", "user@example.com", map[string]string{"SIZE": "1234", "BODY": "8BITMIME"}},
+        {"<>", "", map[string]string{}},
+        {"<> SIZE=10", "", map[string]string{"SIZE": "10"}},
+        {"user@example.com SMTPUTF8", "user@example.com", map[string]string{"SMTPUTF8": ""}},
+        {`<"john doe"@example.com> SIZE=5`, `"john doe"@example.com`, map[string]string{"SIZE": "5"}},
+        {"<@relay.example.net,@hop.example.org:user@example.com>", "user@example.com", map[string]string{}},
+        {"", "", map[string]string{}},
+    }
+    for _, test := range tests {
+        path, params := parseAddressArg(test.arg)
+        if path != test.path || !reflect.DeepEqual(params, test.params) {
+            t.Errorf("parseAddressArg(%q) = %q, %v, want %q, %v", test.arg, path, params, test.path, test.params)
+        }
+    }
+}
+
+func TestParseBDAT(t *testing.T) {
+    tests := []struct {
+        line  string
+        size  int64
+        last  bool
+        fails bool
+    }{
+        {"BDAT 1024", 1024, false, false},
+        {"BDAT 0 LAST", 0, true, false},
+        {"bdat 86 last", 86, true, false},
+        {"BDAT", 0, false, true},
+        {"BDAT -1", 0, false, true},
+        {"BDAT 12x", 0, false, true},
+        {"BDAT 10 FIRST", 0, false, true},
+        {"BDAT 10 LAST more", 0, false, true},
+    }
+    for _, test := range tests {
+        size, last, err := parseBDAT(test.line)
+        if (err != nil) != test.fails {
+            t.Errorf("parseBDAT(%q) error = %v, want failure %t", test.line, err, test.fails)
+            continue
+        }
+        if size != test.size || last != test.last {
+            t.Errorf("parseBDAT(%q) = %d, %t, want %d, %t", test.line, size, last, test.size, test.last)
+        }
+    }
+}
+
+func TestParseXClient(t *testing.T) {
+    tests := []struct {
+        arg   string
+        attrs map[string]string
+        fails bool
+    }{
+        {"ADDR=192.0.2.10 PORT=4711", map[string]string{"ADDR": "192.0.2.10", "PORT": "4711"}, false},
+        {"addr=IPV6:2001:db8::1 helo=client.example.com", map[string]string{"ADDR": "IPV6:2001:db8::1", "HELO": "client.example.com"}, false},
+        {"NAME=[UNAVAILABLE] ADDR=192.0.2.10 LOGIN=[TEMPUNAVAIL]", map[string]string{"ADDR": "192.0.2.10"}, false},
+        {"HELO=my+20host", map[string]string{"HELO": "my host"}, false},
+        {"PROTO=", map[string]string{"PROTO": ""}, false},
+        {"", nil, true},
+        {"ADDR", nil, true},
+        {"=value", nil, true},
+        {"HELO=bad+2", nil, true},
+        {"HELO=bad+zz", nil, true},
+    }
+    for _, test := range tests {
+        attrs, err := parseXClient(test.arg)
+        if (err != nil) != test.fails {
+            t.Errorf("parseXClient(%q) error = %v, want failure %t", test.arg, err, test.fails)
+            continue
+        }
+        if !test.fails && !reflect.DeepEqual(attrs, test.attrs) {
+            t.Errorf("parseXClient(%q) = %v, want %v", test.arg, attrs, test.attrs)
+        }
+    }
+}
+
+func TestCheckCredentials(t *testing.T) {
+    primary := SMTPConfig{SMTPUsername: "nas", SMTPPassword: "secret"}
+    users := []SMTPUser{{Name: "printer", Password: "toner"}}
+    tests := []struct {
+        username, password string
+        config             SMTPConfig
+        want               bool
+    }{
+        {"nas", "secret", primary, true},
+        {"nas", "wrong", primary, false},
+        {"printer", "toner", primary, false},
+        {"printer", "toner", SMTPConfig{SMTPUsername: "nas", SMTPPassword: "secret", Users: users}, true},
+        {"nas", "secret", SMTPConfig{SMTPUsername: "nas", SMTPPassword: "secret", Users: users}, true},
+        // Without a primary account only the users list counts
+        {"printer", "toner", SMTPConfig{Users: users}, true},
+        {"", "", SMTPConfig{Users: users}, false},
+        {"", "", SMTPConfig{}, false},
+        {"", "secret", SMTPConfig{SMTPPassword: "secret"}, false},
+    }
+    for _, test := range tests {
+        if got := checkCredentials(test.username, test.password, test.config); got != test.want {
+            t.Errorf("checkCredentials(%q, %q) with %d users = %v, want %v", test.username, test.password, len(test.config.Users), got, test.want)
+        }
+    }
+}
+
+// testConn gives one end of a net.Pipe the address of a TCP client
+type testConn struct {
+    net.Conn
+}
+
+func (testConn) RemoteAddr() net.Addr {
+    return &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 40000}
+}
+
+// testGotify starts a Gotify server that passes the messages it receives to the test
+func testGotify(t *testing.T) (string, chan GotifyMessage) {
+    messages := make(chan GotifyMessage, 10)
+    server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        var message GotifyMessage
+        if err := json.NewDecoder(r.Body).Decode(&message); err != nil {
+            http.Error(w, err.Error(), http.StatusBadRequest)
+            return
+        }
+        messages <- message
+        fmt.Fprint(w, "{}")
+    }))
+    t.Cleanup(server.Close)
+    return server.URL, messages
+}
+
+// testSMTPConfig returns the default configuration, forwarding to the Gotify server at
+// url without requiring AUTH
+func testSMTPConfig(t *testing.T, url string) AppConfig {
+    t.Helper()
+    // Defaults only: no config.yaml of the machine running the tests, and none is written
+    oldDir, oldContainer := configDirPath, containerMode
+    t.Cleanup(func() {
+        configDirPath, containerMode = oldDir, oldContainer
+    })
+    viper.Reset()
+    configDirPath, containerMode = t.TempDir(), true
+    config, err := loadConfig()
+    if err != nil {
+        t.Fatalf("loadConfig: %v", err)
+    }
+    config.SMTP.Domain = "mx.example.net"
+    config.SMTP.AuthRequired = false
+    config.Gotify.GotifyHost = url
+    config.Gotify.GotifyToken = "test-token"
+    return config
+}
+
+// testClient is the client end of an SMTP session served by handleConnection
+type testClient struct {
+    t      *testing.T
+    conn   net.Conn
+    reader *bufio.Reader
+}
+
+// startSession serves a session with config over a pipe and reads the greeting
+func startSession(t *testing.T, config AppConfig) *testClient {
+    server, err := newServerState(config)
+    if err != nil {
+        t.Fatalf("newServerState: %v", err)
+    }
+    serverEnd, clientEnd := net.Pipe()
+    done := make(chan struct{})
+    go func() {
+        defer close(done)
+        handleConnection(testConn{serverEnd}, server)
+    }()
+    t.Cleanup(func() {
+        clientEnd.Close()
+        <-done
+    })
+    c := &testClient{t: t, conn: clientEnd, reader: bufio.NewReader(clientEnd)}
+    c.expect("220")
+    return c
+}
+
+// write sends raw data, such as a command line or message content
+func (c *testClient) write(data string) {
+    c.t.Helper()
+    c.conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
+    if _, err := io.WriteString(c.conn, data); err != nil {
+        c.t.Fatalf("sending %q: %v", data, err)
+    }
+}
+
+// expect reads a reply, all lines of a multi-line one, and checks its code
+func (c *testClient) expect(code string) string {
+    c.t.Helper()
+    c.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+    var reply, line string
+    for {
+        var err error
+        line, err = c.reader.ReadString('\n')
+        if err != nil {
+            c.t.Fatalf("reading the reply (want %s): %v", code, err)
+        }
+        reply += line
+        if len(line) < 4 || line[3] != '-' {
+            break
+        }
+    }
+    if !strings.HasPrefix(line, code+" ") {
+        c.t.Fatalf("got reply %q, want %s", reply, code)
+    }
+    return reply
+}
+
+// cmd sends a command and checks the code of the reply
+func (c *testClient) cmd(line, code string) string {
+    c.t.Helper()
+    c.write(line + "\r\n")
+    return c.expect(code)
+}
+
+// receive waits for the notification of a delivered email
+func receive(t *testing.T, messages chan GotifyMessage) GotifyMessage {
+    t.Helper()
+    select {
+    case message := <-messages:
+        return message
+    case <-time.After(5 * time.Second):
+        t.Fatal("no notification was sent to Gotify")
+    }
+    return GotifyMessage{}
+}
+
+func TestSessionDATA(t *testing.T) {
+    url, messages := testGotify(t)
+    c := startSession(t, testSMTPConfig(t, url))
+    c.cmd("HELO client.example.com", "250")
+    c.cmd("MAIL FROM:<nas@example.com>", "250")
+    c.cmd("RCPT TO:<alerts@example.net>", "250")
+    c.cmd("DATA", "354")
+    c.write("Subject: Disk full\r\n\r\nVolume 1 is 98% full.\r\n..and dot-stuffed\r\n.\r\n")
+    c.expect("250")
+    message := receive(t, messages)
+    if !strings.Contains(message.Title, "Disk full") {
+        t.Errorf("title = %q, want the subject", message.Title)
+    }
+    if !strings.Contains(message.Message, "Volume 1 is 98% full.") || !strings.Contains(message.Message, "\n.and dot-stuffed") {
+        t.Errorf("message = %q, want the un-stuffed body", message.Message)
+    }
+    // The session is ready for the next transaction
+    c.cmd("MAIL FROM:<nas@example.com>", "250")
+    c.cmd("QUIT", "221")
+}
+
+func TestSessionBDAT(t *testing.T) {
+    url, messages := testGotify(t)
+    c := startSession(t, testSMTPConfig(t, url))
+    if reply := c.cmd("EHLO client.example.com", "250"); !strings.Contains(reply, "CHUNKING") {
+        t.Errorf("EHLO reply %q does not offer CHUNKING", reply)
+    }
+    c.cmd("MAIL FROM:<backup@example.com>", "250")
+    c.cmd("RCPT TO:<alerts@example.net>", "250")
+    head := "Subject: Backup done\r\n\r\n"
+    c.write(fmt.Sprintf("BDAT %d\r\n%s", len(head), head))
+    c.expect("250")
+    body := "All jobs finished.\r\n"
+    c.write(fmt.Sprintf("BDAT %d LAST\r\n%s", len(body), body))
+    c.expect("250")
+    message := receive(t, messages)
+    if !strings.Contains(message.Title, "Backup done") || !strings.Contains(message.Message, "All jobs finished.") {
+        t.Errorf("notification = %q, %q, want the subject and body sent in chunks", message.Title, message.Message)
+    }
+}
+
+func TestSessionOutOfSequence(t *testing.T) {
+    url, messages := testGotify(t)
+    c := startSession(t, testSMTPConfig(t, url))
+    c.cmd("RCPT TO:<alerts@example.net>", "503")
+    c.cmd("DATA", "503")
+    // A BDAT chunk is read even when the command is refused, the session stays in sync
+    c.write("BDAT 5 LAST\r\nhello")
+    c.expect("503")
+    // Clients that never greet are let through, MAIL greets implicitly
+    c.cmd("MAIL FROM:<printer@example.com>", "250")
+    c.cmd("MAIL FROM:<printer@example.com>", "503")
+    c.cmd("DATA", "554")
+    c.cmd("RSET", "250")
+    c.cmd("RCPT TO:<alerts@example.net>", "503")
+    c.cmd("FOO", "500")
+    c.cmd("QUIT", "221")
+    select {
+    case message := <-messages:
+        t.Errorf("notification %q sent without a complete transaction", message.Title)
+    default:
+    }
+}
+
+func TestSessionStrictSequence(t *testing.T) {
+    url, _ := testGotify(t)
+    config := testSMTPConfig(t, url)
+    config.SMTP.StrictSequence = true
+    c := startSession(t, config)
+    c.cmd("MAIL FROM:<printer@example.com>", "503")
+    c.cmd("HELO printer.example.com", "250")
+    c.cmd("MAIL FROM:<printer@example.com>", "250")
+}
+
+func TestSessionLongDataLine(t *testing.T) {
+    url, messages := testGotify(t)
+    config := testSMTPConfig(t, url)
+    config.Ban = BanConfig{Enabled: true, MaxViolations: 1, Window: time.Minute, Duration: time.Hour}
+    ipBans = newBanList(config.Ban, filepath.Join(t.TempDir(), BanListFileName))
+    t.Cleanup(func() {
+        ipBans.Close()
+        ipBans = nil
+    })
+    config.Limits.MaxDataLineLength = 8000
+    c := startSession(t, config)
+    c.cmd("HELO app.example.com", "250")
+    c.cmd("MAIL FROM:<app@example.com>", "250")
+    c.cmd("RCPT TO:<alerts@example.net>", "250")
+    c.cmd("DATA", "354")
+    // Longer than a command line may be, within the message line limit
+    c.write("Subject: Report\r\n\r\n" + strings.Repeat("x", 6000) + "\r\n.\r\n")
+    c.expect("250")
+    receive(t, messages)
+    c.cmd("MAIL FROM:<app@example.com>", "250")
+    c.cmd("RCPT TO:<alerts@example.net>", "250")
+    c.cmd("DATA", "354")
+    // The server stops reading at the limit, so the rest of the line may never be taken
+    go io.WriteString(c.conn, strings.Repeat("x", 10000)+"\r\n")
+    c.expect("500")
+    c.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+    if _, err := c.reader.ReadString('\n'); err != io.EOF {
+        t.Fatalf("read after the overlong line: %v, want the connection closed", err)
+    }
+    if ipBans.IsBanned("192.0.2.1") {
+        t.Error("an overlong message line was counted towards a ban")
+    }
+}
+
+func TestXClientBannedAddr(t *testing.T) {
+    url, _ := testGotify(t)
+    config := testSMTPConfig(t, url)
+    config.SMTP.XClientTrusted = []string{"192.0.2.1"}
+    config.Ban = BanConfig{Enabled: true, MaxViolations: 1, Window: time.Minute, Duration: time.Hour}
+    ipBans = newBanList(config.Ban, filepath.Join(t.TempDir(), BanListFileName))
+    t.Cleanup(func() {
+        ipBans.Close()
+        ipBans = nil
+    })
+    ipBans.RecordViolation("198.51.100.7", "test")
+    c := startSession(t, config)
+    c.cmd("EHLO proxy.example.net", "250")
+    // The proxy itself is not banned, the client it hands over is
+    c.cmd("XCLIENT ADDR=198.51.100.7", "554")
+}
+
+func TestXClientTrust(t *testing.T) {
+    url, _ := testGotify(t)
+    config := testSMTPConfig(t, url)
+    c := startSession(t, config)
+    c.cmd("EHLO proxy.example.net", "250")
+    c.cmd("XCLIENT ADDR=198.51.100.7", "550")
+    config.SMTP.XClientTrusted = []string{"192.0.2.0/24"}
+    c = startSession(t, config)
+    c.cmd("EHLO proxy.example.net", "250")
+    c.cmd("XCLIENT ADDR=198.51.100.7 HELO=client.example.com", "220")
+    c.cmd("EHLO client.example.com", "250")
+}
@@ -3,22 +3,46 @@ package main
 import (
     "bufio"
     "bytes"
+    "context"
+    "crypto/hmac"
+    cryptorand "crypto/rand"
+    "crypto/sha256"
+    "crypto/subtle"
+    "crypto/tls"
     "encoding/base64"
+    "encoding/binary"
+    "encoding/hex"
     "encoding/json"
     "fmt"
+    "html"
     "io"
+    "math"
     "math/rand"
+    "mime"
+    "mime/multipart"
+    "mime/quotedprintable"
     "net"
     "net/http"
+    "net/mail"
+    "net/textproto"
+    "net/url"
     "os"
     "os/exec"
     "os/signal"
+    "os/user"
     "path/filepath"
+    "regexp"
+    "runtime"
     "sort"
+    "strconv"
     "strings"
     "sync"
+    "sync/atomic"
     "syscall"
+    "text/template"
     "time"
+    "unicode"
+    "unicode/utf8"
 
     "github.com/charmbracelet/bubbletea"
     "github.com/charmbracelet/bubbles/help"
@@ -28,10 +52,14 @@ import (
     "github.com/charmbracelet/bubbles/viewport"
     "github.com/charmbracelet/lipgloss"
     "github.com/fatih/color"
+    "github.com/kardianos/service"
     "github.com/spf13/cobra"
     "github.com/spf13/viper"
     "go.uber.org/zap"
     "go.uber.org/zap/zapcore"
+    "golang.org/x/crypto/acme"
+    "golang.org/x/crypto/acme/autocert"
+    "golang.org/x/text/encoding/htmlindex"
 )
 
 // Constants for configuration and UI
@@ -39,6 +67,22 @@ const (
     DefaultConfigDir      = "/opt/smtp-to-gotify"
     ConfigFileName        = "config.yaml"
     LogFileName           = "logs.json"
+    AuthFailLogFileName   = "auth_failures.log"
+    BanListFileName       = "bans.json"
+    AuditLogFileName      = "audit.log"
+    SessionsFileName      = "sessions.json"
+    DisconnectFileName    = "sessions.disconnect"
+    ACMECacheDirName      = "acme"
+    DefaultACMEHTTPAddr   = ":80"
+    // systemd credential names read from $CREDENTIALS_DIRECTORY (LoadCredential=)
+    CredentialSMTPPassword = "smtp_password"
+    CredentialGotifyToken  = "gotify_token"
+    // Service name registered with the Windows service manager
+    WindowsServiceName     = "smtp-to-gotify"
+    // launchd job label and plist locations used on macOS
+    LaunchdLabel           = "com.neometra.smtp-to-gotify"
+    LaunchdDaemonDir       = "/Library/LaunchDaemons"
+    LaunchdAgentDir        = "Library/LaunchAgents"
     MaxStatusLines        = 50
     MatrixFPS             = 10 // Frames per second for Matrix animation
     CubeFPS               = 5  // Frames per second for cube rotation
@@ -51,14 +95,126 @@ const (
     DefaultSMTPPass       = "password"
     DefaultGotifyHost     = "https://gotify.example.com"
     DefaultGotifyPriority = 5
+    // Bounces (null sender or delivery status reports) are labelled and sent at low priority
+    DefaultBounceLabel    = "[Bounce]"
+    DefaultBouncePriority = 2
     GotifyTimeout         = 10 * time.Second
     GotifyMaxRetries      = 3
+    // How long the loopback test email waits for the delivery result to appear in the log
+    TestEmailDeliveryWait = 45 * time.Second
+    // How often the running server publishes its live sessions for the connections screen
+    SessionPublishInterval = time.Second
+    // How often the PEM certificate files are checked for renewal
+    CertReloadInterval = 30 * time.Second
     // Recommendation 4: Log rotation size limit (10MB)
     MaxLogFileSize        = 10 * 1024 * 1024 // 10MB in bytes
     // Recommendation 6: SMTP connection timeout
     SMTPConnectionTimeout = 30 * time.Second
+    // Absolute cap on one SMTP session; the waits below are reset on every read
+    DefaultSessionTimeout = 30 * time.Minute
+    // Time allowed to send the 421 once the session deadline has passed
+    SessionCloseGrace     = 5 * time.Second
+    // RFC 5321 4.5.3.2: wait for the next command and for each block of message data
+    DefaultCommandTimeout = 5 * time.Minute
+    DefaultDataTimeout    = 3 * time.Minute
+    DefaultMaxMessageSize = 1024 * 1024
+    // Protocol limits protecting against resource exhaustion
+    DefaultMaxLineLength  = 4096
+    DefaultMaxHeaderCount = 200
+    DefaultMaxHeaderBytes = 64 * 1024
+    DefaultLineTimeout    = 10 * time.Second
+    // RFC 5321 4.5.3.1.4: a command line is at most 512 octets including CRLF
+    DefaultMaxCommandLength = 512
+    // RFC 5321 4.5.3.1.6 allows 1000 octets per text line, but generated HTML often
+    // runs longer; message lines are only bounded so that they fit in memory
+    DefaultMaxDataLineLength = 1024 * 1024
+    // Messages larger than this are spooled to a temporary file instead of memory
+    DefaultSpoolThreshold = 1024 * 1024
+    // High-water marks above which new work is refused with a temporary error
+    DefaultMaxConnections       = 100
+    DefaultMaxPendingDeliveries = 20
+    // Size of the blocks read backwards from the log file when paging
+    LogPageChunkSize      = 64 * 1024
+    // Maximum number of same-session entries shown on the log detail screen
+    MaxRelatedLogEntries  = 50
+    // Default notification body length in characters, see GotifyConfig.MaxBodyLength
+    MaxNotificationBody   = 5000
+    DefaultTruncateSuffix = "... (truncated)"
+    // Body characters kept by parseEmail, well above the largest gotify.max_body_length
+    // so the notification truncation still sees that the body went on
+    MaxParsedBody         = 128 * 1024
+    // Message body bytes searched for the displayable part of a MIME message
+    MaxMIMEScanBytes      = 1024 * 1024
+    // Nesting depth of multipart entities that is still parsed
+    MaxMIMEDepth          = 5
+    // DNSBL lookup defaults
+    DefaultDNSBLZone    = "zen.spamhaus.org"
+    DefaultDNSBLTimeout = 5 * time.Second
+    // SPF evaluation defaults; RFC 7208 4.6.4 caps the DNS lookups of one check at 10
+    DefaultSPFTimeout = 10 * time.Second
+    SPFMaxLookups     = 10
+    // ClamAV scanning defaults
+    DefaultClamdAddress   = "/var/run/clamav/clamd.ctl"
+    DefaultClamdTimeout   = 30 * time.Second
+    ClamdChunkSize        = 32 * 1024
+    QuarantineDirName     = "quarantine"
+    DeadLetterDirName     = "deadletter"
+    // Spam filter defaults
+    DefaultRspamdAddress = "http://127.0.0.1:11333"
+    DefaultSpamdAddress  = "127.0.0.1:783"
+    DefaultSpamTimeout   = 30 * time.Second
+    DefaultSpamThreshold = 5.0
+    // Attachment store defaults
+    AttachmentsDirName         = "attachments"
+    DefaultAttachmentRetention = 7 * 24 * time.Hour
+    DefaultAttachmentMaxSize   = 10 * 1024 * 1024
+    // Loopback only; a reverse proxy publishes the store at attachments.base_url
+    DefaultAttachmentHTTPAddr  = "127.0.0.1:8025"
+    // The key the links are signed with, kept in the attachment directory
+    AttachmentKeyFileName      = ".link_key"
+    AttachmentCleanupInterval  = time.Hour
+    // Duplicate suppression defaults; closed windows are summarized every sweep
+    DefaultDedupWindow = 10 * time.Minute
+    DedupSweepInterval = 30 * time.Second
+    // Automatic IP ban defaults
+    DefaultBanMaxViolations = 5
+    DefaultBanWindow        = 10 * time.Minute
+    DefaultBanDuration      = 1 * time.Hour
+    // How often the ban file is re-read for changes from the UI and new bans are written
+    BanSyncInterval = 5 * time.Second
+    // Per-IP and per-username failure counters a tracker keeps; past it the stalest goes
+    MaxFailureCounters = 10000
+    // Shortest token accepted in the http_auth section
+    MinHTTPTokenLength = 16
+    // Per-IP rate limit defaults
+    DefaultConnectionsPerMinute = 30
+    DefaultMessagesPerMinute    = 60
+    // Hard cap on simultaneous SMTP sessions, above the overload shedding threshold
+    DefaultMaxSessions = 200
+    // RCPT TO commands accepted per transaction, the minimum RFC 5321 asks servers to take
+    DefaultMaxRecipients = 100
+    // AUTH brute-force lockout defaults
+    DefaultAuthLockoutFailures = 5
+    DefaultAuthLockoutWindow   = 15 * time.Minute
+    DefaultAuthLockoutDuration = 30 * time.Minute
+    // AUTH tarpit defaults: delays start at the third failure and double up to the cap
+    DefaultAuthTarpitAfter    = 3
+    DefaultAuthTarpitDelay    = time.Second
+    DefaultAuthTarpitMaxDelay = 30 * time.Second
+    // Text after the domain in the 220 greeting
+    DefaultBanner = "SMTP Server Ready"
+    // Policy of the "submission" listener profile
+    SubmissionMaxMessageSize = 10 * 1024 * 1024
+    SubmissionSessionTimeout = 10 * time.Minute
+    SubmissionCommandTimeout = time.Minute
+    SubmissionDataTimeout    = 2 * time.Minute
+    // Time allowed to write the 421 reply to a connection refused at the session cap
+    SessionLimitReplyTimeout = 5 * time.Second
+    // How long new connections are still accepted and answered with 421 during shutdown
+    ShutdownDrainTime = 2 * time.Second
     // Fixed height for status box to prevent expansion
     FixedStatusHeight     = 4
+    CompactStatusHeight   = 2
 )
 
 // Color constants for UI styling
@@ -74,8 +230,32 @@ const (
 
 // AppConfig holds the full application configuration
 type AppConfig struct {
-    SMTP   SMTPConfig
-    Gotify GotifyConfig
+    SMTP            SMTPConfig
+    Gotify          GotifyConfig
+    Ban             BanConfig
+    TLS             TLSConfig
+    HTTPAuth        HTTPAuthConfig      `mapstructure:"http_auth"`
+    Limits          LimitsConfig
+    ClamAV          ClamAVConfig
+    SpamFilter      SpamFilterConfig    `mapstructure:"spam_filter"`
+    Overload        OverloadConfig
+    DeadLetter      DeadLetterConfig    `mapstructure:"dead_letter"`
+    Attachments     AttachmentsConfig
+    Dedup           DedupConfig
+    Access          AccessConfig
+    RateLimit       RateLimitConfig     `mapstructure:"rate_limit"`
+    AuthLockout     AuthLockoutConfig   `mapstructure:"auth_lockout"`
+    AuthTarpit      AuthTarpitConfig    `mapstructure:"auth_tarpit"`
+    DNSBL           DNSBLConfig         `mapstructure:"dnsbl"`
+    SPF             SPFConfig           `mapstructure:"spf"`
+    // Transforms rewrite the subject and body of every email before delivery, in order
+    Transforms      []TransformRule     `mapstructure:"transforms"`
+    // SubjectPrefixes strip or rewrite leading tags such as "Re:" or "[SCANNER]"
+    SubjectPrefixes []SubjectPrefixRule `mapstructure:"subject_prefixes"`
+    // PriorityRules pick the Gotify priority of an email, the first matching rule wins
+    PriorityRules   []PriorityRule      `mapstructure:"priority_rules"`
+    // RunAsUser is the account the server switches to once its listeners are bound
+    RunAsUser       string              `mapstructure:"run_as_user"`
 }
 
 // SMTPConfig holds the SMTP server configuration
@@ -84,36 +264,479 @@ type SMTPConfig struct {
     Domain       string
     SMTPUsername string `mapstructure:"smtp_username"`
     SMTPPassword string `mapstructure:"smtp_password"`
-    AuthRequired bool   `mapstructure:"auth_required"`
+    AuthRequired       bool             `mapstructure:"auth_required"`
+    // AuthExemptNetworks are CIDR ranges whose clients may send without AUTH even when
+    // AuthRequired is set, e.g. LAN devices that cannot authenticate
+    AuthExemptNetworks []string         `mapstructure:"auth_exempt_networks"`
+    // XClientTrusted are the CIDR ranges of front-end proxies allowed to send XCLIENT
+    XClientTrusted     []string         `mapstructure:"xclient_trusted"`
+    // RequireTLSForAuth rejects AUTH with 538 until the session has been upgraded via STARTTLS
+    RequireTLSForAuth  bool             `mapstructure:"require_tls_for_auth"`
+    AuthFailLog        string           `mapstructure:"auth_fail_log"`
+    // SessionTimeout caps the total session duration regardless of activity; the client
+    // is then answered with 421 and disconnected
+    SessionTimeout     time.Duration    `mapstructure:"session_timeout"`
+    // CommandTimeout bounds the wait for the next command, DataTimeout the wait for each
+    // block of DATA or BDAT content; both restart on every read
+    CommandTimeout     time.Duration    `mapstructure:"command_timeout"`
+    DataTimeout        time.Duration    `mapstructure:"data_timeout"`
+    // IdleTimeout closes a session with 421 once no bytes arrived for this long, whatever
+    // it is waiting for; zero leaves only the command and data timeouts
+    IdleTimeout        time.Duration    `mapstructure:"idle_timeout"`
+    MaxMessageSize     int64            `mapstructure:"max_message_size"`
+    // MaxSessions caps simultaneous sessions before a handler is started; zero disables the cap
+    MaxSessions        int              `mapstructure:"max_sessions"`
+    // MaxRecipients answers further RCPT TO in a transaction with 452; zero disables the cap
+    MaxRecipients      int              `mapstructure:"max_recipients"`
+    // RequireTLS refuses MAIL with 530 until the session has been upgraded via STARTTLS
+    RequireTLS         bool             `mapstructure:"require_tls"`
+    // StrictHelo refuses HELO/EHLO with 501 unless the argument is a hostname or address literal
+    StrictHelo         bool             `mapstructure:"strict_helo"`
+    // StrictSequence refuses MAIL with 503 until HELO/EHLO; when disabled, clients that skip
+    // the greeting are logged and let through. RCPT and DATA always need a MAIL first.
+    StrictSequence     bool             `mapstructure:"strict_sequence"`
+    // DebugTrace logs every command and reply of each session, with credentials redacted
+    DebugTrace         bool             `mapstructure:"debug_trace"`
+    // AllowedRecipients restricts RCPT TO, see newAddressFilter; empty accepts any recipient
+    AllowedRecipients  []string         `mapstructure:"allowed_recipients"`
+    // NullSender is "accept" or "reject" for MAIL FROM:<>, which bounces use
+    NullSender         string           `mapstructure:"null_sender"`
+    // AllowedSenders and DeniedSenders filter MAIL FROM the same way; deny wins
+    AllowedSenders     []string         `mapstructure:"allowed_senders"`
+    DeniedSenders      []string         `mapstructure:"denied_senders"`
+    // Banner is the text after the domain in the 220 greeting
+    Banner             string           `mapstructure:"banner"`
+    // GreetingDelay holds the banner back; clients that talk before it are dropped
+    GreetingDelay      time.Duration    `mapstructure:"greeting_delay"`
+    // Listeners are additional listen addresses with their own policies
+    Listeners          []ListenerConfig `mapstructure:"listeners"`
+    // Users are additional accounts next to SMTPUsername, each can be revoked on its own
+    Users              []SMTPUser       `mapstructure:"users"`
+}
+
+// ListenerConfig is an additional listen address feeding the same Gotify pipeline, e.g.
+// ":25" without auth for the LAN next to ":587" with auth and TLS. Unset policy fields
+// inherit the values from the smtp section, or from Profile when one is selected.
+type ListenerConfig struct {
+    Addr              string `mapstructure:"addr"`
+    // Profile is a built-in policy preset, currently only "submission"
+    Profile           string `mapstructure:"profile"`
+    AuthRequired      *bool  `mapstructure:"auth_required"`
+    RequireTLS        *bool  `mapstructure:"require_tls"`
+    RequireTLSForAuth *bool  `mapstructure:"require_tls_for_auth"`
+}
+
+// validListenerProfile reports whether name is empty or a known listener profile
+func validListenerProfile(name string) bool {
+    return name == "" || name == "submission"
+}
+
+// apply returns the config used for connections on this listener
+func (l ListenerConfig) apply(config AppConfig) AppConfig {
+    config.SMTP.Addr = l.Addr
+    // The submission profile (RFC 6409) suits an internet-facing port 587
+    if l.Profile == "submission" {
+        config.SMTP.AuthRequired = true
+        config.SMTP.RequireTLS = true
+        config.SMTP.RequireTLSForAuth = true
+        config.SMTP.MaxMessageSize = SubmissionMaxMessageSize
+        config.SMTP.SessionTimeout = SubmissionSessionTimeout
+        config.SMTP.CommandTimeout = SubmissionCommandTimeout
+        config.SMTP.DataTimeout = SubmissionDataTimeout
+    }
+    if l.AuthRequired != nil {
+        config.SMTP.AuthRequired = *l.AuthRequired
+    }
+    if l.RequireTLS != nil {
+        config.SMTP.RequireTLS = *l.RequireTLS
+    }
+    if l.RequireTLSForAuth != nil {
+        config.SMTP.RequireTLSForAuth = *l.RequireTLSForAuth
+    }
+    return config
+}
+
+// SMTPUser is an additional SMTP account; a non-empty GotifyToken sends the
+// account's mail to its own Gotify application instead of gotify.gotify_token
+type SMTPUser struct {
+    Name           string `mapstructure:"name"`
+    Password       string `mapstructure:"password"`
+    GotifyToken    string `mapstructure:"gotify_token"`
+    // Body truncation for the account's notifications; unset values use the gotify settings
+    MaxBodyLength  int    `mapstructure:"max_body_length"`
+    TruncateSuffix string `mapstructure:"truncate_suffix"`
+    TruncateAt     string `mapstructure:"truncate_at"`
+    // BodyPreference overrides gotify.body_preference for the account's mail
+    BodyPreference string `mapstructure:"body_preference"`
+    // ClickURL overrides gotify.click_url, e.g. with the dashboard of the account's device
+    ClickURL       string `mapstructure:"click_url"`
 }
 
 // GotifyConfig holds the configuration for connecting to the Gotify server
 type GotifyConfig struct {
-    GotifyHost  string `mapstructure:"gotify_host"`
-    GotifyToken string `mapstructure:"gotify_token"`
+    GotifyHost      string        `mapstructure:"gotify_host"`
+    GotifyToken     string        `mapstructure:"gotify_token"`
+    Priority        int           `mapstructure:"priority"`
+    Timeout         time.Duration `mapstructure:"timeout"`
+    MaxRetries      int           `mapstructure:"max_retries"`
+    // BounceLabel prefixes the title of bounce notifications, sent with BouncePriority
+    BounceLabel     string        `mapstructure:"bounce_label"`
+    BouncePriority  int           `mapstructure:"bounce_priority"`
+    // MaxBodyLength cuts the notification body to that many characters, ending it with
+    // TruncateSuffix; TruncateAt ("char", "word" or "line") picks where the cut may fall
+    MaxBodyLength   int           `mapstructure:"max_body_length"`
+    TruncateSuffix  string        `mapstructure:"truncate_suffix"`
+    TruncateAt      string        `mapstructure:"truncate_at"`
+    // ShowHeaders adds the Date, Reply-To and Message-ID of the email to the notification
+    // "body", to its "extras" or to neither ("none")
+    ShowHeaders     string        `mapstructure:"show_headers"`
+    // StripQuotes cuts the body at the first reply marker or signature, see stripQuotedReply
+    StripQuotes     bool          `mapstructure:"strip_quotes"`
+    // BodyPreference picks the part of multipart/alternative shown: "plain", "html", or
+    // "plain_fallback" for plain text unless it is blank
+    BodyPreference  string        `mapstructure:"body_preference"`
+    // Sanitize removes ("strip") or spells out ("escape") control characters such as NUL,
+    // ANSI escape sequences and bidi overrides; "none" forwards them unchanged
+    Sanitize        string        `mapstructure:"sanitize"`
+    // ExtractFields parses "Field: value" lines of the body into .Fields for the templates
+    ExtractFields   bool          `mapstructure:"extract_fields"`
+    // TitleTemplate and MessageTemplate replace the default title and text, see
+    // notificationData; e.g. `Disk {{index .Fields "Disk"}} {{index .Fields "Status"}}`
+    TitleTemplate   string        `mapstructure:"title_template"`
+    MessageTemplate string        `mapstructure:"message_template"`
+    // ExtraHeaders are further headers shown when present, e.g. X-Synology-Host; they go
+    // to the extras when ShowHeaders is "extras" and to the body otherwise
+    ExtraHeaders    []string      `mapstructure:"extra_headers"`
+    // JSONBody reformats bodies that are a JSON document: "pretty" indents them, "fields"
+    // shows only the values at JSONFields paths such as $.alerts[0].status; "none" keeps them
+    JSONBody        string        `mapstructure:"json_body"`
+    JSONFields      []string      `mapstructure:"json_fields"`
+    // ClickURL is opened when the notification is tapped; it is a template like the
+    // title, e.g. https://grafana.lan/d/hosts?var-host={{index .Fields "Host"}}
+    ClickURL        string        `mapstructure:"click_url"`
+    // ClickFromBody opens the first http(s) URL of the body when the notification is
+    // tapped; ClickPattern replaces the URL match, its first group being the URL if it has one
+    ClickFromBody   bool          `mapstructure:"click_from_body"`
+    ClickPattern    string        `mapstructure:"click_pattern"`
+    // clickPattern is ClickPattern compiled by compileClickPattern, nil for the URL match
+    clickPattern    *regexp.Regexp
+    // FullMessageLink keeps the whole text of a truncated body in the attachment store and
+    // links it below the cut; it needs attachments.enabled
+    FullMessageLink bool          `mapstructure:"full_message_link"`
+    // Markdown sends notifications as text/markdown, with HTML bodies converted to
+    // Markdown links, emphasis, headings and lists instead of plain text; text/plain
+    // bodies are escaped so they show as written
+    Markdown        bool          `mapstructure:"markdown"`
+}
+
+// BanConfig holds the settings for automatic banning of misbehaving client IPs
+type BanConfig struct {
+    Enabled       bool          `mapstructure:"enabled"`
+    MaxViolations int           `mapstructure:"max_violations"`
+    Window        time.Duration `mapstructure:"window"`
+    Duration      time.Duration `mapstructure:"duration"`
+}
+
+// TLSConfig holds the STARTTLS settings. Certificates come either from
+// PEM files or are obtained and renewed automatically via ACME.
+type TLSConfig struct {
+    Enabled  bool       `mapstructure:"enabled"`
+    CertFile string     `mapstructure:"cert_file"`
+    KeyFile  string     `mapstructure:"key_file"`
+    ACME     ACMEConfig `mapstructure:"acme"`
+}
+
+// ACMEConfig holds the settings for automatic certificate provisioning (e.g. Let's Encrypt)
+type ACMEConfig struct {
+    Enabled      bool     `mapstructure:"enabled"`
+    Hostnames    []string `mapstructure:"hostnames"`
+    Email        string   `mapstructure:"email"`
+    CacheDir     string   `mapstructure:"cache_dir"`
+    DirectoryURL string   `mapstructure:"directory_url"`
+    HTTPAddr     string   `mapstructure:"http_addr"`
+}
+
+// HTTPAuthConfig protects the HTTP endpoints the service exposes. A request carries a
+// token as a bearer token or as the basic auth password; the admin token also grants
+// the read-only scope. A scope without a token is closed, not open.
+type HTTPAuthConfig struct {
+    ReadToken  string `mapstructure:"read_token"`
+    AdminToken string `mapstructure:"admin_token"`
+}
+
+// LimitsConfig holds protocol-level limits that stop a single client from
+// holding buffers open or sending unbounded input
+type LimitsConfig struct {
+    // MaxLineLength bounds command lines, MaxDataLineLength the lines of a DATA message
+    MaxLineLength       int           `mapstructure:"max_line_length"`
+    MaxDataLineLength   int           `mapstructure:"max_data_line_length"`
+    // MaxCommandLength answers longer commands with 500; AUTH may use the full line length
+    MaxCommandLength    int           `mapstructure:"max_command_length"`
+    MaxHeaderCount      int           `mapstructure:"max_header_count"`
+    MaxHeaderBytes      int           `mapstructure:"max_header_bytes"`
+    LineTimeout         time.Duration `mapstructure:"line_timeout"`
+    SpoolThreshold      int           `mapstructure:"spool_threshold"`
+    SpoolDir            string        `mapstructure:"spool_dir"`
+    // MaxBandwidth caps the bytes per second received by all DATA and BDAT transfers
+    // together, MaxSessionBandwidth those of a single session; zero disables a cap
+    MaxBandwidth        int           `mapstructure:"max_bandwidth"`
+    MaxSessionBandwidth int           `mapstructure:"max_session_bandwidth"`
+}
+
+// RateLimitConfig holds the per-IP token bucket limits, applied once Enabled is set.
+// Each bucket holds a full minute's worth of tokens, so short bursts pass. Zero
+// disables a limit.
+type RateLimitConfig struct {
+    Enabled              bool `mapstructure:"enabled"`
+    ConnectionsPerMinute int  `mapstructure:"connections_per_minute"`
+    MessagesPerMinute    int  `mapstructure:"messages_per_minute"`
+}
+
+// DNSBLConfig holds the DNS blocklists queried for every connecting address. Listed
+// hosts are refused before the greeting ("reject") or their mail is marked ("tag").
+type DNSBLConfig struct {
+    Enabled bool          `mapstructure:"enabled"`
+    Zones   []string      `mapstructure:"zones"`
+    Action  string        `mapstructure:"action"`
+    Timeout time.Duration `mapstructure:"timeout"`
+}
+
+// SPFConfig holds the SPF evaluation of the MAIL FROM domain against the connecting
+// address. Action "log" only records the result, "tag" also marks the notification for
+// fail and softfail, and "reject" refuses MAIL FROM with 550 on fail. Authenticated
+// sessions and private addresses are not checked.
+type SPFConfig struct {
+    Enabled bool          `mapstructure:"enabled"`
+    Action  string        `mapstructure:"action"`
+    Timeout time.Duration `mapstructure:"timeout"`
+}
+
+// AuthLockoutConfig holds the brute-force protection for AUTH. Failures are counted per
+// client IP and per username; once either reaches its threshold within Window, AUTH from
+// that IP or for that username is answered with 421 for Duration. Zero disables a threshold.
+// The username threshold is off by default because anyone can use it to lock out a known account.
+type AuthLockoutConfig struct {
+    Enabled         bool          `mapstructure:"enabled"`
+    MaxFailures     int           `mapstructure:"max_failures"`
+    MaxUserFailures int           `mapstructure:"max_user_failures"`
+    Window          time.Duration `mapstructure:"window"`
+    Duration        time.Duration `mapstructure:"duration"`
+}
+
+// AuthTarpitConfig slows down password guessing short of a lockout. From the After-th
+// failed AUTH in a session, or from an IP within Window, the 535 reply is held back for
+// Delay, doubling with every further failure up to MaxDelay.
+type AuthTarpitConfig struct {
+    Enabled  bool          `mapstructure:"enabled"`
+    After    int           `mapstructure:"after"`
+    Delay    time.Duration `mapstructure:"delay"`
+    MaxDelay time.Duration `mapstructure:"max_delay"`
+    Window   time.Duration `mapstructure:"window"`
+}
+
+// AccessConfig holds CIDR rules checked before a connection is handed to the SMTP
+// handler. Deny wins over Allow; an empty Allow list admits every address not denied.
+type AccessConfig struct {
+    Allow []string `mapstructure:"allow"`
+    Deny  []string `mapstructure:"deny"`
+}
+
+// OverloadConfig holds the high-water marks for load shedding. While either is
+// exceeded new connections get 421 and new MAIL commands get 452. Zero disables a limit.
+type OverloadConfig struct {
+    MaxConnections       int64 `mapstructure:"max_connections"`
+    MaxPendingDeliveries int64 `mapstructure:"max_pending_deliveries"`
+}
+
+// ServerMetrics holds counters updated atomically by the connection handlers
+type ServerMetrics struct {
+    OpenConnections   int64
+    PendingDeliveries int64
+    ShedConnections   int64
+    ShedMail          int64
+}
+
+// overloaded reports whether a high-water mark is exceeded and which one
+func (m *ServerMetrics) overloaded(config OverloadConfig) (bool, string) {
+    if config.MaxConnections > 0 {
+        if open := atomic.LoadInt64(&m.OpenConnections); open > config.MaxConnections {
+            return true, fmt.Sprintf("%d open connections (limit %d)", open, config.MaxConnections)
+        }
+    }
+    if config.MaxPendingDeliveries > 0 {
+        if pending := atomic.LoadInt64(&m.PendingDeliveries); pending >= config.MaxPendingDeliveries {
+            return true, fmt.Sprintf("%d pending deliveries (limit %d)", pending, config.MaxPendingDeliveries)
+        }
+    }
+    return false, ""
+}
+
+// ShedTotal returns the number of connections and MAIL commands refused due to overload
+func (m *ServerMetrics) ShedTotal() int64 {
+    return atomic.LoadInt64(&m.ShedConnections) + atomic.LoadInt64(&m.ShedMail)
+}
+
+// ClamAVConfig holds the settings for malware scanning through a clamd daemon.
+// Action is one of "annotate", "quarantine" or "reject".
+type ClamAVConfig struct {
+    Enabled       bool          `mapstructure:"enabled"`
+    Address       string        `mapstructure:"address"`
+    Action        string        `mapstructure:"action"`
+    QuarantineDir string        `mapstructure:"quarantine_dir"`
+    Timeout       time.Duration `mapstructure:"timeout"`
+}
+
+// SpamFilterConfig holds the settings for spam scoring through rspamd or spamd.
+// Backend is "rspamd" (HTTP API) or "spamd" (SpamAssassin); Address is the rspamd URL,
+// or a host:port pair or Unix socket path for spamd. Messages scoring Threshold or more
+// get Action: "drop" discards them, "priority" sends them with Priority and "tag" marks
+// the notification title.
+type SpamFilterConfig struct {
+    Enabled   bool          `mapstructure:"enabled"`
+    Backend   string        `mapstructure:"backend"`
+    Address   string        `mapstructure:"address"`
+    Timeout   time.Duration `mapstructure:"timeout"`
+    Threshold float64       `mapstructure:"threshold"`
+    Action    string        `mapstructure:"action"`
+    Priority  int           `mapstructure:"priority"`
+}
+
+// DeadLetterConfig controls where messages that could not be delivered to Gotify are kept.
+// It is off by default. When enabled, each message is written with its parsed content to
+// <Dir>/<id>.json, readable by the service user only; Dir defaults to the deadletter
+// directory below the data directory ($XDG_DATA_HOME/smtp-to-gotify with XDG paths,
+// otherwise the configuration directory).
+type DeadLetterConfig struct {
+    Enabled bool   `mapstructure:"enabled"`
+    Dir     string `mapstructure:"dir"`
+}
+
+// AttachmentsConfig controls the attachment store. Stored attachments are served on
+// HTTPAddr and linked in the notification below BaseURL, the address Gotify clients
+// reach that listener at; they are deleted after Retention.
+type AttachmentsConfig struct {
+    Enabled   bool          `mapstructure:"enabled"`
+    Dir       string        `mapstructure:"dir"`
+    Retention time.Duration `mapstructure:"retention"`
+    // MaxSize skips storing larger attachments, they are still listed
+    MaxSize   int64         `mapstructure:"max_size"`
+    HTTPAddr  string        `mapstructure:"http_addr"`
+    BaseURL   string        `mapstructure:"base_url"`
+}
+
+// DedupConfig suppresses repeated emails: an email with the same sender, subject and body
+// as one forwarded less than Window ago is only counted, and the count is sent as a
+// summary once the window closes
+type DedupConfig struct {
+    Enabled bool          `mapstructure:"enabled"`
+    Window  time.Duration `mapstructure:"window"`
+}
+
+// DeadLetter is a message whose Gotify delivery failed, kept on disk for a later retry
+type DeadLetter struct {
+    ID          string    `json:"id"`
+    Session     string    `json:"session,omitempty"`
+    // User is the SMTP account that submitted the message, retries use its Gotify token
+    User        string    `json:"user,omitempty"`
+    Email       EmailData `json:"email"`
+    Reason      string    `json:"reason"`
+    FirstFailed time.Time `json:"first_failed"`
+    LastFailed  time.Time `json:"last_failed"`
+    Attempts    int       `json:"attempts"`
 }
 
 // EmailData holds the parsed email data
 type EmailData struct {
-    From    string
-    To      []string
-    Subject string
-    Body    string
+    From        string
+    To          []string
+    Subject     string
+    Body        string
+    ScanResult  string
+    // Bounce is set for the null sender and for delivery status reports
+    Bounce      bool
+    // DNSBL is the blocklist zone the sending host is listed on, if any
+    DNSBL       string
+    // SPF is the result of a failed SPF check that is tagged, e.g. "softfail"
+    SPF         string
+    // Spam is the score of a message tagged by the spam filter
+    Spam        string
+    // Attachments lists the attached files, whose content is not forwarded
+    Attachments []Attachment
+    // Date, ReplyTo and MessageID are copied from the message header
+    Date        string
+    ReplyTo     string
+    MessageID   string
+    // Header is the decoded message header, for GotifyConfig.ExtraHeaders
+    Header      map[string][]string
+    // Markdown marks a body converted from HTML for GotifyConfig.Markdown; it is sent as
+    // is, while plain text bodies have their Markdown characters escaped
+    Markdown    bool
+    // original is the whole text as parsed, before transforms and the MaxParsedBody cut,
+    // kept for GotifyConfig.FullMessageLink only
+    original    string
+}
+
+// Attachment describes a file attached to an email
+type Attachment struct {
+    Name string
+    Type string
+    // Size is the decoded size in bytes; Partial marks a size that is only a lower bound
+    // because the message was too large to read the attachment completely
+    Size    int64
+    Partial bool
+    // URL links to the stored copy when the attachment store is enabled
+    URL     string
+}
+
+// String formats the attachment for a notification, e.g. "report.pdf (application/pdf, 1.2 MB)"
+func (a Attachment) String() string {
+    size := fmt.Sprintf("%d bytes", a.Size)
+    switch {
+    case a.Size >= 1024*1024:
+        size = fmt.Sprintf("%.1f MB", float64(a.Size)/(1024*1024))
+    case a.Size >= 1024:
+        size = fmt.Sprintf("%.1f KB", float64(a.Size)/1024)
+    }
+    if a.Partial {
+        size = "at least " + size
+    }
+    if a.URL != "" {
+        return fmt.Sprintf("%s (%s, %s) %s", a.Name, a.Type, size, a.URL)
+    }
+    return fmt.Sprintf("%s (%s, %s)", a.Name, a.Type, size)
 }
 
 // GotifyMessage represents the structure of a message to send to Gotify
 type GotifyMessage struct {
-    Title    string `json:"title"`
-    Message  string `json:"message"`
-    Priority int    `json:"priority"`
+    Title    string                 `json:"title"`
+    Message  string                 `json:"message"`
+    Priority int                    `json:"priority"`
+    Extras   map[string]interface{} `json:"extras,omitempty"`
 }
 
 // LogEntry represents a single log entry for various events with description
 type LogEntry struct {
-    Timestamp   string `json:"timestamp"`
-    Category    string `json:"category"`
-    Message     string `json:"message"`
-    Description string `json:"description"`
+    Timestamp   string       `json:"timestamp"`
+    Category    string       `json:"category"`
+    Message     string       `json:"message"`
+    Description string       `json:"description"`
+    Level       string       `json:"level,omitempty"`
+    Caller      string       `json:"caller,omitempty"`
+    Session     string       `json:"session,omitempty"`
+    // Summary holds the counters of a finished session for session_summary entries
+    Summary     *SessionInfo `json:"summary,omitempty"`
+}
+
+// AuditEntry is a single record in the append-only audit log
+type AuditEntry struct {
+    Timestamp string `json:"timestamp"`
+    Actor     string `json:"actor"`
+    PID       int    `json:"pid"`
+    Action    string `json:"action"`
+    Field     string `json:"field,omitempty"`
+    OldValue  string `json:"old_value,omitempty"`
+    NewValue  string `json:"new_value,omitempty"`
+    Detail    string `json:"detail,omitempty"`
 }
 
 // LogStore holds the structure for storing logs in JSON
@@ -123,25 +746,75 @@ type LogStore struct {
 
 // ZapLogEntry represents a single log entry as written by Zap logger
 type ZapLogEntry struct {
-    Level       string `json:"level"`
-    Timestamp   string `json:"timestamp"`
-    Caller      string `json:"caller"`
-    Message     string `json:"message"`
-    Category    string `json:"category"`
-    Description string `json:"description"`
-    FullMessage string `json:"message"`
+    Level       string       `json:"level"`
+    Timestamp   string       `json:"timestamp"`
+    Caller      string       `json:"caller"`
+    Message     string       `json:"message"`
+    Category    string       `json:"category"`
+    Description string       `json:"description"`
+    FullMessage string       `json:"message"`
+    Session     string       `json:"session"`
+    Summary     *SessionInfo `json:"summary"`
 }
 
 // Global variables for configuration and logging
 var (
-    configDirPath  = getEnv("SMTP_TO_GOTIFY_CONFIG_DIR", DefaultConfigDir)
+    configDirPath  = getEnv("SMTP_TO_GOTIFY_CONFIG_DIR", defaultConfigDir())
+    stateDirPath   = defaultXDGDir("XDG_STATE_HOME", ".local/state")
+    dataDirPath    = defaultXDGDir("XDG_DATA_HOME", ".local/share")
     configFilePath = filepath.Join(configDirPath, ConfigFileName)
-    logFilePath    = filepath.Join(configDirPath, LogFileName)
+    logFilePath    = filepath.Join(stateDirPath, LogFileName)
+    banListPath    = filepath.Join(stateDirPath, BanListFileName)
+    auditLogPath   = filepath.Join(stateDirPath, AuditLogFileName)
+    sessionsPath   = filepath.Join(stateDirPath, SessionsFileName)
+    disconnectPath = filepath.Join(stateDirPath, DisconnectFileName)
+    auditMutex     sync.Mutex
     zapLogger      *zap.Logger
     logMutex       sync.Mutex
     logUpdateChan  = make(chan LogEntry, StatusUpdateBuffer)
+    authFailMutex  sync.Mutex
     // Recommendation 14: Track active connections for graceful shutdown
     activeConnections sync.WaitGroup
+    // Load and shed-load counters for the running server
+    metrics ServerMetrics
+    // Live SMTP sessions, published to disk for the connections screen
+    sessions = newSessionRegistry()
+    // IP ban tracker shared by all connections, set up in startServer
+    ipBans *BanList
+    // Per-IP rate limiters for new connections and MAIL commands, set up in startServer
+    connectionLimiter *RateLimiter
+    messageLimiter    *RateLimiter
+    // AUTH brute-force lockout shared by all connections, set up in startServer
+    authLockout *AuthLockout
+    // Progressive AUTH failure delays shared by all connections, set up in startServer
+    authTarpit *AuthTarpit
+    // Attachment store used while parsing messages, nil unless enabled; set up in startServer
+    attachmentStore *AttachmentStore
+    // Repeated email suppression shared by all connections, set up in startServer
+    duplicates *DuplicateFilter
+    // Shared cap on the message body bytes received per second, set up in startServer
+    dataBandwidth *bandwidthLimiter
+    // Settings applied to new sessions, set by startServer and replaced on reload
+    liveState      *serverState
+    liveStateMutex sync.RWMutex
+    // TLS configuration used for STARTTLS, nil when TLS is disabled
+    serverTLSConfig *tls.Config
+    // Reloads the PEM certificate pair for serverTLSConfig, nil when TLS is disabled or uses ACME
+    tlsReloader *certReloader
+    // stopServer closes the listener and waits for active connections, set by startServer
+    stopServer   func()
+    // shuttingDown is set by stopServer; new connections and idle sessions then get 421
+    shuttingDown int32
+    // Server run inside the TUI process when no init system is available
+    embeddedMutex   sync.Mutex
+    embeddedRunning bool
+    embeddedDone    chan error
+    // containerMode logs to stdout, never starts the interactive UI and takes settings from the environment
+    containerMode bool
+    // debugSMTP enables the wire-level SMTP trace, set by --debug-smtp or smtp.debug_trace
+    debugSMTP bool
+    // plainMode runs the interactive UI without alt-screen, animation, colors or box drawing
+    plainMode bool
 )
 
 // Global variables for UI state
@@ -160,8 +833,101 @@ func getEnv(key, fallback string) string {
     return fallback
 }
 
-// initLogger initializes the Zap logger for JSON output to a file
+// Path precedence: --config-dir or SMTP_TO_GOTIFY_CONFIG_DIR puts everything in that
+// directory; otherwise root (and Windows) uses the system location, while a normal
+// user gets XDG base directories so `config` works without write access to /opt.
+
+// useXDGPaths reports whether per-user XDG base directories should be used
+func useXDGPaths() bool {
+    if _, explicit := os.LookupEnv("SMTP_TO_GOTIFY_CONFIG_DIR"); explicit {
+        return false
+    }
+    return runtime.GOOS != "windows" && os.Geteuid() != 0
+}
+
+// xdgBaseDir returns an XDG base directory, falling back to the spec default under $HOME
+func xdgBaseDir(envKey, homeRelative string) string {
+    if dir := os.Getenv(envKey); filepath.IsAbs(dir) {
+        return dir
+    }
+    home, err := os.UserHomeDir()
+    if err != nil {
+        return filepath.Join(os.TempDir(), "smtp-to-gotify-"+getEnv("USER", "user"))
+    }
+    return filepath.Join(home, homeRelative)
+}
+
+// defaultConfigDir returns the default configuration directory
+func defaultConfigDir() string {
+    if runtime.GOOS == "windows" {
+        return filepath.Join(getEnv("ProgramData", `C:\ProgramData`), "smtp-to-gotify")
+    }
+    if useXDGPaths() {
+        return filepath.Join(xdgBaseDir("XDG_CONFIG_HOME", ".config"), "smtp-to-gotify")
+    }
+    return DefaultConfigDir
+}
+
+// defaultXDGDir returns the default directory for logs/state or data, which is the
+// configuration directory unless XDG paths are in use
+func defaultXDGDir(envKey, homeRelative string) string {
+    if useXDGPaths() {
+        return filepath.Join(xdgBaseDir(envKey, homeRelative), "smtp-to-gotify")
+    }
+    return getEnv("SMTP_TO_GOTIFY_CONFIG_DIR", defaultConfigDir())
+}
+
+// setConfigDir places all configuration, state and data files in one directory
+func setConfigDir(dir string) {
+    configDirPath = dir
+    stateDirPath = dir
+    dataDirPath = dir
+    configFilePath = filepath.Join(configDirPath, ConfigFileName)
+    logFilePath = filepath.Join(stateDirPath, LogFileName)
+    banListPath = filepath.Join(stateDirPath, BanListFileName)
+    auditLogPath = filepath.Join(stateDirPath, AuditLogFileName)
+    sessionsPath = filepath.Join(stateDirPath, SessionsFileName)
+    disconnectPath = filepath.Join(stateDirPath, DisconnectFileName)
+}
+
+// detectContainer reports whether the process appears to run inside a container
+func detectContainer() bool {
+    if getEnv("SMTP_TO_GOTIFY_CONTAINER", "") == "true" {
+        return true
+    }
+    for _, marker := range []string{"/.dockerenv", "/run/.containerenv"} {
+        if _, err := os.Stat(marker); err == nil {
+            return true
+        }
+    }
+    return os.Getpid() == 1
+}
+
+// stdinIsTerminal reports whether an interactive terminal is attached
+func stdinIsTerminal() bool {
+    info, err := os.Stdin.Stat()
+    if err != nil {
+        return false
+    }
+    return info.Mode()&os.ModeCharDevice != 0
+}
+
+// initLogger initializes the Zap logger for JSON output to a file, or to stdout in container mode
 func initLogger() error {
+    if containerMode {
+        cfg := zap.NewProductionConfig()
+        cfg.OutputPaths = []string{"stdout"}
+        cfg.EncoderConfig.EncodeTime = zapcore.ISO8601TimeEncoder
+        cfg.EncoderConfig.TimeKey = "timestamp"
+        cfg.EncoderConfig.LevelKey = "level"
+        cfg.EncoderConfig.MessageKey = "message"
+        logger, err := cfg.Build()
+        if err != nil {
+            return fmt.Errorf("failed to build zap logger: %v", err)
+        }
+        zapLogger = logger
+        return nil
+    }
     logDir := filepath.Dir(logFilePath)
     if err := os.MkdirAll(logDir, 0750); err != nil {
         return fmt.Errorf("failed to create log directory: %v", err)
@@ -182,492 +948,5721 @@ func initLogger() error {
 
 // logEvent logs an event using Zap and updates UI with detailed description
 func logEvent(category, message, description string) {
+    logSessionEvent("", category, message, description)
+}
+
+// logSessionEvent logs an event tagged with the SMTP session it belongs to, so all
+// entries of one connection can be found again in the log viewer
+func logSessionEvent(session, category, message, description string) {
     if zapLogger != nil {
-        zapLogger.Info("Application Event",
+        fields := []zap.Field{
             zap.String("category", category),
             zap.String("message", message),
             zap.String("description", description),
-        )
+        }
+        if session != "" {
+            fields = append(fields, zap.String("session", session))
+        }
+        zapLogger.Info("Application Event", fields...)
     }
-    entry := LogEntry{
+    queueLogEntry(LogEntry{
         Timestamp:   time.Now().Format("1/2/2006 - 15:04:05"),
         Category:    category,
         Message:     message,
         Description: description,
-    }
+        Level:       "info",
+        Session:     session,
+    })
+}
+
+// queueLogEntry hands an entry to the log viewer
+func queueLogEntry(entry LogEntry) {
     select {
     case logUpdateChan <- entry:
     default:
         // Log to status if channel is full to avoid silent drops
-        appendToStatus(fmt.Sprintf("Log channel full, dropping entry: %s", message))
+        appendToStatus(fmt.Sprintf("Log channel full, dropping entry: %s", entry.Message))
     }
 }
 
-// ensureLogFileExists creates the log file if it doesn't exist
-func ensureLogFileExists() error {
-    if _, err := os.Stat(logFilePath); os.IsNotExist(err) {
-        initialData := []byte(`{"entries": []}`)
-        if err := os.WriteFile(logFilePath, initialData, 0640); err != nil {
-            return fmt.Errorf("failed to create log file: %v", err)
+// logSessionSummary records the counters of a finished SMTP session as one structured
+// entry, so statistics can be built from the log without replaying every event
+func logSessionSummary(info SessionInfo) {
+    duration := info.Ended.Sub(info.Started).Round(time.Millisecond)
+    message := fmt.Sprintf("Session from %s closed after %v", info.RemoteAddr, duration)
+    description := fmt.Sprintf("Session from %s lasted %v: %d commands, %d messages accepted, %d AUTH attempts, %d bytes received and %d bytes sent.", info.RemoteAddr, duration, info.Commands, info.Messages, info.AuthAttempts, info.BytesIn, info.BytesOut)
+    if zapLogger != nil {
+        zapLogger.Info("Application Event",
+            zap.String("category", "session_summary"),
+            zap.String("message", message),
+            zap.String("description", description),
+            zap.String("session", info.ID),
+            zap.Any("summary", info),
+        )
+    }
+    queueLogEntry(LogEntry{
+        Timestamp:   time.Now().Format("1/2/2006 - 15:04:05"),
+        Category:    "session_summary",
+        Message:     message,
+        Description: description,
+        Level:       "info",
+        Session:     info.ID,
+        Summary:     &info,
+    })
+}
+
+// sanitizeLogField strips whitespace and control characters so a client-supplied
+// value cannot break the one-line-per-event format of the auth failure log
+func sanitizeLogField(value string) string {
+    if value == "" {
+        return "-"
+    }
+    return strings.Map(func(r rune) rune {
+        if r <= ' ' || r == 0x7f {
+            return '_'
         }
+        return r
+    }, value)
+}
+
+// logAuthFailure appends a stable, line-oriented record of a failed AUTH attempt
+// to the auth failure log so external tools such as fail2ban can act on it.
+// Format: <RFC3339 timestamp> smtp-to-gotify[<pid>]: auth failed ip=<ip> user=<user> mechanism=<mech>
+func logAuthFailure(path, remoteAddr, username, mechanism string) {
+    if path == "" {
+        return
+    }
+    line := fmt.Sprintf("%s smtp-to-gotify[%d]: auth failed ip=%s user=%s mechanism=%s\n",
+        time.Now().UTC().Format(time.RFC3339), os.Getpid(), remoteIP(remoteAddr), sanitizeLogField(username), mechanism)
+    authFailMutex.Lock()
+    defer authFailMutex.Unlock()
+    file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0640)
+    if err != nil {
+        appendToStatus(fmt.Sprintf("Failed to open auth failure log %s: %v", path, err))
+        return
+    }
+    defer file.Close()
+    if _, err := file.WriteString(line); err != nil {
+        appendToStatus(fmt.Sprintf("Failed to write auth failure log %s: %v", path, err))
     }
-    return nil
 }
 
-// Recommendation 4: Log rotation helper function
-func rotateLogFile() error {
-    logMutex.Lock()
-    defer logMutex.Unlock()
-    // Check current log file size
-    fileInfo, err := os.Stat(logFilePath)
-    if err != nil && !os.IsNotExist(err) {
-        return fmt.Errorf("failed to stat log file: %v", err)
+// remoteIP returns the host part of a "host:port" remote address
+func remoteIP(remoteAddr string) string {
+    if host, _, err := net.SplitHostPort(remoteAddr); err == nil {
+        return host
     }
-    if fileInfo != nil && fileInfo.Size() >= MaxLogFileSize {
-        // Generate a rotated log file name with timestamp
-        timestamp := time.Now().Format("20060102_150405")
-        rotatedPath := fmt.Sprintf("%s.%s", logFilePath, timestamp)
-        if err := os.Rename(logFilePath, rotatedPath); err != nil {
-            return fmt.Errorf("failed to rotate log file: %v", err)
+    return remoteAddr
+}
+
+// AccessList decides which client addresses may open an SMTP session
+type AccessList struct {
+    allow []*net.IPNet
+    deny  []*net.IPNet
+}
+
+// parseNetworks parses CIDR ranges; a bare IP address is treated as a single host
+func parseNetworks(entries []string) ([]*net.IPNet, error) {
+    var networks []*net.IPNet
+    for _, entry := range entries {
+        entry = strings.TrimSpace(entry)
+        if !strings.Contains(entry, "/") {
+            ip := net.ParseIP(entry)
+            if ip == nil {
+                return nil, fmt.Errorf("invalid address %q", entry)
+            }
+            bits := 128
+            if ip.To4() != nil {
+                bits = 32
+            }
+            entry = fmt.Sprintf("%s/%d", entry, bits)
         }
-        // Create a new empty log file
-        initialData := []byte(`{"entries": []}`)
-        if err := os.WriteFile(logFilePath, initialData, 0640); err != nil {
-            return fmt.Errorf("failed to create new log file after rotation: %v", err)
+        _, network, err := net.ParseCIDR(entry)
+        if err != nil {
+            return nil, fmt.Errorf("invalid network %q: %v", entry, err)
         }
-        appendToStatus("Log file rotated due to size limit.")
-        logEvent("log_rotation", "Log file rotated", fmt.Sprintf("Log file %s exceeded size limit and was rotated to %s", logFilePath, rotatedPath))
+        networks = append(networks, network)
     }
-    return nil
+    return networks, nil
 }
 
-// loadLogs loads the logs from the JSON file, handling both formats
-func loadLogs() (LogStore, error) {
-    logMutex.Lock()
-    defer logMutex.Unlock()
-    if err := ensureLogFileExists(); err != nil {
-        appendToStatus(fmt.Sprintf("Debug: Failed to ensure log file exists: %v", err))
-        return LogStore{}, err
+// newAccessList parses the allow and deny rules of the access config
+func newAccessList(config AccessConfig) (*AccessList, error) {
+    allow, err := parseNetworks(config.Allow)
+    if err != nil {
+        return nil, fmt.Errorf("access.allow: %v", err)
     }
-    file, err := os.Open(logFilePath)
+    deny, err := parseNetworks(config.Deny)
     if err != nil {
-        appendToStatus(fmt.Sprintf("Debug: Failed to open log file %s: %v", logFilePath, err))
-        return LogStore{Entries: []LogEntry{}}, fmt.Errorf("failed to open log file: %v", err)
+        return nil, fmt.Errorf("access.deny: %v", err)
     }
-    defer file.Close()
-    var entries []LogEntry
-    scanner := bufio.NewScanner(file)
-    firstLine := ""
-    if scanner.Scan() {
-        firstLine = scanner.Text()
+    return &AccessList{allow: allow, deny: deny}, nil
+}
+
+// Check reports whether the address may connect and, if not, which rule refused it
+func (a *AccessList) Check(addr string) (bool, string) {
+    ip := net.ParseIP(addr)
+    if ip == nil {
+        return false, "unparseable address"
     }
-    if strings.HasPrefix(firstLine, "{\"entries\":") {
-        data, err := os.ReadFile(logFilePath)
-        if err == nil {
-            var store LogStore
-            if json.Unmarshal(data, &store) == nil {
-                appendToStatus(fmt.Sprintf("Debug: Successfully loaded %d entries from JSON store format", len(store.Entries)))
-                return store, nil
-            } else {
-                appendToStatus(fmt.Sprintf("Debug: Failed to unmarshal JSON store format: %v", err))
-            }
+    for _, network := range a.deny {
+        if network.Contains(ip) {
+            return false, fmt.Sprintf("denied by %s", network)
         }
-        file.Seek(0, 0)
-        scanner = bufio.NewScanner(file)
     }
-    for scanner.Scan() {
-        line := scanner.Text()
-        if len(line) == 0 {
-            continue
+    if len(a.allow) == 0 {
+        return true, ""
+    }
+    for _, network := range a.allow {
+        if network.Contains(ip) {
+            return true, ""
+        }
+    }
+    return false, "not in the allow list"
+}
+
+// TransformRule is a regular expression find/replace on the "subject" or "body" of an
+// email. Replace may refer to groups of Pattern as $1 or ${name}.
+type TransformRule struct {
+    Field   string `mapstructure:"field"`
+    Pattern string `mapstructure:"pattern"`
+    Replace string `mapstructure:"replace"`
+}
+
+// transform is a compiled TransformRule
+type transform struct {
+    field   string
+    pattern *regexp.Regexp
+    replace string
+}
+
+// compileTransforms checks and compiles the transforms section
+func compileTransforms(rules []TransformRule) ([]transform, error) {
+    var transforms []transform
+    for i, rule := range rules {
+        field := strings.ToLower(rule.Field)
+        if field != "subject" && field != "body" {
+            return nil, fmt.Errorf("transforms entry %d: unknown field %q, use \"subject\" or \"body\"", i+1, rule.Field)
+        }
+        pattern, err := regexp.Compile(rule.Pattern)
+        if err != nil {
+            return nil, fmt.Errorf("transforms entry %d: invalid pattern: %v", i+1, err)
         }
-        var zapEntry ZapLogEntry
-        if err := json.Unmarshal([]byte(line), &zapEntry); err == nil {
-            message := zapEntry.FullMessage
-            if message == "" {
-                message = zapEntry.Message
-            }
-            timestamp := zapEntry.Timestamp
-            if len(timestamp) > 19 {
-                timestamp = timestamp[:19]
-                timestamp = strings.Replace(timestamp, "T", " ", 1)
-            }
-            if parsedTime, err := time.Parse("2006-01-02 15:04:05", timestamp); err == nil {
-                timestamp = parsedTime.Format("1/2/2006 - 15:04:05")
-            }
-            entries = append(entries, LogEntry{
-                Timestamp:   timestamp,
-                Category:    zapEntry.Category,
-                Message:     message,
-                Description: zapEntry.Description,
-            })
+        transforms = append(transforms, transform{field: field, pattern: pattern, replace: rule.Replace})
+    }
+    return transforms, nil
+}
+
+// applyTransforms runs the transforms on the subject and body of email in order
+func applyTransforms(transforms []transform, email EmailData) EmailData {
+    for _, t := range transforms {
+        if t.field == "subject" {
+            email.Subject = t.pattern.ReplaceAllString(email.Subject, t.replace)
         } else {
-            appendToStatus(fmt.Sprintf("Debug: Failed to parse log line: %s, error: %v", line, err))
+            email.Body = t.pattern.ReplaceAllString(email.Body, t.replace)
         }
     }
-    if err := scanner.Err(); err != nil {
-        appendToStatus(fmt.Sprintf("Debug: Error reading log file line by line: %v", err))
-        return LogStore{Entries: entries}, fmt.Errorf("error reading log file line by line: %v", err)
+    return email
+}
+
+// PriorityRule sends emails whose Field matches Pattern with Priority. Field is "from",
+// "to" (any recipient), "subject", "body" or "importance", the "high", "normal" or
+// "low" taken from the X-Priority, Importance and Priority headers.
+type PriorityRule struct {
+    Field    string `mapstructure:"field"`
+    Pattern  string `mapstructure:"pattern"`
+    Priority int    `mapstructure:"priority"`
+}
+
+// priorityRule is a compiled PriorityRule
+type priorityRule struct {
+    field    string
+    pattern  *regexp.Regexp
+    priority int
+}
+
+// compilePriorityRules checks and compiles the priority_rules section
+func compilePriorityRules(rules []PriorityRule) ([]priorityRule, error) {
+    var compiled []priorityRule
+    for i, rule := range rules {
+        field := strings.ToLower(rule.Field)
+        if field != "from" && field != "to" && field != "subject" && field != "body" && field != "importance" {
+            return nil, fmt.Errorf("priority_rules entry %d: unknown field %q, use \"from\", \"to\", \"subject\", \"body\" or \"importance\"", i+1, rule.Field)
+        }
+        pattern, err := regexp.Compile(rule.Pattern)
+        if err != nil {
+            return nil, fmt.Errorf("priority_rules entry %d: invalid pattern: %v", i+1, err)
+        }
+        if rule.Priority < 0 || rule.Priority > 10 {
+            return nil, fmt.Errorf("priority_rules entry %d: priority %d is not between 0 and 10", i+1, rule.Priority)
+        }
+        compiled = append(compiled, priorityRule{field: field, pattern: pattern, priority: rule.Priority})
     }
-    appendToStatus(fmt.Sprintf("Debug: Loaded %d entries from line-by-line parsing", len(entries)))
-    return LogStore{Entries: entries}, nil
+    return compiled, nil
 }
 
-// Recommendation 4: Modified saveLogs to check for rotation
-func saveLogs(store LogStore) error {
-    logMutex.Lock()
-    defer logMutex.Unlock()
-    data, err := json.MarshalIndent(store, "", "  ")
-    if err != nil {
-        return fmt.Errorf("failed to marshal log data: %v", err)
+// emailImportance reads the priority an email was sent with from its header: "high",
+// "low", or "normal" when it has none
+func emailImportance(header map[string][]string) string {
+    value := func(name string) string {
+        if values := header[name]; len(values) > 0 {
+            return strings.ToLower(strings.TrimSpace(values[0]))
+        }
+        return ""
     }
-    logDir := filepath.Dir(logFilePath)
-    if err := os.MkdirAll(logDir, 0750); err != nil {
-        return fmt.Errorf("failed to create log directory: %v", err)
+    // X-Priority is 1 (highest) to 5 (lowest), often followed by a comment like "(High)"
+    if priority := value("X-Priority"); priority != "" {
+        switch priority[0] {
+        case '1', '2':
+            return "high"
+        case '4', '5':
+            return "low"
+        }
     }
-    if err := rotateLogFile(); err != nil {
-        appendToStatus(fmt.Sprintf("Failed to rotate log file: %v", err))
+    switch value("Importance") {
+    case "high":
+        return "high"
+    case "low":
+        return "low"
     }
-    if err := os.WriteFile(logFilePath, data, 0640); err != nil {
-        return fmt.Errorf("failed to write log file: %v", err)
+    switch value("Priority") {
+    case "urgent":
+        return "high"
+    case "non-urgent":
+        return "low"
     }
-    return nil
+    return "normal"
 }
 
-// appendLog adds a new log entry and writes it directly to the file
-func appendLog(entry LogEntry) error {
-    store, err := loadLogs()
-    if err != nil {
-        store = LogStore{Entries: []LogEntry{}}
+// matchPriority returns the priority of the first rule matching email
+func matchPriority(rules []priorityRule, email EmailData) (int, bool) {
+    for _, rule := range rules {
+        var values []string
+        switch rule.field {
+        case "from":
+            values = []string{email.From}
+        case "to":
+            values = email.To
+        case "subject":
+            values = []string{email.Subject}
+        case "body":
+            values = []string{email.Body}
+        case "importance":
+            values = []string{emailImportance(email.Header)}
+        }
+        for _, value := range values {
+            if rule.pattern.MatchString(value) {
+                return rule.priority, true
+            }
+        }
     }
-    store.Entries = append(store.Entries, entry)
-    return saveLogs(store)
+    return 0, false
 }
 
-// initStatusUpdater initializes the status update handler with debouncing
-func initStatusUpdater(p *tea.Program) {
-    go func() {
-        for {
-            select {
-            case msg, ok := <-statusUpdateChan:
-                if !ok {
-                    return
-                }
-                appMutex.Lock()
-                statusLog = append(statusLog, msg)
-                if len(statusLog) > MaxStatusLines {
-                    statusLog = statusLog[len(statusLog)-MaxStatusLines:]
-                }
-                appMutex.Unlock()
-                if statusUpdateTimer != nil {
-                    statusUpdateTimer.Stop()
-                }
-                statusUpdateTimer = time.AfterFunc(StatusUpdateDebounce, func() {
-                    p.Send(StatusUpdateMsg{})
-                })
-            case logEntry, ok := <-logUpdateChan:
-                if !ok {
-                    return
-                }
-                if err := appendLog(logEntry); err != nil {
-                    appendToStatus(fmt.Sprintf("Failed to append log: %v", err))
-                }
-                p.Send(LogUpdateMsg{Entry: logEntry})
+// SubjectPrefixRule removes Prefix, compared case-insensitively, from the start of a
+// subject, or rewrites it to Replace, e.g. "[SCANNER] " to "Scanner: "
+type SubjectPrefixRule struct {
+    Prefix  string `mapstructure:"prefix"`
+    Replace string `mapstructure:"replace"`
+}
+
+// normalizeSubject applies the prefix rules to the start of subject until none matches,
+// so "Re: Fwd: RE: [SCANNER] Job done" loses all of its tags. Each replacement is kept
+// once, in front of what remains; a subject that would be left empty is not changed.
+func normalizeSubject(rules []SubjectPrefixRule, subject string) string {
+    rest := strings.TrimSpace(subject)
+    var replaced []string
+    seen := make(map[string]bool)
+    for matched := true; matched; {
+        matched = false
+        for _, rule := range rules {
+            if rule.Prefix == "" || len(rest) < len(rule.Prefix) || !strings.EqualFold(rest[:len(rule.Prefix)], rule.Prefix) {
+                continue
+            }
+            rest = strings.TrimSpace(rest[len(rule.Prefix):])
+            matched = true
+            if rule.Replace != "" && !seen[rule.Replace] {
+                seen[rule.Replace] = true
+                replaced = append(replaced, rule.Replace)
             }
         }
-    }()
+    }
+    if rest == "" {
+        return subject
+    }
+    return strings.Join(replaced, "") + rest
 }
 
-// appendToStatus adds a message to the status log panel safely
-func appendToStatus(message string) {
-    timestamp := time.Now().Format("1/2/2006 - 15:04:05")
-    select {
-    case statusUpdateChan <- fmt.Sprintf("[%s] %s", timestamp, message):
-    default:
-        // Fallback to direct append if channel is full to avoid silent drops
-        appMutex.Lock()
-        statusLog = append(statusLog, fmt.Sprintf("[%s] Status channel full, dropping message: %s", timestamp, message))
-        if len(statusLog) > MaxStatusLines {
-            statusLog = statusLog[len(statusLog)-MaxStatusLines:]
+// AddressFilter matches mail addresses against a list of addresses, domains and
+// patterns; a nil filter matches nothing
+type AddressFilter struct {
+    addresses map[string]bool
+    domains   map[string]bool
+    patterns  []*regexp.Regexp
+}
+
+// newAddressFilter parses an address list, nil when it is empty. An entry is a full
+// address (alerts@home.local), a whole domain (@home.local) or a regular expression
+// between slashes (/^nas-.*@home\.local$/). Addresses and domains match case-insensitively.
+func newAddressFilter(entries []string) (*AddressFilter, error) {
+    if len(entries) == 0 {
+        return nil, nil
+    }
+    filter := &AddressFilter{addresses: make(map[string]bool), domains: make(map[string]bool)}
+    for _, entry := range entries {
+        entry = strings.TrimSpace(entry)
+        switch {
+        case len(entry) > 2 && strings.HasPrefix(entry, "/") && strings.HasSuffix(entry, "/"):
+            pattern, err := regexp.Compile("(?i)" + entry[1:len(entry)-1])
+            if err != nil {
+                return nil, fmt.Errorf("invalid pattern %q: %v", entry, err)
+            }
+            filter.patterns = append(filter.patterns, pattern)
+        case strings.HasPrefix(entry, "@") && len(entry) > 1:
+            filter.domains[strings.ToLower(entry[1:])] = true
+        case strings.Contains(entry, "@"):
+            filter.addresses[strings.ToLower(entry)] = true
+        default:
+            return nil, fmt.Errorf("invalid entry %q, expected an address, @domain or /regex/", entry)
         }
-        appMutex.Unlock()
     }
+    return filter, nil
 }
 
-// Recommendation 6: Modified handleConnection with timeout
-func handleConnection(conn net.Conn, config AppConfig) {
-    defer conn.Close()
-    // Set a deadline for the connection to prevent hanging
-    if err := conn.SetDeadline(time.Now().Add(SMTPConnectionTimeout)); err != nil {
-        appendToStatus(fmt.Sprintf("Error setting connection deadline: %v", err))
-        logEvent("error", fmt.Sprintf("Error setting connection deadline: %v", err), fmt.Sprintf("Failed to set timeout for SMTP connection from %s: %v", conn.RemoteAddr().String(), err))
+// Match reports whether the address is on the list
+func (f *AddressFilter) Match(address string) bool {
+    if f == nil {
+        return false
     }
-    // Recommendation 14: Track active connections
-    activeConnections.Add(1)
-    defer activeConnections.Done()
-    reader := bufio.NewReader(conn)
-    writer := bufio.NewWriter(conn)
-    remoteAddr := conn.RemoteAddr().String()
-    appendToStatus(fmt.Sprintf("New SMTP connection from %s", remoteAddr))
-    logEvent("connection", fmt.Sprintf("New SMTP connection from %s", remoteAddr), fmt.Sprintf("Client connected from address %s, initiating SMTP handshake.", remoteAddr))
-    fmt.Fprintf(writer, "220 %s SMTP Server Ready\r\n", config.SMTP.Domain)
-    writer.Flush()
-    var from string
-    var to []string
-    var data strings.Builder
-    authenticated := false
-    var authUsername string
-    for {
-        line, err := reader.ReadString('\n')
+    address = strings.ToLower(address)
+    if f.addresses[address] {
+        return true
+    }
+    if at := strings.LastIndex(address, "@"); at >= 0 && f.domains[address[at+1:]] {
+        return true
+    }
+    for _, pattern := range f.patterns {
+        if pattern.MatchString(address) {
+            return true
+        }
+    }
+    return false
+}
+
+// dnsblQuery returns the name looked up in a DNSBL zone: the reversed octets for IPv4
+// (2.0.0.127.zone) and the reversed nibbles for IPv6
+func dnsblQuery(ip net.IP, zone string) string {
+    var labels []string
+    if v4 := ip.To4(); v4 != nil {
+        for i := len(v4) - 1; i >= 0; i-- {
+            labels = append(labels, strconv.Itoa(int(v4[i])))
+        }
+    } else {
+        const hexDigits = "0123456789abcdef"
+        v6 := ip.To16()
+        for i := len(v6) - 1; i >= 0; i-- {
+            labels = append(labels, string(hexDigits[v6[i]&0x0f]), string(hexDigits[v6[i]>>4]))
+        }
+    }
+    return strings.Join(labels, ".") + "." + strings.TrimSuffix(zone, ".")
+}
+
+// checkDNSBL returns the first zone listing the address, or "" when none does.
+// Private and loopback addresses are never looked up, and failed lookups count as
+// not listed so a broken resolver does not block all mail.
+func checkDNSBL(config DNSBLConfig, addr string) string {
+    ip := net.ParseIP(addr)
+    if !config.Enabled || ip == nil || ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() {
+        return ""
+    }
+    timeout := config.Timeout
+    if timeout <= 0 {
+        timeout = DefaultDNSBLTimeout
+    }
+    for _, zone := range config.Zones {
+        zone = strings.TrimSpace(zone)
+        if zone == "" {
+            continue
+        }
+        ctx, cancel := context.WithTimeout(context.Background(), timeout)
+        answers, err := net.DefaultResolver.LookupHost(ctx, dnsblQuery(ip, zone))
+        cancel()
         if err != nil {
-            appendToStatus(fmt.Sprintf("Error reading from connection: %v", err))
-            logEvent("error", fmt.Sprintf("Error reading from connection from %s: %v", remoteAddr, err), fmt.Sprintf("Failed to read incoming SMTP command from client at %s due to connection error: %v", remoteAddr, err))
-            return
+            continue
         }
-        line = strings.TrimSpace(line)
-        if strings.HasPrefix(line, "HELO") || strings.HasPrefix(line, "EHLO") {
-            fmt.Fprintf(writer, "250-%s Hello\r\n", config.SMTP.Domain)
-            fmt.Fprintf(writer, "250-AUTH LOGIN PLAIN\r\n")
-            fmt.Fprintf(writer, "250-8BITMIME\r\n")
-            fmt.Fprintf(writer, "250-ENHANCEDSTATUSCODES\r\n")
-            fmt.Fprintf(writer, "250-CHUNKING\r\n")
-            fmt.Fprintf(writer, "250 SIZE 1048576\r\n")
-            writer.Flush()
-            logEvent("smtp_handshake", fmt.Sprintf("Received %s from %s", strings.Split(line, " ")[0], remoteAddr), fmt.Sprintf("Client at %s initiated SMTP handshake with %s command, server responded with supported features including AUTH.", remoteAddr, strings.Split(line, " ")[0]))
-        } else if strings.HasPrefix(line, "AUTH LOGIN") {
-            fmt.Fprintf(writer, "334 VXNlcm5hbWU6\r\n")
-            writer.Flush()
-            usernameLine, err := reader.ReadString('\n')
-            if err != nil {
-                appendToStatus(fmt.Sprintf("Error reading username: %v", err))
-                logEvent("error", fmt.Sprintf("Error reading username from %s: %v", remoteAddr, err), fmt.Sprintf("Failed to read username during AUTH LOGIN from client at %s: %v", remoteAddr, err))
-                return
-            }
-            usernameLine = strings.TrimSpace(usernameLine)
-            usernameBytes, err := base64.StdEncoding.DecodeString(usernameLine)
-            if err != nil {
-                appendToStatus(fmt.Sprintf("Error decoding username: %v", err))
-                logEvent("error", fmt.Sprintf("Error decoding username from %s: %v", remoteAddr, err), fmt.Sprintf("Failed to decode base64-encoded username during AUTH LOGIN from client at %s: %v", remoteAddr, err))
-                fmt.Fprintf(writer, "535 Authentication failed\r\n")
-                writer.Flush()
-                continue
+        for _, answer := range answers {
+            // Listings are 127.0.0.0/8; 127.255.255.x are error codes, e.g. for public resolvers
+            if strings.HasPrefix(answer, "127.") && !strings.HasPrefix(answer, "127.255.255.") {
+                return zone
             }
-            authUsername = string(usernameBytes)
-            fmt.Fprintf(writer, "334 UGFzc3dvcmQ6\r\n")
-            writer.Flush()
-            passwordLine, err := reader.ReadString('\n')
-            if err != nil {
-                appendToStatus(fmt.Sprintf("Error reading password: %v", err))
-                logEvent("error", fmt.Sprintf("Error reading password from %s: %v", remoteAddr, err), fmt.Sprintf("Failed to read password during AUTH LOGIN from client at %s: %v", remoteAddr, err))
-                return
+        }
+    }
+    return ""
+}
+
+// spfResolver is the part of *net.Resolver the SPF check uses
+type spfResolver interface {
+    LookupTXT(ctx context.Context, name string) ([]string, error)
+    LookupMX(ctx context.Context, name string) ([]*net.MX, error)
+    LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error)
+    LookupHost(ctx context.Context, host string) ([]string, error)
+}
+
+// spfCheck evaluates SPF records (RFC 7208) for one MAIL FROM. Results are the RFC's:
+// pass, fail, softfail, neutral, none, temperror and permerror.
+type spfCheck struct {
+    ctx      context.Context
+    resolver spfResolver
+    ip       net.IP
+    sender   string
+    helo     string
+    lookups  int
+}
+
+// checkSPF returns the SPF result for mail from sender sent by ip. The null sender is
+// checked as postmaster at the HELO name (RFC 7208 2.4).
+func checkSPF(config SPFConfig, ip net.IP, sender, helo string) string {
+    if !strings.Contains(sender, "@") {
+        sender = "postmaster@" + helo
+    }
+    domain := sender[strings.LastIndex(sender, "@")+1:]
+    if domain == "" || ip == nil {
+        return "none"
+    }
+    timeout := config.Timeout
+    if timeout <= 0 {
+        timeout = DefaultSPFTimeout
+    }
+    ctx, cancel := context.WithTimeout(context.Background(), timeout)
+    defer cancel()
+    check := &spfCheck{ctx: ctx, resolver: net.DefaultResolver, ip: ip, sender: sender, helo: helo}
+    return check.evaluate(domain)
+}
+
+// evaluate runs the check_host() function of RFC 7208 section 4 for domain
+func (c *spfCheck) evaluate(domain string) string {
+    records, err := c.resolver.LookupTXT(c.ctx, domain)
+    if err != nil {
+        if dnsErr, ok := err.(*net.DNSError); ok && dnsErr.IsNotFound {
+            return "none"
+        }
+        return "temperror"
+    }
+    var record string
+    for _, txt := range records {
+        if txt == "v=spf1" || strings.HasPrefix(strings.ToLower(txt), "v=spf1 ") {
+            if record != "" {
+                return "permerror"
             }
-            passwordLine = strings.TrimSpace(passwordLine)
-            passwordBytes, err := base64.StdEncoding.DecodeString(passwordLine)
-            if err != nil {
-                appendToStatus(fmt.Sprintf("Error decoding password: %v", err))
-                logEvent("error", fmt.Sprintf("Error decoding password from %s: %v", remoteAddr, err), fmt.Sprintf("Failed to decode base64-encoded password during AUTH LOGIN from client at %s: %v", remoteAddr, err))
-                fmt.Fprintf(writer, "535 Authentication failed\r\n")
-                writer.Flush()
-                continue
+            record = txt
+        }
+    }
+    if record == "" {
+        return "none"
+    }
+    redirect := ""
+    for _, term := range strings.Fields(record)[1:] {
+        // Modifiers are name=value; only redirect matters here
+        if name, value, ok := strings.Cut(term, "="); ok && !strings.ContainsAny(name, ":/") {
+            if strings.EqualFold(name, "redirect") {
+                redirect = value
             }
-            password := string(passwordBytes)
-            // Recommendation 5: Fix authentication comparison bug
-            if authUsername == config.SMTP.SMTPUsername && password == config.SMTP.SMTPPassword {
-                authenticated = true
-                appendToStatus("Authentication successful (LOGIN)")
-                logEvent("smtp_auth_success", fmt.Sprintf("User %s authenticated successfully (LOGIN) from %s", authUsername, remoteAddr), fmt.Sprintf("Client at %s provided valid credentials for user %s using AUTH LOGIN method, authentication granted.", remoteAddr, authUsername))
-                fmt.Fprintf(writer, "235 Authentication successful\r\n")
-            } else {
-                appendToStatus("Authentication failed: Invalid credentials (LOGIN)")
-                logEvent("smtp_auth_failed", fmt.Sprintf("Failed authentication for user %s (LOGIN) from %s", authUsername, remoteAddr), fmt.Sprintf("Client at %s provided invalid credentials for user %s using AUTH LOGIN method, authentication denied.", remoteAddr, authUsername))
-                fmt.Fprintf(writer, "535 Authentication failed\r\n")
+            continue
+        }
+        qualifier := byte('+')
+        if strings.IndexByte("+-~?", term[0]) >= 0 {
+            qualifier, term = term[0], term[1:]
+        }
+        matched, result := c.mechanism(term, domain)
+        if result != "" {
+            return result
+        }
+        if matched {
+            return map[byte]string{'+': "pass", '-': "fail", '~': "softfail", '?': "neutral"}[qualifier]
+        }
+    }
+    if redirect == "" {
+        return "neutral"
+    }
+    if c.lookups++; c.lookups > SPFMaxLookups {
+        return "permerror"
+    }
+    target, ok := c.expand(redirect, domain)
+    if !ok {
+        return "permerror"
+    }
+    if result := c.evaluate(target); result != "none" {
+        return result
+    }
+    return "permerror"
+}
+
+// mechanism reports whether a mechanism matches the client address; a non-empty result
+// ends the evaluation with that error
+func (c *spfCheck) mechanism(term, domain string) (bool, string) {
+    name, value, _ := strings.Cut(term, ":")
+    // a and mx take a dual CIDR length after the optional domain: a:host/24//64
+    spec, cidr := value, ""
+    if base, _, _ := strings.Cut(name, "/"); strings.EqualFold(base, "a") || strings.EqualFold(base, "mx") {
+        if slash := strings.Index(term, "/"); slash >= 0 {
+            cidr = term[slash:]
+            spec = ""
+            if colon := strings.Index(term, ":"); colon >= 0 && colon < slash {
+                spec = term[colon+1 : slash]
             }
-            writer.Flush()
-        } else if strings.HasPrefix(line, "AUTH PLAIN") {
-            parts := strings.Split(line, " ")
-            var authData string
-            if len(parts) > 2 {
-                authData = parts[2]
+        }
+        name = base
+    }
+    target := domain
+    if spec != "" && !strings.EqualFold(name, "ip4") && !strings.EqualFold(name, "ip6") {
+        expanded, ok := c.expand(spec, domain)
+        if !ok {
+            return false, "permerror"
+        }
+        target = expanded
+    }
+    switch strings.ToLower(name) {
+    case "all":
+        return true, ""
+    case "ip4", "ip6":
+        network := value
+        if !strings.Contains(network, "/") {
+            if strings.EqualFold(name, "ip4") {
+                network += "/32"
             } else {
-                fmt.Fprintf(writer, "334 \r\n")
-                writer.Flush()
-                authDataLine, err := reader.ReadString('\n')
-                if err != nil {
-                    appendToStatus(fmt.Sprintf("Error reading PLAIN data: %v", err))
-                    logEvent("error", fmt.Sprintf("Error reading PLAIN data from %s: %v", remoteAddr, err), fmt.Sprintf("Failed to read authentication data during AUTH PLAIN from client at %s: %v", remoteAddr, err))
-                    return
-                }
-                authData = strings.TrimSpace(authDataLine)
+                network += "/128"
             }
-            authBytes, err := base64.StdEncoding.DecodeString(authData)
-            if err != nil {
-                appendToStatus(fmt.Sprintf("Error decoding PLAIN data: %v", err))
-                logEvent("error", fmt.Sprintf("Error decoding PLAIN data from %s: %v", remoteAddr, err), fmt.Sprintf("Failed to decode base64-encoded data during AUTH PLAIN from client at %s: %v", remoteAddr, err))
-                fmt.Fprintf(writer, "535 Authentication failed\r\n")
-                writer.Flush()
-                continue
+        }
+        _, ipNet, err := net.ParseCIDR(network)
+        if err != nil {
+            return false, "permerror"
+        }
+        return ipNet.Contains(c.ip), ""
+    case "a", "mx":
+        if c.lookups++; c.lookups > SPFMaxLookups {
+            return false, "permerror"
+        }
+        v4Bits, v6Bits := 32, 128
+        if cidr != "" {
+            v4Part, v6Part, _ := strings.Cut(strings.TrimPrefix(cidr, "/"), "//")
+            if strings.HasPrefix(cidr, "//") {
+                v4Part, v6Part = "", strings.TrimPrefix(cidr, "//")
             }
-            authParts := strings.Split(string(authBytes), "\x00")
-            if len(authParts) < 3 {
-                appendToStatus("Invalid PLAIN response format")
-                logEvent("error", fmt.Sprintf("Invalid PLAIN response format from %s", remoteAddr), fmt.Sprintf("Client at %s sent malformed data during AUTH PLAIN, missing required fields.", remoteAddr))
-                fmt.Fprintf(writer, "535 Authentication failed\r\n")
-                writer.Flush()
-                continue
+            var err error
+            if v4Part != "" {
+                if v4Bits, err = strconv.Atoi(v4Part); err != nil || v4Bits > 32 {
+                    return false, "permerror"
+                }
             }
-            username := authParts[1]
-            password := authParts[2]
-            // Recommendation 5: Fix authentication comparison bug
-            if username == config.SMTP.SMTPUsername && password == config.SMTP.SMTPPassword {
-                authenticated = true
-                appendToStatus("PLAIN Authentication successful")
-                logEvent("smtp_auth_success", fmt.Sprintf("User %s authenticated successfully (PLAIN) from %s", username, remoteAddr), fmt.Sprintf("Client at %s provided valid credentials for user %s using AUTH PLAIN method, authentication granted.", remoteAddr, username))
-                fmt.Fprintf(writer, "235 Authentication successful\r\n")
-            } else {
-                appendToStatus("PLAIN Authentication failed: Invalid credentials")
-                logEvent("smtp_auth_failed", fmt.Sprintf("Failed authentication for user %s (PLAIN) from %s", username, remoteAddr), fmt.Sprintf("Client at %s provided invalid credentials for user %s using AUTH PLAIN method, authentication denied.", remoteAddr, username))
-                fmt.Fprintf(writer, "535 Authentication failed\r\n")
+            if v6Part != "" {
+                if v6Bits, err = strconv.Atoi(v6Part); err != nil || v6Bits > 128 {
+                    return false, "permerror"
+                }
             }
-            writer.Flush()
-        } else if strings.HasPrefix(line, "MAIL FROM:") {
-            if !authenticated && config.SMTP.AuthRequired {
-                appendToStatus("Rejecting MAIL command: Authentication required")
-                logEvent("error", fmt.Sprintf("Rejecting MAIL command from %s: Authentication required", remoteAddr), fmt.Sprintf("Client at %s attempted MAIL FROM without authentication, rejected due to auth requirement.", remoteAddr))
-                fmt.Fprintf(writer, "530 Authentication required\r\n")
-                writer.Flush()
-                continue
+        }
+        hosts := []string{target}
+        if strings.EqualFold(name, "mx") {
+            mxs, err := c.resolver.LookupMX(c.ctx, target)
+            if err != nil {
+                if dnsErr, ok := err.(*net.DNSError); ok && dnsErr.IsNotFound {
+                    return false, ""
+                }
+                return false, "temperror"
             }
-            from = strings.TrimPrefix(line, "MAIL FROM:")
-            from = strings.Trim(from, "<>")
-            fmt.Fprintf(writer, "250 OK\r\n")
-            writer.Flush()
-            logEvent("smtp_command", fmt.Sprintf("MAIL FROM %s accepted from %s", from, remoteAddr), fmt.Sprintf("Client at %s specified sender address %s in MAIL FROM command, accepted by server.", remoteAddr, from))
-        } else if strings.HasPrefix(line, "RCPT TO:") {
-            if !authenticated && config.SMTP.AuthRequired {
-                appendToStatus("Rejecting RCPT command: Authentication required")
-                logEvent("error", fmt.Sprintf("Rejecting RCPT command from %s: Authentication required", remoteAddr), fmt.Sprintf("Client at %s attempted RCPT TO without authentication, rejected due to auth requirement.", remoteAddr))
-                fmt.Fprintf(writer, "530 Authentication required\r\n")
-                writer.Flush()
-                continue
+            hosts = hosts[:0]
+            for i, mx := range mxs {
+                if i == SPFMaxLookups {
+                    return false, "permerror"
+                }
+                hosts = append(hosts, mx.Host)
             }
-            toAddr := strings.TrimPrefix(line, "RCPT TO:")
-            toAddr = strings.Trim(toAddr, "<>")
-            to = append(to, toAddr)
-            fmt.Fprintf(writer, "250 OK\r\n")
-            writer.Flush()
-            logEvent("smtp_command", fmt.Sprintf("RCPT TO %s accepted from %s", toAddr, remoteAddr), fmt.Sprintf("Client at %s specified recipient address %s in RCPT TO command, accepted by server.", remoteAddr, toAddr))
-        } else if line == "DATA" {
-            if !authenticated && config.SMTP.AuthRequired {
-                appendToStatus("Rejecting DATA command: Authentication required")
-                logEvent("error", fmt.Sprintf("Rejecting DATA command from %s: Authentication required", remoteAddr), fmt.Sprintf("Client at %s attempted DATA without authentication, rejected due to auth requirement.", remoteAddr))
-                fmt.Fprintf(writer, "530 Authentication required\r\n")
-                writer.Flush()
-                continue
+        }
+        for _, host := range hosts {
+            addrs, err := c.resolver.LookupIPAddr(c.ctx, host)
+            if err != nil {
+                if dnsErr, ok := err.(*net.DNSError); ok && dnsErr.IsNotFound {
+                    continue
+                }
+                return false, "temperror"
             }
-            fmt.Fprintf(writer, "354 Start mail input; end with <CRLF>.<CRLF>\r\n")
-            writer.Flush()
-            logEvent("smtp_command", fmt.Sprintf("DATA command received from %s", remoteAddr), fmt.Sprintf("Client at %s initiated DATA command to send email content, server ready to receive message body.", remoteAddr))
-            for {
-                dataLine, err := reader.ReadString('\n')
-                if err != nil {
-                    appendToStatus(fmt.Sprintf("Error reading data: %v", err))
-                    logEvent("error", fmt.Sprintf("Error reading data from %s: %v", remoteAddr, err), fmt.Sprintf("Failed to read email content during DATA phase from client at %s: %v", remoteAddr, err))
-                    return
+            for _, addr := range addrs {
+                bits, size := v6Bits, 128
+                if addr.IP.To4() != nil {
+                    bits, size = v4Bits, 32
                 }
-                if dataLine == ".\r\n" {
-                    fmt.Fprintf(writer, "250 OK\r\n")
-                    writer.Flush()
-                    logEvent("smtp_command", fmt.Sprintf("DATA completed from %s", remoteAddr), fmt.Sprintf("Client at %s completed email content transmission with DATA command, server accepted the message.", remoteAddr))
-                    break
+                if (addr.IP.To4() != nil) == (c.ip.To4() != nil) && addr.IP.Mask(net.CIDRMask(bits, size)).Equal(c.ip.Mask(net.CIDRMask(bits, size))) {
+                    return true, ""
                 }
-                data.WriteString(dataLine)
             }
-            emailData := parseEmail(from, to, data.String())
-            if err := sendToGotify(config.Gotify, emailData); err != nil {
-                appendToStatus(fmt.Sprintf("Failed to send to Gotify: %v", err))
-                logEvent("gotify_failed", fmt.Sprintf("Failed to send to Gotify for email from %s: %v", emailData.From, err), fmt.Sprintf("Failed to forward email notification to Gotify server for email from %s to %s with subject '%s': %v", emailData.From, strings.Join(emailData.To, ", "), emailData.Subject, err))
+        }
+        return false, ""
+    case "include":
+        if c.lookups++; c.lookups > SPFMaxLookups {
+            return false, "permerror"
+        }
+        switch result := c.evaluate(target); result {
+        case "pass":
+            return true, ""
+        case "temperror":
+            return false, result
+        case "permerror", "none":
+            return false, "permerror"
+        }
+        return false, ""
+    case "exists":
+        if c.lookups++; c.lookups > SPFMaxLookups {
+            return false, "permerror"
+        }
+        addrs, err := c.resolver.LookupHost(c.ctx, target)
+        if err != nil {
+            if dnsErr, ok := err.(*net.DNSError); ok && dnsErr.IsNotFound {
+                return false, ""
+            }
+            return false, "temperror"
+        }
+        return len(addrs) > 0, ""
+    case "ptr":
+        // Deprecated by RFC 7208 5.5 and slow; treated as never matching, but it still
+        // counts as a lookup
+        if c.lookups++; c.lookups > SPFMaxLookups {
+            return false, "permerror"
+        }
+        return false, ""
+    }
+    return false, "permerror"
+}
+
+// expand replaces the macros of a domain-spec (RFC 7208 section 7), e.g. %{i}._spf.%{d}
+func (c *spfCheck) expand(spec, domain string) (string, bool) {
+    var out strings.Builder
+    for i := 0; i < len(spec); i++ {
+        if spec[i] != '%' {
+            out.WriteByte(spec[i])
+            continue
+        }
+        if i+1 >= len(spec) {
+            return "", false
+        }
+        i++
+        switch spec[i] {
+        case '%':
+            out.WriteByte('%')
+            continue
+        case '_':
+            out.WriteByte(' ')
+            continue
+        case '-':
+            out.WriteString("%20")
+            continue
+        case '{':
+        default:
+            return "", false
+        }
+        end := strings.IndexByte(spec[i:], '}')
+        if end < 2 {
+            return "", false
+        }
+        macro := spec[i+1 : i+end]
+        i += end
+        var value string
+        local, senderDomain, _ := strings.Cut(c.sender, "@")
+        switch unicode.ToLower(rune(macro[0])) {
+        case 's':
+            value = c.sender
+        case 'l':
+            value = local
+        case 'o':
+            value = senderDomain
+        case 'd':
+            value = domain
+        case 'h':
+            value = c.helo
+        case 'i':
+            if v4 := c.ip.To4(); v4 != nil {
+                value = v4.String()
             } else {
-                appendToStatus(fmt.Sprintf("Successfully sent notification to Gotify for email from %s", emailData.From))
-                logEvent("gotify_success", fmt.Sprintf("Successfully sent notification to Gotify for email from %s", emailData.From), fmt.Sprintf("Successfully forwarded email notification to Gotify server for email from %s to %s with subject '%s'.", emailData.From, strings.Join(emailData.To, ", "), emailData.Subject))
+                value = strings.TrimSuffix(dnsblQuery(c.ip, "x"), ".x")
+                value = reverseLabels(value)
             }
-        } else if line == "QUIT" {
-            fmt.Fprintf(writer, "221 Bye\r\n")
-            writer.Flush()
-            appendToStatus(fmt.Sprintf("Client disconnected from %s", remoteAddr))
-            logEvent("connection", fmt.Sprintf("Client disconnected from %s", remoteAddr), fmt.Sprintf("Client at %s sent QUIT command, server acknowledged and closed connection.", remoteAddr))
+        case 'v':
+            value = "in-addr"
+            if c.ip.To4() == nil {
+                value = "ip6"
+            }
+        default:
+            return "", false
+        }
+        // Transformers: keep the rightmost N labels, "r" reverses; other delimiters split too
+        transformers := macro[1:]
+        digits := 0
+        for len(transformers) > 0 && transformers[0] >= '0' && transformers[0] <= '9' {
+            digits = digits*10 + int(transformers[0]-'0')
+            transformers = transformers[1:]
+        }
+        reverse := false
+        if len(transformers) > 0 && (transformers[0] == 'r' || transformers[0] == 'R') {
+            reverse, transformers = true, transformers[1:]
+        }
+        delimiters := "."
+        if transformers != "" {
+            delimiters = transformers
+        }
+        labels := strings.FieldsFunc(value, func(r rune) bool { return strings.ContainsRune(delimiters, r) })
+        if reverse {
+            for a, b := 0, len(labels)-1; a < b; a, b = a+1, b-1 {
+                labels[a], labels[b] = labels[b], labels[a]
+            }
+        }
+        if digits > 0 && digits < len(labels) {
+            labels = labels[len(labels)-digits:]
+        }
+        out.WriteString(strings.Join(labels, "."))
+    }
+    return out.String(), true
+}
+
+// reverseLabels reverses the dot-separated labels of a name
+func reverseLabels(name string) string {
+    labels := strings.Split(name, ".")
+    for a, b := 0, len(labels)-1; a < b; a, b = a+1, b-1 {
+        labels[a], labels[b] = labels[b], labels[a]
+    }
+    return strings.Join(labels, ".")
+}
+
+// BanStore is the on-disk representation of the active IP bans
+type BanStore struct {
+    Bans    map[string]time.Time `json:"bans"`
+    // Reasons holds the violation that triggered each ban, for the ban list screen
+    Reasons map[string]string    `json:"reasons"`
+}
+
+// BanEntry is one active ban as shown on the ban list screen
+type BanEntry struct {
+    IP     string
+    Reason string
+    Expiry time.Time
+}
+
+// Active returns the bans of the store that have not expired, soonest to expire first
+func (s BanStore) Active(now time.Time) []BanEntry {
+    var entries []BanEntry
+    for ip, expiry := range s.Bans {
+        if expiry.After(now) {
+            entries = append(entries, BanEntry{IP: ip, Reason: s.Reasons[ip], Expiry: expiry})
+        }
+    }
+    sort.Slice(entries, func(i, j int) bool {
+        return entries[i].Expiry.Before(entries[j].Expiry)
+    })
+    return entries
+}
+
+// BanList tracks protocol violations per IP and temporarily bans offenders.
+// Active bans are persisted to disk so the interactive UI can list and clear them
+// while the service is running. The file is synced every BanSyncInterval rather
+// than on each command: changes made by the UI are picked up and new bans written.
+type BanList struct {
+    mu         sync.Mutex
+    config     BanConfig
+    path       string
+    violations map[string][]time.Time
+    bans       map[string]time.Time
+    reasons    map[string]string
+    // pending holds the bans recorded since the file was last written
+    pending    map[string]bool
+    modTime    time.Time
+    lastPrune  time.Time
+    stop       chan struct{}
+    stopOnce   sync.Once
+}
+
+// newBanList creates a BanList, loads any bans persisted from a previous run and,
+// when banning is enabled, starts syncing the ban file until Close is called
+func newBanList(config BanConfig, path string) *BanList {
+    b := &BanList{
+        config:     config,
+        path:       path,
+        violations: make(map[string][]time.Time),
+        bans:       make(map[string]time.Time),
+        reasons:    make(map[string]string),
+        pending:    make(map[string]bool),
+        stop:       make(chan struct{}),
+    }
+    b.mu.Lock()
+    b.reloadLocked()
+    b.mu.Unlock()
+    if config.Enabled {
+        go b.syncLoop()
+    }
+    return b
+}
+
+// syncLoop syncs the ban file every BanSyncInterval until the list is closed
+func (b *BanList) syncLoop() {
+    ticker := time.NewTicker(BanSyncInterval)
+    defer ticker.Stop()
+    for {
+        select {
+        case <-b.stop:
             return
-        } else {
-            fmt.Fprintf(writer, "500 Unknown command\r\n")
-            writer.Flush()
-            logEvent("error", fmt.Sprintf("Unknown command received from %s: %s", remoteAddr, line), fmt.Sprintf("Client at %s sent an unrecognized or unsupported SMTP command '%s', server responded with error.", remoteAddr, line))
+        case <-ticker.C:
+            b.mu.Lock()
+            b.syncLocked()
+            b.mu.Unlock()
+        }
+    }
+}
+
+// Close stops syncing and writes the bans recorded since the last sync
+func (b *BanList) Close() {
+    if b == nil {
+        return
+    }
+    b.stopOnce.Do(func() {
+        close(b.stop)
+    })
+    b.mu.Lock()
+    defer b.mu.Unlock()
+    b.syncLocked()
+}
+
+// syncLocked picks up changes made to the ban file by another process and writes
+// the bans that are not in it yet
+func (b *BanList) syncLocked() {
+    b.reloadLocked()
+    if len(b.pending) > 0 {
+        b.saveLocked()
+    }
+}
+
+// reloadLocked re-reads the ban file if it was changed by another process (e.g. cleared
+// from the UI), keeping the bans that have not been written to it yet
+func (b *BanList) reloadLocked() {
+    store := BanStore{Bans: make(map[string]time.Time), Reasons: make(map[string]string)}
+    var modTime time.Time
+    info, err := os.Stat(b.path)
+    if err == nil {
+        if info.ModTime().Equal(b.modTime) {
+            return
+        }
+        if store, err = loadBanStore(b.path); err != nil {
+            appendToStatus(fmt.Sprintf("Failed to load ban list: %v", err))
+            return
+        }
+        modTime = info.ModTime()
+    } else if !os.IsNotExist(err) || b.modTime.IsZero() {
+        return
+    }
+    for ip := range b.pending {
+        store.Bans[ip] = b.bans[ip]
+        store.Reasons[ip] = b.reasons[ip]
+    }
+    b.bans = store.Bans
+    b.reasons = store.Reasons
+    b.modTime = modTime
+}
+
+// saveLocked drops expired bans and writes the rest to disk
+func (b *BanList) saveLocked() {
+    now := time.Now()
+    for ip, expiry := range b.bans {
+        if !expiry.After(now) {
+            delete(b.bans, ip)
+            delete(b.reasons, ip)
+        }
+    }
+    if err := saveBanStore(b.path, BanStore{Bans: b.bans, Reasons: b.reasons}); err != nil {
+        appendToStatus(fmt.Sprintf("Failed to save ban list: %v", err))
+        return
+    }
+    b.pending = make(map[string]bool)
+    if info, err := os.Stat(b.path); err == nil {
+        b.modTime = info.ModTime()
+    }
+}
+
+// IsBanned reports whether the given IP is currently banned
+func (b *BanList) IsBanned(ip string) bool {
+    if b == nil || !b.config.Enabled {
+        return false
+    }
+    b.mu.Lock()
+    defer b.mu.Unlock()
+    expiry, ok := b.bans[ip]
+    if !ok {
+        return false
+    }
+    if time.Now().After(expiry) {
+        delete(b.bans, ip)
+        delete(b.reasons, ip)
+        delete(b.pending, ip)
+        return false
+    }
+    return true
+}
+
+// RecordViolation counts an auth failure or protocol violation for the IP and
+// bans it once the configured threshold is reached within the window.
+// It returns true if the IP is banned as a result.
+func (b *BanList) RecordViolation(ip, reason string) bool {
+    if b == nil || !b.config.Enabled {
+        return false
+    }
+    b.mu.Lock()
+    defer b.mu.Unlock()
+    now := time.Now()
+    cutoff := now.Add(-b.config.Window)
+    // IPs that never reach the threshold would otherwise be tracked for good
+    if now.Sub(b.lastPrune) >= b.config.Window {
+        pruneFailures(b.violations, cutoff)
+        b.lastPrune = now
+    }
+    if _, ok := b.violations[ip]; !ok && len(b.violations) >= MaxFailureCounters {
+        evictStalestFailure(b.violations)
+    }
+    recent := b.violations[ip][:0]
+    for _, t := range b.violations[ip] {
+        if t.After(cutoff) {
+            recent = append(recent, t)
+        }
+    }
+    recent = append(recent, now)
+    b.violations[ip] = recent
+    if len(recent) < b.config.MaxViolations {
+        return false
+    }
+    delete(b.violations, ip)
+    expiry := now.Add(b.config.Duration)
+    b.bans[ip] = expiry
+    b.reasons[ip] = reason
+    b.pending[ip] = true
+    appendToStatus(fmt.Sprintf("Banned %s until %s (%s)", ip, expiry.Format("1/2/2006 - 15:04:05"), reason))
+    logEvent("ip_banned", fmt.Sprintf("Banned %s until %s", ip, expiry.Format("1/2/2006 - 15:04:05")), fmt.Sprintf("Client IP %s reached %d violations within %v (last: %s) and was banned for %v.", ip, len(recent), b.config.Window, reason, b.config.Duration))
+    return true
+}
+
+// pruneFailures drops the failure counters whose last entry is not after cutoff
+func pruneFailures(failures map[string][]time.Time, cutoff time.Time) {
+    for key, times := range failures {
+        if len(times) == 0 || !times[len(times)-1].After(cutoff) {
+            delete(failures, key)
+        }
+    }
+}
+
+// evictStalestFailure drops the counter with the oldest last entry, making room for a
+// new key once MaxFailureCounters is reached
+func evictStalestFailure(failures map[string][]time.Time) {
+    stalest := ""
+    var last time.Time
+    for key, times := range failures {
+        if len(times) == 0 {
+            delete(failures, key)
+            return
+        }
+        if stalest == "" || times[len(times)-1].Before(last) {
+            stalest, last = key, times[len(times)-1]
+        }
+    }
+    delete(failures, stalest)
+}
+
+// tokenBucket is the remaining allowance of one client IP
+type tokenBucket struct {
+    tokens float64
+    last   time.Time
+}
+
+// RateLimiter is a token bucket limiter keyed by remote IP
+type RateLimiter struct {
+    mu        sync.Mutex
+    perMinute int
+    buckets   map[string]*tokenBucket
+    lastPrune time.Time
+}
+
+// newRateLimiter creates a limiter allowing perMinute events per IP; it returns nil
+// (which allows everything) when the limit is disabled
+func newRateLimiter(enabled bool, perMinute int) *RateLimiter {
+    if !enabled || perMinute <= 0 {
+        return nil
+    }
+    return &RateLimiter{
+        perMinute: perMinute,
+        buckets:   make(map[string]*tokenBucket),
+        lastPrune: time.Now(),
+    }
+}
+
+// Allow takes a token for the IP and reports whether one was available
+func (r *RateLimiter) Allow(ip string) bool {
+    if r == nil {
+        return true
+    }
+    r.mu.Lock()
+    defer r.mu.Unlock()
+    now := time.Now()
+    capacity := float64(r.perMinute)
+    // Buckets that have refilled completely carry no state worth keeping
+    if now.Sub(r.lastPrune) >= time.Minute {
+        for key, bucket := range r.buckets {
+            if now.Sub(bucket.last) >= time.Minute {
+                delete(r.buckets, key)
+            }
+        }
+        r.lastPrune = now
+    }
+    bucket, ok := r.buckets[ip]
+    if !ok {
+        bucket = &tokenBucket{tokens: capacity, last: now}
+        r.buckets[ip] = bucket
+    }
+    bucket.tokens += now.Sub(bucket.last).Minutes() * capacity
+    if bucket.tokens > capacity {
+        bucket.tokens = capacity
+    }
+    bucket.last = now
+    if bucket.tokens < 1 {
+        return false
+    }
+    bucket.tokens--
+    return true
+}
+
+// AuthLockout counts failed authentications per IP and per username and locks
+// out sources that exceed the configured threshold
+type AuthLockout struct {
+    mu        sync.Mutex
+    config    AuthLockoutConfig
+    failures  map[string][]time.Time
+    locked    map[string]time.Time
+    lastPrune time.Time
+}
+
+// newAuthLockout creates the lockout tracker; it returns nil (which never locks) when disabled
+func newAuthLockout(config AuthLockoutConfig) *AuthLockout {
+    if !config.Enabled {
+        return nil
+    }
+    return &AuthLockout{
+        config:   config,
+        failures: make(map[string][]time.Time),
+        locked:   make(map[string]time.Time),
+    }
+}
+
+// keys returns the counters a failure from ip for username is recorded under
+func (a *AuthLockout) keys(ip, username string) map[string]int {
+    keys := map[string]int{}
+    if a.config.MaxFailures > 0 {
+        keys["ip:"+ip] = a.config.MaxFailures
+    }
+    if a.config.MaxUserFailures > 0 && username != "" {
+        keys["user:"+username] = a.config.MaxUserFailures
+    }
+    return keys
+}
+
+// Locked reports whether AUTH from the IP or for the username is currently refused
+func (a *AuthLockout) Locked(ip, username string) bool {
+    if a == nil {
+        return false
+    }
+    a.mu.Lock()
+    defer a.mu.Unlock()
+    now := time.Now()
+    for key := range a.keys(ip, username) {
+        if expiry, ok := a.locked[key]; ok {
+            if now.Before(expiry) {
+                return true
+            }
+            delete(a.locked, key)
+        }
+    }
+    return false
+}
+
+// RecordFailure counts a failed AUTH and returns the lockouts it triggered
+func (a *AuthLockout) RecordFailure(ip, username string) []string {
+    if a == nil {
+        return nil
+    }
+    a.mu.Lock()
+    defer a.mu.Unlock()
+    now := time.Now()
+    cutoff := now.Add(-a.config.Window)
+    // Credential stuffing tries a new username every time; counters outside the window
+    // and lockouts that ran out are dropped so they do not pile up
+    if now.Sub(a.lastPrune) >= a.config.Window {
+        pruneFailures(a.failures, cutoff)
+        for key, expiry := range a.locked {
+            if !now.Before(expiry) {
+                delete(a.locked, key)
+            }
+        }
+        a.lastPrune = now
+    }
+    var triggered []string
+    for key, limit := range a.keys(ip, username) {
+        if _, ok := a.failures[key]; !ok && len(a.failures) >= MaxFailureCounters {
+            evictStalestFailure(a.failures)
+        }
+        recent := a.failures[key][:0]
+        for _, t := range a.failures[key] {
+            if t.After(cutoff) {
+                recent = append(recent, t)
+            }
+        }
+        recent = append(recent, now)
+        if len(recent) < limit {
+            a.failures[key] = recent
+            continue
+        }
+        delete(a.failures, key)
+        a.locked[key] = now.Add(a.config.Duration)
+        triggered = append(triggered, key)
+    }
+    return triggered
+}
+
+// RecordSuccess forgets the failures of an IP and username after a successful AUTH
+func (a *AuthLockout) RecordSuccess(ip, username string) {
+    if a == nil {
+        return
+    }
+    a.mu.Lock()
+    defer a.mu.Unlock()
+    for key := range a.keys(ip, username) {
+        delete(a.failures, key)
+    }
+}
+
+// AuthTarpit counts recent failed authentications per IP to pick the delay before the
+// next 535 reply
+type AuthTarpit struct {
+    mu        sync.Mutex
+    config    AuthTarpitConfig
+    failures  map[string][]time.Time
+    lastPrune time.Time
+}
+
+// newAuthTarpit creates the tarpit; it returns nil (which never delays) when disabled
+func newAuthTarpit(config AuthTarpitConfig) *AuthTarpit {
+    if !config.Enabled || config.Delay <= 0 {
+        return nil
+    }
+    return &AuthTarpit{
+        config:   config,
+        failures: make(map[string][]time.Time),
+    }
+}
+
+// RecordFailure counts a failed AUTH from ip and returns how long to hold back the reply;
+// sessionFailures are the failures of the current session including this one
+func (t *AuthTarpit) RecordFailure(ip string, sessionFailures int) time.Duration {
+    if t == nil {
+        return 0
+    }
+    t.mu.Lock()
+    defer t.mu.Unlock()
+    now := time.Now()
+    cutoff := now.Add(-t.config.Window)
+    // IPs that stop trying would otherwise be remembered for good
+    if now.Sub(t.lastPrune) >= t.config.Window {
+        pruneFailures(t.failures, cutoff)
+        t.lastPrune = now
+    }
+    if _, ok := t.failures[ip]; !ok && len(t.failures) >= MaxFailureCounters {
+        evictStalestFailure(t.failures)
+    }
+    recent := t.failures[ip][:0]
+    for _, failed := range t.failures[ip] {
+        if failed.After(cutoff) {
+            recent = append(recent, failed)
+        }
+    }
+    recent = append(recent, now)
+    t.failures[ip] = recent
+    failures := len(recent)
+    if sessionFailures > failures {
+        failures = sessionFailures
+    }
+    if failures < t.config.After {
+        return 0
+    }
+    delay := t.config.Delay
+    for i := t.config.After; i < failures && (t.config.MaxDelay <= 0 || delay < t.config.MaxDelay); i++ {
+        delay *= 2
+    }
+    if t.config.MaxDelay > 0 && delay > t.config.MaxDelay {
+        delay = t.config.MaxDelay
+    }
+    return delay
+}
+
+// RecordSuccess forgets the failures of an IP after a successful AUTH
+func (t *AuthTarpit) RecordSuccess(ip string) {
+    if t == nil {
+        return
+    }
+    t.mu.Lock()
+    defer t.mu.Unlock()
+    delete(t.failures, ip)
+}
+
+// loadBanStore reads the ban list file, returning an empty store if it does not exist
+func loadBanStore(path string) (BanStore, error) {
+    store := BanStore{Bans: make(map[string]time.Time), Reasons: make(map[string]string)}
+    data, err := os.ReadFile(path)
+    if err != nil {
+        if os.IsNotExist(err) {
+            return store, nil
+        }
+        return store, fmt.Errorf("failed to read ban list: %v", err)
+    }
+    if err := json.Unmarshal(data, &store); err != nil {
+        return BanStore{Bans: make(map[string]time.Time), Reasons: make(map[string]string)}, fmt.Errorf("failed to parse ban list: %v", err)
+    }
+    if store.Bans == nil {
+        store.Bans = make(map[string]time.Time)
+    }
+    // Files written before reasons were kept have none
+    if store.Reasons == nil {
+        store.Reasons = make(map[string]string)
+    }
+    return store, nil
+}
+
+// saveBanStore writes the ban list file
+func saveBanStore(path string, store BanStore) error {
+    data, err := json.MarshalIndent(store, "", "  ")
+    if err != nil {
+        return fmt.Errorf("failed to marshal ban list: %v", err)
+    }
+    if err := os.WriteFile(path, data, 0640); err != nil {
+        return fmt.Errorf("failed to write ban list: %v", err)
+    }
+    return nil
+}
+
+// SessionInfo describes one live SMTP session as shown on the connections screen
+type SessionInfo struct {
+    ID           string    `json:"id"`
+    RemoteAddr   string    `json:"remote_addr"`
+    State        string    `json:"state"`
+    User         string    `json:"user,omitempty"`
+    Helo         string    `json:"helo,omitempty"`
+    TLS          bool      `json:"tls"`
+    Started      time.Time `json:"started"`
+    // Ended is only set in the summary logged when the session closes
+    Ended        time.Time `json:"ended,omitempty"`
+    BytesIn      int64     `json:"bytes_in"`
+    BytesOut     int64     `json:"bytes_out"`
+    Commands     int64     `json:"commands"`
+    Messages     int64     `json:"messages"`
+    AuthAttempts int64     `json:"auth_attempts"`
+}
+
+// SessionSnapshot is the list of live sessions the server writes to disk
+type SessionSnapshot struct {
+    Updated  time.Time     `json:"updated"`
+    Sessions []SessionInfo `json:"sessions"`
+}
+
+// liveSession is a registry entry; the byte counters are updated atomically by countingConn,
+// the others by the Count methods of the registry
+type liveSession struct {
+    info         SessionInfo
+    conn         net.Conn
+    bytesIn      int64
+    bytesOut     int64
+    commands     int64
+    messages     int64
+    authAttempts int64
+}
+
+// snapshot returns the session info with the current counter values
+func (s *liveSession) snapshot() SessionInfo {
+    info := s.info
+    info.BytesIn = atomic.LoadInt64(&s.bytesIn)
+    info.BytesOut = atomic.LoadInt64(&s.bytesOut)
+    info.Commands = atomic.LoadInt64(&s.commands)
+    info.Messages = atomic.LoadInt64(&s.messages)
+    info.AuthAttempts = atomic.LoadInt64(&s.authAttempts)
+    return info
+}
+
+// countingConn counts the raw bytes of a session, below any TLS layer
+type countingConn struct {
+    net.Conn
+    session *liveSession
+}
+
+func (c *countingConn) Read(p []byte) (int, error) {
+    n, err := c.Conn.Read(p)
+    atomic.AddInt64(&c.session.bytesIn, int64(n))
+    return n, err
+}
+
+func (c *countingConn) Write(p []byte) (int, error) {
+    n, err := c.Conn.Write(p)
+    atomic.AddInt64(&c.session.bytesOut, int64(n))
+    return n, err
+}
+
+// SessionRegistry tracks the live SMTP sessions so they can be listed and disconnected.
+// The server publishes it to disk because the UI usually runs in another process.
+type SessionRegistry struct {
+    mu       sync.Mutex
+    sessions map[string]*liveSession
+}
+
+// newSessionRegistry creates an empty SessionRegistry
+func newSessionRegistry() *SessionRegistry {
+    return &SessionRegistry{sessions: make(map[string]*liveSession)}
+}
+
+// Register adds a session and returns conn wrapped so its traffic is counted
+func (r *SessionRegistry) Register(id string, conn net.Conn) net.Conn {
+    session := &liveSession{
+        info: SessionInfo{
+            ID:         id,
+            RemoteAddr: conn.RemoteAddr().String(),
+            State:      "connected",
+            Started:    time.Now(),
+        },
+        conn: conn,
+    }
+    r.mu.Lock()
+    r.sessions[id] = session
+    r.mu.Unlock()
+    return &countingConn{Conn: conn, session: session}
+}
+
+// Unregister removes a finished session and returns its final counters
+func (r *SessionRegistry) Unregister(id string) SessionInfo {
+    r.mu.Lock()
+    session, ok := r.sessions[id]
+    delete(r.sessions, id)
+    r.mu.Unlock()
+    if !ok {
+        return SessionInfo{ID: id, Ended: time.Now()}
+    }
+    info := session.snapshot()
+    info.Ended = time.Now()
+    return info
+}
+
+// lookup returns the live session with the given ID, nil once it has ended
+func (r *SessionRegistry) lookup(id string) *liveSession {
+    r.mu.Lock()
+    defer r.mu.Unlock()
+    return r.sessions[id]
+}
+
+// CountCommand counts an SMTP command received in a session
+func (r *SessionRegistry) CountCommand(id string) {
+    if session := r.lookup(id); session != nil {
+        atomic.AddInt64(&session.commands, 1)
+    }
+}
+
+// CountMessage counts a message accepted in a session
+func (r *SessionRegistry) CountMessage(id string) {
+    if session := r.lookup(id); session != nil {
+        atomic.AddInt64(&session.messages, 1)
+    }
+}
+
+// CountAuthAttempt counts an AUTH command of a session, successful or not
+func (r *SessionRegistry) CountAuthAttempt(id string) {
+    if session := r.lookup(id); session != nil {
+        atomic.AddInt64(&session.authAttempts, 1)
+    }
+}
+
+// SetState records the SMTP stage a session is in
+func (r *SessionRegistry) SetState(id, state string) {
+    r.mu.Lock()
+    if session, ok := r.sessions[id]; ok {
+        session.info.State = state
+    }
+    r.mu.Unlock()
+}
+
+// SetUser records the authenticated user of a session, empty after a reset
+func (r *SessionRegistry) SetUser(id, user string) {
+    r.mu.Lock()
+    if session, ok := r.sessions[id]; ok {
+        session.info.User = user
+    }
+    r.mu.Unlock()
+}
+
+// SetHelo records the name the client announced with HELO/EHLO
+func (r *SessionRegistry) SetHelo(id, name string) {
+    r.mu.Lock()
+    if session, ok := r.sessions[id]; ok {
+        session.info.Helo = name
+    }
+    r.mu.Unlock()
+}
+
+// SetRemoteAddr replaces the client address of a session, e.g. with the one from XCLIENT
+func (r *SessionRegistry) SetRemoteAddr(id, addr string) {
+    r.mu.Lock()
+    if session, ok := r.sessions[id]; ok {
+        session.info.RemoteAddr = addr
+    }
+    r.mu.Unlock()
+}
+
+// SetTLS marks a session as upgraded with STARTTLS
+func (r *SessionRegistry) SetTLS(id string) {
+    r.mu.Lock()
+    if session, ok := r.sessions[id]; ok {
+        session.info.TLS = true
+    }
+    r.mu.Unlock()
+}
+
+// Snapshot returns the live sessions, oldest first
+func (r *SessionRegistry) Snapshot() SessionSnapshot {
+    r.mu.Lock()
+    defer r.mu.Unlock()
+    snapshot := SessionSnapshot{Updated: time.Now(), Sessions: []SessionInfo{}}
+    for _, session := range r.sessions {
+        snapshot.Sessions = append(snapshot.Sessions, session.snapshot())
+    }
+    sort.Slice(snapshot.Sessions, func(i, j int) bool {
+        return snapshot.Sessions[i].Started.Before(snapshot.Sessions[j].Started)
+    })
+    return snapshot
+}
+
+// Disconnect closes the connection of a session; its handler then exits on the read error
+func (r *SessionRegistry) Disconnect(id string) bool {
+    r.mu.Lock()
+    session, ok := r.sessions[id]
+    r.mu.Unlock()
+    if !ok {
+        return false
+    }
+    session.conn.Close()
+    return true
+}
+
+// InterruptIdle wakes the sessions waiting for a command outside a mail transaction, so
+// their handlers notice the shutdown and close them with 421
+func (r *SessionRegistry) InterruptIdle() {
+    r.mu.Lock()
+    defer r.mu.Unlock()
+    for _, session := range r.sessions {
+        if session.info.State == stateConnected.String() || session.info.State == stateGreeted.String() {
+            session.conn.SetReadDeadline(time.Now())
+        }
+    }
+}
+
+// publish writes the session list to disk and handles disconnect requests from the UI
+// until done is closed
+func (r *SessionRegistry) publish(done chan struct{}) {
+    ticker := time.NewTicker(SessionPublishInterval)
+    defer ticker.Stop()
+    defer os.Remove(sessionsPath)
+    for {
+        select {
+        case <-done:
+            return
+        case <-ticker.C:
+        }
+        // Rename first so requests appended while processing are not lost
+        processing := disconnectPath + ".processing"
+        if err := os.Rename(disconnectPath, processing); err == nil {
+            if data, err := os.ReadFile(processing); err == nil {
+                for _, id := range strings.Fields(string(data)) {
+                    if r.Disconnect(id) {
+                        logSessionEvent(id, "connection", fmt.Sprintf("Session %s disconnected from the UI", id), fmt.Sprintf("SMTP session %s was closed by an operator from the active connections screen.", id))
+                    }
+                }
+            }
+            os.Remove(processing)
+        }
+        data, err := json.MarshalIndent(r.Snapshot(), "", "  ")
+        if err != nil {
+            continue
+        }
+        if err := os.WriteFile(sessionsPath, data, 0640); err != nil {
+            appendToStatus(fmt.Sprintf("Failed to publish sessions: %v", err))
+        }
+    }
+}
+
+// loadSessionSnapshot reads the session list published by the running server
+func loadSessionSnapshot() (SessionSnapshot, error) {
+    var snapshot SessionSnapshot
+    data, err := os.ReadFile(sessionsPath)
+    if err != nil {
+        return snapshot, err
+    }
+    if err := json.Unmarshal(data, &snapshot); err != nil {
+        return snapshot, fmt.Errorf("failed to parse sessions file: %v", err)
+    }
+    return snapshot, nil
+}
+
+// requestDisconnect asks the running server to close a session
+func requestDisconnect(id string) error {
+    file, err := os.OpenFile(disconnectPath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0640)
+    if err != nil {
+        return fmt.Errorf("failed to write disconnect request: %v", err)
+    }
+    defer file.Close()
+    if _, err := fmt.Fprintln(file, id); err != nil {
+        return fmt.Errorf("failed to write disconnect request: %v", err)
+    }
+    return nil
+}
+
+// recordAuthFailure logs a failed AUTH attempt, counts it towards an IP ban and the AUTH
+// lockout and then waits out the tarpit delay, so the caller's 535 reply comes late.
+// sessionFailures are the failed attempts of the session including this one.
+func recordAuthFailure(config AppConfig, sessionID, remoteAddr, username, mechanism string, sessionFailures int) {
+    logAuthFailure(config.SMTP.AuthFailLog, remoteAddr, username, mechanism)
+    ipBans.RecordViolation(remoteIP(remoteAddr), fmt.Sprintf("AUTH %s failure", mechanism))
+    for _, key := range authLockout.RecordFailure(remoteIP(remoteAddr), username) {
+        logSessionEvent(sessionID, "auth_lockout", fmt.Sprintf("AUTH locked out for %s", key), fmt.Sprintf("Too many failed AUTH attempts for %s (last from %s as user '%s') within %v, further AUTH attempts are refused with 421 for %v.", key, remoteAddr, username, config.AuthLockout.Window, config.AuthLockout.Duration))
+    }
+    if delay := authTarpit.RecordFailure(remoteIP(remoteAddr), sessionFailures); delay > 0 {
+        logSessionEvent(sessionID, "auth_lockout", fmt.Sprintf("Delaying AUTH reply to %s by %v", remoteAddr, delay), fmt.Sprintf("Client at %s has failed AUTH repeatedly (%d times in this session), the 535 reply is held back for %v to slow down password guessing.", remoteAddr, sessionFailures, delay))
+        time.Sleep(delay)
+    }
+}
+
+// rejectAuthLockout answers AUTH with 421 when the IP or username is locked out and
+// reports whether it did so; the caller then closes the connection
+func rejectAuthLockout(writer *bufio.Writer, sessionID, remoteAddr, username string) bool {
+    if !authLockout.Locked(remoteIP(remoteAddr), username) {
+        return false
+    }
+    fmt.Fprintf(writer, "421 4.7.0 Too many failed authentication attempts, try again later\r\n")
+    writer.Flush()
+    logSessionEvent(sessionID, "auth_lockout", fmt.Sprintf("Refused AUTH from %s: locked out", remoteAddr), fmt.Sprintf("Client at %s attempted AUTH (user '%s') while locked out after repeated failures, connection closed with 421.", remoteAddr, username))
+    return true
+}
+
+// buildTLSConfig creates the STARTTLS configuration from PEM files or, when ACME is
+// enabled, from certificates issued and renewed automatically via the HTTP-01 challenge
+func buildTLSConfig(config TLSConfig) (*tls.Config, error) {
+    tlsReloader = nil
+    if !config.Enabled {
+        return nil, nil
+    }
+    if config.ACME.Enabled {
+        if len(config.ACME.Hostnames) == 0 {
+            return nil, fmt.Errorf("ACME is enabled but no hostnames are configured")
+        }
+        cacheDir := config.ACME.CacheDir
+        if cacheDir == "" {
+            cacheDir = filepath.Join(dataDirPath, ACMECacheDirName)
+        }
+        if err := os.MkdirAll(cacheDir, 0700); err != nil {
+            return nil, fmt.Errorf("failed to create ACME cache directory: %v", err)
+        }
+        manager := &autocert.Manager{
+            Prompt:     autocert.AcceptTOS,
+            HostPolicy: autocert.HostWhitelist(config.ACME.Hostnames...),
+            Cache:      autocert.DirCache(cacheDir),
+            Email:      config.ACME.Email,
+        }
+        if config.ACME.DirectoryURL != "" {
+            manager.Client = &acme.Client{DirectoryURL: config.ACME.DirectoryURL}
+        }
+        httpAddr := config.ACME.HTTPAddr
+        if httpAddr == "" {
+            httpAddr = DefaultACMEHTTPAddr
+        }
+        // Serve HTTP-01 challenges; the CA must be able to reach this port for every hostname.
+        // The port is bound here so it is still taken as root when run_as_user is set.
+        challengeListener, err := net.Listen("tcp", httpAddr)
+        if err != nil {
+            logEvent("error", fmt.Sprintf("ACME HTTP-01 listener on %s failed: %v", httpAddr, err), fmt.Sprintf("The HTTP listener answering ACME HTTP-01 challenges on %s could not be started, certificate issuance and renewal will fail: %v", httpAddr, err))
+        } else {
+            go func() {
+                if err := http.Serve(challengeListener, manager.HTTPHandler(nil)); err != nil {
+                    logEvent("error", fmt.Sprintf("ACME HTTP-01 listener on %s failed: %v", httpAddr, err), fmt.Sprintf("The HTTP listener answering ACME HTTP-01 challenges on %s stopped, certificate issuance and renewal will fail: %v", httpAddr, err))
+                }
+            }()
+        }
+        defaultHost := config.ACME.Hostnames[0]
+        logEvent("tls", fmt.Sprintf("ACME certificate provisioning enabled for %s", strings.Join(config.ACME.Hostnames, ", ")), fmt.Sprintf("Certificates for %s will be obtained and renewed automatically, HTTP-01 challenges are served on %s and cached in %s.", strings.Join(config.ACME.Hostnames, ", "), httpAddr, cacheDir))
+        return &tls.Config{
+            MinVersion: tls.VersionTLS12,
+            GetCertificate: func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+                // Many SMTP clients omit SNI, fall back to the first configured hostname
+                if hello.ServerName == "" {
+                    hello.ServerName = defaultHost
+                }
+                return manager.GetCertificate(hello)
+            },
+        }, nil
+    }
+    reloader, err := newCertReloader(config.CertFile, config.KeyFile)
+    if err != nil {
+        return nil, err
+    }
+    tlsReloader = reloader
+    return &tls.Config{
+        MinVersion:     tls.VersionTLS12,
+        GetCertificate: reloader.GetCertificate,
+    }, nil
+}
+
+// certReloader serves a PEM certificate pair and swaps it when the files change or on
+// SIGHUP, so renewed certificates apply to new connections without a restart
+type certReloader struct {
+    certFile string
+    keyFile  string
+    mutex    sync.RWMutex
+    cert     *tls.Certificate
+    modTime  time.Time
+}
+
+// newCertReloader loads the initial certificate pair
+func newCertReloader(certFile, keyFile string) (*certReloader, error) {
+    reloader := &certReloader{certFile: certFile, keyFile: keyFile}
+    if err := reloader.reload(); err != nil {
+        return nil, err
+    }
+    return reloader, nil
+}
+
+// filesModTime returns the newest modification time of the certificate and key files
+func (r *certReloader) filesModTime() (time.Time, error) {
+    var newest time.Time
+    for _, path := range []string{r.certFile, r.keyFile} {
+        info, err := os.Stat(path)
+        if err != nil {
+            return time.Time{}, err
+        }
+        if info.ModTime().After(newest) {
+            newest = info.ModTime()
+        }
+    }
+    return newest, nil
+}
+
+// reload reads the pair from disk and swaps it in; on error the previous certificate stays active
+func (r *certReloader) reload() error {
+    modTime, err := r.filesModTime()
+    if err != nil {
+        return fmt.Errorf("failed to stat TLS certificate: %v", err)
+    }
+    cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+    if err != nil {
+        return fmt.Errorf("failed to load TLS certificate: %v", err)
+    }
+    r.mutex.Lock()
+    r.cert = &cert
+    r.modTime = modTime
+    r.mutex.Unlock()
+    return nil
+}
+
+// GetCertificate returns the current certificate for each handshake
+func (r *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+    r.mutex.RLock()
+    defer r.mutex.RUnlock()
+    return r.cert, nil
+}
+
+// watch reloads the certificate when its files change or SIGHUP arrives, until done is closed
+func (r *certReloader) watch(done <-chan struct{}) {
+    hupChan := make(chan os.Signal, 1)
+    signal.Notify(hupChan, syscall.SIGHUP)
+    defer signal.Stop(hupChan)
+    ticker := time.NewTicker(CertReloadInterval)
+    defer ticker.Stop()
+    for {
+        var reason string
+        select {
+        case <-done:
+            return
+        case <-hupChan:
+            reason = "SIGHUP"
+        case <-ticker.C:
+            modTime, err := r.filesModTime()
+            r.mutex.RLock()
+            current := r.modTime
+            r.mutex.RUnlock()
+            // A failed reload leaves modTime unchanged, so a half-written renewal is retried
+            if err != nil || !modTime.After(current) {
+                continue
+            }
+            reason = "a file change"
+        }
+        if err := r.reload(); err != nil {
+            logEvent("error", fmt.Sprintf("TLS certificate reload failed: %v", err), fmt.Sprintf("Reloading %s and %s after %s failed, new connections keep using the previous certificate: %v", r.certFile, r.keyFile, reason, err))
+            continue
+        }
+        logEvent("tls", "TLS certificate reloaded", fmt.Sprintf("The certificate %s and key %s were reloaded after %s, new STARTTLS connections use the renewed certificate.", r.certFile, r.keyFile, reason))
+    }
+}
+
+// auditActor identifies who performed an administrative action
+func auditActor() string {
+    if u, err := user.Current(); err == nil {
+        return u.Username
+    }
+    return getEnv("USER", "unknown")
+}
+
+// maskSecret hides the value of secret configuration fields in the audit log
+func maskSecret(field, value string) string {
+    if value == "" {
+        return ""
+    }
+    switch field {
+    case "smtp.smtp_password", "gotify.gotify_token":
+        return "********"
+    }
+    return value
+}
+
+// writeAudit appends an entry to the audit log. The file is only ever opened for
+// appending and is kept separate from the operational logs, which get rotated.
+func writeAudit(entry AuditEntry) {
+    entry.Timestamp = time.Now().UTC().Format(time.RFC3339)
+    entry.Actor = auditActor()
+    entry.PID = os.Getpid()
+    data, err := json.Marshal(entry)
+    if err != nil {
+        appendToStatus(fmt.Sprintf("Failed to marshal audit entry: %v", err))
+        return
+    }
+    auditMutex.Lock()
+    defer auditMutex.Unlock()
+    file, err := os.OpenFile(auditLogPath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+    if err != nil {
+        appendToStatus(fmt.Sprintf("Failed to open audit log %s: %v", auditLogPath, err))
+        return
+    }
+    defer file.Close()
+    if _, err := file.Write(append(data, '\n')); err != nil {
+        appendToStatus(fmt.Sprintf("Failed to write audit log %s: %v", auditLogPath, err))
+    }
+}
+
+// auditEvent records an administrative action such as a service control command
+func auditEvent(action, detail string) {
+    writeAudit(AuditEntry{Action: action, Detail: detail})
+}
+
+// auditConfigChange records a configuration change with secrets masked
+func auditConfigChange(field, oldValue, newValue string) {
+    writeAudit(AuditEntry{
+        Action:   "config_change",
+        Field:    field,
+        OldValue: maskSecret(field, oldValue),
+        NewValue: maskSecret(field, newValue),
+    })
+}
+
+// auditResult formats the outcome of an audited command
+func auditResult(err error) string {
+    if err != nil {
+        return fmt.Sprintf("failed: %v", err)
+    }
+    return "succeeded"
+}
+
+// ensureLogFileExists creates the log file if it doesn't exist
+func ensureLogFileExists() error {
+    if _, err := os.Stat(logFilePath); os.IsNotExist(err) {
+        initialData := []byte(`{"entries": []}`)
+        if err := os.WriteFile(logFilePath, initialData, 0640); err != nil {
+            return fmt.Errorf("failed to create log file: %v", err)
+        }
+    }
+    return nil
+}
+
+// Recommendation 4: Log rotation helper function
+func rotateLogFile() error {
+    logMutex.Lock()
+    defer logMutex.Unlock()
+    // Check current log file size
+    fileInfo, err := os.Stat(logFilePath)
+    if err != nil && !os.IsNotExist(err) {
+        return fmt.Errorf("failed to stat log file: %v", err)
+    }
+    if fileInfo != nil && fileInfo.Size() >= MaxLogFileSize {
+        // Generate a rotated log file name with timestamp
+        timestamp := time.Now().Format("20060102_150405")
+        rotatedPath := fmt.Sprintf("%s.%s", logFilePath, timestamp)
+        if err := os.Rename(logFilePath, rotatedPath); err != nil {
+            return fmt.Errorf("failed to rotate log file: %v", err)
+        }
+        // Create a new empty log file
+        initialData := []byte(`{"entries": []}`)
+        if err := os.WriteFile(logFilePath, initialData, 0640); err != nil {
+            return fmt.Errorf("failed to create new log file after rotation: %v", err)
+        }
+        appendToStatus("Log file rotated due to size limit.")
+        logEvent("log_rotation", "Log file rotated", fmt.Sprintf("Log file %s exceeded size limit and was rotated to %s", logFilePath, rotatedPath))
+    }
+    return nil
+}
+
+// loadLogs loads the logs from the JSON file, handling both formats
+func loadLogs() (LogStore, error) {
+    logMutex.Lock()
+    defer logMutex.Unlock()
+    if err := ensureLogFileExists(); err != nil {
+        appendToStatus(fmt.Sprintf("Debug: Failed to ensure log file exists: %v", err))
+        return LogStore{}, err
+    }
+    file, err := os.Open(logFilePath)
+    if err != nil {
+        appendToStatus(fmt.Sprintf("Debug: Failed to open log file %s: %v", logFilePath, err))
+        return LogStore{Entries: []LogEntry{}}, fmt.Errorf("failed to open log file: %v", err)
+    }
+    defer file.Close()
+    var entries []LogEntry
+    scanner := bufio.NewScanner(file)
+    firstLine := ""
+    if scanner.Scan() {
+        firstLine = scanner.Text()
+    }
+    if strings.HasPrefix(firstLine, "{\"entries\":") {
+        data, err := os.ReadFile(logFilePath)
+        if err == nil {
+            var store LogStore
+            if json.Unmarshal(data, &store) == nil {
+                appendToStatus(fmt.Sprintf("Debug: Successfully loaded %d entries from JSON store format", len(store.Entries)))
+                return store, nil
+            } else {
+                appendToStatus(fmt.Sprintf("Debug: Failed to unmarshal JSON store format: %v", err))
+            }
+        }
+        file.Seek(0, 0)
+        scanner = bufio.NewScanner(file)
+    }
+    for scanner.Scan() {
+        line := scanner.Text()
+        if len(line) == 0 {
+            continue
+        }
+        if entry, err := parseLogLine(line); err == nil {
+            entries = append(entries, entry)
+        } else {
+            appendToStatus(fmt.Sprintf("Debug: Failed to parse log line: %s, error: %v", line, err))
+        }
+    }
+    if err := scanner.Err(); err != nil {
+        appendToStatus(fmt.Sprintf("Debug: Error reading log file line by line: %v", err))
+        return LogStore{Entries: entries}, fmt.Errorf("error reading log file line by line: %v", err)
+    }
+    appendToStatus(fmt.Sprintf("Debug: Loaded %d entries from line-by-line parsing", len(entries)))
+    return LogStore{Entries: entries}, nil
+}
+
+// parseLogLine converts a single zap JSON line into a LogEntry
+func parseLogLine(line string) (LogEntry, error) {
+    var zapEntry ZapLogEntry
+    if err := json.Unmarshal([]byte(line), &zapEntry); err != nil {
+        return LogEntry{}, err
+    }
+    message := zapEntry.FullMessage
+    if message == "" {
+        message = zapEntry.Message
+    }
+    timestamp := zapEntry.Timestamp
+    if len(timestamp) > 19 {
+        timestamp = timestamp[:19]
+        timestamp = strings.Replace(timestamp, "T", " ", 1)
+    }
+    if parsedTime, err := time.Parse("2006-01-02 15:04:05", timestamp); err == nil {
+        timestamp = parsedTime.Format("1/2/2006 - 15:04:05")
+    }
+    return LogEntry{
+        Timestamp:   timestamp,
+        Category:    zapEntry.Category,
+        Message:     message,
+        Description: zapEntry.Description,
+        Level:       zapEntry.Level,
+        Caller:      zapEntry.Caller,
+        Session:     zapEntry.Session,
+        Summary:     zapEntry.Summary,
+    }, nil
+}
+
+// traceWriter logs each reply line of a traced SMTP session before it goes out
+type traceWriter struct {
+    w         io.Writer
+    sessionID string
+    pending   []byte
+}
+
+func (t *traceWriter) Write(p []byte) (int, error) {
+    t.pending = append(t.pending, p...)
+    for {
+        end := bytes.IndexByte(t.pending, '\n')
+        if end < 0 {
+            break
+        }
+        logSessionEvent(t.sessionID, "smtp_trace", "S: "+strings.TrimRight(string(t.pending[:end]), "\r"), "Reply sent to the client, logged because the SMTP debug trace is enabled.")
+        t.pending = t.pending[end+1:]
+    }
+    return t.w.Write(p)
+}
+
+// newReplyWriter returns the buffered writer for SMTP replies, tracing them when enabled
+func newReplyWriter(conn net.Conn, sessionID string, trace bool) *bufio.Writer {
+    if trace {
+        return bufio.NewWriter(&traceWriter{w: conn, sessionID: sessionID})
+    }
+    return bufio.NewWriter(conn)
+}
+
+// redactCommand hides the initial response of AUTH, which carries the credentials
+func redactCommand(line string) string {
+    verb, arg := parseCommand(line)
+    if verb != "AUTH" {
+        return line
+    }
+    mechanism, initial, _ := strings.Cut(arg, " ")
+    if initial == "" {
+        return line
+    }
+    return fmt.Sprintf("%s %s <redacted>", line[:len(verb)], mechanism)
+}
+
+// newSessionID returns a short random identifier used to correlate the log entries of one connection
+func newSessionID() string {
+    return fmt.Sprintf("%012x", rand.Int63()&0xffffffffffff)
+}
+
+// LogPage is one page of log entries, newest first, read backwards from the log file
+type LogPage struct {
+    Entries []LogEntry
+    // Byte offset where the scan stopped; the next (older) page starts here
+    NextOffset int64
+    HasMore    bool
+}
+
+// readLogPage reads up to limit entries accepted by match, walking the log file
+// backwards from the byte offset end (-1 means the end of the file). Only the chunks
+// needed for one page are read, so the cost does not grow with the size of the log.
+func readLogPage(match func(LogEntry) bool, end int64, limit int) (LogPage, error) {
+    if err := ensureLogFileExists(); err != nil {
+        return LogPage{}, err
+    }
+    file, err := os.Open(logFilePath)
+    if err != nil {
+        return LogPage{}, fmt.Errorf("failed to open log file: %v", err)
+    }
+    defer file.Close()
+    info, err := file.Stat()
+    if err != nil {
+        return LogPage{}, fmt.Errorf("failed to stat log file: %v", err)
+    }
+    // Old JSON store files are a single document and cannot be paged backwards
+    prefix := make([]byte, len(`{"entries":`))
+    if n, _ := file.ReadAt(prefix, 0); n == len(prefix) && string(prefix) == `{"entries":` {
+        return readLegacyLogPage(match, end, limit)
+    }
+    if end < 0 || end > info.Size() {
+        end = info.Size()
+    }
+    page := LogPage{Entries: []LogEntry{}}
+    chunk := make([]byte, LogPageChunkSize)
+    var partial []byte
+    pos := end
+    for pos > 0 {
+        size := int64(len(chunk))
+        if pos < size {
+            size = pos
+        }
+        pos -= size
+        if _, err := file.ReadAt(chunk[:size], pos); err != nil && err != io.EOF {
+            return page, fmt.Errorf("failed to read log file: %v", err)
+        }
+        buf := append(append([]byte{}, chunk[:size]...), partial...)
+        // Everything before the first newline may belong to a line that continues in
+        // the previous chunk, so keep it for the next iteration unless at the start
+        lineEnd := len(buf)
+        for i := len(buf) - 1; i >= -1; i-- {
+            if i >= 0 && buf[i] != '\n' {
+                continue
+            }
+            if i < 0 && pos > 0 {
+                break
+            }
+            line := strings.TrimSpace(string(buf[i+1 : lineEnd]))
+            lineEnd = i
+            if line == "" {
+                continue
+            }
+            entry, err := parseLogLine(line)
+            if err != nil {
+                continue
+            }
+            if !match(entry) {
+                continue
+            }
+            if len(page.Entries) == limit {
+                // One extra match proves an older page exists; it starts with this line
+                page.HasMore = true
+                return page, nil
+            }
+            page.Entries = append(page.Entries, entry)
+            page.NextOffset = pos + int64(i+1)
+        }
+        if lineEnd > 0 {
+            partial = buf[:lineEnd]
+        } else {
+            partial = nil
+        }
+    }
+    return page, nil
+}
+
+// readLegacyLogPage pages through the old {"entries": [...]} store format
+func readLegacyLogPage(match func(LogEntry) bool, end int64, limit int) (LogPage, error) {
+    store, err := loadLogs()
+    if err != nil {
+        return LogPage{}, err
+    }
+    filtered := []LogEntry{}
+    for i := len(store.Entries) - 1; i >= 0; i-- {
+        if match(store.Entries[i]) {
+            filtered = append(filtered, store.Entries[i])
+        }
+    }
+    // For the legacy format the offset is an index into the filtered list
+    start := 0
+    if end > 0 && end < int64(len(filtered)) {
+        start = int(end)
+    }
+    stop := start + limit
+    if stop > len(filtered) {
+        stop = len(filtered)
+    }
+    return LogPage{Entries: filtered[start:stop], NextOffset: int64(stop), HasMore: stop < len(filtered)}, nil
+}
+
+// Recommendation 4: Modified saveLogs to check for rotation
+func saveLogs(store LogStore) error {
+    logMutex.Lock()
+    defer logMutex.Unlock()
+    data, err := json.MarshalIndent(store, "", "  ")
+    if err != nil {
+        return fmt.Errorf("failed to marshal log data: %v", err)
+    }
+    logDir := filepath.Dir(logFilePath)
+    if err := os.MkdirAll(logDir, 0750); err != nil {
+        return fmt.Errorf("failed to create log directory: %v", err)
+    }
+    if err := rotateLogFile(); err != nil {
+        appendToStatus(fmt.Sprintf("Failed to rotate log file: %v", err))
+    }
+    if err := os.WriteFile(logFilePath, data, 0640); err != nil {
+        return fmt.Errorf("failed to write log file: %v", err)
+    }
+    return nil
+}
+
+// appendLog adds a new log entry and writes it directly to the file
+func appendLog(entry LogEntry) error {
+    store, err := loadLogs()
+    if err != nil {
+        store = LogStore{Entries: []LogEntry{}}
+    }
+    store.Entries = append(store.Entries, entry)
+    return saveLogs(store)
+}
+
+// initStatusUpdater initializes the status update handler with debouncing
+func initStatusUpdater(p *tea.Program) {
+    go func() {
+        for {
+            select {
+            case msg, ok := <-statusUpdateChan:
+                if !ok {
+                    return
+                }
+                appMutex.Lock()
+                statusLog = append(statusLog, msg)
+                if len(statusLog) > MaxStatusLines {
+                    statusLog = statusLog[len(statusLog)-MaxStatusLines:]
+                }
+                appMutex.Unlock()
+                if statusUpdateTimer != nil {
+                    statusUpdateTimer.Stop()
+                }
+                statusUpdateTimer = time.AfterFunc(StatusUpdateDebounce, func() {
+                    p.Send(StatusUpdateMsg{})
+                })
+            case logEntry, ok := <-logUpdateChan:
+                if !ok {
+                    return
+                }
+                if err := appendLog(logEntry); err != nil {
+                    appendToStatus(fmt.Sprintf("Failed to append log: %v", err))
+                }
+                p.Send(LogUpdateMsg{Entry: logEntry})
+            }
+        }
+    }()
+}
+
+// appendToStatus adds a message to the status log panel safely
+func appendToStatus(message string) {
+    timestamp := time.Now().Format("1/2/2006 - 15:04:05")
+    select {
+    case statusUpdateChan <- fmt.Sprintf("[%s] %s", timestamp, message):
+    default:
+        // Fallback to direct append if channel is full to avoid silent drops
+        appMutex.Lock()
+        statusLog = append(statusLog, fmt.Sprintf("[%s] Status channel full, dropping message: %s", timestamp, message))
+        if len(statusLog) > MaxStatusLines {
+            statusLog = statusLog[len(statusLog)-MaxStatusLines:]
+        }
+        appMutex.Unlock()
+    }
+}
+
+// secureCompare compares two secrets in constant time so response timing
+// does not reveal how many leading bytes matched
+func secureCompare(given, expected string) bool {
+    return subtle.ConstantTimeCompare([]byte(given), []byte(expected)) == 1
+}
+
+// HTTP access scopes: reading stored data, and administrative operations
+const (
+    HTTPScopeRead  = "read"
+    HTTPScopeAdmin = "admin"
+)
+
+// validate checks that the configured tokens are long enough to resist guessing
+func (c HTTPAuthConfig) validate() error {
+    if c.ReadToken != "" && len(c.ReadToken) < MinHTTPTokenLength {
+        return fmt.Errorf("http_auth.read_token must be at least %d characters", MinHTTPTokenLength)
+    }
+    if c.AdminToken != "" && len(c.AdminToken) < MinHTTPTokenLength {
+        return fmt.Errorf("http_auth.admin_token must be at least %d characters", MinHTTPTokenLength)
+    }
+    return nil
+}
+
+// Authorized reports whether the request carries a token granting scope
+func (c HTTPAuthConfig) Authorized(r *http.Request, scope string) bool {
+    given := ""
+    if _, password, ok := r.BasicAuth(); ok {
+        given = password
+    } else if header := r.Header.Get("Authorization"); strings.HasPrefix(header, "Bearer ") {
+        given = strings.TrimSpace(strings.TrimPrefix(header, "Bearer "))
+    }
+    if given == "" {
+        return false
+    }
+    if c.AdminToken != "" && secureCompare(given, c.AdminToken) {
+        return true
+    }
+    return scope == HTTPScopeRead && c.ReadToken != "" && secureCompare(given, c.ReadToken)
+}
+
+// denyHTTP answers a request that is not authorized with 401 and logs it
+func denyHTTP(w http.ResponseWriter, r *http.Request, realm string) {
+    w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Basic realm="%s"`, realm))
+    http.Error(w, "Unauthorized", http.StatusUnauthorized)
+    logEvent("http_auth_failed", fmt.Sprintf("Refused HTTP request from %s", r.RemoteAddr), fmt.Sprintf("A request from %s for %s was not authorized and was answered with 401.", r.RemoteAddr, r.URL.Path))
+}
+
+// checkCredentials verifies a username/password pair against the primary account and
+// the users list. Every account is compared in full so a wrong username costs the same
+// as a wrong password and the timing does not reveal which accounts exist. An empty
+// username is always refused, and an unset primary account is not an account.
+func checkCredentials(username, password string, config SMTPConfig) bool {
+    if username == "" {
+        return false
+    }
+    matched := false
+    if config.SMTPUsername != "" {
+        userOK := secureCompare(username, config.SMTPUsername)
+        passOK := secureCompare(password, config.SMTPPassword)
+        matched = userOK && passOK
+    }
+    for _, user := range config.Users {
+        userOK := secureCompare(username, user.Name)
+        passOK := secureCompare(password, user.Password)
+        if userOK && passOK {
+            matched = true
+        }
+    }
+    return matched
+}
+
+// gotifyForUser returns the Gotify settings for mail submitted by the given account,
+// using the account's own token and body truncation where it sets them
+func gotifyForUser(gotify GotifyConfig, users []SMTPUser, name string) GotifyConfig {
+    for _, user := range users {
+        if user.Name != name {
+            continue
+        }
+        if user.GotifyToken != "" {
+            gotify.GotifyToken = user.GotifyToken
+        }
+        if user.MaxBodyLength > 0 {
+            gotify.MaxBodyLength = user.MaxBodyLength
+        }
+        if user.TruncateSuffix != "" {
+            gotify.TruncateSuffix = user.TruncateSuffix
+        }
+        if user.TruncateAt != "" {
+            gotify.TruncateAt = user.TruncateAt
+        }
+        if user.BodyPreference != "" {
+            gotify.BodyPreference = user.BodyPreference
+        }
+        if user.ClickURL != "" {
+            gotify.ClickURL = user.ClickURL
+        }
+        break
+    }
+    return gotify
+}
+
+// validBodyPreference reports whether prefer is a known gotify.body_preference value
+func validBodyPreference(prefer string) bool {
+    return prefer == "" || prefer == "plain" || prefer == "html" || prefer == "plain_fallback"
+}
+
+// validTruncateAt reports whether mode is a known gotify.truncate_at value
+func validTruncateAt(mode string) bool {
+    return mode == "" || mode == "char" || mode == "word" || mode == "line"
+}
+
+// Lines that start the quoted part of a reply: "On <date>, <name> wrote:" (the attribution
+// may be wrapped onto a second line) and Outlook's "-----Original Message-----"
+var (
+    replyAttribution = regexp.MustCompile(`^On\s.*\bwrote:\s*$`)
+    originalMessage  = regexp.MustCompile(`(?i)^-{3,}\s*Original Message\s*-{3,}\s*$`)
+)
+
+// stripQuotedReply cuts body at the first reply marker or the "-- " signature separator,
+// and drops a block of ">" quoted lines that runs to the end. A body that would end up
+// empty is returned unchanged.
+func stripQuotedReply(body string) string {
+    lines := strings.Split(body, "\n")
+    end := len(lines)
+    for i, line := range lines {
+        line = strings.TrimRight(line, "\r")
+        next := ""
+        if i+1 < len(lines) {
+            next = strings.TrimRight(lines[i+1], "\r")
+        }
+        if line == "-- " || line == "--" || originalMessage.MatchString(line) || replyAttribution.MatchString(line) ||
+            strings.HasPrefix(line, "On ") && !strings.Contains(line, "wrote:") && replyAttribution.MatchString(line+" "+next) {
+            end = i
+            break
+        }
+    }
+    // Trailing quoted lines, blank ones in between included
+    for end > 0 {
+        line := strings.TrimSpace(lines[end-1])
+        if line != "" && !strings.HasPrefix(line, ">") {
+            break
+        }
+        end--
+    }
+    stripped := strings.TrimRight(strings.Join(lines[:end], "\n"), " \t\r\n")
+    if stripped == "" {
+        return body
+    }
+    return stripped
+}
+
+// truncateBody cuts body to config.MaxBodyLength characters and appends the suffix. With
+// "word" or "line" the cut moves back to the last space or line break, unless there is
+// none and it has to stay mid-word.
+func truncateBody(body string, config GotifyConfig) string {
+    if config.MaxBodyLength <= 0 || utf8.RuneCountInString(body) <= config.MaxBodyLength {
+        return body
+    }
+    cut, count := len(body), 0
+    for i := range body {
+        if count == config.MaxBodyLength {
+            cut = i
+            break
+        }
+        count++
+    }
+    boundary := -1
+    switch config.TruncateAt {
+    case "word":
+        boundary = strings.LastIndexAny(body[:cut], " \t\n")
+    case "line":
+        boundary = strings.LastIndex(body[:cut], "\n")
+    }
+    if boundary > 0 {
+        cut = boundary
+    }
+    return strings.TrimRight(body[:cut], " \t\r\n") + config.TruncateSuffix
+}
+
+// validateSMTPUsers rejects incomplete or duplicate entries in smtp.users
+func validateSMTPUsers(config SMTPConfig) error {
+    seen := map[string]bool{config.SMTPUsername: true}
+    for i, user := range config.Users {
+        if user.Name == "" || user.Password == "" {
+            return fmt.Errorf("smtp.users entry %d needs both a name and a password", i+1)
+        }
+        if seen[user.Name] {
+            return fmt.Errorf("smtp.users entry %d: duplicate username %s", i+1, user.Name)
+        }
+        seen[user.Name] = true
+    }
+    return nil
+}
+
+// scanWithClamd streams the message to clamd using the INSTREAM command and returns
+// the name of the detected signature, or an empty string if the message is clean.
+// Address is a Unix socket path or a host:port pair.
+func scanWithClamd(config ClamAVConfig, message io.Reader) (string, error) {
+    network := "tcp"
+    if strings.HasPrefix(config.Address, "/") {
+        network = "unix"
+    }
+    conn, err := net.DialTimeout(network, config.Address, config.Timeout)
+    if err != nil {
+        return "", fmt.Errorf("failed to connect to clamd at %s: %v", config.Address, err)
+    }
+    defer conn.Close()
+    conn.SetDeadline(time.Now().Add(config.Timeout))
+    if _, err := conn.Write([]byte("zINSTREAM\x00")); err != nil {
+        return "", fmt.Errorf("failed to send INSTREAM to clamd: %v", err)
+    }
+    size := make([]byte, 4)
+    chunk := make([]byte, ClamdChunkSize)
+    for {
+        n, readErr := io.ReadFull(message, chunk)
+        if n > 0 {
+            binary.BigEndian.PutUint32(size, uint32(n))
+            if _, err := conn.Write(size); err != nil {
+                return "", fmt.Errorf("failed to stream message to clamd: %v", err)
+            }
+            if _, err := conn.Write(chunk[:n]); err != nil {
+                return "", fmt.Errorf("failed to stream message to clamd: %v", err)
+            }
+        }
+        if readErr == io.EOF || readErr == io.ErrUnexpectedEOF {
+            break
+        }
+        if readErr != nil {
+            return "", fmt.Errorf("failed to read message for clamd: %v", readErr)
+        }
+    }
+    binary.BigEndian.PutUint32(size, 0)
+    if _, err := conn.Write(size); err != nil {
+        return "", fmt.Errorf("failed to finish clamd stream: %v", err)
+    }
+    reply, err := bufio.NewReader(conn).ReadString('\x00')
+    if err != nil && err != io.EOF {
+        return "", fmt.Errorf("failed to read clamd reply: %v", err)
+    }
+    reply = strings.TrimSpace(strings.TrimRight(reply, "\x00"))
+    reply = strings.TrimPrefix(reply, "stream: ")
+    switch {
+    case reply == "OK":
+        return "", nil
+    case strings.HasSuffix(reply, " FOUND"):
+        return strings.TrimSuffix(reply, " FOUND"), nil
+    default:
+        return "", fmt.Errorf("clamd returned: %s", reply)
+    }
+}
+
+// spamEnvelope is what the spam filter is told about a message besides its content
+type spamEnvelope struct {
+    From string
+    To   []string
+    IP   string
+    Helo string
+}
+
+// scoreSpam sends the message to the configured spam filter and returns its score
+func scoreSpam(config SpamFilterConfig, message io.Reader, size int64, envelope spamEnvelope) (float64, error) {
+    if config.Backend == "spamd" {
+        return scoreWithSpamd(config, message, size, envelope)
+    }
+    return scoreWithRspamd(config, message, envelope)
+}
+
+// scoreWithRspamd posts the message to the checkv2 endpoint of the rspamd HTTP API,
+// passing the envelope in the request headers rspamd reads it from
+func scoreWithRspamd(config SpamFilterConfig, message io.Reader, envelope spamEnvelope) (float64, error) {
+    req, err := http.NewRequest("POST", strings.TrimSuffix(config.Address, "/")+"/checkv2", message)
+    if err != nil {
+        return 0, fmt.Errorf("failed to create rspamd request: %v", err)
+    }
+    if envelope.IP != "" {
+        req.Header.Set("IP", envelope.IP)
+    }
+    if envelope.Helo != "" {
+        req.Header.Set("Helo", envelope.Helo)
+    }
+    if envelope.From != "" {
+        req.Header.Set("From", envelope.From)
+    }
+    for _, rcpt := range envelope.To {
+        req.Header.Add("Rcpt", rcpt)
+    }
+    client := &http.Client{Timeout: config.Timeout}
+    resp, err := client.Do(req)
+    if err != nil {
+        return 0, fmt.Errorf("failed to reach rspamd at %s: %v", config.Address, err)
+    }
+    defer resp.Body.Close()
+    if resp.StatusCode != http.StatusOK {
+        return 0, fmt.Errorf("rspamd returned status %d", resp.StatusCode)
+    }
+    var result struct {
+        Score *float64 `json:"score"`
+    }
+    if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+        return 0, fmt.Errorf("failed to decode rspamd reply: %v", err)
+    }
+    if result.Score == nil {
+        return 0, fmt.Errorf("rspamd reply has no score")
+    }
+    return *result.Score, nil
+}
+
+// scoreWithSpamd runs the CHECK command of the spamc protocol and reads the score from
+// the "Spam: True ; 7.5 / 5.0" header of the reply
+func scoreWithSpamd(config SpamFilterConfig, message io.Reader, size int64, envelope spamEnvelope) (float64, error) {
+    network := "tcp"
+    if strings.HasPrefix(config.Address, "/") {
+        network = "unix"
+    }
+    conn, err := net.DialTimeout(network, config.Address, config.Timeout)
+    if err != nil {
+        return 0, fmt.Errorf("failed to connect to spamd at %s: %v", config.Address, err)
+    }
+    defer conn.Close()
+    conn.SetDeadline(time.Now().Add(config.Timeout))
+    if _, err := fmt.Fprintf(conn, "CHECK SPAMC/1.5\r\nContent-length: %d\r\n\r\n", size); err != nil {
+        return 0, fmt.Errorf("failed to send CHECK to spamd: %v", err)
+    }
+    if _, err := io.Copy(conn, message); err != nil {
+        return 0, fmt.Errorf("failed to stream message to spamd: %v", err)
+    }
+    // Half-close so spamd sees the end of the message
+    if closer, ok := conn.(interface{ CloseWrite() error }); ok {
+        closer.CloseWrite()
+    }
+    reader := bufio.NewReader(conn)
+    status, err := reader.ReadString('\n')
+    if err != nil {
+        return 0, fmt.Errorf("failed to read spamd reply: %v", err)
+    }
+    if fields := strings.Fields(status); len(fields) < 3 || fields[1] != "0" {
+        return 0, fmt.Errorf("spamd returned: %s", strings.TrimSpace(status))
+    }
+    for {
+        line, err := reader.ReadString('\n')
+        line = strings.TrimSpace(line)
+        if name, value, ok := strings.Cut(line, ":"); ok && strings.EqualFold(name, "Spam") {
+            _, scores, _ := strings.Cut(value, ";")
+            score, _, _ := strings.Cut(scores, "/")
+            parsed, parseErr := strconv.ParseFloat(strings.TrimSpace(score), 64)
+            if parseErr != nil {
+                return 0, fmt.Errorf("invalid spamd score header: %s", line)
+            }
+            return parsed, nil
+        }
+        if line == "" || err != nil {
+            return 0, fmt.Errorf("spamd reply has no score")
+        }
+    }
+}
+
+// quarantineMessage stores an infected message on disk and returns its path
+func quarantineMessage(config ClamAVConfig, message io.Reader) (string, error) {
+    dir := config.QuarantineDir
+    if dir == "" {
+        dir = filepath.Join(dataDirPath, QuarantineDirName)
+    }
+    if err := os.MkdirAll(dir, 0700); err != nil {
+        return "", fmt.Errorf("failed to create quarantine directory: %v", err)
+    }
+    path := filepath.Join(dir, fmt.Sprintf("%s_%d.eml", time.Now().Format("20060102_150405"), rand.Int63()))
+    file, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+    if err != nil {
+        return "", fmt.Errorf("failed to create quarantined message: %v", err)
+    }
+    defer file.Close()
+    if _, err := io.Copy(file, message); err != nil {
+        return "", fmt.Errorf("failed to write quarantined message: %v", err)
+    }
+    return path, nil
+}
+
+// AttachmentStore keeps attachments on disk and serves them over HTTP. The attachments
+// of a message share a directory with a random name, and each link carries a signature
+// of its path, so one link does not open any other file of the store.
+type AttachmentStore struct {
+    config AttachmentsConfig
+    // key signs the links, auth lets http_auth tokens with the read scope in as well
+    key    []byte
+    auth   HTTPAuthConfig
+}
+
+// newAttachmentStore creates the store directory and its link key; it returns nil when
+// the store is disabled
+func newAttachmentStore(config AttachmentsConfig, auth HTTPAuthConfig) (*AttachmentStore, error) {
+    if !config.Enabled {
+        return nil, nil
+    }
+    if config.BaseURL == "" {
+        return nil, fmt.Errorf("attachments.base_url is required when the attachment store is enabled")
+    }
+    if config.Dir == "" {
+        config.Dir = filepath.Join(dataDirPath, AttachmentsDirName)
+    }
+    if err := os.MkdirAll(config.Dir, 0750); err != nil {
+        return nil, fmt.Errorf("failed to create attachment directory: %v", err)
+    }
+    key, err := attachmentLinkKey(config.Dir)
+    if err != nil {
+        return nil, err
+    }
+    return &AttachmentStore{config: config, key: key, auth: auth}, nil
+}
+
+// attachmentLinkKey returns the key the links of the store in dir are signed with. It is
+// created on first use and kept, so links sent earlier still open after a restart.
+func attachmentLinkKey(dir string) ([]byte, error) {
+    path := filepath.Join(dir, AttachmentKeyFileName)
+    key, err := os.ReadFile(path)
+    if err == nil && len(key) >= 32 {
+        return key, nil
+    }
+    if err != nil && !os.IsNotExist(err) {
+        return nil, fmt.Errorf("failed to read attachment link key: %v", err)
+    }
+    key = make([]byte, 32)
+    if _, err := cryptorand.Read(key); err != nil {
+        return nil, fmt.Errorf("failed to generate attachment link key: %v", err)
+    }
+    if err := os.WriteFile(path, key, 0600); err != nil {
+        return nil, fmt.Errorf("failed to write attachment link key: %v", err)
+    }
+    return key, nil
+}
+
+// linkSignature returns the signature a link to the stored file dir/fileName carries
+func (s *AttachmentStore) linkSignature(dir, fileName string) string {
+    mac := hmac.New(sha256.New, s.key)
+    mac.Write([]byte(dir + "/" + fileName))
+    return hex.EncodeToString(mac.Sum(nil)[:16])
+}
+
+// attachmentFileName reduces an attachment name from a message to a safe file name
+func attachmentFileName(name string) string {
+    name = strings.Map(func(r rune) rune {
+        if r < 0x20 || r == 0x7f || r == '/' || r == '\\' || r == ':' {
+            return '_'
+        }
+        return r
+    }, name)
+    if name == "" || name == "." || name == ".." {
+        return "attachment"
+    }
+    return name
+}
+
+// Save stores one attachment in the message directory *dir, which is created on first
+// use, and returns its size and URL. Attachments over max_size are only counted and get
+// no URL. A read error is returned like from io.Copy; storage errors are logged.
+func (s *AttachmentStore) Save(dir *string, index int, name string, body io.Reader) (int64, string, error) {
+    if *dir == "" {
+        id := make([]byte, 16)
+        if _, err := cryptorand.Read(id); err != nil {
+            logEvent("error", fmt.Sprintf("Failed to store attachment %s: %v", name, err), fmt.Sprintf("No random directory name could be generated for the attachment %s, it is listed without a link: %v", name, err))
+            return copyCount(body)
+        }
+        *dir = fmt.Sprintf("%x", id)
+        if err := os.MkdirAll(filepath.Join(s.config.Dir, *dir), 0750); err != nil {
+            logEvent("error", fmt.Sprintf("Failed to store attachment %s: %v", name, err), fmt.Sprintf("The directory for the attachments of a message could not be created in %s, the attachment %s is listed without a link: %v", s.config.Dir, name, err))
+            return copyCount(body)
+        }
+    }
+    // The index keeps attachments with the same name apart
+    fileName := fmt.Sprintf("%d-%s", index+1, attachmentFileName(name))
+    path := filepath.Join(s.config.Dir, *dir, fileName)
+    file, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0640)
+    if err != nil {
+        logEvent("error", fmt.Sprintf("Failed to store attachment %s: %v", name, err), fmt.Sprintf("The attachment %s could not be written to %s, it is listed without a link: %v", name, path, err))
+        return copyCount(body)
+    }
+    limit := int64(math.MaxInt64)
+    if s.config.MaxSize > 0 {
+        limit = s.config.MaxSize + 1
+    }
+    written, readErr := io.Copy(file, io.LimitReader(body, limit))
+    if err := file.Close(); err != nil && readErr == nil {
+        logEvent("error", fmt.Sprintf("Failed to store attachment %s: %v", name, err), fmt.Sprintf("The attachment %s could not be written to %s, it is listed without a link: %v", name, path, err))
+        os.Remove(path)
+        return written, "", nil
+    }
+    if readErr != nil || (s.config.MaxSize > 0 && written > s.config.MaxSize) {
+        // Incomplete or oversized copies are not worth a link
+        os.Remove(path)
+        if readErr != nil {
+            return written, "", readErr
+        }
+        rest, _, err := copyCount(body)
+        return written + rest, "", err
+    }
+    link := fmt.Sprintf("%s/attachments/%s/%s?sig=%s", strings.TrimRight(s.config.BaseURL, "/"), *dir, url.PathEscape(fileName), s.linkSignature(*dir, fileName))
+    return written, link, nil
+}
+
+// copyCount reads body to the end and returns its size
+func copyCount(body io.Reader) (int64, string, error) {
+    size, err := io.Copy(io.Discard, body)
+    return size, "", err
+}
+
+// ServeHTTP serves stored attachments below /attachments/ to requests carrying the
+// signature of the link or an http_auth token with the read scope. Only files in a
+// message directory are served, and the content is sandboxed so an attached HTML page
+// cannot run scripts.
+func (s *AttachmentStore) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+    name := strings.TrimPrefix(r.URL.Path, "/attachments/")
+    dir, fileName, ok := strings.Cut(name, "/")
+    if _, err := hex.DecodeString(dir); name == r.URL.Path || !ok || err != nil || len(dir) != 32 || fileName == "" || fileName == "." || fileName == ".." || strings.Contains(fileName, "/") {
+        http.NotFound(w, r)
+        return
+    }
+    signature := r.URL.Query().Get("sig")
+    if !hmac.Equal([]byte(signature), []byte(s.linkSignature(dir, fileName))) && !s.auth.Authorized(r, HTTPScopeRead) {
+        denyHTTP(w, r, "smtp-to-gotify attachments")
+        return
+    }
+    w.Header().Set("Content-Security-Policy", "sandbox")
+    w.Header().Set("X-Content-Type-Options", "nosniff")
+    http.ServeFile(w, r, filepath.Join(s.config.Dir, dir, fileName))
+}
+
+// expire deletes message directories older than the retention period, then repeats
+// every AttachmentCleanupInterval until done is closed
+func (s *AttachmentStore) expire(done chan struct{}) {
+    ticker := time.NewTicker(AttachmentCleanupInterval)
+    defer ticker.Stop()
+    for {
+        entries, err := os.ReadDir(s.config.Dir)
+        if err != nil {
+            appendToStatus(fmt.Sprintf("Failed to read attachment directory: %v", err))
+        }
+        removed := 0
+        for _, entry := range entries {
+            info, err := entry.Info()
+            if err != nil || !entry.IsDir() || time.Since(info.ModTime()) < s.config.Retention {
+                continue
+            }
+            if err := os.RemoveAll(filepath.Join(s.config.Dir, entry.Name())); err == nil {
+                removed++
+            }
+        }
+        if removed > 0 {
+            logEvent("config", fmt.Sprintf("Deleted the attachments of %d messages", removed), fmt.Sprintf("The stored attachments of %d messages in %s were older than the retention period of %v and were deleted.", removed, s.config.Dir, s.config.Retention))
+        }
+        select {
+        case <-done:
+            return
+        case <-ticker.C:
+        }
+    }
+}
+
+// duplicateEntry is an email forwarded within the current window and its repeats
+type duplicateEntry struct {
+    first      time.Time
+    suppressed int
+    email      EmailData
+    gotify     GotifyConfig
+}
+
+// DuplicateFilter recognizes repeated emails by a hash of their sender, subject and body
+type DuplicateFilter struct {
+    mu      sync.Mutex
+    window  time.Duration
+    entries map[[sha256.Size]byte]*duplicateEntry
+}
+
+// newDuplicateFilter creates the filter; it returns nil (which suppresses nothing) when disabled
+func newDuplicateFilter(config DedupConfig) *DuplicateFilter {
+    if !config.Enabled || config.Window <= 0 {
+        return nil
+    }
+    return &DuplicateFilter{
+        window:  config.Window,
+        entries: make(map[[sha256.Size]byte]*duplicateEntry),
+    }
+}
+
+// Suppress reports whether the email repeats one forwarded within the window, counting
+// it if so; otherwise the email starts a new window. Notifications for different
+// Gotify applications are never duplicates of each other.
+func (d *DuplicateFilter) Suppress(email EmailData, gotify GotifyConfig) bool {
+    if d == nil {
+        return false
+    }
+    hash := sha256.New()
+    for _, field := range []string{gotify.GotifyToken, email.From, email.Subject, email.Body} {
+        hash.Write([]byte(field))
+        hash.Write([]byte{0})
+    }
+    var key [sha256.Size]byte
+    copy(key[:], hash.Sum(nil))
+    d.mu.Lock()
+    defer d.mu.Unlock()
+    if entry, ok := d.entries[key]; ok && time.Since(entry.first) < d.window {
+        entry.suppressed++
+        return true
+    }
+    // An expired entry that is replaced here has not been summarized yet
+    if entry, ok := d.entries[key]; ok && entry.suppressed > 0 {
+        go d.summarize(entry)
+    }
+    d.entries[key] = &duplicateEntry{first: time.Now(), email: email, gotify: gotify}
+    return false
+}
+
+// sweep removes the entries whose window has closed and summarizes their repeats
+func (d *DuplicateFilter) sweep(done chan struct{}) {
+    ticker := time.NewTicker(DedupSweepInterval)
+    defer ticker.Stop()
+    for {
+        select {
+        case <-done:
+            return
+        case <-ticker.C:
+        }
+        var closed []*duplicateEntry
+        d.mu.Lock()
+        for key, entry := range d.entries {
+            if time.Since(entry.first) < d.window {
+                continue
+            }
+            delete(d.entries, key)
+            if entry.suppressed > 0 {
+                closed = append(closed, entry)
+            }
+        }
+        d.mu.Unlock()
+        for _, entry := range closed {
+            d.summarize(entry)
+        }
+    }
+}
+
+// summarize logs and notifies how often an email was repeated during its window
+func (d *DuplicateFilter) summarize(entry *duplicateEntry) {
+    summary := entry.email
+    summary.Subject = fmt.Sprintf("%s (repeated %d times)", entry.email.Subject, entry.suppressed)
+    summary.Body = fmt.Sprintf("This email was received %d more times within %v of %s; the repeats were not forwarded.", entry.suppressed, d.window, entry.first.Format("1/2/2006 - 15:04:05"))
+    summary.Attachments = nil
+    logEvent("duplicate", fmt.Sprintf("Suppressed %d repeats of email from %s", entry.suppressed, entry.email.From), fmt.Sprintf("The email from %s with subject '%s' was received %d more times within %v of its first delivery at %s, the repeats were not forwarded.", entry.email.From, entry.email.Subject, entry.suppressed, d.window, entry.first.Format("1/2/2006 - 15:04:05")))
+    if err := sendToGotify(entry.gotify, summary); err != nil {
+        appendToStatus(fmt.Sprintf("Failed to send duplicate summary to Gotify: %v", err))
+    }
+}
+
+// deadLetterDir returns the dead-letter directory, falling back to the data directory
+func deadLetterDir(dir string) string {
+    if dir == "" {
+        return filepath.Join(dataDirPath, DeadLetterDirName)
+    }
+    return dir
+}
+
+// saveDeadLetter writes a dead letter to its own file, replacing an older version
+func saveDeadLetter(dir string, letter DeadLetter) error {
+    dir = deadLetterDir(dir)
+    if err := os.MkdirAll(dir, 0700); err != nil {
+        return fmt.Errorf("failed to create dead-letter directory: %v", err)
+    }
+    data, err := json.MarshalIndent(letter, "", "  ")
+    if err != nil {
+        return fmt.Errorf("failed to marshal dead letter: %v", err)
+    }
+    if err := os.WriteFile(filepath.Join(dir, letter.ID+".json"), data, 0600); err != nil {
+        return fmt.Errorf("failed to write dead letter: %v", err)
+    }
+    return nil
+}
+
+// listDeadLetters loads all dead letters, oldest first
+func listDeadLetters(dir string) ([]DeadLetter, error) {
+    entries, err := os.ReadDir(deadLetterDir(dir))
+    if os.IsNotExist(err) {
+        return []DeadLetter{}, nil
+    }
+    if err != nil {
+        return nil, fmt.Errorf("failed to read dead-letter directory: %v", err)
+    }
+    letters := []DeadLetter{}
+    for _, entry := range entries {
+        if entry.IsDir() || filepath.Ext(entry.Name()) != ".json" {
+            continue
+        }
+        data, err := os.ReadFile(filepath.Join(deadLetterDir(dir), entry.Name()))
+        if err != nil {
+            continue
+        }
+        var letter DeadLetter
+        if json.Unmarshal(data, &letter) == nil {
+            letters = append(letters, letter)
+        }
+    }
+    sort.Slice(letters, func(i, j int) bool {
+        return letters[i].FirstFailed.Before(letters[j].FirstFailed)
+    })
+    return letters, nil
+}
+
+// deleteDeadLetter removes a dead letter
+func deleteDeadLetter(dir, id string) error {
+    if err := os.Remove(filepath.Join(deadLetterDir(dir), id+".json")); err != nil && !os.IsNotExist(err) {
+        return fmt.Errorf("failed to delete dead letter: %v", err)
+    }
+    return nil
+}
+
+// retryDeadLetter sends a dead letter to Gotify again; it is removed on success and
+// updated with the new failure reason otherwise
+func retryDeadLetter(dir string, gotify GotifyConfig, letter DeadLetter) error {
+    if err := sendToGotify(gotify, letter.Email); err != nil {
+        letter.Attempts++
+        letter.Reason = err.Error()
+        letter.LastFailed = time.Now()
+        if saveErr := saveDeadLetter(dir, letter); saveErr != nil {
+            appendToStatus(fmt.Sprintf("Failed to update dead letter %s: %v", letter.ID, saveErr))
+        }
+        return err
+    }
+    return deleteDeadLetter(dir, letter.ID)
+}
+
+// spoolBuffer collects a message body in memory up to a threshold and spills the rest
+// to an unlinked temporary file, so concurrent large messages cannot exhaust RAM
+type spoolBuffer struct {
+    mem       bytes.Buffer
+    file      *os.File
+    threshold int
+    dir       string
+    size      int64
+}
+
+// newSpoolBuffer creates a spoolBuffer using the configured threshold and directory
+func newSpoolBuffer(limits LimitsConfig) *spoolBuffer {
+    return &spoolBuffer{threshold: limits.SpoolThreshold, dir: limits.SpoolDir}
+}
+
+// WriteString appends data, moving to the spool file once the threshold is crossed
+func (b *spoolBuffer) WriteString(s string) error {
+    b.size += int64(len(s))
+    if b.file == nil && (b.threshold <= 0 || b.mem.Len()+len(s) <= b.threshold) {
+        b.mem.WriteString(s)
+        return nil
+    }
+    if b.file == nil {
+        file, err := os.CreateTemp(b.dir, "smtp-to-gotify-spool-*")
+        if err != nil {
+            return fmt.Errorf("failed to create spool file: %v", err)
+        }
+        // Unlink right away so the data vanishes with the descriptor (like O_TMPFILE)
+        if runtime.GOOS != "windows" {
+            os.Remove(file.Name())
+        }
+        b.file = file
+    }
+    if _, err := b.file.WriteString(s); err != nil {
+        return fmt.Errorf("failed to write spool file: %v", err)
+    }
+    return nil
+}
+
+// Len returns the total number of bytes written
+func (b *spoolBuffer) Len() int64 {
+    return b.size
+}
+
+// Spooled reports whether part of the message lives in a spool file
+func (b *spoolBuffer) Spooled() bool {
+    return b.file != nil
+}
+
+// Reader returns a reader over the complete message; each call starts from the beginning
+func (b *spoolBuffer) Reader() (io.Reader, error) {
+    memReader := bytes.NewReader(b.mem.Bytes())
+    if b.file == nil {
+        return memReader, nil
+    }
+    if _, err := b.file.Seek(0, io.SeekStart); err != nil {
+        return nil, fmt.Errorf("failed to rewind spool file: %v", err)
+    }
+    return io.MultiReader(memReader, b.file), nil
+}
+
+// Reset discards the buffered message and releases the spool file
+func (b *spoolBuffer) Reset() {
+    b.mem.Reset()
+    b.size = 0
+    if b.file != nil {
+        name := b.file.Name()
+        b.file.Close()
+        os.Remove(name)
+        b.file = nil
+    }
+}
+
+// Errors returned by lineReader when a client violates the protocol limits
+var (
+    errLineTooLong     = fmt.Errorf("line exceeds maximum length")
+    errDataLineTooLong = fmt.Errorf("message line exceeds maximum length")
+    errSlowClient      = fmt.Errorf("client is sending data too slowly")
+    errIdleClient      = fmt.Errorf("no data received from client before the timeout")
+    errSessionExpired  = fmt.Errorf("maximum session duration reached")
+)
+
+// lineReader reads CRLF-terminated lines with a bounded length. Once the first
+// byte of a line has arrived the rest must follow within the line timeout, which
+// drops slowloris-style clients that dribble bytes to hold the connection open.
+type lineReader struct {
+    conn        net.Conn
+    reader      *bufio.Reader
+    maxLength   int
+    lineTimeout time.Duration
+    // timeout bounds the wait for the next line or chunk block, see SetTimeout
+    timeout     time.Duration
+    idleTimeout time.Duration
+    deadline    time.Time
+    // throttles slow down reading while a message body is received, see SetThrottle
+    throttles   []*bandwidthLimiter
+}
+
+// bandwidthLimiter spaces out reads so that no more than rate bytes per second pass on
+// average. The client is slowed down by TCP flow control while the reader waits.
+type bandwidthLimiter struct {
+    mu   sync.Mutex
+    rate int
+    next time.Time
+}
+
+// newBandwidthLimiter creates a limiter; it returns nil (which never waits) for rate 0
+func newBandwidthLimiter(rate int) *bandwidthLimiter {
+    if rate <= 0 {
+        return nil
+    }
+    return &bandwidthLimiter{rate: rate}
+}
+
+// Wait blocks until n more bytes fit into the rate
+func (l *bandwidthLimiter) Wait(n int) {
+    if l == nil || n <= 0 {
+        return
+    }
+    l.mu.Lock()
+    now := time.Now()
+    if l.next.Before(now) {
+        l.next = now
+    }
+    l.next = l.next.Add(time.Duration(int64(n) * int64(time.Second) / int64(l.rate)))
+    wait := l.next.Sub(now)
+    l.mu.Unlock()
+    time.Sleep(wait)
+}
+
+// newLineReader creates a lineReader; timeout is the wait allowed for each read, idle
+// the wait for any byte at all and deadline the session deadline no read may run past
+func newLineReader(conn net.Conn, limits LimitsConfig, timeout, idle time.Duration, deadline time.Time) *lineReader {
+    return &lineReader{
+        conn:        conn,
+        reader:      bufio.NewReader(conn),
+        maxLength:   limits.MaxLineLength,
+        lineTimeout: limits.LineTimeout,
+        timeout:     timeout,
+        idleTimeout: idle,
+        deadline:    deadline,
+    }
+}
+
+// SetTimeout changes the wait allowed for each following read, e.g. while receiving DATA
+func (r *lineReader) SetTimeout(timeout time.Duration) {
+    r.timeout = timeout
+}
+
+// SetMaxLength changes the length allowed for each following line, 0 for no limit
+func (r *lineReader) SetMaxLength(length int) {
+    r.maxLength = length
+}
+
+// armDeadline starts the read deadline for the next read, capped by the idle timeout
+// and the session deadline
+func (r *lineReader) armDeadline(timeout time.Duration) {
+    if r.idleTimeout > 0 && (timeout <= 0 || r.idleTimeout < timeout) {
+        timeout = r.idleTimeout
+    }
+    deadline := r.deadline
+    if timeout > 0 {
+        next := time.Now().Add(timeout)
+        if deadline.IsZero() || next.Before(deadline) {
+            deadline = next
+        }
+    }
+    r.conn.SetReadDeadline(deadline)
+}
+
+// ReadLine returns the next line including its terminator
+func (r *lineReader) ReadLine() (string, error) {
+    // Wait for the first byte under the read timeout; idle time is not dribbling
+    r.armDeadline(r.timeout)
+    if _, err := r.reader.Peek(1); err != nil {
+        return "", r.idleErr(err)
+    }
+    if r.lineTimeout > 0 {
+        r.armDeadline(r.lineTimeout)
+    }
+    var line []byte
+    for {
+        chunk, err := r.reader.ReadSlice('\n')
+        line = append(line, chunk...)
+        if r.maxLength > 0 && len(line) > r.maxLength {
+            return "", errLineTooLong
+        }
+        if err == bufio.ErrBufferFull {
+            continue
+        }
+        if err != nil {
+            if netErr, ok := err.(net.Error); ok && netErr.Timeout() && len(line) > 0 && !r.expired() {
+                return "", errSlowClient
+            }
+            return "", r.idleErr(err)
+        }
+        r.throttle(len(line))
+        return string(line), nil
+    }
+}
+
+// idleErr reports a read timeout as errIdleClient, or as errSessionExpired when the
+// session deadline ran out. The connection then accepts writes for a moment longer so
+// the caller can still send its 421.
+func (r *lineReader) idleErr(err error) error {
+    netErr, ok := err.(net.Error)
+    if !ok || !netErr.Timeout() {
+        return err
+    }
+    if r.expired() {
+        r.conn.SetWriteDeadline(time.Now().Add(SessionCloseGrace))
+        return errSessionExpired
+    }
+    return errIdleClient
+}
+
+// expired reports whether the session deadline has passed
+func (r *lineReader) expired() bool {
+    return !r.deadline.IsZero() && !time.Now().Before(r.deadline)
+}
+
+// SetThrottle sets the limiters every following read waits for; none stops throttling.
+// The wait happens after a read, so it does not count against the read timeouts.
+func (r *lineReader) SetThrottle(limiters ...*bandwidthLimiter) {
+    r.throttles = limiters
+}
+
+// throttle waits until n received bytes fit into all limiters
+func (r *lineReader) throttle(n int) {
+    for _, limiter := range r.throttles {
+        limiter.Wait(n)
+    }
+}
+
+// Buffered returns the number of bytes already received but not yet read, which is
+// non-zero when the client has pipelined further commands
+func (r *lineReader) Buffered() int {
+    return r.reader.Buffered()
+}
+
+// ReadChunk consumes exactly size bytes of a BDAT chunk and appends them to dst, or
+// discards them when dst is nil. A failing dst does not stop the read so the command
+// stream stays in sync; its first error is returned as storeErr.
+func (r *lineReader) ReadChunk(size int64, dst *spoolBuffer) (storeErr error, err error) {
+    buf := make([]byte, 32*1024)
+    for size > 0 {
+        n := int64(len(buf))
+        if size < n {
+            n = size
+        }
+        // Every read restarts the wait, so a slow but steady transfer is not cut off
+        r.armDeadline(r.timeout)
+        read, err := r.reader.Read(buf[:n])
+        if err != nil {
+            return storeErr, r.idleErr(err)
+        }
+        size -= int64(read)
+        r.throttle(read)
+        if dst != nil && storeErr == nil {
+            storeErr = dst.WriteString(string(buf[:read]))
+        }
+    }
+    return storeErr, nil
+}
+
+// parseBDAT parses "BDAT <size> [LAST]" (RFC 3030)
+func parseBDAT(line string) (int64, bool, error) {
+    fields := strings.Fields(line)
+    if len(fields) < 2 || len(fields) > 3 || (len(fields) == 3 && !strings.EqualFold(fields[2], "LAST")) {
+        return 0, false, fmt.Errorf("syntax: BDAT <size> [LAST]")
+    }
+    size, err := strconv.ParseInt(fields[1], 10, 64)
+    if err != nil || size < 0 {
+        return 0, false, fmt.Errorf("invalid chunk size %q", fields[1])
+    }
+    return size, len(fields) == 3, nil
+}
+
+// smtpState is the position of a session in the SMTP command sequence
+type smtpState int
+
+const (
+    stateConnected smtpState = iota // no HELO/EHLO yet, or reset by STARTTLS
+    stateGreeted                    // no mail transaction open
+    stateMail                       // MAIL FROM accepted
+    stateRcpt                       // at least one RCPT TO accepted
+    stateData                       // message content is being received
+)
+
+// String returns the state name shown in the sessions view
+func (s smtpState) String() string {
+    switch s {
+    case stateGreeted:
+        return "greeted"
+    case stateMail:
+        return "mail"
+    case stateRcpt:
+        return "rcpt"
+    case stateData:
+        return "data"
+    default:
+        return "connected"
+    }
+}
+
+// parseCommand splits a command line into its upper-case verb and the argument,
+// so "mail from:<a>" and "MAIL FROM:<a>" dispatch the same way
+func parseCommand(line string) (string, string) {
+    verb, arg, _ := strings.Cut(line, " ")
+    return strings.ToUpper(verb), strings.TrimSpace(arg)
+}
+
+// cutKeyword strips a case-insensitive keyword such as "FROM:" from a command argument
+func cutKeyword(arg, keyword string) (string, bool) {
+    if len(arg) < len(keyword) || !strings.EqualFold(arg[:len(keyword)], keyword) {
+        return "", false
+    }
+    return arg[len(keyword):], true
+}
+
+// validHeloName reports whether a HELO/EHLO argument is a hostname or an address
+// literal such as [192.0.2.1] or [IPv6:2001:db8::1]
+func validHeloName(name string) bool {
+    if strings.HasPrefix(name, "[") && strings.HasSuffix(name, "]") {
+        literal := strings.TrimPrefix(name[1:len(name)-1], "IPv6:")
+        return net.ParseIP(literal) != nil
+    }
+    if name == "" || len(name) > 253 {
+        return false
+    }
+    for _, label := range strings.Split(strings.TrimSuffix(name, "."), ".") {
+        if label == "" || len(label) > 63 || label[0] == '-' || label[len(label)-1] == '-' {
+            return false
+        }
+        for _, r := range label {
+            if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-') {
+                return false
+            }
+        }
+    }
+    return true
+}
+
+// checkSequence returns the reply for a command that is not allowed in the given state,
+// or "" when it may run. Commands outside the mail transaction are always allowed. A
+// MAIL before HELO/EHLO only gets here with smtp.strict_sequence; otherwise
+// handleConnection greets implicitly first, as clients such as printers expect.
+func checkSequence(state smtpState, verb string) string {
+    switch verb {
+    case "STARTTLS", "AUTH":
+        if state == stateConnected {
+            return "503 5.5.1 Send EHLO first"
+        }
+        if state != stateGreeted {
+            return fmt.Sprintf("503 5.5.1 %s not permitted during a mail transaction", verb)
+        }
+    case "MAIL":
+        if state == stateConnected {
+            return "503 5.5.1 Send HELO/EHLO first"
+        }
+        if state != stateGreeted {
+            return "503 5.5.1 Sender already specified"
+        }
+    case "XCLIENT":
+        if state == stateMail || state == stateRcpt || state == stateData {
+            return "503 5.5.1 Mail transaction in progress"
+        }
+    case "RCPT":
+        if state != stateMail && state != stateRcpt {
+            return "503 5.5.1 Need MAIL command first"
+        }
+    case "DATA", "BDAT":
+        if verb == "DATA" && state == stateData {
+            return "503 5.5.1 DATA not allowed during a BDAT transfer"
+        }
+        // With pipelining, DATA arrives even when every RCPT was refused
+        if state == stateMail {
+            return "554 5.5.1 No valid recipients"
+        }
+        if state != stateRcpt && state != stateData {
+            return "503 5.5.1 Need MAIL command first"
+        }
+    }
+    return ""
+}
+
+// parseAddressArg splits the argument of MAIL FROM or RCPT TO into the address and its
+// ESMTP parameters (e.g. SIZE=1234 SMTPUTF8), keyed by upper-case name. A path in angle
+// brackets may contain spaces, e.g. a quoted local part; a bare address is tolerated.
+func parseAddressArg(arg string) (string, map[string]string) {
+    params := make(map[string]string)
+    path, rest := strings.TrimSpace(arg), ""
+    if end := strings.Index(path, ">"); strings.HasPrefix(path, "<") && end > 0 {
+        path, rest = path[1:end], path[end+1:]
+    } else if fields := strings.Fields(path); len(fields) > 0 {
+        path, rest = strings.Trim(fields[0], "<>"), strings.Join(fields[1:], " ")
+    }
+    // RFC 5321 4.1.2: source routes such as <@relay:user@example.com> are ignored
+    if strings.HasPrefix(path, "@") {
+        if colon := strings.Index(path, ":"); colon > 0 {
+            path = path[colon+1:]
+        }
+    }
+    for _, field := range strings.Fields(rest) {
+        key, value, _ := strings.Cut(field, "=")
+        params[strings.ToUpper(key)] = value
+    }
+    return path, params
+}
+
+// decodeXtext decodes the RFC 3461 xtext encoding, where "+XX" stands for a hex byte
+func decodeXtext(value string) (string, error) {
+    var decoded strings.Builder
+    for i := 0; i < len(value); i++ {
+        if value[i] != '+' {
+            decoded.WriteByte(value[i])
+            continue
+        }
+        if i+2 >= len(value) {
+            return "", fmt.Errorf("truncated xtext escape in %q", value)
+        }
+        b, err := strconv.ParseUint(value[i+1:i+3], 16, 8)
+        if err != nil {
+            return "", fmt.Errorf("invalid xtext escape in %q", value)
+        }
+        decoded.WriteByte(byte(b))
+        i += 2
+    }
+    return decoded.String(), nil
+}
+
+// parseXClient parses the NAME=VALUE attributes of an XCLIENT command, keyed by upper-case
+// name. Values a proxy does not know ([UNAVAILABLE], [TEMPUNAVAIL]) are left out.
+func parseXClient(arg string) (map[string]string, error) {
+    attrs := make(map[string]string)
+    fields := strings.Fields(arg)
+    if len(fields) == 0 {
+        return nil, fmt.Errorf("no attributes given")
+    }
+    for _, field := range fields {
+        name, value, ok := strings.Cut(field, "=")
+        if !ok || name == "" {
+            return nil, fmt.Errorf("attribute %q is not NAME=VALUE", field)
+        }
+        decoded, err := decodeXtext(value)
+        if err != nil {
+            return nil, err
+        }
+        if decoded == "[UNAVAILABLE]" || decoded == "[TEMPUNAVAIL]" {
+            continue
+        }
+        attrs[strings.ToUpper(name)] = decoded
+    }
+    return attrs, nil
+}
+
+// dsnParams formats the RFC 3461 DSN parameters among params for logging. MTAs often send
+// them without checking the EHLO reply, so they are accepted even though no DSNs are generated.
+func dsnParams(params map[string]string, names ...string) string {
+    var parts []string
+    for _, name := range names {
+        if value, ok := params[name]; ok {
+            parts = append(parts, name+"="+value)
+        }
+    }
+    return strings.Join(parts, " ")
+}
+
+// clientTalksFirst waits delay before the greeting and reports whether the client sent
+// anything or hung up meanwhile. RFC 5321 clients wait for the banner, spam bots often do not.
+func clientTalksFirst(conn net.Conn, delay time.Duration, sessionDeadline time.Time) bool {
+    conn.SetReadDeadline(time.Now().Add(delay))
+    defer conn.SetReadDeadline(sessionDeadline)
+    buf := make([]byte, 1)
+    n, err := conn.Read(buf)
+    if n > 0 {
+        return true
+    }
+    netErr, ok := err.(net.Error)
+    return !ok || !netErr.Timeout()
+}
+
+// rejectLimitViolation answers a protocol limit violation before the connection is
+// closed and counts it towards an IP ban; idle clients and overlong message lines get
+// their reply without a ban. Other read errors are left untouched.
+func rejectLimitViolation(writer *bufio.Writer, sessionID, remoteAddr string, err error) {
+    switch err {
+    case errLineTooLong:
+        fmt.Fprintf(writer, "500 5.5.2 Line too long\r\n")
+    case errDataLineTooLong:
+        // Mailers that do not wrap their lines are broken, not abusive
+        fmt.Fprintf(writer, "500 5.5.2 Message line too long\r\n")
+        writer.Flush()
+        logSessionEvent(sessionID, "protocol_violation", fmt.Sprintf("Dropping %s: %v", remoteAddr, err), fmt.Sprintf("Client at %s sent a message line longer than limits.max_data_line_length, answered with 500 and closed.", remoteAddr))
+        return
+    case errSlowClient:
+        fmt.Fprintf(writer, "421 4.4.2 Connection too slow, closing\r\n")
+    case errIdleClient:
+        // A dead peer is not abuse, so the timeout does not count towards a ban
+        fmt.Fprintf(writer, "421 4.4.2 Idle timeout, closing connection\r\n")
+        writer.Flush()
+        logSessionEvent(sessionID, "connection", fmt.Sprintf("Closing idle connection from %s", remoteAddr), fmt.Sprintf("Client at %s sent nothing before the timeout expired, answered with 421 and closed.", remoteAddr))
+        return
+    case errSessionExpired:
+        // Like an idle timeout this is not counted towards a ban
+        fmt.Fprintf(writer, "421 4.4.2 Maximum session time exceeded, closing connection\r\n")
+        writer.Flush()
+        logSessionEvent(sessionID, "connection", fmt.Sprintf("Closing connection from %s: session time exceeded", remoteAddr), fmt.Sprintf("The session from %s reached smtp.session_timeout, answered with 421 and closed.", remoteAddr))
+        return
+    default:
+        return
+    }
+    writer.Flush()
+    logSessionEvent(sessionID, "protocol_violation", fmt.Sprintf("Dropping %s: %v", remoteAddr, err), fmt.Sprintf("Client at %s exceeded a protocol limit (%v), connection closed.", remoteAddr, err))
+    ipBans.RecordViolation(remoteIP(remoteAddr), err.Error())
+}
+
+// Recommendation 6: Modified handleConnection with timeout
+func handleConnection(conn net.Conn, server *serverState) {
+    defer conn.Close()
+    config := server.config
+    sessionID := newSessionID()
+    // sessionStatus tags status lines with the session ID so they match the log entries
+    sessionStatus := func(message string) {
+        appendToStatus(fmt.Sprintf("[%s] %s", sessionID, message))
+    }
+    // Set a deadline for the connection to prevent hanging
+    sessionTimeout := config.SMTP.SessionTimeout
+    if sessionTimeout <= 0 {
+        sessionTimeout = DefaultSessionTimeout
+    }
+    sessionDeadline := time.Now().Add(sessionTimeout)
+    if err := conn.SetDeadline(sessionDeadline); err != nil {
+        sessionStatus(fmt.Sprintf("Error setting connection deadline: %v", err))
+        logSessionEvent(sessionID, "error", fmt.Sprintf("Error setting connection deadline: %v", err), fmt.Sprintf("Failed to set timeout for SMTP connection from %s: %v", conn.RemoteAddr().String(), err))
+    }
+    // Recommendation 14: Track active connections
+    activeConnections.Add(1)
+    defer activeConnections.Done()
+    conn = sessions.Register(sessionID, conn)
+    defer func() {
+        logSessionSummary(sessions.Unregister(sessionID))
+    }()
+    reader := newLineReader(conn, config.Limits, config.SMTP.CommandTimeout, config.SMTP.IdleTimeout, sessionDeadline)
+    trace := debugSMTP || config.SMTP.DebugTrace
+    writer := newReplyWriter(conn, sessionID, trace)
+    // traceClient logs a line received from the client when the debug trace is enabled
+    traceClient := func(line string) {
+        if trace {
+            logSessionEvent(sessionID, "smtp_trace", "C: "+line, "Line received from the client, logged because the SMTP debug trace is enabled.")
+        }
+    }
+    // flush sends pending replies unless more pipelined commands are already buffered,
+    // so a batch of commands is answered with a single write (RFC 2920)
+    flush := func() {
+        if reader.Buffered() == 0 {
+            writer.Flush()
+        }
+    }
+    remoteAddr := conn.RemoteAddr().String()
+    // peerAddr stays the directly connected host when XCLIENT replaces remoteAddr
+    peerAddr := remoteAddr
+    if ipBans.IsBanned(remoteIP(remoteAddr)) {
+        fmt.Fprintf(writer, "554 5.7.1 %s is temporarily banned\r\n", remoteIP(remoteAddr))
+        writer.Flush()
+        logSessionEvent(sessionID, "ip_banned", fmt.Sprintf("Rejected connection from banned IP %s", remoteAddr), fmt.Sprintf("Client at %s is on the temporary ban list, connection refused before SMTP greeting.", remoteAddr))
+        return
+    }
+    if !connectionLimiter.Allow(remoteIP(remoteAddr)) {
+        fmt.Fprintf(writer, "421 4.7.0 %s Too many connections from %s, try again later\r\n", config.SMTP.Domain, remoteIP(remoteAddr))
+        writer.Flush()
+        logSessionEvent(sessionID, "rate_limited", fmt.Sprintf("Refused connection from %s: connection rate exceeded", remoteAddr), fmt.Sprintf("Client at %s opened more than %d connections per minute and was answered with 421.", remoteAddr, config.RateLimit.ConnectionsPerMinute))
+        return
+    }
+    atomic.AddInt64(&metrics.OpenConnections, 1)
+    defer atomic.AddInt64(&metrics.OpenConnections, -1)
+    if busy, reason := metrics.overloaded(config.Overload); busy {
+        shed := atomic.AddInt64(&metrics.ShedConnections, 1)
+        fmt.Fprintf(writer, "421 4.3.2 %s Service busy, try again later\r\n", config.SMTP.Domain)
+        writer.Flush()
+        logSessionEvent(sessionID, "overload", fmt.Sprintf("Refused connection from %s: server overloaded", remoteAddr), fmt.Sprintf("Connection from %s was answered with 421 because the server has %s. Connections shed so far: %d, total shed: %d.", remoteAddr, reason, shed, metrics.ShedTotal()))
+        return
+    }
+    sessionStatus(fmt.Sprintf("New SMTP connection from %s", remoteAddr))
+    logSessionEvent(sessionID, "connection", fmt.Sprintf("New SMTP connection from %s", remoteAddr), fmt.Sprintf("Client connected from address %s, initiating SMTP handshake.", remoteAddr))
+    // Trusted networks skip the AUTH requirement for this session only; AUTH is still offered
+    if config.SMTP.AuthRequired && server.exemptFromAuth(remoteIP(remoteAddr)) {
+        config.SMTP.AuthRequired = false
+        logSessionEvent(sessionID, "connection", fmt.Sprintf("Authentication not required for %s", remoteAddr), fmt.Sprintf("Client at %s is in smtp.auth_exempt_networks, so it may send mail without authenticating.", remoteAddr))
+    }
+    dnsblListing := checkDNSBL(config.DNSBL, remoteIP(remoteAddr))
+    if dnsblListing != "" {
+        if config.DNSBL.Action != "tag" {
+            fmt.Fprintf(writer, "554 5.7.1 Service unavailable; client host [%s] blocked using %s\r\n", remoteIP(remoteAddr), dnsblListing)
+            writer.Flush()
+            logSessionEvent(sessionID, "dnsbl", fmt.Sprintf("Refused connection from %s: listed on %s", remoteAddr, dnsblListing), fmt.Sprintf("Client at %s is listed on the DNS blocklist %s, the connection was refused before the SMTP greeting.", remoteAddr, dnsblListing))
+            return
+        }
+        logSessionEvent(sessionID, "dnsbl", fmt.Sprintf("Connection from %s listed on %s", remoteAddr, dnsblListing), fmt.Sprintf("Client at %s is listed on the DNS blocklist %s, its messages will be tagged.", remoteAddr, dnsblListing))
+    }
+    if config.SMTP.GreetingDelay > 0 && clientTalksFirst(conn, config.SMTP.GreetingDelay, sessionDeadline) {
+        fmt.Fprintf(writer, "554 5.5.0 %s Protocol error: talked before the greeting\r\n", config.SMTP.Domain)
+        writer.Flush()
+        ipBans.RecordViolation(remoteIP(remoteAddr), "early talker")
+        logSessionEvent(sessionID, "protocol_violation", fmt.Sprintf("Dropped %s: sent data before the greeting", remoteAddr), fmt.Sprintf("Client at %s sent data or disconnected during the %v greeting delay, before the 220 banner; the connection was closed.", remoteAddr, config.SMTP.GreetingDelay))
+        return
+    }
+    // Collapsing whitespace keeps a configured banner on one reply line
+    banner := strings.Join(strings.Fields(config.SMTP.Banner), " ")
+    if banner == "" {
+        banner = DefaultBanner
+    }
+    fmt.Fprintf(writer, "220 %s %s\r\n", config.SMTP.Domain, banner)
+    flush()
+    var from string
+    var to []string
+    data := newSpoolBuffer(config.Limits)
+    defer data.Reset()
+    authenticated := false
+    var authUsername string
+    // authAccount is the account that last authenticated successfully, it selects the Gotify token
+    var authAccount string
+    // authFailures counts the failed AUTH attempts of this session for the tarpit
+    authFailures := 0
+    // sessionBandwidth caps the body bytes per second of this session, on top of dataBandwidth
+    sessionBandwidth := newBandwidthLimiter(config.Limits.MaxSessionBandwidth)
+    // state decides which commands are accepted next, see checkSequence
+    state := stateConnected
+    setState := func(s smtpState) {
+        state = s
+        sessions.SetState(sessionID, s.String())
+    }
+    // spfResult is the SPF result of the current transaction when it is tagged
+    var spfResult string
+    // resetTransaction ends the current mail transaction so the next MAIL starts clean
+    resetTransaction := func() {
+        from = ""
+        to = nil
+        spfResult = ""
+        data.Reset()
+        if state != stateConnected {
+            setState(stateGreeted)
+        }
+    }
+    // heloName is the argument of the last HELO/EHLO, kept for the log entries
+    var heloName string
+    // acceptGreeting validates and records the HELO/EHLO argument; in strict mode an
+    // invalid name is refused and the session stays where it was
+    acceptGreeting := func(verb, name string) bool {
+        if !validHeloName(name) {
+            if config.SMTP.StrictHelo {
+                fmt.Fprintf(writer, "501 5.5.4 Syntax: %s hostname\r\n", verb)
+                flush()
+                ipBans.RecordViolation(remoteIP(remoteAddr), "invalid HELO name")
+                logSessionEvent(sessionID, "protocol_violation", fmt.Sprintf("Rejected %s '%s' from %s", verb, name, remoteAddr), fmt.Sprintf("Client at %s sent %s with '%s', which is not a hostname or address literal; refused because smtp.strict_helo is enabled.", remoteAddr, verb, name))
+                return false
+            }
+            logSessionEvent(sessionID, "smtp_handshake", fmt.Sprintf("Invalid %s name '%s' from %s", verb, name, remoteAddr), fmt.Sprintf("Client at %s sent %s with '%s', which is not a hostname or address literal; accepted because smtp.strict_helo is disabled.", remoteAddr, verb, name))
+        }
+        heloName = name
+        sessions.SetHelo(sessionID, name)
+        return true
+    }
+    // acceptMessage scans and delivers the buffered message once DATA or the last
+    // BDAT chunk has been received, answering the client with the final reply
+    acceptMessage := func(command string) {
+        defer resetTransaction()
+        var scanResult string
+        if config.ClamAV.Enabled {
+            raw, err := data.Reader()
+            signature := ""
+            if err == nil {
+                signature, err = scanWithClamd(config.ClamAV, raw)
+            }
+            if err != nil {
+                scanResult = fmt.Sprintf("scan failed: %v", err)
+                sessionStatus(fmt.Sprintf("ClamAV scan failed: %v", err))
+                logSessionEvent(sessionID, "malware_scan", fmt.Sprintf("ClamAV scan failed for message from %s: %v", from, err), fmt.Sprintf("Could not scan the message from %s received from %s with clamd at %s, delivering unscanned: %v", from, remoteAddr, config.ClamAV.Address, err))
+            } else if signature == "" {
+                scanResult = "clean"
+            } else {
+                scanResult = fmt.Sprintf("infected (%s)", signature)
+                switch config.ClamAV.Action {
+                case "reject":
+                    fmt.Fprintf(writer, "554 5.7.1 Message rejected: virus found (%s)\r\n", signature)
+                    flush()
+                    logSessionEvent(sessionID, "malware_scan", fmt.Sprintf("Rejected infected message from %s: %s", from, signature), fmt.Sprintf("ClamAV detected %s in the message from %s received from %s, the message was rejected.", signature, from, remoteAddr))
+                    data.Reset()
+                    return
+                case "quarantine":
+                    path := ""
+                    raw, err := data.Reader()
+                    if err == nil {
+                        path, err = quarantineMessage(config.ClamAV, raw)
+                    }
+                    if err != nil {
+                        sessionStatus(fmt.Sprintf("Failed to quarantine message: %v", err))
+                        scanResult = fmt.Sprintf("infected (%s), quarantine failed: %v", signature, err)
+                    } else {
+                        scanResult = fmt.Sprintf("infected (%s), quarantined to %s", signature, path)
+                    }
+                }
+                logSessionEvent(sessionID, "malware_scan", fmt.Sprintf("ClamAV found %s in message from %s", signature, from), fmt.Sprintf("ClamAV detected %s in the message from %s received from %s, verdict: %s.", signature, from, remoteAddr, scanResult))
+            }
+        }
+        // spamScore is only set when the spam filter scored the message at its threshold
+        var spamScore string
+        if config.SpamFilter.Enabled {
+            raw, err := data.Reader()
+            var score float64
+            if err == nil {
+                score, err = scoreSpam(config.SpamFilter, raw, data.Len(), spamEnvelope{From: from, To: to, IP: remoteIP(remoteAddr), Helo: heloName})
+            }
+            if err != nil {
+                sessionStatus(fmt.Sprintf("Spam filter failed: %v", err))
+                logSessionEvent(sessionID, "spam_filter", fmt.Sprintf("Spam check failed for message from %s: %v", from, err), fmt.Sprintf("Could not score the message from %s received from %s with %s at %s, delivering unchecked: %v", from, remoteAddr, config.SpamFilter.Backend, config.SpamFilter.Address, err))
+            } else if score >= config.SpamFilter.Threshold {
+                spamScore = strconv.FormatFloat(score, 'f', 1, 64)
+                logSessionEvent(sessionID, "spam_filter", fmt.Sprintf("Spam score %s for message from %s", spamScore, from), fmt.Sprintf("%s scored the message from %s received from %s at %s, at or above the threshold of %.1f; applying action %s.", config.SpamFilter.Backend, from, remoteAddr, spamScore, config.SpamFilter.Threshold, config.SpamFilter.Action))
+            }
+        }
+        fmt.Fprintf(writer, "250 OK\r\n")
+        flush()
+        sessions.CountMessage(sessionID)
+        logSessionEvent(sessionID, "smtp_command", fmt.Sprintf("%s completed from %s", command, remoteAddr), fmt.Sprintf("Client at %s completed email content transmission with %s, server accepted the message.", remoteAddr, command))
+        if spamScore != "" && config.SpamFilter.Action == "drop" {
+            logSessionEvent(sessionID, "spam_filter", fmt.Sprintf("Dropped spam from %s (score %s)", from, spamScore), fmt.Sprintf("The message from %s received from %s scored %s and was discarded without a notification because spam_filter.action is drop.", from, remoteAddr, spamScore))
+            data.Reset()
+            return
+        }
+        message, err := data.Reader()
+        if err != nil {
+            sessionStatus(fmt.Sprintf("Failed to read buffered message: %v", err))
+            logSessionEvent(sessionID, "error", fmt.Sprintf("Failed to read buffered message from %s: %v", remoteAddr, err), fmt.Sprintf("The message accepted from %s could not be read back from its buffer: %v", remoteAddr, err))
+            data.Reset()
+            return
+        }
+        if data.Spooled() {
+            logSessionEvent(sessionID, "smtp_command", fmt.Sprintf("Message from %s spooled to disk (%d bytes)", remoteAddr, data.Len()), fmt.Sprintf("The message from %s exceeded the in-memory threshold of %d bytes and was spooled to a temporary file.", remoteAddr, config.Limits.SpoolThreshold))
+        }
+        gotify := gotifyForUser(config.Gotify, config.SMTP.Users, authAccount)
+        emailData := applyTransforms(server.transforms, parseEmail(from, to, message, gotify, config.SMTP.MaxMessageSize))
+        emailData.Subject = normalizeSubject(config.SubjectPrefixes, emailData.Subject)
+        if priority, ok := matchPriority(server.priorityRules, emailData); ok {
+            gotify.Priority = priority
+        }
+        data.Reset()
+        emailData.ScanResult = scanResult
+        emailData.DNSBL = dnsblListing
+        emailData.SPF = spfResult
+        if strings.Contains(scanResult, "quarantined to") {
+            emailData.Body = "[Message body withheld, see quarantine]"
+        }
+        if spamScore != "" {
+            switch config.SpamFilter.Action {
+            case "priority":
+                gotify.Priority = config.SpamFilter.Priority
+            case "tag":
+                emailData.Spam = spamScore
+            }
+        }
+        if duplicates.Suppress(emailData, gotify) {
+            logSessionEvent(sessionID, "duplicate", fmt.Sprintf("Suppressed repeated email from %s", emailData.From), fmt.Sprintf("The email from %s with subject '%s' received from %s repeats one forwarded within the last %v and was not forwarded again.", emailData.From, emailData.Subject, remoteAddr, config.Dedup.Window))
+            return
+        }
+        sessions.SetState(sessionID, "delivering")
+        atomic.AddInt64(&metrics.PendingDeliveries, 1)
+        err = sendToGotify(gotify, emailData)
+        atomic.AddInt64(&metrics.PendingDeliveries, -1)
+        sessions.SetState(sessionID, "greeted")
+        if err != nil {
+            sessionStatus(fmt.Sprintf("Failed to send to Gotify: %v", err))
+            logSessionEvent(sessionID, "gotify_failed", fmt.Sprintf("Failed to send to Gotify for email from %s: %v", emailData.From, err), fmt.Sprintf("Failed to forward email notification to Gotify server for email from %s to %s with subject '%s': %v", emailData.From, strings.Join(emailData.To, ", "), emailData.Subject, err))
+            if config.DeadLetter.Enabled {
+                now := time.Now()
+                letter := DeadLetter{
+                    ID:          fmt.Sprintf("%s_%s", now.Format("20060102_150405"), newSessionID()),
+                    Session:     sessionID,
+                    User:        authAccount,
+                    Email:       emailData,
+                    Reason:      err.Error(),
+                    FirstFailed: now,
+                    LastFailed:  now,
+                    Attempts:    1,
+                }
+                if err := saveDeadLetter(config.DeadLetter.Dir, letter); err != nil {
+                    logSessionEvent(sessionID, "error", fmt.Sprintf("Failed to dead-letter email from %s: %v", emailData.From, err), fmt.Sprintf("The undeliverable email from %s with subject '%s' could not be stored for a later retry: %v", emailData.From, emailData.Subject, err))
+                } else {
+                    logSessionEvent(sessionID, "dead_letter", fmt.Sprintf("Email from %s stored as dead letter %s", emailData.From, letter.ID), fmt.Sprintf("The undeliverable email from %s with subject '%s' was stored in the dead-letter directory and can be retried from the UI.", emailData.From, emailData.Subject))
+                }
+            }
+        } else {
+            sessionStatus(fmt.Sprintf("Successfully sent notification to Gotify for email from %s", emailData.From))
+            logSessionEvent(sessionID, "gotify_success", fmt.Sprintf("Successfully sent notification to Gotify for email from %s", emailData.From), fmt.Sprintf("Successfully forwarded email notification to Gotify server for email from %s to %s with subject '%s'.", emailData.From, strings.Join(emailData.To, ", "), emailData.Subject))
+        }
+    }
+    // closeForShutdown reports whether the server is stopping while no transaction is in
+    // progress and, if so, answers 421; a session in a transaction may finish it first
+    closeForShutdown := func() bool {
+        if atomic.LoadInt32(&shuttingDown) == 0 || (state != stateConnected && state != stateGreeted) {
+            return false
+        }
+        fmt.Fprintf(writer, "421 4.3.2 %s Service shutting down\r\n", config.SMTP.Domain)
+        writer.Flush()
+        logSessionEvent(sessionID, "connection", fmt.Sprintf("Closed idle connection from %s for shutdown", remoteAddr), fmt.Sprintf("The server is shutting down, so the session from %s was answered with 421 between transactions and closed.", remoteAddr))
+        return true
+    }
+    tlsActive := false
+    for {
+        if closeForShutdown() {
+            return
+        }
+        if ipBans.IsBanned(remoteIP(remoteAddr)) {
+            fmt.Fprintf(writer, "421 4.7.0 Too many errors, closing connection\r\n")
+            writer.Flush()
+            logSessionEvent(sessionID, "ip_banned", fmt.Sprintf("Closed connection from %s after ban", remoteAddr), fmt.Sprintf("Client at %s was banned during the session, connection closed.", remoteAddr))
+            return
+        }
+        // Replies held back for a pipelined batch must go out before blocking on the next read
+        flush()
+        line, err := reader.ReadLine()
+        if err != nil {
+            // InterruptIdle ends the wait for a command with a timeout
+            if closeForShutdown() {
+                return
+            }
+            sessionStatus(fmt.Sprintf("Error reading from connection: %v", err))
+            logSessionEvent(sessionID, "error", fmt.Sprintf("Error reading from connection from %s: %v", remoteAddr, err), fmt.Sprintf("Failed to read incoming SMTP command from client at %s due to connection error: %v", remoteAddr, err))
+            rejectLimitViolation(writer, sessionID, remoteAddr, err)
+            return
+        }
+        lineLength := len(line)
+        line = strings.TrimSpace(line)
+        traceClient(redactCommand(line))
+        verb, arg := parseCommand(line)
+        sessions.CountCommand(sessionID)
+        // RFC 4954 lets AUTH exceed the command limit with a long initial response
+        if config.Limits.MaxCommandLength > 0 && lineLength > config.Limits.MaxCommandLength && verb != "AUTH" {
+            fmt.Fprintf(writer, "500 5.5.2 Command line too long\r\n")
+            flush()
+            logSessionEvent(sessionID, "protocol_violation", fmt.Sprintf("Command line too long from %s", remoteAddr), fmt.Sprintf("Client at %s sent a %d byte %s command, longer than the %d bytes allowed by limits.max_command_length; answered with 500.", remoteAddr, lineLength, verb, config.Limits.MaxCommandLength))
+            continue
+        }
+        // Lenient mode: a MAIL without a greeting implicitly greets, so legacy clients work
+        if state == stateConnected && verb == "MAIL" && !config.SMTP.StrictSequence {
+            setState(stateGreeted)
+            logSessionEvent(sessionID, "protocol_violation", fmt.Sprintf("MAIL without HELO/EHLO from %s", remoteAddr), fmt.Sprintf("Client at %s sent MAIL FROM before HELO/EHLO; accepted because smtp.strict_sequence is disabled.", remoteAddr))
+        }
+        // BDAT checks the sequence itself, its chunk has to be read either way
+        if reply := checkSequence(state, verb); reply != "" && verb != "BDAT" {
+            fmt.Fprintf(writer, "%s\r\n", reply)
+            flush()
+            logSessionEvent(sessionID, "protocol_violation", fmt.Sprintf("Out of sequence %s from %s", verb, remoteAddr), fmt.Sprintf("Client at %s sent %s while the session was in state '%s', answered with: %s", remoteAddr, verb, state, reply))
+            continue
+        }
+        switch verb {
+        case "HELO":
+            if !acceptGreeting(verb, arg) {
+                continue
+            }
+            resetTransaction()
+            fmt.Fprintf(writer, "250 %s Hello\r\n", config.SMTP.Domain)
+            flush()
+            setState(stateGreeted)
+            logSessionEvent(sessionID, "smtp_handshake", fmt.Sprintf("Received HELO %s from %s", heloName, remoteAddr), fmt.Sprintf("Client at %s initiated SMTP handshake with HELO %s, no service extensions were offered.", remoteAddr, heloName))
+        case "EHLO":
+            if !acceptGreeting(verb, arg) {
+                continue
+            }
+            // RFC 5321: EHLO also aborts a mail transaction in progress
+            resetTransaction()
+            fmt.Fprintf(writer, "250-%s Hello\r\n", config.SMTP.Domain)
+            if serverTLSConfig != nil && !tlsActive {
+                fmt.Fprintf(writer, "250-STARTTLS\r\n")
+            }
+            // Only offer AUTH once credentials cannot travel in plaintext
+            if !config.SMTP.RequireTLSForAuth || tlsActive {
+                fmt.Fprintf(writer, "250-AUTH LOGIN PLAIN\r\n")
+            }
+            fmt.Fprintf(writer, "250-PIPELINING\r\n")
+            fmt.Fprintf(writer, "250-8BITMIME\r\n")
+            fmt.Fprintf(writer, "250-SMTPUTF8\r\n")
+            fmt.Fprintf(writer, "250-ENHANCEDSTATUSCODES\r\n")
+            fmt.Fprintf(writer, "250-CHUNKING\r\n")
+            if server.trustsXClient(remoteIP(peerAddr)) {
+                fmt.Fprintf(writer, "250-XCLIENT ADDR PORT NAME HELO PROTO\r\n")
+            }
+            fmt.Fprintf(writer, "250 SIZE %d\r\n", config.SMTP.MaxMessageSize)
+            flush()
+            setState(stateGreeted)
+            logSessionEvent(sessionID, "smtp_handshake", fmt.Sprintf("Received EHLO %s from %s", heloName, remoteAddr), fmt.Sprintf("Client at %s initiated SMTP handshake with EHLO %s, server responded with supported features including AUTH.", remoteAddr, heloName))
+        case "STARTTLS":
+            if serverTLSConfig == nil || tlsActive {
+                fmt.Fprintf(writer, "502 5.5.1 STARTTLS not available\r\n")
+                flush()
+                continue
+            }
+            fmt.Fprintf(writer, "220 2.0.0 Ready to start TLS\r\n")
+            writer.Flush()
+            tlsConn := tls.Server(conn, serverTLSConfig)
+            if err := tlsConn.Handshake(); err != nil {
+                sessionStatus(fmt.Sprintf("TLS handshake failed: %v", err))
+                logSessionEvent(sessionID, "error", fmt.Sprintf("TLS handshake with %s failed: %v", remoteAddr, err), fmt.Sprintf("Client at %s issued STARTTLS but the TLS handshake failed: %v", remoteAddr, err))
+                return
+            }
+            // RFC 3207: discard all state learned before the TLS negotiation
+            conn = tlsConn
+            reader = newLineReader(conn, config.Limits, config.SMTP.CommandTimeout, config.SMTP.IdleTimeout, sessionDeadline)
+            writer = newReplyWriter(conn, sessionID, trace)
+            tlsActive = true
+            authenticated = false
+            authUsername = ""
+            authAccount = ""
+            resetTransaction()
+            // The client has to introduce itself again over the encrypted channel
+            setState(stateConnected)
+            sessions.SetTLS(sessionID)
+            sessions.SetUser(sessionID, "")
+            logSessionEvent(sessionID, "tls", fmt.Sprintf("STARTTLS negotiated with %s", remoteAddr), fmt.Sprintf("Client at %s upgraded the SMTP session to TLS (version 0x%04x).", remoteAddr, tlsConn.ConnectionState().Version))
+        case "XCLIENT":
+            if !server.trustsXClient(remoteIP(peerAddr)) {
+                fmt.Fprintf(writer, "550 5.7.0 Insufficient authorization\r\n")
+                flush()
+                logSessionEvent(sessionID, "protocol_violation", fmt.Sprintf("Refused XCLIENT from %s", peerAddr), fmt.Sprintf("Host %s sent XCLIENT but is not listed in smtp.xclient_trusted; answered with 550.", peerAddr))
+                continue
+            }
+            attrs, err := parseXClient(arg)
+            if err != nil {
+                fmt.Fprintf(writer, "501 5.5.4 Bad XCLIENT syntax: %v\r\n", err)
+                flush()
+                continue
+            }
+            if addr, ok := attrs["ADDR"]; ok {
+                addr = strings.TrimPrefix(strings.TrimPrefix(addr, "IPV6:"), "IPv6:")
+                if net.ParseIP(addr) == nil {
+                    fmt.Fprintf(writer, "501 5.5.4 Bad XCLIENT ADDR %s\r\n", addr)
+                    flush()
+                    continue
+                }
+                port := attrs["PORT"]
+                if port == "" {
+                    port = "0"
+                }
+                remoteAddr = net.JoinHostPort(addr, port)
+                sessions.SetRemoteAddr(sessionID, remoteAddr)
+            }
+            // Like a new connection, the client has to introduce itself again
+            resetTransaction()
+            setState(stateConnected)
+            authenticated = false
+            authUsername = ""
+            authAccount = ""
+            sessions.SetUser(sessionID, "")
+            heloName = ""
+            if helo, ok := attrs["HELO"]; ok {
+                heloName = helo
+                sessions.SetHelo(sessionID, helo)
+            }
+            logSessionEvent(sessionID, "connection", fmt.Sprintf("XCLIENT from %s: client is %s", peerAddr, remoteAddr), fmt.Sprintf("Trusted proxy %s passed the original client %s (name %s, HELO %s, protocol %s); logging and policy checks now use the client address.", peerAddr, remoteAddr, attrs["NAME"], attrs["HELO"], attrs["PROTO"]))
+            // Re-run the connect-time checks against the real client
+            if allowed, reason := server.access.Check(remoteIP(remoteAddr)); !allowed {
+                fmt.Fprintf(writer, "550 5.7.1 Client %s not allowed\r\n", remoteIP(remoteAddr))
+                writer.Flush()
+                logSessionEvent(sessionID, "access_denied", fmt.Sprintf("Refused connection from %s: %s", remoteAddr, reason), fmt.Sprintf("Client %s, passed by proxy %s with XCLIENT, is %s by the access rules; the session was closed.", remoteAddr, peerAddr, reason))
+                return
+            }
+            if ipBans.IsBanned(remoteIP(remoteAddr)) {
+                fmt.Fprintf(writer, "554 5.7.1 %s is temporarily banned\r\n", remoteIP(remoteAddr))
+                writer.Flush()
+                logSessionEvent(sessionID, "ip_banned", fmt.Sprintf("Rejected connection from banned IP %s", remoteAddr), fmt.Sprintf("Client %s, passed by proxy %s with XCLIENT, is on the temporary ban list; the session was closed.", remoteAddr, peerAddr))
+                return
+            }
+            // Without ADDR the client is still the proxy, whose connection was counted already
+            if _, ok := attrs["ADDR"]; ok && !connectionLimiter.Allow(remoteIP(remoteAddr)) {
+                fmt.Fprintf(writer, "421 4.7.0 %s Too many connections from %s, try again later\r\n", config.SMTP.Domain, remoteIP(remoteAddr))
+                writer.Flush()
+                logSessionEvent(sessionID, "rate_limited", fmt.Sprintf("Refused connection from %s: connection rate exceeded", remoteAddr), fmt.Sprintf("Client %s, passed by proxy %s with XCLIENT, opened more than %d connections per minute; the session was closed with 421.", remoteAddr, peerAddr, config.RateLimit.ConnectionsPerMinute))
+                return
+            }
+            if busy, reason := metrics.overloaded(config.Overload); busy {
+                shed := atomic.AddInt64(&metrics.ShedConnections, 1)
+                fmt.Fprintf(writer, "421 4.3.2 %s Service busy, try again later\r\n", config.SMTP.Domain)
+                writer.Flush()
+                logSessionEvent(sessionID, "overload", fmt.Sprintf("Refused connection from %s: server overloaded", remoteAddr), fmt.Sprintf("Client %s, passed by proxy %s with XCLIENT, was answered with 421 because the server has %s. Connections shed so far: %d, total shed: %d.", remoteAddr, peerAddr, reason, shed, metrics.ShedTotal()))
+                return
+            }
+            dnsblListing = checkDNSBL(config.DNSBL, remoteIP(remoteAddr))
+            if dnsblListing != "" && config.DNSBL.Action != "tag" {
+                fmt.Fprintf(writer, "554 5.7.1 Service unavailable; client host [%s] blocked using %s\r\n", remoteIP(remoteAddr), dnsblListing)
+                writer.Flush()
+                logSessionEvent(sessionID, "dnsbl", fmt.Sprintf("Refused connection from %s: listed on %s", remoteAddr, dnsblListing), fmt.Sprintf("Client at %s, passed by proxy %s with XCLIENT, is listed on the DNS blocklist %s; the session was closed.", remoteAddr, peerAddr, dnsblListing))
+                return
+            }
+            config.SMTP.AuthRequired = server.config.SMTP.AuthRequired && !server.exemptFromAuth(remoteIP(remoteAddr))
+            fmt.Fprintf(writer, "220 %s %s\r\n", config.SMTP.Domain, banner)
+            flush()
+        case "AUTH":
+            sessions.CountAuthAttempt(sessionID)
+            // failAuth records a failed attempt of this session before the 535 reply
+            failAuth := func(username, mechanism string) {
+                authFailures++
+                recordAuthFailure(config, sessionID, remoteAddr, username, mechanism, authFailures)
+            }
+            if config.SMTP.RequireTLSForAuth && !tlsActive {
+                fmt.Fprintf(writer, "538 5.7.11 Encryption required for requested authentication mechanism\r\n")
+                flush()
+                logSessionEvent(sessionID, "smtp_auth_failed", fmt.Sprintf("Rejected plaintext AUTH from %s", remoteAddr), fmt.Sprintf("Client at %s attempted AUTH before STARTTLS while smtp.require_tls_for_auth is enabled, the credentials were not read.", remoteAddr))
+                continue
+            }
+            if authenticated {
+                fmt.Fprintf(writer, "503 5.5.1 Already authenticated\r\n")
+                flush()
+                continue
+            }
+            // RFC 4954 initial response: sent with the command instead of after a 334
+            // prompt, "=" stands for an empty response
+            mechanism, initial, _ := strings.Cut(arg, " ")
+            initial = strings.TrimSpace(initial)
+            switch strings.ToUpper(mechanism) {
+            case "LOGIN":
+                if rejectAuthLockout(writer, sessionID, remoteAddr, "") {
+                    return
+                }
+                usernameLine := initial
+                if usernameLine == "" {
+                    fmt.Fprintf(writer, "334 VXNlcm5hbWU6\r\n")
+                    flush()
+                    line, err := reader.ReadLine()
+                    if err != nil {
+                        sessionStatus(fmt.Sprintf("Error reading username: %v", err))
+                        logSessionEvent(sessionID, "error", fmt.Sprintf("Error reading username from %s: %v", remoteAddr, err), fmt.Sprintf("Failed to read username during AUTH LOGIN from client at %s: %v", remoteAddr, err))
+                        rejectLimitViolation(writer, sessionID, remoteAddr, err)
+                        return
+                    }
+                    traceClient("<credentials redacted>")
+                    usernameLine = strings.TrimRight(line, "\r\n")
+                } else if usernameLine == "=" {
+                    usernameLine = ""
+                }
+                usernameBytes, err := base64.StdEncoding.DecodeString(usernameLine)
+                if err != nil {
+                    sessionStatus(fmt.Sprintf("Error decoding username: %v", err))
+                    logSessionEvent(sessionID, "error", fmt.Sprintf("Error decoding username from %s: %v", remoteAddr, err), fmt.Sprintf("Failed to decode base64-encoded username during AUTH LOGIN from client at %s: %v", remoteAddr, err))
+                    failAuth("", "LOGIN")
+                    fmt.Fprintf(writer, "535 Authentication failed\r\n")
+                    flush()
+                    continue
+                }
+                authUsername = string(usernameBytes)
+                if rejectAuthLockout(writer, sessionID, remoteAddr, authUsername) {
+                    return
+                }
+                fmt.Fprintf(writer, "334 UGFzc3dvcmQ6\r\n")
+                flush()
+                passwordLine, err := reader.ReadLine()
+                if err != nil {
+                    sessionStatus(fmt.Sprintf("Error reading password: %v", err))
+                    logSessionEvent(sessionID, "error", fmt.Sprintf("Error reading password from %s: %v", remoteAddr, err), fmt.Sprintf("Failed to read password during AUTH LOGIN from client at %s: %v", remoteAddr, err))
+                    rejectLimitViolation(writer, sessionID, remoteAddr, err)
+                    return
+                }
+                traceClient("<credentials redacted>")
+                passwordLine = strings.TrimRight(passwordLine, "\r\n")
+                passwordBytes, err := base64.StdEncoding.DecodeString(passwordLine)
+                if err != nil {
+                    sessionStatus(fmt.Sprintf("Error decoding password: %v", err))
+                    logSessionEvent(sessionID, "error", fmt.Sprintf("Error decoding password from %s: %v", remoteAddr, err), fmt.Sprintf("Failed to decode base64-encoded password during AUTH LOGIN from client at %s: %v", remoteAddr, err))
+                    failAuth(authUsername, "LOGIN")
+                    fmt.Fprintf(writer, "535 Authentication failed\r\n")
+                    flush()
+                    continue
+                }
+                password := string(passwordBytes)
+                // Recommendation 5: Fix authentication comparison bug
+                if checkCredentials(authUsername, password, config.SMTP) {
+                    authenticated = true
+                    authAccount = authUsername
+                    authLockout.RecordSuccess(remoteIP(remoteAddr), authUsername)
+                    authTarpit.RecordSuccess(remoteIP(remoteAddr))
+                    sessions.SetUser(sessionID, authUsername)
+                    sessionStatus("Authentication successful (LOGIN)")
+                    logSessionEvent(sessionID, "smtp_auth_success", fmt.Sprintf("User %s authenticated successfully (LOGIN) from %s", authUsername, remoteAddr), fmt.Sprintf("Client at %s provided valid credentials for user %s using AUTH LOGIN method, authentication granted.", remoteAddr, authUsername))
+                    fmt.Fprintf(writer, "235 Authentication successful\r\n")
+                } else {
+                    sessionStatus("Authentication failed: Invalid credentials (LOGIN)")
+                    logSessionEvent(sessionID, "smtp_auth_failed", fmt.Sprintf("Failed authentication for user %s (LOGIN) from %s", authUsername, remoteAddr), fmt.Sprintf("Client at %s provided invalid credentials for user %s using AUTH LOGIN method, authentication denied.", remoteAddr, authUsername))
+                    failAuth(authUsername, "LOGIN")
+                    fmt.Fprintf(writer, "535 Authentication failed\r\n")
+                }
+                flush()
+            case "PLAIN":
+                if rejectAuthLockout(writer, sessionID, remoteAddr, "") {
+                    return
+                }
+                authData := initial
+                if authData == "=" {
+                    authData = ""
+                } else if authData == "" {
+                    fmt.Fprintf(writer, "334 \r\n")
+                    flush()
+                    authDataLine, err := reader.ReadLine()
+                    if err != nil {
+                        sessionStatus(fmt.Sprintf("Error reading PLAIN data: %v", err))
+                        logSessionEvent(sessionID, "error", fmt.Sprintf("Error reading PLAIN data from %s: %v", remoteAddr, err), fmt.Sprintf("Failed to read authentication data during AUTH PLAIN from client at %s: %v", remoteAddr, err))
+                        rejectLimitViolation(writer, sessionID, remoteAddr, err)
+                        return
+                    }
+                    traceClient("<credentials redacted>")
+                    authData = strings.TrimRight(authDataLine, "\r\n")
+                }
+                authBytes, err := base64.StdEncoding.DecodeString(authData)
+                if err != nil {
+                    sessionStatus(fmt.Sprintf("Error decoding PLAIN data: %v", err))
+                    logSessionEvent(sessionID, "error", fmt.Sprintf("Error decoding PLAIN data from %s: %v", remoteAddr, err), fmt.Sprintf("Failed to decode base64-encoded data during AUTH PLAIN from client at %s: %v", remoteAddr, err))
+                    failAuth("", "PLAIN")
+                    fmt.Fprintf(writer, "535 Authentication failed\r\n")
+                    flush()
+                    continue
+                }
+                authParts := strings.Split(string(authBytes), "\x00")
+                if len(authParts) < 3 {
+                    sessionStatus("Invalid PLAIN response format")
+                    logSessionEvent(sessionID, "error", fmt.Sprintf("Invalid PLAIN response format from %s", remoteAddr), fmt.Sprintf("Client at %s sent malformed data during AUTH PLAIN, missing required fields.", remoteAddr))
+                    failAuth("", "PLAIN")
+                    fmt.Fprintf(writer, "535 Authentication failed\r\n")
+                    flush()
+                    continue
+                }
+                username := authParts[1]
+                password := authParts[2]
+                if rejectAuthLockout(writer, sessionID, remoteAddr, username) {
+                    return
+                }
+                // Recommendation 5: Fix authentication comparison bug
+                if checkCredentials(username, password, config.SMTP) {
+                    authenticated = true
+                    authAccount = username
+                    authLockout.RecordSuccess(remoteIP(remoteAddr), username)
+                    authTarpit.RecordSuccess(remoteIP(remoteAddr))
+                    sessions.SetUser(sessionID, username)
+                    sessionStatus("PLAIN Authentication successful")
+                    logSessionEvent(sessionID, "smtp_auth_success", fmt.Sprintf("User %s authenticated successfully (PLAIN) from %s", username, remoteAddr), fmt.Sprintf("Client at %s provided valid credentials for user %s using AUTH PLAIN method, authentication granted.", remoteAddr, username))
+                    fmt.Fprintf(writer, "235 Authentication successful\r\n")
+                } else {
+                    sessionStatus("PLAIN Authentication failed: Invalid credentials")
+                    logSessionEvent(sessionID, "smtp_auth_failed", fmt.Sprintf("Failed authentication for user %s (PLAIN) from %s", username, remoteAddr), fmt.Sprintf("Client at %s provided invalid credentials for user %s using AUTH PLAIN method, authentication denied.", remoteAddr, username))
+                    failAuth(username, "PLAIN")
+                    fmt.Fprintf(writer, "535 Authentication failed\r\n")
+                }
+                flush()
+            default:
+                fmt.Fprintf(writer, "504 5.5.4 Unrecognized authentication type\r\n")
+                flush()
+            }
+        case "MAIL":
+            if !authenticated && config.SMTP.AuthRequired {
+                sessionStatus("Rejecting MAIL command: Authentication required")
+                logSessionEvent(sessionID, "error", fmt.Sprintf("Rejecting MAIL command from %s: Authentication required", remoteAddr), fmt.Sprintf("Client at %s attempted MAIL FROM without authentication, rejected due to auth requirement.", remoteAddr))
+                fmt.Fprintf(writer, "530 Authentication required\r\n")
+                flush()
+                continue
+            }
+            if config.SMTP.RequireTLS && !tlsActive {
+                logSessionEvent(sessionID, "error", fmt.Sprintf("Rejecting MAIL command from %s: TLS required", remoteAddr), fmt.Sprintf("Client at %s attempted MAIL FROM before STARTTLS on a listener that requires TLS.", remoteAddr))
+                fmt.Fprintf(writer, "530 5.7.0 Must issue a STARTTLS command first\r\n")
+                flush()
+                continue
+            }
+            if busy, reason := metrics.overloaded(config.Overload); busy {
+                shed := atomic.AddInt64(&metrics.ShedMail, 1)
+                fmt.Fprintf(writer, "452 4.3.1 Server busy, try again later\r\n")
+                flush()
+                logSessionEvent(sessionID, "overload", fmt.Sprintf("Deferred MAIL command from %s: server overloaded", remoteAddr), fmt.Sprintf("MAIL FROM from %s was answered with 452 because the server has %s. MAIL commands shed so far: %d, total shed: %d.", remoteAddr, reason, shed, metrics.ShedTotal()))
+                continue
+            }
+            if !messageLimiter.Allow(remoteIP(remoteAddr)) {
+                fmt.Fprintf(writer, "450 4.7.1 Message rate limit exceeded, try again later\r\n")
+                flush()
+                logSessionEvent(sessionID, "rate_limited", fmt.Sprintf("Deferred MAIL command from %s: message rate exceeded", remoteAddr), fmt.Sprintf("Client at %s started more than %d messages per minute, MAIL FROM was answered with 450.", remoteAddr, config.RateLimit.MessagesPerMinute))
+                continue
+            }
+            fromArg, ok := cutKeyword(arg, "FROM:")
+            if !ok {
+                fmt.Fprintf(writer, "501 5.5.4 Syntax: MAIL FROM:<address>\r\n")
+                flush()
+                continue
+            }
+            mailFrom, params := parseAddressArg(fromArg)
+            if !utf8.ValidString(mailFrom) {
+                fmt.Fprintf(writer, "553 5.1.7 Sender address is not valid UTF-8\r\n")
+                flush()
+                continue
+            }
+            if mailFrom == "" && config.SMTP.NullSender == "reject" {
+                fmt.Fprintf(writer, "550 5.7.1 Null sender not accepted\r\n")
+                flush()
+                logSessionEvent(sessionID, "sender_rejected", fmt.Sprintf("Rejected null sender from %s", remoteAddr), fmt.Sprintf("Client at %s sent MAIL FROM:<>, which smtp.null_sender refuses; answered with 550.", remoteAddr))
+                continue
+            }
+            // The null sender of bounces has no address to filter on
+            if mailFrom != "" && (server.deniedSenders.Match(mailFrom) || (server.allowedSenders != nil && !server.allowedSenders.Match(mailFrom))) {
+                fmt.Fprintf(writer, "550 5.7.1 <%s>: Sender address rejected\r\n", mailFrom)
+                flush()
+                logSessionEvent(sessionID, "sender_rejected", fmt.Sprintf("Rejected MAIL FROM %s from %s", mailFrom, remoteAddr), fmt.Sprintf("Client at %s specified sender address %s, which is refused by smtp.allowed_senders/smtp.denied_senders; answered with 550.", remoteAddr, mailFrom))
+                continue
+            }
+            if sizeParam, ok := params["SIZE"]; ok {
+                declared, err := strconv.ParseInt(sizeParam, 10, 64)
+                if err != nil || declared < 0 {
+                    fmt.Fprintf(writer, "501 5.5.4 Invalid SIZE parameter\r\n")
+                    flush()
+                    continue
+                }
+                if config.SMTP.MaxMessageSize > 0 && declared > config.SMTP.MaxMessageSize {
+                    fmt.Fprintf(writer, "552 5.3.4 Message size exceeds fixed maximum message size\r\n")
+                    flush()
+                    logSessionEvent(sessionID, "protocol_violation", fmt.Sprintf("Rejected MAIL FROM %s from %s: declared size %d too large", mailFrom, remoteAddr, declared), fmt.Sprintf("Client at %s declared SIZE=%d in MAIL FROM, above the maximum message size of %d bytes; the message was refused before DATA.", remoteAddr, declared, config.SMTP.MaxMessageSize))
+                    continue
+                }
+            }
+            if config.SPF.Enabled && !authenticated {
+                if ip := net.ParseIP(remoteIP(remoteAddr)); ip != nil && !ip.IsLoopback() && !ip.IsPrivate() && !ip.IsLinkLocalUnicast() {
+                    result := checkSPF(config.SPF, ip, mailFrom, heloName)
+                    logSessionEvent(sessionID, "spf", fmt.Sprintf("SPF %s for MAIL FROM %s from %s", result, mailFrom, remoteAddr), fmt.Sprintf("The SPF record for the sender %s (HELO %s) evaluated to %s for the client at %s; spf.action is %s.", mailFrom, heloName, result, remoteAddr, config.SPF.Action))
+                    if result == "fail" && config.SPF.Action == "reject" {
+                        fmt.Fprintf(writer, "550 5.7.23 SPF validation failed for %s\r\n", mailFrom)
+                        flush()
+                        continue
+                    }
+                    if (result == "fail" || result == "softfail") && config.SPF.Action == "tag" {
+                        spfResult = result
+                    }
+                }
+            }
+            if dsn := dsnParams(params, "RET", "ENVID"); dsn != "" {
+                logSessionEvent(sessionID, "smtp_command", fmt.Sprintf("DSN parameters in MAIL FROM from %s: %s", remoteAddr, dsn), fmt.Sprintf("Client at %s sent the delivery status notification parameters %s with MAIL FROM; they are accepted and ignored, no DSNs are generated.", remoteAddr, dsn))
+            }
+            from = mailFrom
+            setState(stateMail)
+            fmt.Fprintf(writer, "250 OK\r\n")
+            flush()
+            logSessionEvent(sessionID, "smtp_command", fmt.Sprintf("MAIL FROM %s accepted from %s", from, remoteAddr), fmt.Sprintf("Client at %s (HELO %s) specified sender address %s in MAIL FROM command, accepted by server.", remoteAddr, heloName, from))
+        case "RCPT":
+            if !authenticated && config.SMTP.AuthRequired {
+                sessionStatus("Rejecting RCPT command: Authentication required")
+                logSessionEvent(sessionID, "error", fmt.Sprintf("Rejecting RCPT command from %s: Authentication required", remoteAddr), fmt.Sprintf("Client at %s attempted RCPT TO without authentication, rejected due to auth requirement.", remoteAddr))
+                fmt.Fprintf(writer, "530 Authentication required\r\n")
+                flush()
+                continue
+            }
+            toArg, ok := cutKeyword(arg, "TO:")
+            if !ok {
+                fmt.Fprintf(writer, "501 5.5.4 Syntax: RCPT TO:<address>\r\n")
+                flush()
+                continue
+            }
+            if config.SMTP.MaxRecipients > 0 && len(to) >= config.SMTP.MaxRecipients {
+                fmt.Fprintf(writer, "452 4.5.3 Too many recipients\r\n")
+                flush()
+                logSessionEvent(sessionID, "protocol_violation", fmt.Sprintf("Too many recipients from %s", remoteAddr), fmt.Sprintf("Client at %s sent more than %d RCPT TO commands in one transaction, the extra recipients were answered with 452.", remoteAddr, config.SMTP.MaxRecipients))
+                continue
+            }
+            toAddr, toParams := parseAddressArg(toArg)
+            if !utf8.ValidString(toAddr) {
+                fmt.Fprintf(writer, "553 5.1.3 Recipient address is not valid UTF-8\r\n")
+                flush()
+                continue
+            }
+            if server.allowedRecipients != nil && !server.allowedRecipients.Match(toAddr) {
+                fmt.Fprintf(writer, "550 5.1.1 <%s>: Recipient address rejected\r\n", toAddr)
+                flush()
+                logSessionEvent(sessionID, "recipient_rejected", fmt.Sprintf("Rejected RCPT TO %s from %s", toAddr, remoteAddr), fmt.Sprintf("Client at %s specified recipient address %s, which is not in smtp.allowed_recipients; answered with 550.", remoteAddr, toAddr))
+                continue
+            }
+            if dsn := dsnParams(toParams, "NOTIFY", "ORCPT"); dsn != "" {
+                logSessionEvent(sessionID, "smtp_command", fmt.Sprintf("DSN parameters in RCPT TO %s from %s: %s", toAddr, remoteAddr, dsn), fmt.Sprintf("Client at %s sent the delivery status notification parameters %s for recipient %s; they are accepted and ignored, no DSNs are generated.", remoteAddr, dsn, toAddr))
+            }
+            to = append(to, toAddr)
+            setState(stateRcpt)
+            fmt.Fprintf(writer, "250 OK\r\n")
+            flush()
+            logSessionEvent(sessionID, "smtp_command", fmt.Sprintf("RCPT TO %s accepted from %s", toAddr, remoteAddr), fmt.Sprintf("Client at %s specified recipient address %s in RCPT TO command, accepted by server.", remoteAddr, toAddr))
+        case "BDAT":
+            size, last, err := parseBDAT(line)
+            if err != nil {
+                // Without a valid size the chunk cannot be skipped, so the session cannot continue
+                fmt.Fprintf(writer, "501 5.5.4 %v\r\n", err)
+                writer.Flush()
+                logSessionEvent(sessionID, "protocol_violation", fmt.Sprintf("Invalid BDAT command from %s", remoteAddr), fmt.Sprintf("Client at %s sent '%s' (%v), the chunk boundary is unknown so the connection was closed.", remoteAddr, line, err))
+                return
+            }
+            // The chunk follows the command immediately, so it is read even when rejected
+            var dst *spoolBuffer
+            reply := ""
+            if !authenticated && config.SMTP.AuthRequired {
+                reply = "530 Authentication required"
+                logSessionEvent(sessionID, "error", fmt.Sprintf("Rejecting BDAT command from %s: Authentication required", remoteAddr), fmt.Sprintf("Client at %s attempted BDAT without authentication, rejected due to auth requirement.", remoteAddr))
+            } else if sequence := checkSequence(state, verb); sequence != "" {
+                // Pipelined BDAT may follow a MAIL FROM or RCPT TO that was refused
+                reply = sequence
+            } else if config.SMTP.MaxMessageSize > 0 && data.Len()+size > config.SMTP.MaxMessageSize {
+                reply = "552 5.3.4 Message size exceeds fixed maximum message size"
+                logSessionEvent(sessionID, "protocol_violation", fmt.Sprintf("Message from %s exceeds the maximum size", remoteAddr), fmt.Sprintf("Client at %s sent BDAT chunks totalling more than the advertised maximum message size of %d bytes; the message was rejected.", remoteAddr, config.SMTP.MaxMessageSize))
+            } else {
+                dst = data
+                if state != stateData {
+                    setState(stateData)
+                    logSessionEvent(sessionID, "smtp_command", fmt.Sprintf("BDAT transfer started from %s", remoteAddr), fmt.Sprintf("Client at %s started sending the message in BDAT chunks (RFC 3030).", remoteAddr))
+                }
+            }
+            reader.SetTimeout(config.SMTP.DataTimeout)
+            reader.SetThrottle(dataBandwidth, sessionBandwidth)
+            storeErr, err := reader.ReadChunk(size, dst)
+            reader.SetTimeout(config.SMTP.CommandTimeout)
+            reader.SetThrottle()
+            if err != nil {
+                sessionStatus(fmt.Sprintf("Error reading BDAT chunk: %v", err))
+                logSessionEvent(sessionID, "error", fmt.Sprintf("Error reading BDAT chunk from %s: %v", remoteAddr, err), fmt.Sprintf("Failed to read a %d byte BDAT chunk from client at %s: %v", size, remoteAddr, err))
+                rejectLimitViolation(writer, sessionID, remoteAddr, err)
+                return
+            }
+            if storeErr != nil {
+                reply = "452 4.3.1 Insufficient system storage"
+                sessionStatus(fmt.Sprintf("Failed to buffer message: %v", storeErr))
+                logSessionEvent(sessionID, "error", fmt.Sprintf("Failed to buffer message from %s: %v", remoteAddr, storeErr), fmt.Sprintf("Could not store the BDAT chunk received from %s, the message was rejected with a temporary error: %v", remoteAddr, storeErr))
+            }
+            if reply != "" {
+                // RFC 3030: a failed chunk fails the whole transaction
+                fmt.Fprintf(writer, "%s\r\n", reply)
+                flush()
+                if state == stateData {
+                    resetTransaction()
+                }
+                continue
+            }
+            if !last {
+                fmt.Fprintf(writer, "250 2.0.0 %d octets received\r\n", size)
+                flush()
+                continue
+            }
+            acceptMessage("BDAT")
+        case "DATA":
+            if !authenticated && config.SMTP.AuthRequired {
+                sessionStatus("Rejecting DATA command: Authentication required")
+                logSessionEvent(sessionID, "error", fmt.Sprintf("Rejecting DATA command from %s: Authentication required", remoteAddr), fmt.Sprintf("Client at %s attempted DATA without authentication, rejected due to auth requirement.", remoteAddr))
+                fmt.Fprintf(writer, "530 Authentication required\r\n")
+                flush()
+                continue
+            }
+            fmt.Fprintf(writer, "354 Start mail input; end with <CRLF>.<CRLF>\r\n")
+            flush()
+            setState(stateData)
+            logSessionEvent(sessionID, "smtp_command", fmt.Sprintf("DATA command received from %s", remoteAddr), fmt.Sprintf("Client at %s initiated DATA command to send email content, server ready to receive message body.", remoteAddr))
+            inHeaders := true
+            headerCount := 0
+            headerBytes := 0
+            headerLimitExceeded := false
+            sizeExceeded := false
+            spoolFailed := false
+            // received counts every body byte, including the ones discarded after a limit was hit
+            var received int64
+            // RFC 5321 transparency only applies at the start of a line that follows a CRLF;
+            // a bare LF inside the body does not start a new SMTP line
+            afterCRLF := true
+            reader.SetTimeout(config.SMTP.DataTimeout)
+            reader.SetMaxLength(config.Limits.MaxDataLineLength)
+            reader.SetThrottle(dataBandwidth, sessionBandwidth)
+            for {
+                dataLine, err := reader.ReadLine()
+                if err == errLineTooLong {
+                    err = errDataLineTooLong
+                }
+                if err != nil {
+                    sessionStatus(fmt.Sprintf("Error reading data: %v", err))
+                    logSessionEvent(sessionID, "error", fmt.Sprintf("Error reading data from %s: %v", remoteAddr, err), fmt.Sprintf("Failed to read email content during DATA phase from client at %s: %v", remoteAddr, err))
+                    rejectLimitViolation(writer, sessionID, remoteAddr, err)
+                    return
+                }
+                lineStart := afterCRLF
+                afterCRLF = strings.HasSuffix(dataLine, "\r\n")
+                if lineStart && dataLine == ".\r\n" {
+                    if headerLimitExceeded {
+                        fmt.Fprintf(writer, "552 5.3.4 Message header exceeds limits\r\n")
+                        flush()
+                    } else if sizeExceeded {
+                        fmt.Fprintf(writer, "552 5.3.4 Message size exceeds fixed maximum message size\r\n")
+                        flush()
+                    }
+                    reader.SetTimeout(config.SMTP.CommandTimeout)
+                    reader.SetMaxLength(config.Limits.MaxLineLength)
+                    reader.SetThrottle()
+                    break
+                }
+                // Remove the dot the client added to lines beginning with "." (section 4.5.2)
+                if lineStart && strings.HasPrefix(dataLine, ".") {
+                    dataLine = dataLine[1:]
+                }
+                if inHeaders {
+                    if dataLine == "\r\n" || dataLine == "\n" {
+                        inHeaders = false
+                    } else {
+                        // Folded continuation lines belong to the previous header
+                        if dataLine[0] != ' ' && dataLine[0] != '\t' {
+                            headerCount++
+                        }
+                        headerBytes += len(dataLine)
+                        if !headerLimitExceeded && ((config.Limits.MaxHeaderCount > 0 && headerCount > config.Limits.MaxHeaderCount) || (config.Limits.MaxHeaderBytes > 0 && headerBytes > config.Limits.MaxHeaderBytes)) {
+                            headerLimitExceeded = true
+                            logSessionEvent(sessionID, "protocol_violation", fmt.Sprintf("Message header from %s exceeds limits", remoteAddr), fmt.Sprintf("Client at %s sent %d header lines (%d bytes), exceeding the configured limits of %d headers / %d bytes; the message will be rejected.", remoteAddr, headerCount, headerBytes, config.Limits.MaxHeaderCount, config.Limits.MaxHeaderBytes))
+                            ipBans.RecordViolation(remoteIP(remoteAddr), "header limits exceeded")
+                        }
+                    }
+                }
+                received += int64(len(dataLine))
+                if !sizeExceeded && config.SMTP.MaxMessageSize > 0 && received > config.SMTP.MaxMessageSize {
+                    sizeExceeded = true
+                    logSessionEvent(sessionID, "protocol_violation", fmt.Sprintf("Message from %s exceeds the maximum size", remoteAddr), fmt.Sprintf("Client at %s sent more than the advertised maximum message size of %d bytes; the message will be rejected.", remoteAddr, config.SMTP.MaxMessageSize))
+                }
+                // Stop buffering once the message is known to be rejected
+                if !headerLimitExceeded && !sizeExceeded && !spoolFailed {
+                    if err := data.WriteString(dataLine); err != nil {
+                        spoolFailed = true
+                        sessionStatus(fmt.Sprintf("Failed to buffer message: %v", err))
+                        logSessionEvent(sessionID, "error", fmt.Sprintf("Failed to buffer message from %s: %v", remoteAddr, err), fmt.Sprintf("Could not store the message body received from %s, it will be rejected with a temporary error: %v", remoteAddr, err))
+                    }
+                }
+            }
+            traceClient(fmt.Sprintf("<message content, %d bytes>", received))
+            traceClient(".")
+            if sizeExceeded {
+                logSessionEvent(sessionID, "protocol_violation", fmt.Sprintf("Rejected oversized message from %s: %d bytes", remoteAddr, received), fmt.Sprintf("Client at %s sent %d bytes of DATA against a maximum of %d; everything past the limit was discarded without buffering and the message was rejected with 552.", remoteAddr, received, config.SMTP.MaxMessageSize))
+            }
+            if headerLimitExceeded || sizeExceeded {
+                resetTransaction()
+                continue
+            }
+            if spoolFailed {
+                fmt.Fprintf(writer, "452 4.3.1 Insufficient system storage\r\n")
+                flush()
+                resetTransaction()
+                continue
+            }
+            acceptMessage("DATA")
+        case "RSET":
+            resetTransaction()
+            fmt.Fprintf(writer, "250 2.0.0 OK\r\n")
+            flush()
+            logSessionEvent(sessionID, "smtp_command", fmt.Sprintf("RSET received from %s", remoteAddr), fmt.Sprintf("Client at %s reset the mail transaction, sender, recipients and buffered data were discarded.", remoteAddr))
+        case "NOOP":
+            fmt.Fprintf(writer, "250 2.0.0 OK\r\n")
+            flush()
+        case "VRFY":
+            // Never confirm addresses, that would let clients enumerate accounts
+            fmt.Fprintf(writer, "252 2.1.5 Cannot VRFY user, but will accept message\r\n")
+            flush()
+        case "HELP":
+            fmt.Fprintf(writer, "214-2.0.0 Commands supported:\r\n")
+            fmt.Fprintf(writer, "214-2.0.0 HELO EHLO STARTTLS AUTH MAIL RCPT DATA BDAT\r\n")
+            fmt.Fprintf(writer, "214 2.0.0 RSET NOOP VRFY HELP QUIT\r\n")
+            flush()
+        case "QUIT":
+            fmt.Fprintf(writer, "221 Bye\r\n")
+            writer.Flush()
+            sessionStatus(fmt.Sprintf("Client disconnected from %s", remoteAddr))
+            logSessionEvent(sessionID, "connection", fmt.Sprintf("Client disconnected from %s", remoteAddr), fmt.Sprintf("Client at %s sent QUIT command, server acknowledged and closed connection.", remoteAddr))
+            return
+        default:
+            fmt.Fprintf(writer, "500 Unknown command\r\n")
+            flush()
+            logSessionEvent(sessionID, "error", fmt.Sprintf("Unknown command received from %s: %s", remoteAddr, line), fmt.Sprintf("Client at %s sent an unrecognized or unsupported SMTP command '%s', server responded with error.", remoteAddr, line))
+        }
+    }
+}
+
+// decodeHeader decodes RFC 2047 encoded words (e.g. =?UTF-8?B?...?=) in a header value.
+// Raw UTF-8 from SMTPUTF8 clients passes through and other raw 8-bit text is taken for
+// Latin-1; undecodable values are kept as sent.
+func decodeHeader(value string) string {
+    decoded, err := wordDecoder.DecodeHeader(value)
+    if err != nil {
+        decoded = value
+    }
+    return decodeCharset([]byte(decoded), "")
+}
+
+// HTML is reduced to text for notifications: hidden elements and comments are dropped,
+// links keep their target, blocks and list items start new lines and all other markup
+// is removed
+var (
+    htmlHidden    = regexp.MustCompile(`(?is)<!--.*?-->|<(head|script|style|title)\b.*?</(head|script|style|title)\s*>`)
+    htmlSpace     = regexp.MustCompile(`\s+`)
+    htmlLink      = regexp.MustCompile(`(?is)<a\b[^>]*?\bhref\s*=\s*("[^"]*"|'[^']*'|[^\s>]+)[^>]*>(.*?)</a\s*>`)
+    htmlImage     = regexp.MustCompile(`(?i)<img\b[^>]*>`)
+    htmlImageAttr = regexp.MustCompile(`(?i)\b(src|alt)\s*=\s*("[^"]*"|'[^']*'|[^\s>]+)`)
+    htmlListItem  = regexp.MustCompile(`(?i)<li\b[^>]*>`)
+    htmlStrong    = regexp.MustCompile(`(?i)</?(b|strong)\b[^>]*>`)
+    htmlEmphasis  = regexp.MustCompile(`(?i)</?(i|em)\b[^>]*>`)
+    htmlHeading   = regexp.MustCompile(`(?i)<h([1-6])\b[^>]*>`)
+    htmlCell      = regexp.MustCompile(`(?i)</t[dh]\s*>`)
+    htmlBreak     = regexp.MustCompile(`(?i)<(br|hr|/?p|/?div|/?tr|/?table|/?ul|/?ol|/?h[1-6]|/?blockquote|/?pre)\b[^>]*>`)
+    htmlTag       = regexp.MustCompile(`<[^>]*>`)
+    htmlLineSpace = regexp.MustCompile(`[ \t]*\n[ \t]*`)
+    blankLines    = regexp.MustCompile(`\n{3,}`)
+    // Outlook writes inline images into the plain text part as [cid:image001.png@01D9...]
+    textImage     = regexp.MustCompile(`(?i)\[cid:([^\]]*)\]`)
+)
+
+// fieldLine is a "Field: value" line of a structured alert, as many appliances send
+var fieldLine = regexp.MustCompile(`^\s*([A-Za-z][\w .()/'\[\]-]{0,40}?)\s*:\s+(\S.*?)\s*$`)
+
+// extractFields returns the "Field: value" pairs of a body; the first value of a field
+// wins, as later lines are usually quoted or repeated further down
+func extractFields(body string) map[string]string {
+    fields := map[string]string{}
+    for _, line := range strings.Split(body, "\n") {
+        match := fieldLine.FindStringSubmatch(line)
+        if match == nil {
+            continue
+        }
+        if _, ok := fields[match[1]]; !ok {
+            fields[match[1]] = match[2]
+        }
+    }
+    return fields
+}
+
+// jsonPathStep is one key or index of a JSON path: .name, ['name'] or [0]
+var jsonPathStep = regexp.MustCompile(`^(?:\.?([^.\[\]]+)|\[(\d+)\]|\['([^']*)'\]|\["([^"]*)"\])`)
+
+// jsonLookup returns the value at path in a decoded JSON document. Paths are the common
+// subset of JSONPath: a leading $, object keys and array indexes, e.g. $.alerts[0].labels.host
+func jsonLookup(value interface{}, path string) (interface{}, bool) {
+    path = strings.TrimPrefix(strings.TrimSpace(path), "$")
+    for path != "" {
+        match := jsonPathStep.FindStringSubmatch(path)
+        if match == nil {
+            return nil, false
+        }
+        path = path[len(match[0]):]
+        if match[2] != "" {
+            array, ok := value.([]interface{})
+            index, _ := strconv.Atoi(match[2])
+            if !ok || index >= len(array) {
+                return nil, false
+            }
+            value = array[index]
+            continue
+        }
+        object, ok := value.(map[string]interface{})
+        if !ok {
+            return nil, false
+        }
+        if value, ok = object[match[1]+match[3]+match[4]]; !ok {
+            return nil, false
+        }
+    }
+    return value, true
+}
+
+// formatJSONBody applies gotify.json_body to a body that is a JSON object or array;
+// other bodies are returned unchanged. The "fields" mode writes one "path: value" line
+// per configured path that is present, which gotify.extract_fields reads back.
+func formatJSONBody(body string, config GotifyConfig) string {
+    trimmed := strings.TrimSpace(body)
+    if config.JSONBody != "pretty" && config.JSONBody != "fields" || !strings.HasPrefix(trimmed, "{") && !strings.HasPrefix(trimmed, "[") {
+        return body
+    }
+    var document interface{}
+    if err := json.Unmarshal([]byte(trimmed), &document); err != nil {
+        return body
+    }
+    if config.JSONBody == "pretty" {
+        pretty, err := json.MarshalIndent(document, "", "  ")
+        if err != nil {
+            return body
+        }
+        return string(pretty)
+    }
+    var lines []string
+    for _, path := range config.JSONFields {
+        value, ok := jsonLookup(document, path)
+        if !ok {
+            continue
+        }
+        text, isString := value.(string)
+        if !isString {
+            encoded, _ := json.Marshal(value)
+            text = string(encoded)
+        }
+        lines = append(lines, fmt.Sprintf("%s: %s", strings.TrimPrefix(strings.TrimPrefix(path, "$"), "."), text))
+    }
+    if len(lines) == 0 {
+        return body
+    }
+    return strings.Join(lines, "\n")
+}
+
+// bodyURL is the default gotify.click_pattern: an http(s) URL up to whitespace, quotes or brackets
+var bodyURL = regexp.MustCompile(`(?i)\bhttps?://[^\s<>"'()\[\]]+`)
+
+// clickURL returns the URL of the body the notification opens, or "" when there is none
+func clickURL(body string, pattern *regexp.Regexp) string {
+    re := bodyURL
+    if pattern != nil {
+        re = pattern
+    }
+    match := re.FindStringSubmatch(body)
+    if match == nil {
+        return ""
+    }
+    found := match[0]
+    if len(match) > 1 {
+        found = match[1]
+    }
+    // Punctuation ending the sentence the URL stands in is not part of it
+    return strings.TrimRight(found, ".,;:!?")
+}
+
+// compileClickPattern compiles gotify.click_pattern once, so a bad pattern is found
+// when the config is loaded rather than when a message arrives
+func compileClickPattern(config *GotifyConfig) error {
+    config.clickPattern = nil
+    if config.ClickPattern == "" {
+        return nil
+    }
+    pattern, err := regexp.Compile(config.ClickPattern)
+    if err != nil {
+        return fmt.Errorf("invalid gotify.click_pattern: %v", err)
+    }
+    config.clickPattern = pattern
+    return nil
+}
+
+// notificationData is what gotify.title_template and gotify.message_template are
+// executed with. Body is the text the default message would show; Fields holds the
+// values found by gotify.extract_fields, e.g. {{index .Fields "Host"}}.
+type notificationData struct {
+    From    string
+    To      string
+    Subject string
+    Body    string
+    Fields  map[string]string
+}
+
+// renderTemplate executes a notification template
+func renderTemplate(text string, data notificationData) (string, error) {
+    tmpl, err := template.New("notification").Option("missingkey=zero").Parse(text)
+    if err != nil {
+        return "", err
+    }
+    var out strings.Builder
+    if err := tmpl.Execute(&out, data); err != nil {
+        return "", err
+    }
+    return out.String(), nil
+}
+
+// ANSI escape sequences: CSI (colors, cursor movement), OSC (window titles) and the
+// two-character escapes
+var ansiEscape = regexp.MustCompile(`\x1b(\[[0-?]*[ -/]*[@-~]|\][^\x07\x1b]*(\x07|\x1b\\)?|[@-Z\\-_])`)
+
+// sanitizeText applies gotify.sanitize to text. Tabs and line breaks are kept; other
+// control characters and bidi controls are removed by "strip", which also drops whole
+// ANSI escape sequences, and written as \x1b or \u202e by "escape".
+func sanitizeText(text, mode string) string {
+    if mode != "strip" && mode != "escape" {
+        return text
+    }
+    if mode == "strip" {
+        text = ansiEscape.ReplaceAllString(text, "")
+    }
+    var out strings.Builder
+    for _, r := range text {
+        if r == '\n' || r == '\r' || r == '\t' || !unicode.IsControl(r) && !unicode.Is(unicode.Bidi_Control, r) {
+            out.WriteRune(r)
+            continue
+        }
+        if mode == "escape" {
+            if r < 0x100 {
+                fmt.Fprintf(&out, "\\x%02x", r)
+            } else {
+                fmt.Fprintf(&out, "\\u%04x", r)
+            }
+        }
+    }
+    return out.String()
+}
+
+// imagePlaceholder stands in for an inline image, e.g. "[image: logo.png]". The name is
+// the alt text, else the file name a Content-ID like "logo.png@01D9..." starts with.
+func imagePlaceholder(cid, alt string) string {
+    name := strings.TrimSpace(alt)
+    if name == "" {
+        name, _, _ = strings.Cut(cid, "@")
+        name = strings.TrimSpace(name)
+    }
+    if name == "" {
+        return "[image]"
+    }
+    return "[image: " + name + "]"
+}
+
+// htmlToText returns the readable text of an HTML body, e.g. for appliances that send
+// text/html only. A link is written as "text (url)" unless its text is the URL itself.
+// With markdown, links become [text](url) and bold, italics and headings are kept.
+func htmlToText(body string, markdown bool) string {
+    body = htmlHidden.ReplaceAllString(body, "")
+    // Whitespace in HTML is insignificant, the line structure comes from the markup
+    body = htmlSpace.ReplaceAllString(body, " ")
+    body = htmlLink.ReplaceAllStringFunc(body, func(link string) string {
+        match := htmlLink.FindStringSubmatch(link)
+        href := html.UnescapeString(strings.Trim(match[1], `"'`))
+        text := match[2]
+        plain := strings.TrimSpace(html.UnescapeString(htmlTag.ReplaceAllString(text, "")))
+        if href == "" || strings.HasPrefix(href, "#") || plain == href || "mailto:"+plain == href {
+            return text
+        }
+        if markdown {
+            return "[" + text + "](" + html.EscapeString(strings.ReplaceAll(href, " ", "%20")) + ")"
+        }
+        return text + " (" + html.EscapeString(href) + ")"
+    })
+    // Embedded images (cid: and data: URIs) get a placeholder, remote ones are dropped
+    // like the rest of the markup since they are mostly logos and tracking pixels
+    body = htmlImage.ReplaceAllStringFunc(body, func(image string) string {
+        var src, alt string
+        for _, attr := range htmlImageAttr.FindAllStringSubmatch(image, -1) {
+            value := strings.Trim(attr[2], `"'`)
+            if strings.EqualFold(attr[1], "src") {
+                src = html.UnescapeString(value)
+            } else {
+                alt = value
+            }
+        }
+        switch {
+        case len(src) > 4 && strings.EqualFold(src[:4], "cid:"):
+            cid := src[4:]
+            if unescaped, err := url.PathUnescape(cid); err == nil {
+                cid = unescaped
+            }
+            return imagePlaceholder(cid, alt)
+        case len(src) > 5 && strings.EqualFold(src[:5], "data:"):
+            return imagePlaceholder("", alt)
+        }
+        return ""
+    })
+    if markdown {
+        body = htmlStrong.ReplaceAllString(body, "**")
+        body = htmlEmphasis.ReplaceAllString(body, "_")
+        body = htmlHeading.ReplaceAllStringFunc(body, func(heading string) string {
+            return "\n" + strings.Repeat("#", int(heading[2]-'0')) + " "
+        })
+    }
+    body = htmlListItem.ReplaceAllString(body, "\n- ")
+    body = htmlCell.ReplaceAllString(body, " ")
+    body = htmlBreak.ReplaceAllString(body, "\n")
+    // Entities are decoded last so an escaped "<" is not taken for markup
+    body = html.UnescapeString(htmlTag.ReplaceAllString(body, ""))
+    body = htmlLineSpace.ReplaceAllString(body, "\n")
+    return strings.TrimSpace(blankLines.ReplaceAllString(body, "\n\n"))
+}
+
+// markdownSpecial matches the characters Markdown or inline HTML would interpret
+var markdownSpecial = regexp.MustCompile("[\\\\`*_\\[\\]<>#|~&]")
+
+// markdownLineStart matches the start of a line that would make a list, a heading,
+// a rule or a setext underline
+var markdownLineStart = regexp.MustCompile(`(?m)^[ \t]*([-+=]|\d+[.)])`)
+
+// escapeMarkdown backslash-escapes text so Markdown shows it literally, e.g. an alert
+// reading "*** disk_usage > 90% ***". URLs are left alone so they stay clickable.
+func escapeMarkdown(text string) string {
+    var out strings.Builder
+    last := 0
+    for _, match := range bodyURL.FindAllStringIndex(text, -1) {
+        out.WriteString(markdownSpecial.ReplaceAllString(text[last:match[0]], `\$0`))
+        out.WriteString(text[match[0]:match[1]])
+        last = match[1]
+    }
+    out.WriteString(markdownSpecial.ReplaceAllString(text[last:], `\$0`))
+    return markdownLineStart.ReplaceAllStringFunc(out.String(), func(start string) string {
+        cut := len(start) - 1
+        return start[:cut] + `\` + start[cut:]
+    })
+}
+
+// validUTF8 reports whether text is UTF-8, not counting a character cut off at the end
+// as the scan limit may leave one
+func validUTF8(text []byte) bool {
+    end := len(text)
+    for i := 1; i < utf8.UTFMax && i <= len(text); i++ {
+        if utf8.RuneStart(text[len(text)-i]) {
+            if !utf8.FullRune(text[len(text)-i:]) {
+                end = len(text) - i
+            }
+            break
+        }
+    }
+    return utf8.Valid(text[:end])
+}
+
+// decodeCharset converts text in the given charset to UTF-8. Declared charsets are
+// decoded by their WHATWG name (golang.org/x/text), so windows-1252, KOI8-R or
+// Shift_JIS come out right; unknown ones are passed through as sent. Without a charset,
+// or with US-ASCII that has 8-bit bytes anyway (common with IP cameras), text that is
+// not valid UTF-8 is taken for Latin-1, the usual charset of such devices.
+func decodeCharset(text []byte, charset string) string {
+    charset = strings.ToLower(strings.TrimSpace(charset))
+    if charset == "" || charset == "us-ascii" || charset == "utf-8" {
+        if charset == "utf-8" || validUTF8(text) {
+            return string(text)
+        }
+        runes := make([]rune, len(text))
+        for i, b := range text {
+            runes[i] = rune(b)
+        }
+        return string(runes)
+    }
+    encoding, err := htmlindex.Get(charset)
+    if err != nil {
+        return string(text)
+    }
+    decoded, err := encoding.NewDecoder().Bytes(text)
+    if err != nil {
+        return string(text)
+    }
+    return string(decoded)
+}
+
+// wordDecoder decodes RFC 2047 encoded words in the charsets decodeCharset knows
+var wordDecoder = &mime.WordDecoder{CharsetReader: func(charset string, input io.Reader) (io.Reader, error) {
+    encoding, err := htmlindex.Get(charset)
+    if err != nil {
+        return nil, fmt.Errorf("unsupported charset %q", charset)
+    }
+    return encoding.NewDecoder().Reader(input), nil
+}}
+
+// headBuffer keeps the first limit bytes written to it and discards the rest, so a
+// message streamed through it is not held in memory
+type headBuffer struct {
+    bytes.Buffer
+    limit int
+}
+
+// Write keeps what still fits below the limit and always reports success
+func (b *headBuffer) Write(p []byte) (int, error) {
+    if room := b.limit - b.Len(); room > 0 {
+        if len(p) > room {
+            b.Buffer.Write(p[:room])
+        } else {
+            b.Buffer.Write(p)
+        }
+    }
+    return len(p), nil
+}
+
+// attachmentCollector gathers the attachments found while walking a message and saves
+// them to the attachment store when one is set up
+type attachmentCollector struct {
+    list  []Attachment
+    store *AttachmentStore
+    // dir is the store directory of the message, created with its first attachment
+    dir   string
+    // calendar summarizes the first calendar invitation found, see summarizeCalendar
+    calendar string
+}
+
+// add records an attachment, reading its decoded content to the end
+func (c *attachmentCollector) add(name, mediaType string, body io.Reader) {
+    attachment := Attachment{Name: name, Type: mediaType}
+    var err error
+    if c.store != nil {
+        attachment.Size, attachment.URL, err = c.store.Save(&c.dir, len(c.list), name, body)
+    } else {
+        attachment.Size, _, err = copyCount(body)
+    }
+    // A read that ends in an error ran into the end of the scanned bytes
+    attachment.Partial = err != nil
+    c.list = append(c.list, attachment)
+}
+
+// decodeTransfer undoes the Content-Transfer-Encoding of a MIME entity. multipart.Reader
+// already decodes quoted-printable parts and drops their header.
+func decodeTransfer(header textproto.MIMEHeader, body io.Reader) io.Reader {
+    switch strings.ToLower(strings.TrimSpace(header.Get("Content-Transfer-Encoding"))) {
+    case "base64":
+        return base64.NewDecoder(base64.StdEncoding, body)
+    case "quoted-printable":
+        return quotedprintable.NewReader(body)
+    }
+    return body
+}
+
+// bodyRank orders the versions of a multipart/alternative by the body preference; a
+// version of rank 2 is final, otherwise a later version of the same or a higher rank wins
+func bodyRank(prefer, textType, text string) int {
+    switch {
+    case prefer == "html" && textType == "text/html":
+        return 2
+    case prefer != "html" && textType == "text/plain":
+        if prefer == "plain_fallback" && strings.TrimSpace(text) == "" {
+            return 0
+        }
+        return 2
+    }
+    return 1
+}
+
+// displayText returns the decoded text of a MIME entity and its media type, text/plain
+// or text/html; the type is "" when nothing is displayable. multipart/alternative picks
+// a version by config.BodyPreference (see bodyRank), other multiparts give their first
+// displayable part.
+// Files, i.e. parts with a filename or a type that is neither text nor multipart, are
+// added to attachments instead. A message/rfc822 entity gives the text of the embedded
+// message, whose header is returned as well; it is nil when the text is not forwarded.
+func displayText(header textproto.MIMEHeader, body io.Reader, depth int, config GotifyConfig, attachments *attachmentCollector) (string, string, mail.Header) {
+    mediaType, params, err := mime.ParseMediaType(header.Get("Content-Type"))
+    if err != nil {
+        // RFC 2045 5.2: a missing or broken Content-Type means US-ASCII plain text
+        mediaType, params = "text/plain", map[string]string{}
+    }
+    // Forwarded as attachment: show the embedded message rather than list it as a file
+    if mediaType == "message/rfc822" && depth < MaxMIMEDepth {
+        embedded, err := mail.ReadMessage(bufio.NewReader(decodeTransfer(header, body)))
+        if err != nil {
+            return "", "", nil
+        }
+        text, textType, inner := displayText(textproto.MIMEHeader(embedded.Header), embedded.Body, depth+1, config, attachments)
+        if textType == "" {
+            return "", "", nil
+        }
+        if inner == nil {
+            inner = embedded.Header
+        }
+        return text, textType, inner
+    }
+    disposition, dispositionParams, _ := mime.ParseMediaType(header.Get("Content-Disposition"))
+    name := dispositionParams["filename"]
+    if name == "" {
+        name = params["name"]
+    }
+    if name == "" {
+        name = "unnamed"
+    }
+    // Invitations are summarized instead of shown as iCalendar text; an .ics file is
+    // still listed with the attachments
+    if mediaType == "text/calendar" || mediaType == "application/ics" {
+        content := decodeTransfer(header, body)
+        decoded, _ := io.ReadAll(io.LimitReader(content, MaxMIMEScanBytes))
+        if attachments.calendar == "" {
+            attachments.calendar = summarizeCalendar(decodeCharset(decoded, params["charset"]))
+        }
+        if disposition == "attachment" || dispositionParams["filename"] != "" {
+            attachments.add(decodeHeader(name), mediaType, io.MultiReader(bytes.NewReader(decoded), content))
+        }
+        return "", "", nil
+    }
+    isText := mediaType == "text/plain" || mediaType == "text/html"
+    if disposition == "attachment" || dispositionParams["filename"] != "" || !isText && !strings.HasPrefix(mediaType, "multipart/") {
+        attachments.add(decodeHeader(name), mediaType, decodeTransfer(header, body))
+        return "", "", nil
+    }
+    if strings.HasPrefix(mediaType, "multipart/") {
+        if depth >= MaxMIMEDepth || params["boundary"] == "" {
+            return "", "", nil
+        }
+        parts := multipart.NewReader(body, params["boundary"])
+        text, textType := "", ""
+        var embedded mail.Header
+        for {
+            part, err := parts.NextPart()
+            if err != nil {
+                break
+            }
+            // Parts after the chosen text are still read for their attachments
+            partText, partType, partEmbedded := displayText(part.Header, part, depth+1, config, attachments)
+            // A blank cover note gives way to the forwarded message after it
+            replace := partEmbedded != nil && embedded == nil && strings.TrimSpace(text) == ""
+            if mediaType == "multipart/alternative" && textType != "" {
+                current := bodyRank(config.BodyPreference, textType, text)
+                replace = current < 2 && bodyRank(config.BodyPreference, partType, partText) >= current
+            }
+            if partType == "" || !replace && textType != "" {
+                continue
+            }
+            text, textType, embedded = partText, partType, partEmbedded
+        }
+        return text, textType, embedded
+    }
+    // A body cut off at MaxMIMEScanBytes fails to decode at the end, keep what was decoded
+    decoded, _ := io.ReadAll(io.LimitReader(decodeTransfer(header, body), MaxMIMEScanBytes))
+    text := decodeCharset(decoded, params["charset"])
+    if mediaType == "text/html" {
+        text = htmlToText(text, config.Markdown)
+    } else {
+        text = textImage.ReplaceAllStringFunc(text, func(image string) string {
+            return imagePlaceholder(textImage.FindStringSubmatch(image)[1], "")
+        })
+    }
+    return text, mediaType, nil
+}
+
+// calendarText undoes the escaping of iCalendar TEXT values
+var calendarText = strings.NewReplacer(`\n`, "\n", `\N`, "\n", `\,`, ",", `\;`, ";", `\\`, `\`)
+
+// calendarParam returns a parameter such as TZID from the ";"-separated parameters
+// of an iCalendar property
+func calendarParam(params, name string) string {
+    for _, param := range strings.Split(params, ";") {
+        if key, value, ok := strings.Cut(param, "="); ok && strings.EqualFold(key, name) {
+            return strings.Trim(value, `"`)
+        }
+    }
+    return ""
+}
+
+// calendarTime parses a DATE-TIME or DATE value into local time; allDay is set for dates
+func calendarTime(value, params string) (start time.Time, allDay bool, ok bool) {
+    var err error
+    switch {
+    case len(value) == 8:
+        start, err = time.ParseInLocation("20060102", value, time.Local)
+        allDay = true
+    case strings.HasSuffix(value, "Z"):
+        start, err = time.Parse("20060102T150405Z", value)
+    default:
+        location := time.Local
+        if tzid := calendarParam(params, "TZID"); tzid != "" {
+            if loaded, loadErr := time.LoadLocation(tzid); loadErr == nil {
+                location = loaded
+            }
+        }
+        start, err = time.ParseInLocation("20060102T150405", value, location)
+    }
+    if err != nil {
+        return time.Time{}, false, false
+    }
+    if !allDay {
+        start = start.Local()
+    }
+    return start, allDay, true
+}
+
+// summarizeCalendar describes the first event of an iCalendar object (RFC 5545), e.g.
+// "Meeting: Review at 15:00 on Mon 10/19/2026" followed by its location and organizer.
+// It returns "" when there is no event.
+func summarizeCalendar(ics string) string {
+    // Long lines are folded by a line break followed by a space or tab
+    ics = strings.NewReplacer("\r\n ", "", "\r\n\t", "", "\n ", "", "\n\t", "").Replace(ics)
+    method := ""
+    event := map[string]string{}
+    startParams, organizerParams := "", ""
+    inEvent, nested := false, 0
+    for _, line := range strings.Split(ics, "\n") {
+        property, value, ok := strings.Cut(strings.TrimRight(line, "\r"), ":")
+        if !ok {
+            continue
+        }
+        name, params, _ := strings.Cut(property, ";")
+        name = strings.ToUpper(name)
+        switch {
+        case name == "METHOD" && !inEvent:
+            method = strings.ToUpper(value)
+        case name == "BEGIN" && strings.EqualFold(value, "VEVENT"):
+            inEvent = true
+        case !inEvent:
+        // Alarms inside the event have properties of their own
+        case name == "BEGIN":
+            nested++
+        case name == "END" && nested > 0:
+            nested--
+        case name == "END":
+            inEvent = false
+        case nested == 0 && event[name] == "":
+            event[name] = value
+            if name == "DTSTART" {
+                startParams = params
+            } else if name == "ORGANIZER" {
+                organizerParams = params
+            }
+        }
+        if name == "END" && strings.EqualFold(value, "VEVENT") {
+            break
+        }
+    }
+    if len(event) == 0 {
+        return ""
+    }
+    label := "Meeting"
+    if method == "CANCEL" || strings.EqualFold(event["STATUS"], "CANCELLED") {
+        label = "Cancelled"
+    }
+    title := calendarText.Replace(event["SUMMARY"])
+    if title == "" {
+        title = "(no title)"
+    }
+    summary := fmt.Sprintf("%s: %s", label, title)
+    if start, allDay, ok := calendarTime(event["DTSTART"], startParams); ok {
+        if allDay {
+            summary += start.Format(" on Mon 1/2/2006 (all day)")
+        } else {
+            summary += start.Format(" at 15:04 on Mon 1/2/2006")
+        }
+    }
+    if location := calendarText.Replace(event["LOCATION"]); location != "" {
+        summary += "\nLocation: " + location
+    }
+    organizer := calendarParam(organizerParams, "CN")
+    if address := strings.TrimPrefix(strings.TrimPrefix(event["ORGANIZER"], "mailto:"), "MAILTO:"); address != "" {
+        if organizer == "" {
+            organizer = address
+        } else {
+            organizer += " <" + address + ">"
+        }
+    }
+    if organizer != "" {
+        summary += "\nOrganizer: " + organizer
+    }
+    return summary
+}
+
+// parseEmail extracts relevant information from the email. Only the headers and the
+// start of the body are read into memory; MIME messages are reduced to their text as
+// the notification settings in config ask for.
+// With the attachment store the body is streamed to its end, at most maxSize bytes
+// (SMTP.MaxMessageSize, 0 for no limit), and each attachment goes to disk as it is read.
+func parseEmail(from string, to []string, data io.Reader, config GotifyConfig, maxSize int64) EmailData {
+    subject := "No Subject"
+    bounce := from == ""
+    // What the header parser reads is kept, so a message without a valid header can
+    // still be shown
+    consumed := &headBuffer{limit: MaxMIMEScanBytes}
+    msg, err := mail.ReadMessage(bufio.NewReader(io.TeeReader(data, consumed)))
+    var body, date, replyTo, messageID string
+    var header map[string][]string
+    markdown := false
+    attachments := &attachmentCollector{store: attachmentStore}
+    if err != nil {
+        raw, _ := io.ReadAll(io.LimitReader(io.MultiReader(bytes.NewReader(consumed.Bytes()), data), MaxMIMEScanBytes))
+        body = decodeCharset(raw, "")
+    } else {
+        if value := msg.Header.Get("Subject"); value != "" {
+            subject = decodeHeader(value)
+        }
+        date = msg.Header.Get("Date")
+        replyTo = decodeHeader(msg.Header.Get("Reply-To"))
+        messageID = msg.Header.Get("Message-Id")
+        header = make(map[string][]string, len(msg.Header))
+        for name, values := range msg.Header {
+            for _, value := range values {
+                header[name] = append(header[name], decodeHeader(value))
+            }
+        }
+        // RFC 3464 delivery status notifications
+        if mediaType, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type")); err == nil && mediaType == "multipart/report" && strings.EqualFold(params["report-type"], "delivery-status") {
+            bounce = true
+        }
+        // Stored attachments must be complete, so the store reads on to the size limit;
+        // only the start of the body is kept, for messages without displayable text
+        scanLimit := int64(MaxMIMEScanBytes)
+        if attachmentStore != nil {
+            scanLimit = math.MaxInt64
+            if maxSize > 0 {
+                scanLimit = maxSize
+            }
+        }
+        head := &headBuffer{limit: MaxMIMEScanBytes}
+        scanned := io.TeeReader(io.LimitReader(msg.Body, scanLimit), head)
+        text, textType, embedded := displayText(textproto.MIMEHeader(msg.Header), scanned, 0, config, attachments)
+        if textType != "" || len(attachments.list) > 0 || attachments.calendar != "" {
+            body = text
+            markdown = config.Markdown && textType == "text/html"
+        } else {
+            // Nothing was displayable, the raw body is shown as far as it is scanned
+            io.Copy(io.Discard, io.LimitReader(scanned, int64(MaxMIMEScanBytes-head.Len())))
+            body = head.String()
+        }
+        // An invitation is shown as "Meeting: ..." above the text that came with it
+        if attachments.calendar != "" {
+            body = strings.TrimSpace(attachments.calendar + "\n\n" + body)
+        }
+        // A message forwarded as attachment is shown with its own subject
+        if value := embedded.Get("Subject"); value != "" {
+            subject = decodeHeader(value)
+        }
+    }
+    // The full message link shows the text as received, not what the settings made of it
+    original := ""
+    if config.FullMessageLink && attachmentStore != nil {
+        original = body
+    }
+    // The notification is truncated per account in sendToGotify; this only bounds memory
+    if len(body) > MaxParsedBody {
+        // Cut on a rune boundary so multi-byte UTF-8 characters are not split
+        cut := MaxParsedBody
+        for cut > 0 && !utf8.RuneStart(body[cut]) {
+            cut--
+        }
+        body = body[:cut]
+    }
+    return EmailData{
+        From:    from,
+        To:      to,
+        Subject:     subject,
+        Body:        body,
+        Bounce:      bounce,
+        Attachments: attachments.list,
+        Date:        date,
+        ReplyTo:     replyTo,
+        MessageID:   messageID,
+        Header:      header,
+        Markdown:    markdown,
+        original:    original,
+    }
+}
+
+// sendmailOptions are the sendmail(8) options understood by the sendmail command
+type sendmailOptions struct {
+    from       string
+    recipients []string
+    // fromHeaders (-t) adds the To, Cc and Bcc addresses of the message to the recipients
+    fromHeaders bool
+    // ignoreDots (-i, -oi) stops a line holding a single dot from ending the message
+    ignoreDots bool
+}
+
+// parseSendmailArgs parses sendmail(8) style arguments. Options that only matter to a
+// real MTA (-F, -oem, -odi, -v, ...) are accepted and ignored so existing scripts work.
+func parseSendmailArgs(args []string) (sendmailOptions, error) {
+    var opts sendmailOptions
+    for i := 0; i < len(args); i++ {
+        arg := args[i]
+        switch {
+        case arg == "--":
+            opts.recipients = append(opts.recipients, args[i+1:]...)
+            return opts, nil
+        case arg == "-t":
+            opts.fromHeaders = true
+        case arg == "-i" || arg == "-oi":
+            opts.ignoreDots = true
+        case arg == "-f" || arg == "-r" || arg == "-F":
+            if i+1 >= len(args) {
+                return opts, fmt.Errorf("option %s requires an argument", arg)
+            }
+            i++
+            if arg != "-F" {
+                opts.from = args[i]
+            }
+        case strings.HasPrefix(arg, "-f") || strings.HasPrefix(arg, "-r"):
+            opts.from = arg[2:]
+        case strings.HasPrefix(arg, "-"):
+            // Other MTA options have no meaning here
+        default:
+            opts.recipients = append(opts.recipients, arg)
+        }
+    }
+    return opts, nil
+}
+
+// readSendmailMessage reads a message of at most maxSize bytes (zero for no limit). Unless
+// ignoreDots is set a line holding a single dot ends it, as with sendmail without -i.
+func readSendmailMessage(r io.Reader, ignoreDots bool, maxSize int64) ([]byte, error) {
+    reader := bufio.NewReader(r)
+    var message bytes.Buffer
+    for {
+        line, err := reader.ReadString('\n')
+        if !ignoreDots && strings.TrimRight(line, "\r\n") == "." {
+            break
+        }
+        message.WriteString(line)
+        if maxSize > 0 && int64(message.Len()) > maxSize {
+            return nil, fmt.Errorf("message exceeds the maximum message size of %d bytes", maxSize)
+        }
+        if err == io.EOF {
+            break
+        }
+        if err != nil {
+            return nil, fmt.Errorf("failed to read message: %v", err)
+        }
+    }
+    return message.Bytes(), nil
+}
+
+// messageHeader returns the header of message; a message without a valid header has none
+func messageHeader(message []byte) mail.Header {
+    msg, err := mail.ReadMessage(bytes.NewReader(message))
+    if err != nil {
+        return mail.Header{}
+    }
+    return msg.Header
+}
+
+// headerAddresses extracts the addresses from the address list header fields name, e.g.
+// "Ops <ops@example.com>, admin@example.com". Lists that do not follow RFC 5322 are
+// split on commas instead.
+func headerAddresses(header mail.Header, name string) []string {
+    var addresses []string
+    for _, value := range header[textproto.CanonicalMIMEHeaderKey(name)] {
+        if list, err := mail.ParseAddressList(value); err == nil {
+            for _, address := range list {
+                addresses = append(addresses, address.Address)
+            }
+            continue
+        }
+        addresses = append(addresses, splitAddresses(value)...)
+    }
+    return addresses
+}
+
+// splitAddresses is the lenient fallback of headerAddresses
+func splitAddresses(value string) []string {
+    var addresses []string
+    for _, entry := range strings.Split(value, ",") {
+        entry = strings.TrimSpace(entry)
+        if start := strings.LastIndex(entry, "<"); start >= 0 {
+            if end := strings.Index(entry[start:], ">"); end > 0 {
+                entry = entry[start+1 : start+end]
+            }
+        }
+        if strings.Contains(entry, "@") {
+            addresses = append(addresses, entry)
+        }
+    }
+    return addresses
+}
+
+// runSendmail reads a message like sendmail(8) and sends it through the same parsing
+// and Gotify pipeline as SMTP, so cron jobs and scripts need no TCP connection.
+// A message that cannot be delivered is kept as a dead letter when those are enabled.
+func runSendmail(config AppConfig, args []string, stdin io.Reader) error {
+    opts, err := parseSendmailArgs(args)
+    if err != nil {
+        return err
+    }
+    transforms, err := compileTransforms(config.Transforms)
+    if err != nil {
+        return err
+    }
+    priorityRules, err := compilePriorityRules(config.PriorityRules)
+    if err != nil {
+        return err
+    }
+    if err := compileClickPattern(&config.Gotify); err != nil {
+        return err
+    }
+    message, err := readSendmailMessage(stdin, opts.ignoreDots, config.SMTP.MaxMessageSize)
+    if err != nil {
+        return err
+    }
+    header := messageHeader(message)
+    recipients := opts.recipients
+    if opts.fromHeaders {
+        for _, name := range []string{"To", "Cc", "Bcc"} {
+            recipients = append(recipients, headerAddresses(header, name)...)
+        }
+    }
+    if len(recipients) == 0 {
+        return fmt.Errorf("no recipients given, pass addresses or use -t")
+    }
+    from := opts.from
+    if from == "" {
+        if addresses := headerAddresses(header, "From"); len(addresses) > 0 {
+            from = addresses[0]
+        } else {
+            from = auditActor()
+            if host, err := os.Hostname(); err == nil {
+                from += "@" + host
+            }
+        }
+    }
+    email := applyTransforms(transforms, parseEmail(from, recipients, bytes.NewReader(message), config.Gotify, config.SMTP.MaxMessageSize))
+    email.Subject = normalizeSubject(config.SubjectPrefixes, email.Subject)
+    if priority, ok := matchPriority(priorityRules, email); ok {
+        config.Gotify.Priority = priority
+    }
+    if err := sendToGotify(config.Gotify, email); err != nil {
+        logEvent("gotify_failed", fmt.Sprintf("Failed to send to Gotify for email from %s: %v", email.From, err), fmt.Sprintf("Failed to forward the email from %s with subject '%s' received on standard input by the sendmail command: %v", email.From, email.Subject, err))
+        if !config.DeadLetter.Enabled {
+            return fmt.Errorf("failed to send to Gotify: %v", err)
+        }
+        now := time.Now()
+        letter := DeadLetter{
+            ID:          fmt.Sprintf("%s_%s", now.Format("20060102_150405"), newSessionID()),
+            Email:       email,
+            Reason:      err.Error(),
+            FirstFailed: now,
+            LastFailed:  now,
+            Attempts:    1,
+        }
+        if saveErr := saveDeadLetter(config.DeadLetter.Dir, letter); saveErr != nil {
+            return fmt.Errorf("failed to send to Gotify: %v, and failed to store the message: %v", err, saveErr)
+        }
+        logEvent("dead_letter", fmt.Sprintf("Email from %s stored as dead letter %s", email.From, letter.ID), fmt.Sprintf("The undeliverable email from %s with subject '%s' was stored in the dead-letter directory and can be retried from the UI.", email.From, email.Subject))
+        fmt.Fprintf(os.Stderr, "Gotify is unreachable, the message was stored as dead letter %s: %v\n", letter.ID, err)
+        return nil
+    }
+    logEvent("gotify_success", fmt.Sprintf("Successfully sent notification to Gotify for email from %s", email.From), fmt.Sprintf("Successfully forwarded the email from %s to %s with subject '%s' received on standard input by the sendmail command.", email.From, strings.Join(email.To, ", "), email.Subject))
+    return nil
+}
+
+// sendToGotify sends the email content as a notification to Gotify with retry logic
+func sendToGotify(config GotifyConfig, email EmailData) error {
+    email.From = sanitizeText(email.From, config.Sanitize)
+    email.Subject = sanitizeText(email.Subject, config.Sanitize)
+    email.Body = sanitizeText(formatJSONBody(email.Body, config), config.Sanitize)
+    sender := email.From
+    if sender == "" {
+        sender = "<> (null sender)"
+    }
+    // details are the header lines shown below From and To, see GotifyConfig.ShowHeaders
+    details := ""
+    if config.ShowHeaders == "body" {
+        for _, field := range []struct{ name, value string }{{"Date", email.Date}, {"Reply-To", email.ReplyTo}, {"Message-ID", email.MessageID}} {
+            if field.value != "" {
+                details += fmt.Sprintf("\n%s: %s", field.name, field.value)
+            }
+        }
+    }
+    // extraHeaders holds the allowlisted headers the message has, under their configured name
+    extraHeaders := map[string]string{}
+    for _, name := range config.ExtraHeaders {
+        values := email.Header[textproto.CanonicalMIMEHeaderKey(name)]
+        if len(values) == 0 {
+            continue
+        }
+        value := strings.Join(values, ", ")
+        if config.ShowHeaders == "extras" {
+            extraHeaders[name] = value
+        } else {
+            details += fmt.Sprintf("\n%s: %s", name, value)
+        }
+    }
+    body := email.Body
+    if config.StripQuotes {
+        body = stripQuotedReply(body)
+    }
+    // plain escapes text for Markdown mode; a body converted from HTML is Markdown already
+    plain := func(text string) string {
+        if config.Markdown {
+            return escapeMarkdown(text)
+        }
+        return text
+    }
+    shown := truncateBody(body, config)
+    cut := shown != body
+    if !email.Markdown {
+        shown = plain(shown)
+    }
+    if cut && config.FullMessageLink && attachmentStore != nil {
+        // Dead letters are stored without the original, they link what they kept
+        original := email.original
+        if original == "" {
+            original = email.Body
+        }
+        dir := ""
+        if _, link, err := attachmentStore.Save(&dir, 0, "message.txt", strings.NewReader(original)); err == nil && link != "" {
+            shown += "\n\nFull message: " + link
+        }
+    }
+    message := GotifyMessage{
+        Title:    fmt.Sprintf("New Email: %s", email.Subject),
+        Message:  fmt.Sprintf("From: %s\nTo: %s%s\n\n%s", plain(sender), plain(strings.Join(email.To, ", ")), plain(details), shown),
+        Priority: config.Priority,
+    }
+    // clickTarget is the URL opened when the notification is tapped
+    clickTarget := ""
+    if config.TitleTemplate != "" || config.MessageTemplate != "" || config.ClickURL != "" {
+        data := notificationData{From: sender, To: strings.Join(email.To, ", "), Subject: email.Subject, Body: shown}
+        if config.ExtractFields {
+            data.Fields = extractFields(email.Body)
+        }
+        // A template that fails leaves the default text, the email is not lost over it
+        for _, target := range []struct {
+            name, text string
+            value      *string
+        }{{"gotify.title_template", config.TitleTemplate, &message.Title}, {"gotify.message_template", config.MessageTemplate, &message.Message}, {"gotify.click_url", config.ClickURL, &clickTarget}} {
+            if target.text == "" {
+                continue
+            }
+            rendered, err := renderTemplate(target.text, data)
+            if err != nil {
+                appendToStatus(fmt.Sprintf("Failed to render %s: %v", target.name, err))
+                continue
+            }
+            *target.value = rendered
+        }
+        clickTarget = strings.TrimSpace(clickTarget)
+    }
+    if config.ShowHeaders == "extras" {
+        headers := map[string]string{"date": email.Date, "reply_to": email.ReplyTo, "message_id": email.MessageID}
+        for name, value := range extraHeaders {
+            headers[name] = value
+        }
+        message.Extras = map[string]interface{}{
+            "smtp::headers": headers,
+        }
+    }
+    // A configured URL comes first, then one from the body, then the first stored attachment
+    if clickTarget == "" && config.ClickFromBody {
+        clickTarget = clickURL(email.Body, config.clickPattern)
+    }
+    if clickTarget != "" {
+        if message.Extras == nil {
+            message.Extras = map[string]interface{}{}
+        }
+        message.Extras["client::notification"] = map[string]interface{}{
+            "click": map[string]string{"url": clickTarget},
+        }
+    }
+    if len(email.Attachments) > 0 {
+        message.Message += fmt.Sprintf("\n\nAttachments (%d):", len(email.Attachments))
+        for _, attachment := range email.Attachments {
+            message.Message += "\n- " + plain(attachment.String())
+            // Tapping the notification opens the first stored attachment
+            if attachment.URL != "" && message.Extras["client::notification"] == nil {
+                if message.Extras == nil {
+                    message.Extras = map[string]interface{}{}
+                }
+                message.Extras["client::notification"] = map[string]interface{}{
+                    "click": map[string]string{"url": attachment.URL},
+                }
+            }
+        }
+    }
+    if email.Bounce {
+        label := config.BounceLabel
+        if label == "" {
+            label = DefaultBounceLabel
+        }
+        message.Title = fmt.Sprintf("%s %s", label, message.Title)
+        message.Priority = config.BouncePriority
+    }
+    if strings.HasPrefix(email.ScanResult, "infected") {
+        message.Title = fmt.Sprintf("[VIRUS] %s", message.Title)
+    }
+    if email.ScanResult != "" {
+        message.Message = fmt.Sprintf("Virus scan: %s\n%s", plain(email.ScanResult), message.Message)
+    }
+    if email.Spam != "" {
+        message.Title = fmt.Sprintf("[SPAM] %s", message.Title)
+        message.Message = fmt.Sprintf("Spam score: %s\n%s", plain(email.Spam), message.Message)
+    }
+    if email.DNSBL != "" {
+        message.Title = fmt.Sprintf("[DNSBL] %s", message.Title)
+        message.Message = fmt.Sprintf("Sending host listed on %s\n%s", plain(email.DNSBL), message.Message)
+    }
+    if email.SPF != "" {
+        message.Title = fmt.Sprintf("[SPF %s] %s", email.SPF, message.Title)
+        message.Message = fmt.Sprintf("SPF check of the sender: %s\n%s", plain(email.SPF), message.Message)
+    }
+    if config.Markdown {
+        // Single line breaks would join lines into one paragraph, two trailing spaces keep them
+        message.Message = strings.ReplaceAll(message.Message, "\n", "  \n")
+        if message.Extras == nil {
+            message.Extras = map[string]interface{}{}
+        }
+        message.Extras["client::display"] = map[string]string{"contentType": "text/markdown"}
+    }
+    jsonData, err := json.Marshal(message)
+    if err != nil {
+        return fmt.Errorf("failed to marshal Gotify message: %v", err)
+    }
+    timeout := config.Timeout
+    if timeout <= 0 {
+        timeout = GotifyTimeout
+    }
+    maxRetries := config.MaxRetries
+    if maxRetries < 1 {
+        maxRetries = GotifyMaxRetries
+    }
+    client := &http.Client{
+        Timeout: timeout,
+    }
+    url := fmt.Sprintf("%s/message?token=%s", strings.TrimSuffix(config.GotifyHost, "/"), config.GotifyToken)
+    for attempt := 1; attempt <= maxRetries; attempt++ {
+        resp, err := client.Post(url, "application/json", bytes.NewBuffer(jsonData))
+        if err != nil {
+            logEvent("gotify_failed", fmt.Sprintf("Attempt %d/%d: Failed to send to Gotify for email from %s: %v", attempt, maxRetries, email.From, err), fmt.Sprintf("Attempt %d of %d to send notification to Gotify at %s failed due to network or connection error: %v", attempt, maxRetries, config.GotifyHost, err))
+            if attempt == maxRetries {
+                return fmt.Errorf("failed to send to Gotify after %d attempts: %v", maxRetries, err)
+            }
+            time.Sleep(time.Duration(attempt) * time.Second)
+            continue
+        }
+        defer resp.Body.Close()
+        if resp.StatusCode != http.StatusOK {
+            body, _ := io.ReadAll(resp.Body)
+            logEvent("gotify_failed", fmt.Sprintf("Attempt %d/%d: Gotify API returned non-OK status for email from %s: %d, body: %s", attempt, maxRetries, email.From, resp.StatusCode, string(body)), fmt.Sprintf("Attempt %d of %d to send notification to Gotify at %s failed with HTTP status %d, response body: %s", attempt, maxRetries, config.GotifyHost, resp.StatusCode, string(body)))
+            if attempt == maxRetries {
+                return fmt.Errorf("Gotify API returned non-OK status: %d, body: %s", resp.StatusCode, string(body))
+            }
+            time.Sleep(time.Duration(attempt) * time.Second)
+            continue
+        }
+        return nil
+    }
+    return fmt.Errorf("unexpected error in Gotify send loop")
+}
+
+// loopbackAddr turns a listen address such as ":2525" into one that can be dialed locally
+func loopbackAddr(addr string) string {
+    host, port, err := net.SplitHostPort(addr)
+    if err != nil {
+        return addr
+    }
+    if host == "" || host == "0.0.0.0" || host == "::" {
+        host = "localhost"
+    }
+    return net.JoinHostPort(host, port)
+}
+
+// sendTestEmail submits a synthetic email to the local SMTP listener and reports each
+// stage through report. Delivery happens after the server has answered DATA, so the
+// outcome is taken from the log entry that mentions the unique test subject.
+func sendTestEmail(config SMTPConfig, report func(string)) error {
+    addr := loopbackAddr(config.Addr)
+    conn, err := net.DialTimeout("tcp", addr, SMTPConnectionTimeout)
+    if err != nil {
+        return fmt.Errorf("connect to %s: %v", addr, err)
+    }
+    defer conn.Close()
+    conn.SetDeadline(time.Now().Add(SMTPConnectionTimeout))
+    reader := bufio.NewReader(conn)
+    // expect reads a possibly multi-line reply and checks its status code
+    expect := func(stage, code string) error {
+        for {
+            line, err := reader.ReadString('\n')
+            if err != nil {
+                return fmt.Errorf("%s: %v", stage, err)
+            }
+            line = strings.TrimSpace(line)
+            if !strings.HasPrefix(line, code) {
+                return fmt.Errorf("%s: unexpected reply %q", stage, line)
+            }
+            if len(line) < 4 || line[3] != '-' {
+                report(fmt.Sprintf("Test email: %s OK (%s)", stage, line))
+                return nil
+            }
+        }
+    }
+    send := func(format string, args ...interface{}) error {
+        _, err := fmt.Fprintf(conn, format+"\r\n", args...)
+        return err
+    }
+    if err := expect("greeting", "220"); err != nil {
+        return err
+    }
+    if err := send("EHLO %s", "localhost"); err != nil {
+        return fmt.Errorf("EHLO: %v", err)
+    }
+    if err := expect("EHLO", "250"); err != nil {
+        return err
+    }
+    if config.RequireTLSForAuth {
+        if err := send("STARTTLS"); err != nil {
+            return fmt.Errorf("STARTTLS: %v", err)
+        }
+        if err := expect("STARTTLS", "220"); err != nil {
+            return err
+        }
+        // The loopback listener presents a certificate for its public name, not localhost
+        tlsConn := tls.Client(conn, &tls.Config{InsecureSkipVerify: true})
+        if err := tlsConn.Handshake(); err != nil {
+            return fmt.Errorf("TLS handshake: %v", err)
+        }
+        conn = tlsConn
+        reader = bufio.NewReader(conn)
+        if err := send("EHLO %s", "localhost"); err != nil {
+            return fmt.Errorf("EHLO: %v", err)
+        }
+        if err := expect("EHLO", "250"); err != nil {
+            return err
+        }
+    }
+    if config.AuthRequired || config.SMTPUsername != "" {
+        credentials := base64.StdEncoding.EncodeToString([]byte("\x00" + config.SMTPUsername + "\x00" + config.SMTPPassword))
+        if err := send("AUTH PLAIN %s", credentials); err != nil {
+            return fmt.Errorf("AUTH: %v", err)
+        }
+        if err := expect("AUTH", "235"); err != nil {
+            return err
+        }
+    }
+    from := fmt.Sprintf("test@%s", config.Domain)
+    if err := send("MAIL FROM:<%s>", from); err != nil {
+        return fmt.Errorf("MAIL FROM: %v", err)
+    }
+    if err := expect("MAIL FROM", "250"); err != nil {
+        return err
+    }
+    if err := send("RCPT TO:<%s>", from); err != nil {
+        return fmt.Errorf("RCPT TO: %v", err)
+    }
+    if err := expect("RCPT TO", "250"); err != nil {
+        return err
+    }
+    if err := send("DATA"); err != nil {
+        return fmt.Errorf("DATA: %v", err)
+    }
+    if err := expect("DATA", "354"); err != nil {
+        return err
+    }
+    marker := fmt.Sprintf("test-%d", time.Now().UnixNano())
+    subject := fmt.Sprintf("SMTP to Gotify loopback test %s", marker)
+    if err := send("From: <%s>\r\nTo: <%s>\r\nSubject: %s\r\n\r\nThis is a loopback test email sent from the configuration UI.\r\n.", from, from, subject); err != nil {
+        return fmt.Errorf("message: %v", err)
+    }
+    if err := expect("message", "250"); err != nil {
+        return err
+    }
+    send("QUIT")
+    // Parsing and delivery run after the reply, watch the log for the outcome
+    deadline := time.Now().Add(TestEmailDeliveryWait)
+    for time.Now().Before(deadline) {
+        page, err := readLogPage(func(entry LogEntry) bool {
+            return strings.HasPrefix(entry.Category, "gotify") && strings.Contains(entry.Description, marker)
+        }, -1, 1)
+        if err == nil && len(page.Entries) > 0 {
+            entry := page.Entries[0]
+            if entry.Category != "gotify_success" {
+                return fmt.Errorf("delivery: %s", entry.Description)
+            }
+            report(fmt.Sprintf("Test email: parsing OK (subject %q)", subject))
+            report("Test email: delivery to Gotify OK")
+            return nil
         }
+        time.Sleep(time.Second)
     }
+    return fmt.Errorf("delivery: no result in the log after %v, check that the service is running and logging", TestEmailDeliveryWait)
 }
 
-// parseEmail extracts relevant information from the email
-func parseEmail(from string, to []string, data string) EmailData {
-    subject := "No Subject"
-    body := data
-    lines := strings.Split(data, "\n")
-    for _, line := range lines {
-        if strings.HasPrefix(line, "Subject:") {
-            subject = strings.TrimPrefix(line, "Subject:")
-            subject = strings.TrimSpace(subject)
-            break
-        }
-    }
-    bodyStart := strings.Index(data, "\r\n\r\n")
-    if bodyStart != -1 {
-        body = data[bodyStart+4:]
-    }
-    if len(body) > 5000 {
-        body = body[:5000] + "... (truncated)"
-    }
-    return EmailData{
-        From:    from,
-        To:      to,
-        Subject: subject,
-        Body:    body,
+// gotifyConfigFromViper builds a GotifyConfig from the values currently entered in the UI
+func gotifyConfigFromViper() GotifyConfig {
+    return GotifyConfig{
+        GotifyHost:      viper.GetString("gotify.gotify_host"),
+        GotifyToken:     viper.GetString("gotify.gotify_token"),
+        Priority:        viper.GetInt("gotify.priority"),
+        Timeout:         viper.GetDuration("gotify.timeout"),
+        MaxRetries:      viper.GetInt("gotify.max_retries"),
+        BounceLabel:     viper.GetString("gotify.bounce_label"),
+        BouncePriority:  viper.GetInt("gotify.bounce_priority"),
+        MaxBodyLength:   viper.GetInt("gotify.max_body_length"),
+        TruncateSuffix:  viper.GetString("gotify.truncate_suffix"),
+        TruncateAt:      viper.GetString("gotify.truncate_at"),
+        ShowHeaders:     viper.GetString("gotify.show_headers"),
+        BodyPreference:  viper.GetString("gotify.body_preference"),
+        Sanitize:        viper.GetString("gotify.sanitize"),
+        ExtractFields:   viper.GetBool("gotify.extract_fields"),
+        TitleTemplate:   viper.GetString("gotify.title_template"),
+        MessageTemplate: viper.GetString("gotify.message_template"),
+        StripQuotes:     viper.GetBool("gotify.strip_quotes"),
+        ExtraHeaders:    viper.GetStringSlice("gotify.extra_headers"),
+        JSONBody:        viper.GetString("gotify.json_body"),
+        JSONFields:      viper.GetStringSlice("gotify.json_fields"),
+        ClickURL:        viper.GetString("gotify.click_url"),
+        ClickFromBody:   viper.GetBool("gotify.click_from_body"),
+        ClickPattern:    viper.GetString("gotify.click_pattern"),
+        FullMessageLink: viper.GetBool("gotify.full_message_link"),
+        Markdown:        viper.GetBool("gotify.markdown"),
     }
 }
 
-// sendToGotify sends the email content as a notification to Gotify with retry logic
-func sendToGotify(config GotifyConfig, email EmailData) error {
+// smtpUsersFromViper reads the additional SMTP accounts from the current config
+func smtpUsersFromViper() []SMTPUser {
+    var users []SMTPUser
+    viper.UnmarshalKey("smtp.users", &users)
+    return users
+}
+
+// sendTestNotification pushes a single test message without retries and returns the
+// HTTP status, so configuration mistakes show up immediately
+func sendTestNotification(config GotifyConfig) (string, error) {
+    if config.GotifyToken == "" {
+        return "", fmt.Errorf("no Gotify token configured")
+    }
     message := GotifyMessage{
-        Title:    fmt.Sprintf("New Email: %s", email.Subject),
-        Message:  fmt.Sprintf("From: %s\nTo: %s\n\n%s", email.From, strings.Join(email.To, ", "), email.Body),
-        Priority: DefaultGotifyPriority,
+        Title:    "SMTP to Gotify test notification",
+        Message:  fmt.Sprintf("This is a test message sent from the configuration UI on %s.", time.Now().Format("1/2/2006 - 15:04:05")),
+        Priority: config.Priority,
     }
     jsonData, err := json.Marshal(message)
     if err != nil {
-        return fmt.Errorf("failed to marshal Gotify message: %v", err)
+        return "", fmt.Errorf("failed to marshal Gotify message: %v", err)
+    }
+    timeout := config.Timeout
+    if timeout <= 0 {
+        timeout = GotifyTimeout
     }
     client := &http.Client{
-        Timeout: GotifyTimeout,
+        Timeout: timeout,
     }
     url := fmt.Sprintf("%s/message?token=%s", strings.TrimSuffix(config.GotifyHost, "/"), config.GotifyToken)
-    for attempt := 1; attempt <= GotifyMaxRetries; attempt++ {
-        resp, err := client.Post(url, "application/json", bytes.NewBuffer(jsonData))
-        if err != nil {
-            logEvent("gotify_failed", fmt.Sprintf("Attempt %d/%d: Failed to send to Gotify for email from %s: %v", attempt, GotifyMaxRetries, email.From, err), fmt.Sprintf("Attempt %d of %d to send notification to Gotify at %s failed due to network or connection error: %v", attempt, GotifyMaxRetries, config.GotifyHost, err))
-            if attempt == GotifyMaxRetries {
-                return fmt.Errorf("failed to send to Gotify after %d attempts: %v", GotifyMaxRetries, err)
-            }
-            time.Sleep(time.Duration(attempt) * time.Second)
-            continue
-        }
-        defer resp.Body.Close()
-        if resp.StatusCode != http.StatusOK {
-            body, _ := io.ReadAll(resp.Body)
-            logEvent("gotify_failed", fmt.Sprintf("Attempt %d/%d: Gotify API returned non-OK status for email from %s: %d, body: %s", attempt, GotifyMaxRetries, email.From, resp.StatusCode, string(body)), fmt.Sprintf("Attempt %d of %d to send notification to Gotify at %s failed with HTTP status %d, response body: %s", attempt, GotifyMaxRetries, config.GotifyHost, resp.StatusCode, string(body)))
-            if attempt == GotifyMaxRetries {
-                return fmt.Errorf("Gotify API returned non-OK status: %d, body: %s", resp.StatusCode, string(body))
-            }
-            time.Sleep(time.Duration(attempt) * time.Second)
-            continue
-        }
-        return nil
+    resp, err := client.Post(url, "application/json", bytes.NewBuffer(jsonData))
+    if err != nil {
+        return "", fmt.Errorf("request to %s failed: %v", config.GotifyHost, err)
     }
-    return fmt.Errorf("unexpected error in Gotify send loop")
+    defer resp.Body.Close()
+    body, _ := io.ReadAll(io.LimitReader(resp.Body, 500))
+    if resp.StatusCode != http.StatusOK {
+        return "", fmt.Errorf("HTTP %s, body: %s", resp.Status, strings.TrimSpace(string(body)))
+    }
+    return fmt.Sprintf("HTTP %s", resp.Status), nil
 }
 
 // loadConfig loads the configuration from the YAML file or environment variables
@@ -681,14 +6676,130 @@ func loadConfig() (AppConfig, error) {
     viper.SetDefault("smtp.smtp_username", DefaultSMTPUser)
     viper.SetDefault("smtp.smtp_password", DefaultSMTPPass)
     viper.SetDefault("smtp.auth_required", true)
+    viper.SetDefault("smtp.auth_exempt_networks", []string{})
+    viper.SetDefault("smtp.xclient_trusted", []string{})
+    viper.SetDefault("smtp.require_tls_for_auth", false)
+    viper.SetDefault("smtp.strict_helo", false)
+    viper.SetDefault("smtp.strict_sequence", false)
+    viper.SetDefault("smtp.debug_trace", false)
+    viper.SetDefault("smtp.banner", DefaultBanner)
+    viper.SetDefault("smtp.greeting_delay", "0s")
+    viper.SetDefault("smtp.max_sessions", DefaultMaxSessions)
+    viper.SetDefault("smtp.max_recipients", DefaultMaxRecipients)
+    viper.SetDefault("smtp.require_tls", false)
+    viper.SetDefault("smtp.auth_fail_log", filepath.Join(stateDirPath, AuthFailLogFileName))
     viper.SetDefault("gotify.gotify_host", DefaultGotifyHost)
     viper.SetDefault("gotify.gotify_token", "")
+    viper.SetDefault("gotify.priority", DefaultGotifyPriority)
+    viper.SetDefault("gotify.timeout", GotifyTimeout.String())
+    viper.SetDefault("gotify.max_retries", GotifyMaxRetries)
+    viper.SetDefault("gotify.bounce_label", DefaultBounceLabel)
+    viper.SetDefault("gotify.bounce_priority", DefaultBouncePriority)
+    viper.SetDefault("gotify.max_body_length", MaxNotificationBody)
+    viper.SetDefault("gotify.truncate_suffix", DefaultTruncateSuffix)
+    viper.SetDefault("gotify.truncate_at", "word")
+    viper.SetDefault("gotify.show_headers", "none")
+    viper.SetDefault("gotify.body_preference", "plain")
+    viper.SetDefault("gotify.sanitize", "none")
+    viper.SetDefault("gotify.extract_fields", false)
+    viper.SetDefault("gotify.json_body", "none")
+    viper.SetDefault("gotify.json_fields", []string{})
+    viper.SetDefault("gotify.click_url", "")
+    viper.SetDefault("gotify.click_from_body", false)
+    viper.SetDefault("gotify.click_pattern", "")
+    viper.SetDefault("gotify.full_message_link", false)
+    viper.SetDefault("gotify.markdown", false)
+    viper.SetDefault("gotify.title_template", "")
+    viper.SetDefault("gotify.message_template", "")
+    viper.SetDefault("gotify.extra_headers", []string{})
+    viper.SetDefault("gotify.strip_quotes", false)
+    viper.SetDefault("smtp.null_sender", "accept")
+    viper.SetDefault("smtp.session_timeout", DefaultSessionTimeout.String())
+    viper.SetDefault("smtp.command_timeout", DefaultCommandTimeout.String())
+    viper.SetDefault("smtp.data_timeout", DefaultDataTimeout.String())
+    viper.SetDefault("smtp.idle_timeout", "0s")
+    viper.SetDefault("smtp.max_message_size", DefaultMaxMessageSize)
+    viper.SetDefault("tls.enabled", false)
+    viper.SetDefault("tls.cert_file", "")
+    viper.SetDefault("tls.key_file", "")
+    viper.SetDefault("tls.acme.enabled", false)
+    viper.SetDefault("tls.acme.hostnames", []string{})
+    viper.SetDefault("tls.acme.email", "")
+    viper.SetDefault("tls.acme.cache_dir", filepath.Join(dataDirPath, ACMECacheDirName))
+    viper.SetDefault("tls.acme.directory_url", "")
+    viper.SetDefault("tls.acme.http_addr", DefaultACMEHTTPAddr)
+    viper.SetDefault("limits.max_line_length", DefaultMaxLineLength)
+    viper.SetDefault("limits.max_data_line_length", DefaultMaxDataLineLength)
+    viper.SetDefault("limits.max_command_length", DefaultMaxCommandLength)
+    viper.SetDefault("limits.max_header_count", DefaultMaxHeaderCount)
+    viper.SetDefault("limits.max_header_bytes", DefaultMaxHeaderBytes)
+    viper.SetDefault("limits.line_timeout", DefaultLineTimeout.String())
+    viper.SetDefault("clamav.enabled", false)
+    viper.SetDefault("clamav.address", DefaultClamdAddress)
+    viper.SetDefault("clamav.action", "annotate")
+    viper.SetDefault("clamav.quarantine_dir", filepath.Join(dataDirPath, QuarantineDirName))
+    viper.SetDefault("clamav.timeout", DefaultClamdTimeout.String())
+    viper.SetDefault("spam_filter.enabled", false)
+    viper.SetDefault("spam_filter.backend", "rspamd")
+    viper.SetDefault("spam_filter.timeout", DefaultSpamTimeout.String())
+    viper.SetDefault("spam_filter.threshold", DefaultSpamThreshold)
+    viper.SetDefault("spam_filter.action", "tag")
+    viper.SetDefault("spam_filter.priority", 1)
+    viper.SetDefault("service.manager", "auto")
+    viper.SetDefault("run_as_user", "")
+    viper.SetDefault("limits.spool_threshold", DefaultSpoolThreshold)
+    viper.SetDefault("limits.spool_dir", "")
+    viper.SetDefault("limits.max_bandwidth", 0)
+    viper.SetDefault("limits.max_session_bandwidth", 0)
+    viper.SetDefault("overload.max_connections", DefaultMaxConnections)
+    viper.SetDefault("dead_letter.enabled", false)
+    viper.SetDefault("dead_letter.dir", filepath.Join(dataDirPath, DeadLetterDirName))
+    viper.SetDefault("attachments.enabled", false)
+    viper.SetDefault("attachments.dir", filepath.Join(dataDirPath, AttachmentsDirName))
+    viper.SetDefault("attachments.retention", DefaultAttachmentRetention.String())
+    viper.SetDefault("attachments.max_size", DefaultAttachmentMaxSize)
+    viper.SetDefault("attachments.http_addr", DefaultAttachmentHTTPAddr)
+    viper.SetDefault("attachments.base_url", "")
+    viper.SetDefault("dedup.enabled", false)
+    viper.SetDefault("dedup.window", DefaultDedupWindow.String())
+    viper.SetDefault("overload.max_pending_deliveries", DefaultMaxPendingDeliveries)
+    viper.SetDefault("access.allow", []string{})
+    viper.SetDefault("access.deny", []string{})
+    viper.SetDefault("dnsbl.enabled", false)
+    viper.SetDefault("dnsbl.zones", []string{DefaultDNSBLZone})
+    viper.SetDefault("dnsbl.action", "reject")
+    viper.SetDefault("dnsbl.timeout", DefaultDNSBLTimeout.String())
+    viper.SetDefault("spf.enabled", false)
+    viper.SetDefault("spf.action", "log")
+    viper.SetDefault("spf.timeout", DefaultSPFTimeout.String())
+    viper.SetDefault("rate_limit.enabled", false)
+    viper.SetDefault("rate_limit.connections_per_minute", DefaultConnectionsPerMinute)
+    viper.SetDefault("rate_limit.messages_per_minute", DefaultMessagesPerMinute)
+    viper.SetDefault("auth_lockout.enabled", true)
+    viper.SetDefault("auth_lockout.max_failures", DefaultAuthLockoutFailures)
+    viper.SetDefault("auth_lockout.max_user_failures", 0)
+    viper.SetDefault("auth_lockout.window", DefaultAuthLockoutWindow.String())
+    viper.SetDefault("auth_lockout.duration", DefaultAuthLockoutDuration.String())
+    viper.SetDefault("auth_tarpit.enabled", true)
+    viper.SetDefault("auth_tarpit.after", DefaultAuthTarpitAfter)
+    viper.SetDefault("auth_tarpit.delay", DefaultAuthTarpitDelay.String())
+    viper.SetDefault("auth_tarpit.max_delay", DefaultAuthTarpitMaxDelay.String())
+    viper.SetDefault("auth_tarpit.window", DefaultAuthLockoutWindow.String())
+    viper.SetDefault("ban.enabled", false)
+    viper.SetDefault("ban.max_violations", DefaultBanMaxViolations)
+    viper.SetDefault("ban.window", DefaultBanWindow.String())
+    viper.SetDefault("ban.duration", DefaultBanDuration.String())
+    viper.SetDefault("http_auth.read_token", "")
+    viper.SetDefault("http_auth.admin_token", "")
     viper.AutomaticEnv()
     viper.SetEnvPrefix("SMTP_TO_GOTIFY")
     viper.SetEnvKeyReplacer(strings.NewReplacer(".", "_"))
     err := viper.ReadInConfig()
     if err != nil {
-        if _, ok := err.(viper.ConfigFileNotFoundError); ok {
+        if _, ok := err.(viper.ConfigFileNotFoundError); ok && containerMode {
+            // Containers are configured through SMTP_TO_GOTIFY_* environment variables
+            err = nil
+        } else if ok {
             err = saveConfig()
             if err != nil {
                 return AppConfig{}, fmt.Errorf("failed to create config file: %v", err)
@@ -702,9 +6813,49 @@ func loadConfig() (AppConfig, error) {
     if err != nil {
         return AppConfig{}, fmt.Errorf("failed to unmarshal config: %v", err)
     }
+    if err := applyCredentials(&config); err != nil {
+        return AppConfig{}, err
+    }
+    // The spam filter address defaults to the usual port of the chosen backend
+    if config.SpamFilter.Address == "" {
+        config.SpamFilter.Address = DefaultRspamdAddress
+        if config.SpamFilter.Backend == "spamd" {
+            config.SpamFilter.Address = DefaultSpamdAddress
+        }
+    }
+    if err := validateSMTPUsers(config.SMTP); err != nil {
+        return AppConfig{}, fmt.Errorf("invalid config: %v", err)
+    }
+    if config.Gotify.FullMessageLink && !config.Attachments.Enabled {
+        return AppConfig{}, fmt.Errorf("invalid config: gotify.full_message_link needs the attachment store, enable attachments.enabled")
+    }
     return config, nil
 }
 
+// applyCredentials overrides secrets with systemd credentials when running under a
+// unit that uses LoadCredential=, so they never have to live in the YAML or environment
+func applyCredentials(config *AppConfig) error {
+    credDir := os.Getenv("CREDENTIALS_DIRECTORY")
+    if credDir == "" {
+        return nil
+    }
+    credentials := map[string]*string{
+        CredentialSMTPPassword: &config.SMTP.SMTPPassword,
+        CredentialGotifyToken:  &config.Gotify.GotifyToken,
+    }
+    for name, target := range credentials {
+        data, err := os.ReadFile(filepath.Join(credDir, name))
+        if err != nil {
+            if os.IsNotExist(err) {
+                continue
+            }
+            return fmt.Errorf("failed to read credential %s: %v", name, err)
+        }
+        *target = strings.TrimRight(string(data), "\r\n")
+    }
+    return nil
+}
+
 // saveConfig saves the current configuration to the YAML file
 func saveConfig() error {
     if err := os.MkdirAll(configDirPath, 0750); err != nil {
@@ -725,10 +6876,30 @@ type StatusUpdateMsg struct{}
 type LogUpdateMsg struct {
     Entry LogEntry
 }
-type LogLoadedMsg struct {
+type DeadLettersLoadedMsg struct {
+    Letters []DeadLetter
+    Err     error
+}
+type ConnectionsLoadedMsg struct {
+    Snapshot SessionSnapshot
+    Err      error
+}
+type LogRelatedMsg struct {
+    Session string
     Entries []LogEntry
     Err     error
 }
+type LogLoadedMsg struct {
+    Page       int
+    Entries    []LogEntry
+    NextOffset int64
+    HasMore    bool
+    Err        error
+}
+type BansLoadedMsg struct {
+    Bans []BanEntry
+    Err  error
+}
 type ServiceCmdMsg struct {
     Output string
     Err    error
@@ -808,10 +6979,19 @@ type AppModel struct {
     ProgramConfigs  list.Model
     SMTPConfigs     list.Model
     GotifyConfigs   list.Model
+    LimitsConfigs   list.Model
     LogViewer       LogViewerModel
+    Bans            BansModel
+    LogDetail       LogDetailModel
+    Connections     ConnectionsModel
+    DeadLetters     DeadLettersModel
     InputModel      InputModel
+    SelectModel     SelectModel
     StatusViewport  viewport.Model
     StatusText      string
+    StatusMode      StatusMode
+    // StatusOffset is the scroll position of the status panel; -1 follows new messages
+    StatusOffset    int
     Quit            bool
     StartServer     bool
     Help            help.Model
@@ -820,35 +7000,130 @@ type AppModel struct {
     Banner          BannerModel
 }
 
-// LogViewerModel for viewing logs with pagination
+// StatusMode is the display state of the status panel
+type StatusMode int
+
+const (
+    StatusNormal StatusMode = iota
+    StatusCompact
+    StatusHidden
+    StatusExpanded
+)
+
+// statusHeight returns the number of status lines shown for the current mode
+func (m AppModel) statusHeight() int {
+    switch m.StatusMode {
+    case StatusCompact:
+        return CompactStatusHeight
+    case StatusHidden:
+        return 0
+    case StatusExpanded:
+        if m.Height/2 > FixedStatusHeight {
+            return m.Height / 2
+        }
+    }
+    return FixedStatusHeight
+}
+
+// scrollStatus moves the status panel by delta lines and resumes following at the bottom
+func (m *AppModel) scrollStatus(delta int) {
+    height := m.statusHeight()
+    maxOffset := strings.Count(m.StatusText, "\n") + 1 - height
+    if maxOffset < 0 {
+        maxOffset = 0
+    }
+    offset := m.StatusOffset
+    if offset < 0 {
+        offset = maxOffset
+    }
+    offset += delta
+    if offset < 0 {
+        offset = 0
+    }
+    if offset >= maxOffset {
+        offset = -1
+    }
+    m.StatusOffset = offset
+}
+
+// LogViewerModel for viewing logs with pagination. Only the current page is held in
+// memory; PageOffsets remembers where each page starts in the log file.
 type LogViewerModel struct {
     Viewport       viewport.Model
     Entries        []LogEntry
     CategoryFilter string
     CurrentPage    int
     PageSize       int
-    TotalPages     int
+    PageOffsets    []int64
+    HasMore        bool
+    Selected       int
+    SelectLast     bool
+    Searching      bool
+    SearchInput    textinput.Model
+    Search         *regexp.Regexp
     Loading        bool
     BackScreen     string
     Width          int
     Height         int
 }
 
+// matcher returns the filter for the current category and search, safe to use from a tea.Cmd
+func (m *LogViewerModel) matcher() func(LogEntry) bool {
+    categoryFilter, search := m.CategoryFilter, m.Search
+    return func(entry LogEntry) bool {
+        if categoryFilter != "all" && !strings.HasPrefix(entry.Category, categoryFilter) {
+            return false
+        }
+        return search == nil || search.MatchString(entry.Message) || search.MatchString(entry.Description) || search.MatchString(entry.Session)
+    }
+}
+
+// compileLogSearch turns the search prompt into a case-insensitive regex; input that
+// is not a valid regex is matched as a plain substring
+func compileLogSearch(text string) *regexp.Regexp {
+    if re, err := regexp.Compile("(?i)" + text); err == nil {
+        return re
+    }
+    return regexp.MustCompile("(?i)" + regexp.QuoteMeta(text))
+}
+
+// highlight marks the search hits in s
+func (m *LogViewerModel) highlight(s string) string {
+    if m.Search == nil {
+        return s
+    }
+    return m.Search.ReplaceAllStringFunc(s, func(hit string) string {
+        return color.New(color.FgBlack, color.BgYellow).Sprint(hit)
+    })
+}
+
 // RenderPage renders the current page of logs in the viewport
 func (m *LogViewerModel) RenderPage() {
+    prompt := ""
+    if m.Searching {
+        prompt = m.SearchInput.View() + "\n\n"
+    } else if m.Search != nil {
+        prompt = color.YellowString("Search: %s (n/N=next/prev hit, esc=clear)", m.SearchInput.Value()) + "\n\n"
+    }
     if len(m.Entries) == 0 {
-        m.Viewport.SetContent(color.YellowString("No logs found for this category."))
+        if m.Search != nil {
+            m.Viewport.SetContent(prompt + color.YellowString("No logs match the search."))
+        } else {
+            m.Viewport.SetContent(prompt + color.YellowString("No logs found for this category."))
+        }
         return
     }
-    start := m.CurrentPage * m.PageSize
-    end := start + m.PageSize
-    if end > len(m.Entries) {
-        end = len(m.Entries)
+    more := ""
+    if m.HasMore {
+        more = "+"
     }
     var content strings.Builder
-    content.WriteString(fmt.Sprintf("Page %d/%d (p/←=prev, n/→=next, r=refresh, esc=back, q=quit)\n\n", m.CurrentPage+1, m.TotalPages))
-    for i := start; i < end; i++ {
-        entry := m.Entries[i]
+    if m.Selected >= len(m.Entries) {
+        m.Selected = len(m.Entries) - 1
+    }
+    content.WriteString(prompt)
+    content.WriteString(fmt.Sprintf("Page %d%s (p/←=prev, n/→=next, enter=details, /=search, y/Y=copy, r=refresh, esc=back, q=quit)\n\n", m.CurrentPage+1, more))
+    for i, entry := range m.Entries {
         var categoryColor string
         switch {
         case strings.HasPrefix(entry.Category, "smtp_auth_failed"):
@@ -866,12 +7141,244 @@ func (m *LogViewerModel) RenderPage() {
         }
         timestamp := color.BlueString(entry.Timestamp)
         cat := fmt.Sprintf("%s%-20s\033[0m", categoryColor, strings.ToUpper(strings.ReplaceAll(entry.Category, "_", " ")))
-        message := entry.Message
+        message := m.highlight(entry.Message)
         desc := entry.Description
         if len(desc) > 100 {
             desc = desc[:100] + "..."
         }
-        content.WriteString(fmt.Sprintf("%d. [%s] | %s | %s\n    Desc: %s\n", i+1, timestamp, cat, message, desc))
+        desc = m.highlight(desc)
+        marker := "  "
+        if i == m.Selected {
+            marker = selectedStyle.Render("> ")
+        }
+        // The session ID groups the entries of one SMTP connection, searchable with /
+        if entry.Session != "" {
+            timestamp += " " + color.CyanString(m.highlight(entry.Session))
+        }
+        content.WriteString(fmt.Sprintf("%s%d. [%s] | %s | %s\n    Desc: %s\n", marker, m.CurrentPage*m.PageSize+i+1, timestamp, cat, message, desc))
+    }
+    m.Viewport.SetContent(content.String())
+    // Keep the selected entry (two lines, after the header lines) in view
+    line := strings.Count(prompt, "\n") + 2 + m.Selected*2
+    if line < m.Viewport.YOffset {
+        m.Viewport.SetYOffset(line)
+    } else if line+2 > m.Viewport.YOffset+m.Viewport.Height {
+        m.Viewport.SetYOffset(line + 2 - m.Viewport.Height)
+    }
+}
+
+// formatLogEntry renders an entry as plain text for the clipboard, or as JSON when asJSON is set
+func formatLogEntry(entry LogEntry, asJSON bool) string {
+    if asJSON {
+        data, err := json.MarshalIndent(entry, "", "  ")
+        if err == nil {
+            return string(data)
+        }
+    }
+    text := fmt.Sprintf("[%s] %s | %s\n%s", entry.Timestamp, strings.ToUpper(strings.ReplaceAll(entry.Category, "_", " ")), entry.Message, entry.Description)
+    if entry.Session != "" {
+        text += fmt.Sprintf("\nSession: %s", entry.Session)
+    }
+    return text
+}
+
+// copyToClipboard sets the terminal clipboard with an OSC 52 escape sequence, which also
+// works over SSH; inside tmux the sequence is passed through to the outer terminal
+func copyToClipboard(text string) {
+    sequence := fmt.Sprintf("\x1b]52;c;%s\x07", base64.StdEncoding.EncodeToString([]byte(text)))
+    if os.Getenv("TMUX") != "" {
+        sequence = fmt.Sprintf("\x1bPtmux;\x1b%s\x1b\\", sequence)
+    }
+    os.Stdout.WriteString(sequence)
+}
+
+// LogDetailModel shows a single log entry in full together with the other
+// entries logged by the same SMTP session
+type LogDetailModel struct {
+    Viewport viewport.Model
+    Entry    LogEntry
+    Related  []LogEntry
+    Loading  bool
+    Err      error
+}
+
+// Render writes the entry details into the viewport
+func (m *LogDetailModel) Render() {
+    var content strings.Builder
+    content.WriteString("Log entry details (↑/↓=scroll, y/Y=copy, esc=back, q=quit)\n\n")
+    field := func(name, value string) {
+        if value == "" {
+            value = "-"
+        }
+        content.WriteString(fmt.Sprintf("%s %s\n", color.CyanString("%-12s", name+":"), value))
+    }
+    field("Timestamp", m.Entry.Timestamp)
+    field("Category", m.Entry.Category)
+    field("Level", m.Entry.Level)
+    field("Caller", m.Entry.Caller)
+    field("Session", m.Entry.Session)
+    field("Message", m.Entry.Message)
+    content.WriteString(color.CyanString("Description:") + "\n")
+    description := m.Entry.Description
+    if m.Viewport.Width > 4 {
+        description = lipgloss.NewStyle().Width(m.Viewport.Width - 4).Render(description)
+    }
+    content.WriteString(description + "\n\n")
+    switch {
+    case m.Entry.Session == "":
+        content.WriteString(color.YellowString("This entry does not belong to an SMTP session.") + "\n")
+    case m.Loading:
+        content.WriteString("Loading related entries...\n")
+    case m.Err != nil:
+        content.WriteString(color.RedString("Failed to load related entries: %v", m.Err) + "\n")
+    default:
+        content.WriteString(color.CyanString("Entries from session %s:", m.Entry.Session) + "\n")
+        for _, entry := range m.Related {
+            line := fmt.Sprintf("  [%s] %s | %s", color.BlueString(entry.Timestamp), strings.ToUpper(strings.ReplaceAll(entry.Category, "_", " ")), entry.Message)
+            if entry.Timestamp == m.Entry.Timestamp && entry.Message == m.Entry.Message {
+                line = selectedStyle.Render(line)
+            }
+            content.WriteString(line + "\n")
+        }
+    }
+    m.Viewport.SetContent(content.String())
+}
+
+// ConnectionsModel lists the live SMTP sessions published by the running server
+type ConnectionsModel struct {
+    Viewport viewport.Model
+    Snapshot SessionSnapshot
+    Selected int
+    Err      error
+}
+
+// Render writes the session table into the viewport
+func (m *ConnectionsModel) Render() {
+    var content strings.Builder
+    content.WriteString("Active SMTP sessions (↑/↓=select, d=disconnect, esc=back, q=quit)\n\n")
+    switch {
+    case m.Err != nil && os.IsNotExist(m.Err):
+        content.WriteString(color.YellowString("No session data found, the service is not running."))
+    case m.Err != nil:
+        content.WriteString(color.RedString("Failed to load sessions: %v", m.Err))
+    case time.Since(m.Snapshot.Updated) > 3*SessionPublishInterval:
+        content.WriteString(color.YellowString("Session data is stale (last update %s), the service may have stopped.", m.Snapshot.Updated.Format("1/2/2006 - 15:04:05")))
+    case len(m.Snapshot.Sessions) == 0:
+        content.WriteString(color.GreenString("No active sessions."))
+    default:
+        if m.Selected >= len(m.Snapshot.Sessions) {
+            m.Selected = len(m.Snapshot.Sessions) - 1
+        }
+        content.WriteString(fmt.Sprintf("  %-12s %-22s %-20s %-10s %-16s %-4s %-9s %10s %10s\n", "SESSION", "REMOTE", "HELO", "STATE", "USER", "TLS", "DURATION", "IN", "OUT"))
+        for i, session := range m.Snapshot.Sessions {
+            user := session.User
+            if user == "" {
+                user = "-"
+            }
+            helo := session.Helo
+            if helo == "" {
+                helo = "-"
+            } else if len(helo) > 20 {
+                helo = helo[:17] + "..."
+            }
+            tlsFlag := "no"
+            if session.TLS {
+                tlsFlag = "yes"
+            }
+            row := fmt.Sprintf("%-12s %-22s %-20s %-10s %-16s %-4s %-9s %10d %10d", session.ID, session.RemoteAddr, helo, session.State, user, tlsFlag, time.Since(session.Started).Round(time.Second), session.BytesIn, session.BytesOut)
+            if i == m.Selected {
+                content.WriteString(selectedStyle.Render("> "+row) + "\n")
+            } else {
+                content.WriteString("  " + row + "\n")
+            }
+        }
+    }
+    m.Viewport.SetContent(content.String())
+}
+
+// DeadLettersModel lists messages whose delivery to Gotify failed
+type DeadLettersModel struct {
+    Viewport viewport.Model
+    Letters  []DeadLetter
+    Selected int
+    Busy     bool
+    Err      error
+}
+
+// Render writes the dead-letter table into the viewport
+func (m *DeadLettersModel) Render() {
+    var content strings.Builder
+    content.WriteString("Dead letters (↑/↓=select, enter=retry, a=retry all, x=delete, esc=back, q=quit)\n\n")
+    switch {
+    case m.Busy:
+        content.WriteString("Working...")
+    case m.Err != nil:
+        content.WriteString(color.RedString("Failed to load dead letters: %v", m.Err))
+    case len(m.Letters) == 0:
+        content.WriteString(color.GreenString("No undelivered messages."))
+        if !viper.GetBool("dead_letter.enabled") {
+            content.WriteString("\n\ndead_letter.enabled is off, messages Gotify does not accept are not kept.")
+        }
+    default:
+        if m.Selected >= len(m.Letters) {
+            m.Selected = len(m.Letters) - 1
+        }
+        for i, letter := range m.Letters {
+            subject := letter.Email.Subject
+            if len(subject) > 40 {
+                subject = subject[:40] + "..."
+            }
+            reason := letter.Reason
+            if len(reason) > 100 {
+                reason = reason[:100] + "..."
+            }
+            marker := "  "
+            if i == m.Selected {
+                marker = selectedStyle.Render("> ")
+            }
+            content.WriteString(fmt.Sprintf("%s%s | %s | age %s | %d attempt(s)\n    Subject: %s\n    Reason: %s\n", marker, color.BlueString(letter.ID), letter.Email.From, time.Since(letter.FirstFailed).Round(time.Second), letter.Attempts, subject, color.RedString(reason)))
+        }
+    }
+    m.Viewport.SetContent(content.String())
+}
+
+// BansModel lists the IPs currently banned for abuse
+type BansModel struct {
+    Viewport viewport.Model
+    Bans     []BanEntry
+    Selected int
+    Busy     bool
+    Err      error
+}
+
+// Render writes the ban table into the viewport
+func (m *BansModel) Render() {
+    var content strings.Builder
+    content.WriteString("Banned IPs (↑/↓=select, enter=lift ban, r=refresh, esc=back, q=quit)\n\n")
+    switch {
+    case m.Busy:
+        content.WriteString("Working...")
+    case m.Err != nil:
+        content.WriteString(color.RedString("Failed to load ban list: %v", m.Err))
+    case len(m.Bans) == 0:
+        content.WriteString(color.GreenString("No IPs are currently banned."))
+    default:
+        if m.Selected >= len(m.Bans) {
+            m.Selected = len(m.Bans) - 1
+        }
+        for i, ban := range m.Bans {
+            reason := ban.Reason
+            if reason == "" {
+                reason = "unknown"
+            } else if len(reason) > 100 {
+                reason = reason[:100] + "..."
+            }
+            marker := "  "
+            if i == m.Selected {
+                marker = selectedStyle.Render("> ")
+            }
+            content.WriteString(fmt.Sprintf("%s%s | until %s (%s left)\n    Reason: %s\n", marker, color.BlueString(ban.IP), ban.Expiry.Format("1/2/2006 - 15:04:05"), time.Until(ban.Expiry).Round(time.Second), color.RedString(reason)))
+        }
     }
     m.Viewport.SetContent(content.String())
 }
@@ -886,17 +7393,128 @@ type InputModel struct {
     SaveAction  bool
 }
 
+// numericField describes the accepted range of a numeric config field edited in the UI
+type numericField struct {
+    Min        int64
+    Max        int64
+    IsDuration bool
+}
+
+// numericFields lists the numeric config fields and their valid ranges
+var numericFields = map[string]numericField{
+    "gotify.priority":              {Min: 0, Max: 10},
+    "gotify.timeout":               {Min: int64(time.Second), Max: int64(5 * time.Minute), IsDuration: true},
+    "gotify.max_retries":           {Min: 1, Max: 10},
+    "gotify.bounce_priority":       {Min: 0, Max: 10},
+    "gotify.max_body_length":       {Min: 100, Max: 64 * 1024},
+    "smtp.session_timeout":         {Min: int64(5 * time.Second), Max: int64(time.Hour), IsDuration: true},
+    "smtp.command_timeout":         {Min: int64(5 * time.Second), Max: int64(time.Hour), IsDuration: true},
+    "smtp.data_timeout":            {Min: int64(5 * time.Second), Max: int64(time.Hour), IsDuration: true},
+    "smtp.idle_timeout":            {Min: 0, Max: int64(time.Hour), IsDuration: true},
+    "smtp.max_message_size":        {Min: 1024, Max: 100 * 1024 * 1024},
+    "smtp.max_sessions":            {Min: 0, Max: 10000},
+    "smtp.max_recipients":          {Min: 0, Max: 10000},
+    "smtp.greeting_delay":          {Min: 0, Max: int64(time.Minute), IsDuration: true},
+    "limits.max_line_length":       {Min: 1000, Max: 1024 * 1024},
+    "limits.max_data_line_length":  {Min: 1000, Max: 64 * 1024 * 1024},
+    "limits.max_command_length":    {Min: 512, Max: 1024 * 1024},
+    "limits.max_header_count":      {Min: 10, Max: 10000},
+    "limits.max_header_bytes":      {Min: 1024, Max: 10 * 1024 * 1024},
+    "limits.line_timeout":          {Min: int64(time.Second), Max: int64(10 * time.Minute), IsDuration: true},
+    "limits.max_bandwidth":         {Min: 0, Max: 1024 * 1024 * 1024},
+    "limits.max_session_bandwidth": {Min: 0, Max: 1024 * 1024 * 1024},
+}
+
+// Hint describes the valid range, e.g. "1-10" or "1s-5m0s"
+func (f numericField) Hint() string {
+    if f.IsDuration {
+        return fmt.Sprintf("duration %v-%v, e.g. 30s or 2m", time.Duration(f.Min), time.Duration(f.Max))
+    }
+    return fmt.Sprintf("whole number %d-%d", f.Min, f.Max)
+}
+
+// Parse validates value against the range and returns it in the form stored in viper
+func (f numericField) Parse(value string) (interface{}, error) {
+    value = strings.TrimSpace(value)
+    if f.IsDuration {
+        d, err := time.ParseDuration(value)
+        if err != nil || int64(d) < f.Min || int64(d) > f.Max {
+            return nil, fmt.Errorf("must be a %s", f.Hint())
+        }
+        return d.String(), nil
+    }
+    n, err := strconv.ParseInt(value, 10, 64)
+    if err != nil || n < f.Min || n > f.Max {
+        return nil, fmt.Errorf("must be a %s", f.Hint())
+    }
+    return n, nil
+}
+
+// SelectModel edits boolean and enum configuration fields by choosing from a fixed list
+type SelectModel struct {
+    FieldName  string
+    Options    []string
+    Selected   int
+    IsBool     bool
+    BackScreen string
+}
+
+// newSelectModel creates a SelectModel with the current value preselected
+func newSelectModel(fieldName string, options []string, current, backScreen string) SelectModel {
+    m := SelectModel{FieldName: fieldName, Options: options, BackScreen: backScreen}
+    for i, option := range options {
+        if option == current {
+            m.Selected = i
+        }
+    }
+    return m
+}
+
+// newToggleModel creates a SelectModel for a boolean field
+func newToggleModel(fieldName, backScreen string) SelectModel {
+    m := newSelectModel(fieldName, []string{"true", "false"}, fmt.Sprint(viper.GetBool(fieldName)), backScreen)
+    m.IsBool = true
+    return m
+}
+
+// View renders the options with the current choice highlighted
+func (m SelectModel) View() string {
+    var content strings.Builder
+    content.WriteString(fmt.Sprintf("Select value for %s:\n\n", strings.Title(strings.ReplaceAll(strings.Split(m.FieldName, ".")[1], "_", " "))))
+    for i, option := range m.Options {
+        if i == m.Selected {
+            content.WriteString(selectedStyle.Render("> "+option) + "\n")
+        } else {
+            content.WriteString("  " + option + "\n")
+        }
+    }
+    hint := "↑/↓ to choose"
+    if m.IsBool {
+        hint = "↑/↓ or space to toggle"
+    }
+    content.WriteString(fmt.Sprintf("\n(%s, Enter to save, Esc to cancel)", hint))
+    return content.String()
+}
+
 // KeyMap defines keybindings for the application
 type KeyMap struct {
-    Up      key.Binding
-    Down    key.Binding
-    Quit    key.Binding
-    Enter   key.Binding
-    Back    key.Binding
-    Help    key.Binding
-    NextPg  key.Binding
-    PrevPg  key.Binding
-    Refresh key.Binding
+    Up           key.Binding
+    Down         key.Binding
+    Quit         key.Binding
+    Enter        key.Binding
+    Back         key.Binding
+    Help         key.Binding
+    NextPg       key.Binding
+    PrevPg       key.Binding
+    Refresh      key.Binding
+    Search       key.Binding
+    Disconnect   key.Binding
+    RetryAll     key.Binding
+    Delete       key.Binding
+    Copy         key.Binding
+    StatusToggle key.Binding
+    StatusUp     key.Binding
+    StatusDown   key.Binding
 }
 
 func (k KeyMap) ShortHelp() []key.Binding {
@@ -906,20 +7524,126 @@ func (k KeyMap) ShortHelp() []key.Binding {
 func (k KeyMap) FullHelp() [][]key.Binding {
     return [][]key.Binding{
         {k.Up, k.Down, k.Enter, k.Back},
-        {k.NextPg, k.PrevPg, k.Refresh, k.Quit, k.Help},
+        {k.NextPg, k.PrevPg, k.Refresh, k.Search, k.Disconnect, k.RetryAll, k.Delete, k.Copy, k.Quit, k.Help},
+        {k.StatusToggle, k.StatusUp, k.StatusDown},
     }
 }
 
 var DefaultKeyMap = KeyMap{
-    Up:      key.NewBinding(key.WithKeys("up", "k"), key.WithHelp("↑/k", "move up")),
-    Down:    key.NewBinding(key.WithKeys("down", "j"), key.WithHelp("↓/j", "move down")),
-    Quit:    key.NewBinding(key.WithKeys("q", "ctrl+c"), key.WithHelp("q/ctrl+c", "quit")),
-    Enter:   key.NewBinding(key.WithKeys("enter"), key.WithHelp("enter", "select")),
-    Back:    key.NewBinding(key.WithKeys("esc"), key.WithHelp("esc", "back")),
-    Help:    key.NewBinding(key.WithKeys("?"), key.WithHelp("?", "toggle help")),
-    NextPg:  key.NewBinding(key.WithKeys("n", "right"), key.WithHelp("n/→", "next page")),
-    PrevPg:  key.NewBinding(key.WithKeys("p", "left"), key.WithHelp("p/←", "prev page")),
-    Refresh: key.NewBinding(key.WithKeys("r"), key.WithHelp("r", "refresh logs")),
+    Up:           key.NewBinding(key.WithKeys("up", "k"), key.WithHelp("↑/k", "move up")),
+    Down:         key.NewBinding(key.WithKeys("down", "j"), key.WithHelp("↓/j", "move down")),
+    Quit:         key.NewBinding(key.WithKeys("q", "ctrl+c"), key.WithHelp("q/ctrl+c", "quit")),
+    Enter:        key.NewBinding(key.WithKeys("enter"), key.WithHelp("enter", "select")),
+    Back:         key.NewBinding(key.WithKeys("esc"), key.WithHelp("esc", "back")),
+    Help:         key.NewBinding(key.WithKeys("?"), key.WithHelp("?", "toggle help")),
+    NextPg:       key.NewBinding(key.WithKeys("n", "right"), key.WithHelp("n/→", "next page")),
+    PrevPg:       key.NewBinding(key.WithKeys("p", "left"), key.WithHelp("p/←", "prev page")),
+    Refresh:      key.NewBinding(key.WithKeys("r"), key.WithHelp("r", "refresh logs")),
+    Search:       key.NewBinding(key.WithKeys("/"), key.WithHelp("/", "search logs")),
+    Disconnect:   key.NewBinding(key.WithKeys("d"), key.WithHelp("d", "disconnect session")),
+    RetryAll:     key.NewBinding(key.WithKeys("a"), key.WithHelp("a", "retry all")),
+    Delete:       key.NewBinding(key.WithKeys("x"), key.WithHelp("x", "delete")),
+    Copy:         key.NewBinding(key.WithKeys("y", "Y"), key.WithHelp("y/Y", "copy entry/JSON")),
+    StatusToggle: key.NewBinding(key.WithKeys("s"), key.WithHelp("s", "status panel size")),
+    StatusUp:     key.NewBinding(key.WithKeys("pgup"), key.WithHelp("pgup", "scroll status up")),
+    StatusDown:   key.NewBinding(key.WithKeys("pgdown"), key.WithHelp("pgdn", "scroll status down")),
+}
+
+// bindings maps the config names of the keybindings to the fields of the KeyMap
+func (k *KeyMap) bindings() map[string]*key.Binding {
+    return map[string]*key.Binding{
+        "up":            &k.Up,
+        "down":          &k.Down,
+        "quit":          &k.Quit,
+        "enter":         &k.Enter,
+        "back":          &k.Back,
+        "help":          &k.Help,
+        "next_page":     &k.NextPg,
+        "prev_page":     &k.PrevPg,
+        "refresh":       &k.Refresh,
+        "search":        &k.Search,
+        "disconnect":    &k.Disconnect,
+        "retry_all":     &k.RetryAll,
+        "delete":        &k.Delete,
+        "copy":          &k.Copy,
+        "status_toggle": &k.StatusToggle,
+        "status_up":     &k.StatusUp,
+        "status_down":   &k.StatusDown,
+    }
+}
+
+// buildKeyMap applies keybinding overrides from the "keys" config section to the
+// default KeyMap. An override is rejected when it names an unknown action or uses a
+// key that is already bound to another action; the returned problems describe why.
+func buildKeyMap(overrides map[string][]string) (KeyMap, []string) {
+    keyMap := DefaultKeyMap
+    bindings := keyMap.bindings()
+    var problems []string
+    overridden := map[string]bool{}
+    names := make([]string, 0, len(overrides))
+    for name := range overrides {
+        names = append(names, name)
+    }
+    sort.Strings(names)
+    for _, name := range names {
+        binding, ok := bindings[name]
+        if !ok {
+            problems = append(problems, fmt.Sprintf("unknown key action %q", name))
+            continue
+        }
+        if len(overrides[name]) == 0 {
+            problems = append(problems, fmt.Sprintf("no keys given for %q", name))
+            continue
+        }
+        binding.SetKeys(overrides[name]...)
+        binding.SetHelp(strings.Join(overrides[name], "/"), binding.Help().Desc)
+        overridden[name] = true
+    }
+    // Revert overrides that clash with another action until no key is bound twice;
+    // the defaults never clash, so this ends once every conflicting override is undone
+    actions := make([]string, 0, len(bindings))
+    for name := range bindings {
+        actions = append(actions, name)
+    }
+    sort.Strings(actions)
+    defaults := DefaultKeyMap.bindings()
+    for {
+        owners := map[string]string{}
+        reverted := ""
+        for _, name := range actions {
+            for _, k := range bindings[name].Keys() {
+                owner, taken := owners[k]
+                if !taken {
+                    owners[k] = name
+                    continue
+                }
+                reverted = name
+                if !overridden[name] {
+                    reverted = owner
+                }
+                problems = append(problems, fmt.Sprintf("key %q is bound to both %q and %q, keeping the default for %q", k, owner, name, reverted))
+                break
+            }
+            if reverted != "" {
+                break
+            }
+        }
+        if reverted == "" {
+            return keyMap, problems
+        }
+        *bindings[reverted] = *defaults[reverted]
+        delete(overridden, reverted)
+    }
+}
+
+// loadKeyMap builds the KeyMap from the config and reports rejected overrides
+func loadKeyMap() KeyMap {
+    keyMap, problems := buildKeyMap(viper.GetStringMapStringSlice("keys"))
+    for _, problem := range problems {
+        appendToStatus(color.YellowString("Keybinding ignored: %s", problem))
+        logEvent("warning", fmt.Sprintf("Keybinding ignored: %s", problem), fmt.Sprintf("A keybinding override in the keys section of %s was not applied: %s", configFilePath, problem))
+    }
+    return keyMap
 }
 
 // Styles for UI rendering
@@ -935,6 +7659,42 @@ var (
     cubeStyle     = lipgloss.NewStyle().Foreground(lipgloss.Color(ColorCubeRed))     // Crimson Red for Cube
 )
 
+// applyPlainStyles strips colors, borders and padding from all UI output for plain mode
+func applyPlainStyles() {
+    color.NoColor = true
+    titleStyle = lipgloss.NewStyle()
+    statusStyle = lipgloss.NewStyle()
+    errorStyle = lipgloss.NewStyle()
+    selectedStyle = lipgloss.NewStyle()
+    bannerStyle = lipgloss.NewStyle()
+    helpStyle = lipgloss.NewStyle()
+    confirmStyle = lipgloss.NewStyle()
+    matrixStyle = lipgloss.NewStyle()
+    cubeStyle = lipgloss.NewStyle()
+}
+
+// plainListView renders a menu as numbered lines with a text marker on the selected item
+func plainListView(l list.Model) string {
+    var content strings.Builder
+    for i, item := range l.Items() {
+        menuItem := item.(MenuItem)
+        marker := "  "
+        if i == l.Index() {
+            marker = "> "
+        }
+        content.WriteString(fmt.Sprintf("%s%d. %s - %s\n", marker, i+1, menuItem.Title(), menuItem.Description()))
+    }
+    return content.String()
+}
+
+// menuView renders a menu list, as plain lines in plain mode
+func menuView(l list.Model) string {
+    if plainMode {
+        return plainListView(l)
+    }
+    return l.View()
+}
+
 // renderBanner renders the animated banner (Matrix + Cube)
 func (m *AppModel) renderBanner() string {
     bm := m.Banner
@@ -1038,6 +7798,10 @@ func (m *AppModel) renderBanner() string {
 
 // Init initializes the AppModel
 func (m AppModel) Init() tea.Cmd {
+    // Plain mode has no banner, so the animation ticker is never started
+    if plainMode {
+        return nil
+    }
     // Initialize random seed for banner animation
     rand.Seed(time.Now().UnixNano())
     // Initialize banner model with dynamic dimensions
@@ -1072,6 +7836,7 @@ func (m AppModel) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
         m.ProgramConfigs.SetSize(m.Width-2, listHeight)
         m.SMTPConfigs.SetSize(m.Width-2, listHeight)
         m.GotifyConfigs.SetSize(m.Width-2, listHeight)
+        m.LimitsConfigs.SetSize(m.Width-2, listHeight)
         m.ServiceMenu.SetSize(m.Width-2, listHeight)
         m.LogViewer.Width = m.Width - 2
         m.LogViewer.Height = listHeight
@@ -1079,6 +7844,14 @@ func (m AppModel) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
         if !m.LogViewer.Loading {
             m.LogViewer.RenderPage()
         }
+        m.Bans.Viewport = viewport.New(m.Width-2, listHeight)
+        m.Bans.Render()
+        m.LogDetail.Viewport = viewport.New(m.Width-2, listHeight)
+        m.LogDetail.Render()
+        m.Connections.Viewport = viewport.New(m.Width-2, listHeight)
+        m.Connections.Render()
+        m.DeadLetters.Viewport = viewport.New(m.Width-2, listHeight)
+        m.DeadLetters.Render()
         // Set status viewport to fixed height regardless of content
         m.StatusViewport = viewport.New(m.Width-2, FixedStatusHeight)
         m.StatusViewport.SetContent(m.StatusText)
@@ -1136,6 +7909,30 @@ func (m AppModel) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
             }
             return m, nil
         }
+        if m.CurrentScreen == "LogViewer" && m.LogViewer.Searching {
+            // The search prompt takes every key, including q
+            switch msg.Type {
+            case tea.KeyEsc:
+                m.LogViewer.Searching = false
+                m.LogViewer.SearchInput.Blur()
+                m.LogViewer.RenderPage()
+                return m, nil
+            case tea.KeyEnter:
+                m.LogViewer.Searching = false
+                m.LogViewer.SearchInput.Blur()
+                if m.LogViewer.SearchInput.Value() == "" {
+                    m.LogViewer.Search = nil
+                } else {
+                    m.LogViewer.Search = compileLogSearch(m.LogViewer.SearchInput.Value())
+                }
+                m.LogViewer.Loading = true
+                m.LogViewer.PageOffsets = []int64{-1}
+                return m, loadLogsCmd(m.LogViewer.matcher(), 0, -1, m.LogViewer.PageSize)
+            }
+            m.LogViewer.SearchInput, cmd = m.LogViewer.SearchInput.Update(msg)
+            m.LogViewer.RenderPage()
+            return m, cmd
+        }
         if key.Matches(msg, m.Keys.Quit) {
             m.QuitConfirm = true
             return m, nil
@@ -1144,6 +7941,22 @@ func (m AppModel) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
             m.Help.ShowAll = !m.Help.ShowAll
             return m, nil
         }
+        // Text input screens need every key, so the status panel keys only apply elsewhere
+        if m.CurrentScreen != "Input" {
+            if key.Matches(msg, m.Keys.StatusToggle) {
+                m.StatusMode = (m.StatusMode + 1) % (StatusExpanded + 1)
+                m.StatusOffset = -1
+                return m, nil
+            }
+            if key.Matches(msg, m.Keys.StatusUp) && m.StatusMode != StatusHidden {
+                m.scrollStatus(-m.statusHeight())
+                return m, nil
+            }
+            if key.Matches(msg, m.Keys.StatusDown) && m.StatusMode != StatusHidden {
+                m.scrollStatus(m.statusHeight())
+                return m, nil
+            }
+        }
         switch m.CurrentScreen {
         case "MainMenu":
             if key.Matches(msg, m.Keys.Enter) {
@@ -1161,23 +7974,23 @@ func (m AppModel) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
                         go func() {
                             if err := saveConfig(); err != nil {
                                 appendToStatus(color.RedString("Failed to save config: %v", err))
+                                auditEvent("config_save", auditResult(err))
                                 return
                             }
+                            auditEvent("config_save", auditResult(nil))
                             appendToStatus("Stopping smtp-to-gotify service...")
-                            // Changed to use SystemD systemctl command
-                            stopCmd := exec.Command("systemctl", "stop", "smtp-to-gotify")
-                            stopOutput, stopErr := stopCmd.CombinedOutput()
+                            stopOutput, stopErr := serviceControl("stop")
+                            auditEvent("service_stop", auditResult(stopErr))
                             if stopErr != nil {
-                                appendToStatus(color.RedString("Failed to stop service: %v, output: %s", stopErr, string(stopOutput)))
+                                appendToStatus(color.RedString("Failed to stop service: %v, output: %s", stopErr, stopOutput))
                                 return
                             }
                             appendToStatus(color.GreenString("Service stopped successfully"))
                             appendToStatus("Starting smtp-to-gotify service with updated config...")
-                            // Changed to use SystemD systemctl command
-                            startCmd := exec.Command("systemctl", "start", "smtp-to-gotify")
-                            startOutput, startErr := startCmd.CombinedOutput()
+                            startOutput, startErr := serviceControl("start")
+                            auditEvent("service_start", auditResult(startErr))
                             if startErr != nil {
-                                appendToStatus(color.RedString("Failed to start service: %v, output: %s", startErr, string(startOutput)))
+                                appendToStatus(color.RedString("Failed to start service: %v, output: %s", startErr, startOutput))
                                 return
                             }
                             appendToStatus(color.GreenString("Service started successfully with updated config"))
@@ -1205,39 +8018,42 @@ func (m AppModel) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
                             CategoryFilter: "smtp_auth",
                             PageSize:       20,
                             CurrentPage:    0,
+                            PageOffsets:    []int64{-1},
                             Loading:        true,
                             BackScreen:     "Logging",
                             Width:          m.Width - 2,
                             Height:         m.Height - 10,
                         }
                         m.CurrentScreen = "LogViewer"
-                        return m, loadLogsCmd(m.LogViewer.CategoryFilter)
+                        return m, loadLogsCmd(m.LogViewer.matcher(), 0, -1, m.LogViewer.PageSize)
                     case "Gotify Logs":
                         m.LogViewer = LogViewerModel{
                             Viewport:       viewport.New(m.Width-2, m.Height-10),
                             CategoryFilter: "gotify",
                             PageSize:       20,
                             CurrentPage:    0,
+                            PageOffsets:    []int64{-1},
                             Loading:        true,
                             BackScreen:     "Logging",
                             Width:          m.Width - 2,
                             Height:         m.Height - 10,
                         }
                         m.CurrentScreen = "LogViewer"
-                        return m, loadLogsCmd(m.LogViewer.CategoryFilter)
+                        return m, loadLogsCmd(m.LogViewer.matcher(), 0, -1, m.LogViewer.PageSize)
                     case "All Logs":
                         m.LogViewer = LogViewerModel{
                             Viewport:       viewport.New(m.Width-2, m.Height-10),
                             CategoryFilter: "all",
                             PageSize:       20,
                             CurrentPage:    0,
+                            PageOffsets:    []int64{-1},
                             Loading:        true,
                             BackScreen:     "Logging",
                             Width:          m.Width - 2,
                             Height:         m.Height - 10,
                         }
                         m.CurrentScreen = "LogViewer"
-                        return m, loadLogsCmd(m.LogViewer.CategoryFilter)
+                        return m, loadLogsCmd(m.LogViewer.matcher(), 0, -1, m.LogViewer.PageSize)
                     }
                 }
             } else if key.Matches(msg, m.Keys.Back) {
@@ -1255,6 +8071,8 @@ func (m AppModel) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
                         m.CurrentScreen = "SMTPConfigs"
                     case "Gotify Configs":
                         m.CurrentScreen = "GotifyConfigs"
+                    case "Limits Configs":
+                        m.CurrentScreen = "LimitsConfigs"
                     case "Back to Main Menu":
                         m.CurrentScreen = "MainMenu"
                     }
@@ -1272,13 +8090,40 @@ func (m AppModel) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
                     switch item.Title() {
                     case "Back to Program Configs":
                         m.CurrentScreen = "ProgramConfigs"
+                    case "Auth Required":
+                        m.SelectModel = newToggleModel("smtp.auth_required", "SMTPConfigs")
+                        m.CurrentScreen = "Select"
+                    case "Require TLS for Auth":
+                        m.SelectModel = newToggleModel("smtp.require_tls_for_auth", "SMTPConfigs")
+                        m.CurrentScreen = "Select"
+                    case "Strict HELO":
+                        m.SelectModel = newToggleModel("smtp.strict_helo", "SMTPConfigs")
+                        m.CurrentScreen = "Select"
+                    case "Strict Sequence":
+                        m.SelectModel = newToggleModel("smtp.strict_sequence", "SMTPConfigs")
+                        m.CurrentScreen = "Select"
+                    case "Debug Trace":
+                        m.SelectModel = newToggleModel("smtp.debug_trace", "SMTPConfigs")
+                        m.CurrentScreen = "Select"
+                    case "Null Sender":
+                        m.SelectModel = newSelectModel("smtp.null_sender", []string{"accept", "reject"}, viper.GetString("smtp.null_sender"), "SMTPConfigs")
+                        m.CurrentScreen = "Select"
                     default:
                         fieldName := strings.ToLower(strings.ReplaceAll(item.Title(), " ", "_"))
                         configField := map[string]string{
-                            "smtp_domain":   "smtp.domain",
-                            "smtp_port":     "smtp.addr",
-                            "smtp_username": "smtp.smtp_username",
-                            "smtp_password": "smtp.smtp_password",
+                            "smtp_domain":      "smtp.domain",
+                            "smtp_port":        "smtp.addr",
+                            "smtp_username":    "smtp.smtp_username",
+                            "smtp_password":    "smtp.smtp_password",
+                            "session_timeout":  "smtp.session_timeout",
+                            "command_timeout":  "smtp.command_timeout",
+                            "data_timeout":     "smtp.data_timeout",
+                            "idle_timeout":     "smtp.idle_timeout",
+                            "max_message_size": "smtp.max_message_size",
+                            "max_sessions":     "smtp.max_sessions",
+                            "max_recipients":   "smtp.max_recipients",
+                            "banner":           "smtp.banner",
+                            "greeting_delay":   "smtp.greeting_delay",
                         }[fieldName]
                         if configField == "" {
                             appendToStatus(color.RedString("Unknown field: %s", fieldName))
@@ -1313,11 +8158,65 @@ func (m AppModel) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
                     switch item.Title() {
                     case "Back to Program Configs":
                         m.CurrentScreen = "ProgramConfigs"
+                    case "Markdown":
+                        m.SelectModel = newToggleModel("gotify.markdown", "GotifyConfigs")
+                        m.CurrentScreen = "Select"
+                    case "Full Message Link":
+                        m.SelectModel = newToggleModel("gotify.full_message_link", "GotifyConfigs")
+                        m.CurrentScreen = "Select"
+                    case "Click URL From Body":
+                        m.SelectModel = newToggleModel("gotify.click_from_body", "GotifyConfigs")
+                        m.CurrentScreen = "Select"
+                    case "Strip Quotes":
+                        m.SelectModel = newToggleModel("gotify.strip_quotes", "GotifyConfigs")
+                        m.CurrentScreen = "Select"
+                    case "JSON Body":
+                        m.SelectModel = newSelectModel("gotify.json_body", []string{"none", "pretty", "fields"}, viper.GetString("gotify.json_body"), "GotifyConfigs")
+                        m.CurrentScreen = "Select"
+                    case "Extract Fields":
+                        m.SelectModel = newToggleModel("gotify.extract_fields", "GotifyConfigs")
+                        m.CurrentScreen = "Select"
+                    case "Sanitize":
+                        m.SelectModel = newSelectModel("gotify.sanitize", []string{"none", "strip", "escape"}, viper.GetString("gotify.sanitize"), "GotifyConfigs")
+                        m.CurrentScreen = "Select"
+                    case "Body Preference":
+                        m.SelectModel = newSelectModel("gotify.body_preference", []string{"plain", "html", "plain_fallback"}, viper.GetString("gotify.body_preference"), "GotifyConfigs")
+                        m.CurrentScreen = "Select"
+                    case "Show Headers":
+                        m.SelectModel = newSelectModel("gotify.show_headers", []string{"none", "body", "extras"}, viper.GetString("gotify.show_headers"), "GotifyConfigs")
+                        m.CurrentScreen = "Select"
+                    case "Truncate At":
+                        m.SelectModel = newSelectModel("gotify.truncate_at", []string{"char", "word", "line"}, viper.GetString("gotify.truncate_at"), "GotifyConfigs")
+                        m.CurrentScreen = "Select"
+                    case "Send Test Notification":
+                        gotifyConfig := gotifyConfigFromViper()
+                        appendToStatus(fmt.Sprintf("Sending test notification to %s...", gotifyConfig.GotifyHost))
+                        go func() {
+                            result, err := sendTestNotification(gotifyConfig)
+                            if err != nil {
+                                appendToStatus(color.RedString("Test notification failed: %v", err))
+                                logEvent("gotify_failed", fmt.Sprintf("Test notification to %s failed: %v", gotifyConfig.GotifyHost, err), fmt.Sprintf("Sending a test notification from the configuration UI to Gotify at %s failed: %v", gotifyConfig.GotifyHost, err))
+                                return
+                            }
+                            appendToStatus(color.GreenString("Test notification delivered: %s", result))
+                            logEvent("gotify_success", fmt.Sprintf("Test notification delivered to %s", gotifyConfig.GotifyHost), fmt.Sprintf("A test notification from the configuration UI was accepted by Gotify at %s: %s", gotifyConfig.GotifyHost, result))
+                        }()
                     default:
                         fieldName := strings.ToLower(strings.ReplaceAll(item.Title(), " ", "_"))
                         configField := map[string]string{
-                            "gotify_host":  "gotify.gotify_host",
-                            "gotify_token": "gotify.gotify_token",
+                            "gotify_host":        "gotify.gotify_host",
+                            "gotify_token":       "gotify.gotify_token",
+                            "gotify_priority":    "gotify.priority",
+                            "gotify_timeout":     "gotify.timeout",
+                            "gotify_max_retries": "gotify.max_retries",
+                            "bounce_label":       "gotify.bounce_label",
+                            "bounce_priority":    "gotify.bounce_priority",
+                            "max_body_length":    "gotify.max_body_length",
+                            "truncate_suffix":    "gotify.truncate_suffix",
+                            "title_template":     "gotify.title_template",
+                            "message_template":   "gotify.message_template",
+                            "click_url_pattern":  "gotify.click_pattern",
+                            "click_url":          "gotify.click_url",
                         }[fieldName]
                         if configField == "" {
                             appendToStatus(color.RedString("Unknown field: %s", fieldName))
@@ -1342,7 +8241,36 @@ func (m AppModel) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
             } else if key.Matches(msg, m.Keys.Back) {
                 m.CurrentScreen = "ProgramConfigs"
             } else {
-                m.GotifyConfigs, cmd = m.GotifyConfigs.Update(msg)
+                m.GotifyConfigs, cmd = m.GotifyConfigs.Update(msg)
+            }
+        case "LimitsConfigs":
+            if key.Matches(msg, m.Keys.Enter) {
+                selected := m.LimitsConfigs.SelectedItem()
+                if selected != nil {
+                    item := selected.(MenuItem)
+                    switch item.Title() {
+                    case "Back to Program Configs":
+                        m.CurrentScreen = "ProgramConfigs"
+                    default:
+                        configField := "limits." + strings.ToLower(strings.ReplaceAll(item.Title(), " ", "_"))
+                        if _, ok := numericFields[configField]; !ok {
+                            appendToStatus(color.RedString("Unknown field: %s", configField))
+                            break
+                        }
+                        m.InputModel = InputModel{
+                            TextInput:  textinput.New(),
+                            FieldName:  configField,
+                            BackScreen: "LimitsConfigs",
+                        }
+                        m.InputModel.TextInput.SetValue(viper.GetString(configField))
+                        m.InputModel.TextInput.Focus()
+                        m.CurrentScreen = "Input"
+                    }
+                }
+            } else if key.Matches(msg, m.Keys.Back) {
+                m.CurrentScreen = "ProgramConfigs"
+            } else {
+                m.LimitsConfigs, cmd = m.LimitsConfigs.Update(msg)
             }
         case "ServiceMenu":
             if key.Matches(msg, m.Keys.Enter) {
@@ -1355,13 +8283,12 @@ func (m AppModel) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
                     case "Stop Service":
                         go func() {
                             appendToStatus("Stopping smtp-to-gotify service...")
-                            // Changed to use SystemD systemctl command
-                            cmd := exec.Command("systemctl", "stop", "smtp-to-gotify")
-                            output, err := cmd.CombinedOutput()
+                            output, err := serviceControl("stop")
+                            auditEvent("service_stop", auditResult(err))
                             // Recommendation 10: Improved error handling for service commands
                             if err != nil {
-                                appendToStatus(color.RedString("Failed to stop service: %v, output: %s", err, string(output)))
-                                logEvent("error", fmt.Sprintf("Failed to stop service: %v", err), fmt.Sprintf("systemctl stop command failed with output: %s", string(output)))
+                                appendToStatus(color.RedString("Failed to stop service: %v, output: %s", err, output))
+                                logEvent("error", fmt.Sprintf("Failed to stop service: %v", err), fmt.Sprintf("%s stop command failed with output: %s", detectInitSystem(), output))
                             } else {
                                 appendToStatus(color.GreenString("Service stopped successfully"))
                             }
@@ -1369,47 +8296,107 @@ func (m AppModel) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
                     case "Start Service":
                         go func() {
                             appendToStatus("Starting smtp-to-gotify service...")
-                            // Changed to use SystemD systemctl command
-                            cmd := exec.Command("systemctl", "start", "smtp-to-gotify")
-                            output, err := cmd.CombinedOutput()
+                            output, err := serviceControl("start")
+                            auditEvent("service_start", auditResult(err))
                             // Recommendation 10: Improved error handling for service commands
                             if err != nil {
-                                appendToStatus(color.RedString("Failed to start service: %v, output: %s", err, string(output)))
-                                logEvent("error", fmt.Sprintf("Failed to start service: %v", err), fmt.Sprintf("systemctl start command failed with output: %s", string(output)))
+                                appendToStatus(color.RedString("Failed to start service: %v, output: %s", err, output))
+                                logEvent("error", fmt.Sprintf("Failed to start service: %v", err), fmt.Sprintf("%s start command failed with output: %s", detectInitSystem(), output))
                             } else {
                                 appendToStatus(color.GreenString("Service started successfully"))
                             }
                         }()
+                    case "Apply Config and Reload Service":
+                        go func() {
+                            if err := saveConfig(); err != nil {
+                                appendToStatus(color.RedString("Failed to save config: %v", err))
+                                auditEvent("config_save", auditResult(err))
+                                return
+                            }
+                            auditEvent("config_save", auditResult(nil))
+                            appendToStatus("Reloading smtp-to-gotify configuration...")
+                            output, err := serviceControl("reload")
+                            auditEvent("service_reload", auditResult(err))
+                            if err != nil {
+                                appendToStatus(color.RedString("Failed to reload service: %v, output: %s", err, output))
+                                logEvent("error", fmt.Sprintf("Failed to reload service: %v", err), fmt.Sprintf("%s reload command failed with output: %s", detectInitSystem(), output))
+                            } else {
+                                appendToStatus(color.GreenString("Service configuration reloaded, new sessions use the saved settings"))
+                            }
+                        }()
                     case "Apply Config and Restart Service":
                         go func() {
                             if err := saveConfig(); err != nil {
                                 appendToStatus(color.RedString("Failed to save config: %v", err))
+                                auditEvent("config_save", auditResult(err))
                                 return
                             }
+                            auditEvent("config_save", auditResult(nil))
                             appendToStatus("Restarting smtp-to-gotify service...")
-                            // Changed to use SystemD systemctl command
-                            cmd := exec.Command("systemctl", "restart", "smtp-to-gotify")
-                            output, err := cmd.CombinedOutput()
+                            output, err := serviceControl("restart")
+                            auditEvent("service_restart", auditResult(err))
                             // Recommendation 10: Improved error handling for service commands
                             if err != nil {
-                                appendToStatus(color.RedString("Failed to restart service: %v, output: %s", err, string(output)))
-                                logEvent("error", fmt.Sprintf("Failed to restart service: %v", err), fmt.Sprintf("systemctl restart command failed with output: %s", string(output)))
+                                appendToStatus(color.RedString("Failed to restart service: %v, output: %s", err, output))
+                                logEvent("error", fmt.Sprintf("Failed to restart service: %v", err), fmt.Sprintf("%s restart command failed with output: %s", detectInitSystem(), output))
                             } else {
                                 appendToStatus(color.GreenString("Service restarted successfully"))
                             }
                         }()
+                    case "Dead Letters":
+                        m.DeadLetters = DeadLettersModel{Viewport: viewport.New(m.Width-2, m.Height-10), Busy: true}
+                        m.DeadLetters.Render()
+                        m.CurrentScreen = "DeadLetters"
+                        return m, deadLettersCmd("", nil)
+                    case "Active Connections":
+                        m.Connections = ConnectionsModel{Viewport: viewport.New(m.Width-2, m.Height-10)}
+                        m.Connections.Render()
+                        m.CurrentScreen = "Connections"
+                        return m, loadConnectionsCmd(0)
+                    case "Send Test Email":
+                        smtpConfig := SMTPConfig{
+                            Addr:              viper.GetString("smtp.addr"),
+                            Domain:            viper.GetString("smtp.domain"),
+                            SMTPUsername:      viper.GetString("smtp.smtp_username"),
+                            SMTPPassword:      viper.GetString("smtp.smtp_password"),
+                            AuthRequired:      viper.GetBool("smtp.auth_required"),
+                            RequireTLSForAuth: viper.GetBool("smtp.require_tls_for_auth"),
+                        }
+                        appendToStatus(fmt.Sprintf("Sending test email through %s...", smtpConfig.Addr))
+                        go func() {
+                            if err := sendTestEmail(smtpConfig, appendToStatus); err != nil {
+                                appendToStatus(color.RedString("Test email failed: %v", err))
+                                logEvent("error", fmt.Sprintf("Loopback test email failed: %v", err), fmt.Sprintf("The end-to-end test email submitted from the configuration UI through %s failed: %v", smtpConfig.Addr, err))
+                                return
+                            }
+                            appendToStatus(color.GreenString("Test email delivered end-to-end"))
+                        }()
+                    case "View IP Bans":
+                        m.Bans = BansModel{Viewport: viewport.New(m.Width-2, m.Height-10), Busy: true}
+                        m.Bans.Render()
+                        m.CurrentScreen = "Bans"
+                        return m, bansCmd("")
+                    case "Clear IP Bans":
+                        go func() {
+                            err := saveBanStore(banListPath, BanStore{Bans: map[string]time.Time{}, Reasons: map[string]string{}})
+                            auditEvent("ban_list_clear", auditResult(err))
+                            if err != nil {
+                                appendToStatus(color.RedString("Failed to clear ban list: %v", err))
+                                return
+                            }
+                            appendToStatus(color.GreenString("All IP bans cleared"))
+                            logEvent("ip_banned", "IP ban list cleared", "All temporary IP bans were cleared from the interactive UI.")
+                        }()
                     case "Service Status":
                         go func() {
                             appendToStatus("Fetching smtp-to-gotify service status...")
-                            // Changed to use SystemD systemctl command
-                            cmd := exec.Command("systemctl", "status", "smtp-to-gotify")
-                            output, err := cmd.CombinedOutput()
+                            output, err := serviceControl("status")
                             // Recommendation 10: Improved error handling for service commands
                             if err != nil {
                                 appendToStatus(color.RedString("Failed to fetch service status: %v", err))
-                                logEvent("error", fmt.Sprintf("Failed to fetch service status: %v", err), fmt.Sprintf("systemctl status command failed with output: %s", string(output)))
+                                logEvent("error", fmt.Sprintf("Failed to fetch service status: %v", err), fmt.Sprintf("%s status command failed with output: %s", detectInitSystem(), output))
                             } else {
-                                outStr := string(output)
+                                outStr := output
                                 if len(outStr) > 500 {
                                     outStr = outStr[:500] + "... (truncated)"
                                 }
@@ -1423,26 +8410,209 @@ func (m AppModel) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
             } else {
                 m.ServiceMenu, cmd = m.ServiceMenu.Update(msg)
             }
-        case "LogViewer":
+        case "Bans":
             if key.Matches(msg, m.Keys.Back) {
+                m.CurrentScreen = "ServiceMenu"
+            } else if key.Matches(msg, m.Keys.Up) {
+                if m.Bans.Selected > 0 {
+                    m.Bans.Selected--
+                    m.Bans.Render()
+                }
+            } else if key.Matches(msg, m.Keys.Down) {
+                if m.Bans.Selected < len(m.Bans.Bans)-1 {
+                    m.Bans.Selected++
+                    m.Bans.Render()
+                }
+            } else if !m.Bans.Busy && key.Matches(msg, m.Keys.Refresh) {
+                m.Bans.Busy = true
+                m.Bans.Render()
+                return m, bansCmd("")
+            } else if !m.Bans.Busy && key.Matches(msg, m.Keys.Enter) && len(m.Bans.Bans) > 0 {
+                m.Bans.Busy = true
+                m.Bans.Render()
+                return m, bansCmd(m.Bans.Bans[m.Bans.Selected].IP)
+            }
+        case "LogViewer":
+            if key.Matches(msg, m.Keys.Back) && m.LogViewer.Search != nil {
+                m.LogViewer.Search = nil
+                m.LogViewer.SearchInput.SetValue("")
+                m.LogViewer.Loading = true
+                m.LogViewer.PageOffsets = []int64{-1}
+                return m, loadLogsCmd(m.LogViewer.matcher(), 0, -1, m.LogViewer.PageSize)
+            } else if key.Matches(msg, m.Keys.Back) {
                 m.CurrentScreen = m.LogViewer.BackScreen
+            } else if key.Matches(msg, m.Keys.Search) {
+                previous := m.LogViewer.SearchInput.Value()
+                m.LogViewer.Searching = true
+                m.LogViewer.SearchInput = textinput.New()
+                m.LogViewer.SearchInput.Prompt = "/"
+                m.LogViewer.SearchInput.Placeholder = "text or regex"
+                m.LogViewer.SearchInput.SetValue(previous)
+                m.LogViewer.SearchInput.Focus()
+                m.LogViewer.RenderPage()
+                return m, textinput.Blink
+            } else if m.LogViewer.Search != nil && (msg.String() == "n" || msg.String() == "N") {
+                // With an active search every listed entry is a hit, so step through them across pages
+                if msg.String() == "n" {
+                    if m.LogViewer.Selected < len(m.LogViewer.Entries)-1 {
+                        m.LogViewer.Selected++
+                        m.LogViewer.RenderPage()
+                    } else if m.LogViewer.HasMore && !m.LogViewer.Loading {
+                        page := m.LogViewer.CurrentPage + 1
+                        m.LogViewer.Loading = true
+                        return m, loadLogsCmd(m.LogViewer.matcher(), page, m.LogViewer.PageOffsets[page], m.LogViewer.PageSize)
+                    }
+                } else {
+                    if m.LogViewer.Selected > 0 {
+                        m.LogViewer.Selected--
+                        m.LogViewer.RenderPage()
+                    } else if m.LogViewer.CurrentPage > 0 && !m.LogViewer.Loading {
+                        page := m.LogViewer.CurrentPage - 1
+                        m.LogViewer.Loading = true
+                        m.LogViewer.SelectLast = true
+                        return m, loadLogsCmd(m.LogViewer.matcher(), page, m.LogViewer.PageOffsets[page], m.LogViewer.PageSize)
+                    }
+                }
             } else if key.Matches(msg, m.Keys.PrevPg) {
-                if m.LogViewer.CurrentPage > 0 {
-                    m.LogViewer.CurrentPage--
-                    m.LogViewer.RenderPage()
+                if m.LogViewer.CurrentPage > 0 && !m.LogViewer.Loading {
+                    page := m.LogViewer.CurrentPage - 1
+                    m.LogViewer.Loading = true
+                    return m, loadLogsCmd(m.LogViewer.matcher(), page, m.LogViewer.PageOffsets[page], m.LogViewer.PageSize)
                 }
             } else if key.Matches(msg, m.Keys.NextPg) {
-                if m.LogViewer.CurrentPage < m.LogViewer.TotalPages-1 {
-                    m.LogViewer.CurrentPage++
-                    m.LogViewer.RenderPage()
+                if m.LogViewer.HasMore && !m.LogViewer.Loading {
+                    page := m.LogViewer.CurrentPage + 1
+                    m.LogViewer.Loading = true
+                    return m, loadLogsCmd(m.LogViewer.matcher(), page, m.LogViewer.PageOffsets[page], m.LogViewer.PageSize)
                 }
             } else if key.Matches(msg, m.Keys.Refresh) {
                 m.LogViewer.Loading = true
-                return m, loadLogsCmd(m.LogViewer.CategoryFilter)
+                m.LogViewer.PageOffsets = []int64{-1}
+                return m, loadLogsCmd(m.LogViewer.matcher(), 0, -1, m.LogViewer.PageSize)
+            } else if key.Matches(msg, m.Keys.Up) {
+                if m.LogViewer.Selected > 0 {
+                    m.LogViewer.Selected--
+                    m.LogViewer.RenderPage()
+                }
+            } else if key.Matches(msg, m.Keys.Down) {
+                if m.LogViewer.Selected < len(m.LogViewer.Entries)-1 {
+                    m.LogViewer.Selected++
+                    m.LogViewer.RenderPage()
+                }
+            } else if key.Matches(msg, m.Keys.Copy) {
+                if !m.LogViewer.Loading && m.LogViewer.Selected < len(m.LogViewer.Entries) {
+                    copyToClipboard(formatLogEntry(m.LogViewer.Entries[m.LogViewer.Selected], msg.String() == "Y"))
+                    appendToStatus("Copied log entry to clipboard")
+                }
+            } else if key.Matches(msg, m.Keys.Enter) {
+                if !m.LogViewer.Loading && m.LogViewer.Selected < len(m.LogViewer.Entries) {
+                    entry := m.LogViewer.Entries[m.LogViewer.Selected]
+                    m.LogDetail = LogDetailModel{
+                        Viewport: viewport.New(m.LogViewer.Width, m.LogViewer.Height),
+                        Entry:    entry,
+                        Loading:  entry.Session != "",
+                    }
+                    m.LogDetail.Render()
+                    m.CurrentScreen = "LogDetail"
+                    if entry.Session != "" {
+                        return m, loadRelatedLogsCmd(entry.Session)
+                    }
+                }
+            }
+        case "DeadLetters":
+            if key.Matches(msg, m.Keys.Back) {
+                m.CurrentScreen = "ServiceMenu"
+            } else if key.Matches(msg, m.Keys.Up) {
+                if m.DeadLetters.Selected > 0 {
+                    m.DeadLetters.Selected--
+                    m.DeadLetters.Render()
+                }
+            } else if key.Matches(msg, m.Keys.Down) {
+                if m.DeadLetters.Selected < len(m.DeadLetters.Letters)-1 {
+                    m.DeadLetters.Selected++
+                    m.DeadLetters.Render()
+                }
+            } else if !m.DeadLetters.Busy && len(m.DeadLetters.Letters) > 0 {
+                var action string
+                var letters []DeadLetter
+                switch {
+                case key.Matches(msg, m.Keys.Enter):
+                    action, letters = "retry", []DeadLetter{m.DeadLetters.Letters[m.DeadLetters.Selected]}
+                case key.Matches(msg, m.Keys.RetryAll):
+                    action, letters = "retry", m.DeadLetters.Letters
+                case key.Matches(msg, m.Keys.Delete):
+                    action, letters = "delete", []DeadLetter{m.DeadLetters.Letters[m.DeadLetters.Selected]}
+                }
+                if action != "" {
+                    m.DeadLetters.Busy = true
+                    m.DeadLetters.Render()
+                    return m, deadLettersCmd(action, letters)
+                }
+            }
+        case "Connections":
+            if key.Matches(msg, m.Keys.Back) {
+                m.CurrentScreen = "ServiceMenu"
+            } else if key.Matches(msg, m.Keys.Up) {
+                if m.Connections.Selected > 0 {
+                    m.Connections.Selected--
+                    m.Connections.Render()
+                }
+            } else if key.Matches(msg, m.Keys.Down) {
+                if m.Connections.Selected < len(m.Connections.Snapshot.Sessions)-1 {
+                    m.Connections.Selected++
+                    m.Connections.Render()
+                }
+            } else if key.Matches(msg, m.Keys.Disconnect) {
+                if m.Connections.Err == nil && m.Connections.Selected < len(m.Connections.Snapshot.Sessions) {
+                    session := m.Connections.Snapshot.Sessions[m.Connections.Selected]
+                    err := requestDisconnect(session.ID)
+                    auditEvent("session_disconnect", fmt.Sprintf("%s (%s) %s", session.ID, session.RemoteAddr, auditResult(err)))
+                    if err != nil {
+                        appendToStatus(color.RedString("Failed to disconnect %s: %v", session.RemoteAddr, err))
+                    } else {
+                        appendToStatus(color.YellowString("Requested disconnect of session %s from %s", session.ID, session.RemoteAddr))
+                    }
+                }
+            }
+        case "LogDetail":
+            if key.Matches(msg, m.Keys.Copy) {
+                copyToClipboard(formatLogEntry(m.LogDetail.Entry, msg.String() == "Y"))
+                appendToStatus("Copied log entry to clipboard")
+            } else if key.Matches(msg, m.Keys.Back) {
+                m.CurrentScreen = "LogViewer"
+            } else if key.Matches(msg, m.Keys.Up) {
+                m.LogDetail.Viewport.LineUp(1)
+            } else if key.Matches(msg, m.Keys.Down) {
+                m.LogDetail.Viewport.LineDown(1)
+            }
+        case "Select":
+            if key.Matches(msg, m.Keys.Back) {
+                m.CurrentScreen = m.SelectModel.BackScreen
             } else if key.Matches(msg, m.Keys.Up) {
-                m.LogViewer.Viewport.LineUp(1)
+                if m.SelectModel.Selected > 0 {
+                    m.SelectModel.Selected--
+                } else if m.SelectModel.IsBool {
+                    m.SelectModel.Selected = 1
+                }
             } else if key.Matches(msg, m.Keys.Down) {
-                m.LogViewer.Viewport.LineDown(1)
+                if m.SelectModel.Selected < len(m.SelectModel.Options)-1 {
+                    m.SelectModel.Selected++
+                } else if m.SelectModel.IsBool {
+                    m.SelectModel.Selected = 0
+                }
+            } else if msg.String() == " " && m.SelectModel.IsBool {
+                m.SelectModel.Selected = 1 - m.SelectModel.Selected
+            } else if key.Matches(msg, m.Keys.Enter) {
+                value := m.SelectModel.Options[m.SelectModel.Selected]
+                oldValue := viper.GetString(m.SelectModel.FieldName)
+                if m.SelectModel.IsBool {
+                    viper.Set(m.SelectModel.FieldName, value == "true")
+                } else {
+                    viper.Set(m.SelectModel.FieldName, value)
+                }
+                auditConfigChange(m.SelectModel.FieldName, oldValue, value)
+                appendToStatus(color.GreenString("Updated %s to %s", strings.Title(strings.ReplaceAll(strings.Split(m.SelectModel.FieldName, ".")[1], "_", " ")), value))
+                m.CurrentScreen = m.SelectModel.BackScreen
             }
         case "Input":
             m.InputModel.TextInput, cmd = m.InputModel.TextInput.Update(msg)
@@ -1451,6 +8621,7 @@ func (m AppModel) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
             } else if key.Matches(msg, m.Keys.Enter) {
                 m.InputModel.SaveAction = true
                 value := m.InputModel.TextInput.Value()
+                oldValue := viper.GetString(m.InputModel.FieldName)
                 // Recommendation 3: Enhanced input validation for configuration fields
                 if m.InputModel.FieldName == "smtp.addr" {
                     if !strings.HasPrefix(value, ":") && !strings.Contains(value, ":") {
@@ -1488,9 +8659,17 @@ func (m AppModel) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
                         return m, nil
                     }
                     viper.Set(m.InputModel.FieldName, value)
+                } else if spec, ok := numericFields[m.InputModel.FieldName]; ok {
+                    parsed, err := spec.Parse(value)
+                    if err != nil {
+                        m.InputModel.ErrorMsg = fmt.Sprintf("Invalid value, %v", err)
+                        return m, nil
+                    }
+                    viper.Set(m.InputModel.FieldName, parsed)
                 } else {
                     viper.Set(m.InputModel.FieldName, value)
                 }
+                auditConfigChange(m.InputModel.FieldName, oldValue, value)
                 appendToStatus(color.GreenString("Updated %s successfully", strings.Title(strings.ReplaceAll(strings.Split(m.InputModel.FieldName, ".")[1], "_", " "))))
                 m.CurrentScreen = m.InputModel.BackScreen
             }
@@ -1504,15 +8683,21 @@ func (m AppModel) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
         m.StatusViewport.GotoBottom()
     case LogUpdateMsg:
         if m.CurrentScreen == "LogViewer" {
-            if m.LogViewer.CategoryFilter == "all" || strings.HasPrefix(msg.Entry.Category, m.LogViewer.CategoryFilter) {
-                m.LogViewer.Entries = append(m.LogViewer.Entries, msg.Entry)
-                m.LogViewer.TotalPages = (len(m.LogViewer.Entries) + m.LogViewer.PageSize - 1) / m.LogViewer.PageSize
-                if m.LogViewer.TotalPages == 0 {
-                    m.LogViewer.TotalPages = 1
+            // New entries only belong on the first (newest) page; older pages are
+            // addressed by file offset and are unaffected
+            if m.LogViewer.CurrentPage == 0 && !m.LogViewer.Loading && m.LogViewer.matcher()(msg.Entry) {
+                m.LogViewer.Entries = append([]LogEntry{msg.Entry}, m.LogViewer.Entries...)
+                if len(m.LogViewer.Entries) > 1 {
+                    m.LogViewer.Selected++
                 }
                 m.LogViewer.RenderPage()
             }
         }
+    case BansLoadedMsg:
+        m.Bans.Busy = false
+        m.Bans.Bans = msg.Bans
+        m.Bans.Err = msg.Err
+        m.Bans.Render()
     case LogLoadedMsg:
         if msg.Err != nil {
             m.LogViewer.Loading = false
@@ -1520,21 +8705,58 @@ func (m AppModel) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
             appendToStatus(fmt.Sprintf("Debug: Log load error in UI: %v", msg.Err))
             return m, nil
         }
+        m.LogViewer.Loading = false
+        if msg.Page > 0 && len(msg.Entries) == 0 {
+            // The remaining lines did not match the filter, stay on the current page
+            m.LogViewer.HasMore = false
+            m.LogViewer.SelectLast = false
+            m.LogViewer.RenderPage()
+            return m, nil
+        }
         m.LogViewer.Entries = msg.Entries
-        m.LogViewer.TotalPages = (len(msg.Entries) + m.LogViewer.PageSize - 1) / m.LogViewer.PageSize
-        if m.LogViewer.TotalPages == 0 {
-            m.LogViewer.TotalPages = 1
+        m.LogViewer.Selected = 0
+        if m.LogViewer.SelectLast {
+            m.LogViewer.Selected = len(msg.Entries) - 1
+            m.LogViewer.SelectLast = false
         }
-        m.LogViewer.Loading = false
-        appendToStatus(fmt.Sprintf("Debug: Loaded %d log entries into UI, total pages: %d", len(msg.Entries), m.LogViewer.TotalPages))
+        m.LogViewer.CurrentPage = msg.Page
+        m.LogViewer.HasMore = msg.HasMore
+        m.LogViewer.PageOffsets = m.LogViewer.PageOffsets[:msg.Page+1]
+        if msg.HasMore {
+            m.LogViewer.PageOffsets = append(m.LogViewer.PageOffsets, msg.NextOffset)
+        }
+        appendToStatus(fmt.Sprintf("Debug: Loaded %d log entries into UI for page %d", len(msg.Entries), msg.Page+1))
+        m.LogViewer.Viewport.GotoTop()
         m.LogViewer.RenderPage()
+    case DeadLettersLoadedMsg:
+        m.DeadLetters.Busy = false
+        m.DeadLetters.Letters = msg.Letters
+        m.DeadLetters.Err = msg.Err
+        m.DeadLetters.Render()
+    case ConnectionsLoadedMsg:
+        if m.CurrentScreen == "Connections" {
+            m.Connections.Snapshot = msg.Snapshot
+            m.Connections.Err = msg.Err
+            m.Connections.Render()
+            // Keep refreshing while the screen is open
+            return m, loadConnectionsCmd(SessionPublishInterval)
+        }
+    case LogRelatedMsg:
+        if msg.Session == m.LogDetail.Entry.Session {
+            m.LogDetail.Loading = false
+            m.LogDetail.Related = msg.Entries
+            m.LogDetail.Err = msg.Err
+            m.LogDetail.Render()
+        }
     }
     return m, cmd
 }
 
 // View renders the UI
 func (m AppModel) View() string {
-    var content string
+    if plainMode {
+        return m.plainView()
+    }
     // Calculate help text height with a minimum to ensure it's always visible
     helpText := m.Help.View(m.Keys)
     helpHeight := strings.Count(helpText, "\n") + 1
@@ -1550,13 +8772,23 @@ func (m AppModel) View() string {
     // Calculate title height
     title := titleStyle.Render(fmt.Sprintf("SMTP to Gotify Forwarder - %s", m.CurrentScreen))
     titleHeight := 1
-    // Use fixed status height to prevent expansion
-    statusHeight := FixedStatusHeight
-    // Ensure status viewport maintains fixed dimensions
-    m.StatusViewport = viewport.New(m.Width-2, statusHeight)
-    m.StatusViewport.SetContent(m.StatusText)
-    m.StatusViewport.GotoBottom()
-    status := statusStyle.Width(m.Width - 2).Height(statusHeight).Render("Status:\n" + m.StatusViewport.View())
+    // The status panel height depends on its mode and does not grow with its content
+    statusHeight := m.statusHeight()
+    status := ""
+    if m.StatusMode != StatusHidden {
+        m.StatusViewport = viewport.New(m.Width-2, statusHeight)
+        m.StatusViewport.SetContent(m.StatusText)
+        if m.StatusOffset < 0 {
+            m.StatusViewport.GotoBottom()
+        } else {
+            m.StatusViewport.SetYOffset(m.StatusOffset)
+        }
+        label := "Status:"
+        if m.StatusOffset >= 0 {
+            label = "Status (scrolled, pgdn to follow):"
+        }
+        status = statusStyle.Width(m.Width - 2).Height(statusHeight).Render(label + "\n" + m.StatusViewport.View())
+    }
     if m.QuitConfirm {
         confirmMsg := confirmStyle.Width(m.Width - 2).Render("Are you sure you want to quit? (y/N)")
         confirmHeight := strings.Count(confirmMsg, "\n") + 2
@@ -1571,61 +8803,189 @@ func (m AppModel) View() string {
         mainContent := lipgloss.NewStyle().Width(m.Width-2).Height(availableHeight).Foreground(lipgloss.Color(ColorWhite)).Render("")
         return lipgloss.JoinVertical(lipgloss.Top, banner, title, mainContent, confirmMsg, status, helpText)
     }
+    content := m.screenContent()
+    availableHeight := m.Height - bannerHeight - titleHeight - statusHeight - helpHeight
+    if availableHeight < 3 {
+        availableHeight = 3
+    }
+    // Ensure main content area fully overwrites previous content with default foreground
+    mainContent := lipgloss.NewStyle().Width(m.Width-2).Height(availableHeight).Foreground(lipgloss.Color(ColorWhite)).Render(content)
+    return lipgloss.JoinVertical(lipgloss.Top, banner, title, mainContent, status, helpText)
+}
+
+// plainView renders the UI as unstyled lines without banner, borders or fixed-height panels
+func (m AppModel) plainView() string {
+    var b strings.Builder
+    b.WriteString(fmt.Sprintf("SMTP to Gotify Forwarder - %s\n\n", m.CurrentScreen))
+    if m.QuitConfirm {
+        b.WriteString("Are you sure you want to quit? (y/N)\n")
+        return b.String()
+    }
+    b.WriteString(strings.TrimRight(m.screenContent(), "\n") + "\n")
+    if m.StatusMode != StatusHidden {
+        status := viewport.New(m.Width, m.statusHeight())
+        status.SetContent(m.StatusText)
+        label := "Status:"
+        if m.StatusOffset < 0 {
+            status.GotoBottom()
+        } else {
+            status.SetYOffset(m.StatusOffset)
+            label = "Status (scrolled, pgdn to follow):"
+        }
+        b.WriteString("\n" + label + "\n" + strings.TrimRight(status.View(), "\n") + "\n")
+    }
+    b.WriteString("\n" + m.Help.View(m.Keys))
+    return b.String()
+}
+
+// screenContent renders the body of the current screen
+func (m AppModel) screenContent() string {
+    var content string
     switch m.CurrentScreen {
     case "MainMenu":
-        content = m.MainMenu.View()
+        content = menuView(m.MainMenu)
     case "Logging":
-        content = m.LoggingMenu.View()
+        content = menuView(m.LoggingMenu)
     case "ProgramConfigs":
-        content = m.ProgramConfigs.View()
+        content = menuView(m.ProgramConfigs)
     case "SMTPConfigs":
-        content = m.SMTPConfigs.View()
+        content = menuView(m.SMTPConfigs)
     case "GotifyConfigs":
-        content = m.GotifyConfigs.View()
+        content = menuView(m.GotifyConfigs)
+    case "LimitsConfigs":
+        content = menuView(m.LimitsConfigs)
     case "ServiceMenu":
-        content = m.ServiceMenu.View()
+        content = menuView(m.ServiceMenu)
     case "LogViewer":
         if m.LogViewer.Loading {
             content = "Loading logs...\n\n" + m.LogViewer.Viewport.View()
         } else {
             content = m.LogViewer.Viewport.View()
         }
+    case "LogDetail":
+        content = m.LogDetail.Viewport.View()
+    case "Connections":
+        content = m.Connections.Viewport.View()
+    case "DeadLetters":
+        content = m.DeadLetters.Viewport.View()
+    case "Select":
+        content = m.SelectModel.View()
+    case "Bans":
+        content = m.Bans.Viewport.View()
     case "Input":
         content = fmt.Sprintf("Enter value for %s:\n\n%s\n", strings.Title(strings.ReplaceAll(strings.Split(m.InputModel.FieldName, ".")[1], "_", " ")), m.InputModel.TextInput.View())
+        if spec, ok := numericFields[m.InputModel.FieldName]; ok {
+            content += helpStyle.Render(fmt.Sprintf("Range: %s", spec.Hint())) + "\n"
+        }
         if m.InputModel.ErrorMsg != "" {
             content += errorStyle.Render(m.InputModel.ErrorMsg) + "\n"
         }
         content += "\n(Enter to save, Esc to cancel)"
     }
-    availableHeight := m.Height - bannerHeight - titleHeight - statusHeight - helpHeight
-    if availableHeight < 3 {
-        availableHeight = 3
+    return content
+}
+
+// bansCmd lifts the ban of the given IP, if any, and then reloads the ban list; the
+// running server picks the change up from the file
+func bansCmd(lift string) tea.Cmd {
+    return func() tea.Msg {
+        store, err := loadBanStore(banListPath)
+        if err != nil {
+            return BansLoadedMsg{Err: err}
+        }
+        if lift != "" {
+            delete(store.Bans, lift)
+            delete(store.Reasons, lift)
+            err = saveBanStore(banListPath, store)
+            auditEvent("ban_lift", fmt.Sprintf("%s %s", lift, auditResult(err)))
+            if err != nil {
+                appendToStatus(color.RedString("Failed to lift the ban of %s: %v", lift, err))
+            } else {
+                appendToStatus(color.GreenString("Ban of %s lifted", lift))
+                logEvent("ip_banned", fmt.Sprintf("Ban of %s lifted", lift), fmt.Sprintf("The temporary ban of client IP %s was lifted from the interactive UI.", lift))
+            }
+        }
+        return BansLoadedMsg{Bans: store.Active(time.Now())}
     }
-    // Ensure main content area fully overwrites previous content with default foreground
-    mainContent := lipgloss.NewStyle().Width(m.Width-2).Height(availableHeight).Foreground(lipgloss.Color(ColorWhite)).Render(content)
-    return lipgloss.JoinVertical(lipgloss.Top, banner, title, mainContent, status, helpText)
 }
 
-// loadLogsCmd loads logs asynchronously
-func loadLogsCmd(categoryFilter string) tea.Cmd {
+// loadLogsCmd loads a single page of logs asynchronously, starting at the given file offset
+func loadLogsCmd(match func(LogEntry) bool, page int, offset int64, pageSize int) tea.Cmd {
     return func() tea.Msg {
-        store, err := loadLogs()
+        result, err := readLogPage(match, offset, pageSize)
         if err != nil {
             appendToStatus(fmt.Sprintf("Debug: Failed to load logs in loadLogsCmd: %v", err))
             return LogLoadedMsg{Err: err}
         }
-        filtered := []LogEntry{}
-        for _, entry := range store.Entries {
-            if categoryFilter == "all" || strings.HasPrefix(entry.Category, categoryFilter) {
-                filtered = append(filtered, entry)
+        return LogLoadedMsg{Page: page, Entries: result.Entries, NextOffset: result.NextOffset, HasMore: result.HasMore}
+    }
+}
+
+// deadLettersCmd retries or deletes the given dead letters (action "retry" or "delete")
+// and then reloads the list; an empty action only reloads
+func deadLettersCmd(action string, letters []DeadLetter) tea.Cmd {
+    dir := viper.GetString("dead_letter.dir")
+    gotifyConfig := gotifyConfigFromViper()
+    patternErr := compileClickPattern(&gotifyConfig)
+    users := smtpUsersFromViper()
+    return func() tea.Msg {
+        for _, letter := range letters {
+            var err error
+            switch action {
+            case "retry":
+                err = patternErr
+                if err == nil {
+                    err = retryDeadLetter(dir, gotifyForUser(gotifyConfig, users, letter.User), letter)
+                }
+                if err == nil {
+                    appendToStatus(color.GreenString("Dead letter %s delivered", letter.ID))
+                    logEvent("gotify_success", fmt.Sprintf("Dead letter %s delivered on retry", letter.ID), fmt.Sprintf("The email from %s with subject '%s' was delivered to Gotify after %d failed attempt(s).", letter.Email.From, letter.Email.Subject, letter.Attempts))
+                } else {
+                    appendToStatus(color.RedString("Retry of dead letter %s failed: %v", letter.ID, err))
+                }
+            case "delete":
+                err = deleteDeadLetter(dir, letter.ID)
+                if err == nil {
+                    appendToStatus(color.YellowString("Dead letter %s deleted", letter.ID))
+                } else {
+                    appendToStatus(color.RedString("Failed to delete dead letter %s: %v", letter.ID, err))
+                }
             }
+            auditEvent("dead_letter_"+action, fmt.Sprintf("%s %s", letter.ID, auditResult(err)))
+        }
+        remaining, err := listDeadLetters(dir)
+        return DeadLettersLoadedMsg{Letters: remaining, Err: err}
+    }
+}
+
+// loadConnectionsCmd reads the published session list after the given delay
+func loadConnectionsCmd(delay time.Duration) tea.Cmd {
+    load := func() tea.Msg {
+        snapshot, err := loadSessionSnapshot()
+        return ConnectionsLoadedMsg{Snapshot: snapshot, Err: err}
+    }
+    if delay <= 0 {
+        return load
+    }
+    return tea.Tick(delay, func(time.Time) tea.Msg {
+        return load()
+    })
+}
+
+// loadRelatedLogsCmd loads the most recent entries of an SMTP session, oldest first
+func loadRelatedLogsCmd(session string) tea.Cmd {
+    return func() tea.Msg {
+        result, err := readLogPage(func(entry LogEntry) bool {
+            return entry.Session == session
+        }, -1, MaxRelatedLogEntries)
+        if err != nil {
+            return LogRelatedMsg{Session: session, Err: err}
         }
-        appendToStatus(fmt.Sprintf("Debug: Filtered %d logs for category '%s' out of %d total entries", len(filtered), categoryFilter, len(store.Entries)))
-        // Reverse to show newest first
-        for i, j := 0, len(filtered)-1; i < j; i, j = i+1, j-1 {
-            filtered[i], filtered[j] = filtered[j], filtered[i]
+        entries := result.Entries
+        for i, j := 0, len(entries)-1; i < j; i, j = i+1, j-1 {
+            entries[i], entries[j] = entries[j], entries[i]
         }
-        return LogLoadedMsg{Entries: filtered}
+        return LogRelatedMsg{Session: session, Entries: entries}
     }
 }
 
@@ -1672,6 +9032,7 @@ func NewAppModel() AppModel {
     programItems := []list.Item{
         MenuItem{title: "SMTP Configs", description: "Configure SMTP server settings"},
         MenuItem{title: "Gotify Configs", description: "Configure Gotify notification settings"},
+        MenuItem{title: "Limits Configs", description: "Configure protocol size and time limits"},
         MenuItem{title: "Back to Main Menu", description: "Return to main menu"},
     }
     programItems = sortMenuItems(programItems)
@@ -1680,67 +9041,545 @@ func NewAppModel() AppModel {
         MenuItem{title: "SMTP Port", description: "Set SMTP port (e.g., :2525)"},
         MenuItem{title: "SMTP Username", description: "Set SMTP username for client authentication"},
         MenuItem{title: "SMTP Password", description: "Set SMTP password for client authentication"},
+        MenuItem{title: "Auth Required", description: "Require clients to authenticate before sending"},
+        MenuItem{title: "Require TLS for Auth", description: "Reject AUTH with 538 until the session uses STARTTLS"},
+        MenuItem{title: "Strict HELO", description: "Reject HELO/EHLO without a valid hostname argument"},
+        MenuItem{title: "Strict Sequence", description: "Reject MAIL with 503 until the client sent HELO/EHLO"},
+        MenuItem{title: "Null Sender", description: "Accept or reject MAIL FROM:<> used by bounces"},
+        MenuItem{title: "Debug Trace", description: "Log every SMTP command and reply (credentials redacted)"},
+        MenuItem{title: "Session Timeout", description: "Maximum duration of one SMTP session (e.g., 30m)"},
+        MenuItem{title: "Command Timeout", description: "Wait for the next command, reset on every command (e.g., 5m)"},
+        MenuItem{title: "Data Timeout", description: "Wait for each block of message data (e.g., 3m)"},
+        MenuItem{title: "Idle Timeout", description: "Close with 421 after no bytes for this long (0s = off)"},
+        MenuItem{title: "Max Message Size", description: "Largest accepted message in bytes, advertised via SIZE"},
+        MenuItem{title: "Max Sessions", description: "Simultaneous SMTP sessions before 421 (0 = unlimited)"},
+        MenuItem{title: "Max Recipients", description: "RCPT TO per message before 452 (0 = unlimited)"},
+        MenuItem{title: "Banner", description: "Text after the domain in the 220 greeting"},
+        MenuItem{title: "Greeting Delay", description: "Hold the banner back and drop early talkers (0s = off)"},
         MenuItem{title: "Back to Program Configs", description: "Return to program configs"},
     }
     smtpItems = sortMenuItems(smtpItems)
     gotifyItems := []list.Item{
         MenuItem{title: "Gotify Host", description: "Set Gotify host (e.g., https://gotify.example.com)"},
         MenuItem{title: "Gotify Token", description: "Set Gotify API token"},
+        MenuItem{title: "Gotify Priority", description: "Priority of forwarded notifications (0-10)"},
+        MenuItem{title: "Gotify Timeout", description: "HTTP timeout per delivery attempt (e.g., 10s)"},
+        MenuItem{title: "Gotify Max Retries", description: "Delivery attempts before giving up (1-10)"},
+        MenuItem{title: "Bounce Label", description: "Title prefix for bounces and delivery reports"},
+        MenuItem{title: "Bounce Priority", description: "Priority of bounce notifications (0-10)"},
+        MenuItem{title: "Max Body Length", description: "Characters of the email body shown in a notification"},
+        MenuItem{title: "Truncate Suffix", description: "Text appended to a shortened body"},
+        MenuItem{title: "Truncate At", description: "Shorten the body mid-word, at a word or at a line break"},
+        MenuItem{title: "Full Message Link", description: "Link the whole text of shortened bodies (needs the attachment store)"},
+        MenuItem{title: "Markdown", description: "Send notifications as Markdown with links, bold and lists"},
+        MenuItem{title: "Show Headers", description: "Add Date, Reply-To and Message-ID to the body or extras"},
+        MenuItem{title: "Strip Quotes", description: "Cut quoted replies and signatures from the body"},
+        MenuItem{title: "Body Preference", description: "Show the plain text or HTML version of an email"},
+        MenuItem{title: "Sanitize", description: "Strip or escape control characters and escape sequences"},
+        MenuItem{title: "Extract Fields", description: "Parse \"Field: value\" lines for use in the templates"},
+        MenuItem{title: "JSON Body", description: "Indent JSON bodies or show only the gotify.json_fields paths"},
+        MenuItem{title: "Click URL", description: "URL opened when the notification is tapped, may use {{.Subject}} etc."},
+        MenuItem{title: "Click URL From Body", description: "Open the first link of the email when the notification is tapped"},
+        MenuItem{title: "Click URL Pattern", description: "Regex finding the link instead, its first group is the URL"},
+        MenuItem{title: "Title Template", description: "Notification title, e.g. {{.Subject}} or {{index .Fields \"Host\"}}"},
+        MenuItem{title: "Message Template", description: "Notification text, e.g. {{.Body}}; empty keeps the default"},
+        MenuItem{title: "Send Test Notification", description: "Push a test message using the current host and token"},
         MenuItem{title: "Back to Program Configs", description: "Return to program configs"},
     }
-    gotifyItems = sortMenuItems(gotifyItems)
-    serviceItems := []list.Item{
-        MenuItem{title: "Stop Service", description: "Stop the SMTP-to-Gotify service"},
-        MenuItem{title: "Start Service", description: "Start the SMTP-to-Gotify service"},
-        MenuItem{title: "Apply Config and Restart Service", description: "Save config and restart service"},
-        MenuItem{title: "Service Status", description: "View current service status"},
-        MenuItem{title: "Back to Main Menu", description: "Return to main menu"},
+    gotifyItems = sortMenuItems(gotifyItems)
+    limitsItems := []list.Item{
+        MenuItem{title: "Max Line Length", description: "Longest accepted SMTP line in bytes"},
+        MenuItem{title: "Max Command Length", description: "Longest accepted SMTP command in bytes (RFC minimum 512)"},
+        MenuItem{title: "Max Header Count", description: "Maximum number of header lines per message"},
+        MenuItem{title: "Max Header Bytes", description: "Maximum total header size in bytes"},
+        MenuItem{title: "Line Timeout", description: "Time allowed to finish one line (e.g., 10s)"},
+        MenuItem{title: "Max Bandwidth", description: "Bytes per second for all message transfers together (0 = unlimited)"},
+        MenuItem{title: "Max Session Bandwidth", description: "Bytes per second for one message transfer (0 = unlimited)"},
+        MenuItem{title: "Back to Program Configs", description: "Return to program configs"},
+    }
+    limitsItems = sortMenuItems(limitsItems)
+    serviceItems := []list.Item{
+        MenuItem{title: "Stop Service", description: "Stop the SMTP-to-Gotify service"},
+        MenuItem{title: "Start Service", description: "Start the SMTP-to-Gotify service"},
+        MenuItem{title: "Apply Config and Restart Service", description: "Save config and restart service"},
+        MenuItem{title: "Apply Config and Reload Service", description: "Save config and apply it to new sessions without a restart"},
+        MenuItem{title: "Service Status", description: "View current service status"},
+        MenuItem{title: "View IP Bans", description: "List banned IPs with reason and expiry, and lift bans"},
+        MenuItem{title: "Clear IP Bans", description: "Lift all temporary IP bans"},
+        MenuItem{title: "Send Test Email", description: "Submit an email through the local SMTP listener end-to-end"},
+        MenuItem{title: "Active Connections", description: "List live SMTP sessions and disconnect them"},
+        MenuItem{title: "Dead Letters", description: "Retry or delete messages Gotify did not accept"},
+        MenuItem{title: "Back to Main Menu", description: "Return to main menu"},
+    }
+    serviceItems = sortMenuItems(serviceItems)
+    defaultWidth, defaultHeight := 80, 24
+    model := AppModel{
+        CurrentScreen:  "MainMenu",
+        Width:          defaultWidth,
+        Height:         defaultHeight,
+        MainMenu:       list.New(mainItems, list.NewDefaultDelegate(), defaultWidth-2, defaultHeight-10),
+        LoggingMenu:    list.New(loggingItems, list.NewDefaultDelegate(), defaultWidth-2, defaultHeight-10),
+        ProgramConfigs: list.New(programItems, list.NewDefaultDelegate(), defaultWidth-2, defaultHeight-10),
+        SMTPConfigs:    list.New(smtpItems, list.NewDefaultDelegate(), defaultWidth-2, defaultHeight-10),
+        GotifyConfigs:  list.New(gotifyItems, list.NewDefaultDelegate(), defaultWidth-2, defaultHeight-10),
+        LimitsConfigs:  list.New(limitsItems, list.NewDefaultDelegate(), defaultWidth-2, defaultHeight-10),
+        ServiceMenu:    list.New(serviceItems, list.NewDefaultDelegate(), defaultWidth-2, defaultHeight-10),
+        LogViewer:      LogViewerModel{Viewport: viewport.New(defaultWidth-2, defaultHeight-10), PageSize: 20, Width: defaultWidth - 2, Height: defaultHeight - 10},
+        StatusViewport: viewport.New(defaultWidth-2, FixedStatusHeight),
+        StatusText:     "Status Panel: SMTP server events will appear here.",
+        StatusOffset:   -1,
+        Help:           help.New(),
+        Keys:           loadKeyMap(),
+        Banner:         newBannerModel(defaultWidth/2, defaultHeight/3),
+    }
+    if plainMode {
+        // Filter input would be invisible in the plain menu rendering
+        for _, menu := range []*list.Model{&model.MainMenu, &model.LoggingMenu, &model.ProgramConfigs, &model.SMTPConfigs, &model.GotifyConfigs, &model.LimitsConfigs, &model.ServiceMenu} {
+            menu.SetFilteringEnabled(false)
+        }
+        model.Help.ShortSeparator = " | "
+        model.Help.Ellipsis = "..."
+        model.Help.Styles = help.Styles{}
+    }
+    return model
+}
+
+// interactiveConfig runs the BubbleTea UI
+func interactiveConfig() error {
+    model := NewAppModel()
+    var options []tea.ProgramOption
+    if !plainMode {
+        options = append(options, tea.WithAltScreen())
+    }
+    p := tea.NewProgram(model, options...)
+    initStatusUpdater(p)
+    finalModel, err := p.Run()
+    if err != nil {
+        return fmt.Errorf("failed to run bubbletea app: %v", err)
+    }
+    // Free the port for the foreground server started after the UI exits
+    stopEmbeddedServer()
+    appModel := finalModel.(AppModel)
+    if appModel.Quit && !appModel.StartServer {
+        os.Exit(0)
+    }
+    return nil
+}
+
+// windowsProgram adapts the SMTP server to the Windows service manager
+type windowsProgram struct {
+    config AppConfig
+}
+
+// Start is called by the service manager and must not block
+func (p *windowsProgram) Start(s service.Service) error {
+    go func() {
+        if err := startServer(p.config); err != nil {
+            logEvent("error", fmt.Sprintf("Failed to start SMTP server: %v", err), fmt.Sprintf("SMTP server failed to start under the Windows service manager: %v", err))
+            os.Exit(1)
+        }
+    }()
+    return nil
+}
+
+// Stop is called by the service manager and shuts the server down gracefully
+func (p *windowsProgram) Stop(s service.Service) error {
+    logEvent("connection", "Received service stop request, closing listener...", "The Windows service manager requested a stop, initiating graceful shutdown of the SMTP server.")
+    if stopServer != nil {
+        stopServer()
+    }
+    return nil
+}
+
+// newWindowsService creates the service handle used to run and control STG on Windows
+func newWindowsService(config AppConfig) (service.Service, error) {
+    svcConfig := &service.Config{
+        Name:        WindowsServiceName,
+        DisplayName: "SMTP to Gotify Forwarder",
+        Description: "A local SMTP server that forwards emails to Gotify",
+        Arguments:   []string{"start", "--config-dir", configDirPath},
+    }
+    return service.New(&windowsProgram{config: config}, svcConfig)
+}
+
+// runningAsWindowsService reports whether the process was started by the Windows service manager
+func runningAsWindowsService() bool {
+    return runtime.GOOS == "windows" && !service.Interactive()
+}
+
+// serviceControl runs a service manager action ("start", "stop", "restart", "reload" or "status")
+// and returns its output
+func serviceControl(action string) (string, error) {
+    if detectInitSystem() == "windows" {
+        s, err := newWindowsService(AppConfig{})
+        if err != nil {
+            return "", err
+        }
+        if action == "status" {
+            status, err := s.Status()
+            if err != nil {
+                return "", err
+            }
+            switch status {
+            case service.StatusRunning:
+                return "smtp-to-gotify is running", nil
+            case service.StatusStopped:
+                return "smtp-to-gotify is stopped", nil
+            default:
+                return "smtp-to-gotify status is unknown", nil
+            }
+        }
+        return "", service.Control(s, action)
+    }
+    initSystem := detectInitSystem()
+    if initSystem == "none" {
+        return embeddedServiceControl(action)
+    }
+    cmd, err := initServiceCommand(initSystem, action)
+    if err != nil {
+        return "", err
+    }
+    output, err := cmd.CombinedOutput()
+    return string(output), err
+}
+
+// embeddedServiceControl supervises the SMTP server as a goroutine of the current process,
+// so Service Management works on hosts without an init system (plain Docker, dev machines)
+func embeddedServiceControl(action string) (string, error) {
+    switch action {
+    case "start":
+        return startEmbeddedServer()
+    case "stop":
+        return stopEmbeddedServer()
+    case "restart":
+        if _, err := stopEmbeddedServer(); err != nil {
+            return "", err
+        }
+        return startEmbeddedServer()
+    case "reload":
+        embeddedMutex.Lock()
+        running := embeddedRunning
+        embeddedMutex.Unlock()
+        if !running {
+            return "", fmt.Errorf("embedded server is not running")
+        }
+        if err := reloadConfig(); err != nil {
+            return "", err
+        }
+        return "embedded server configuration reloaded", nil
+    default:
+        embeddedMutex.Lock()
+        defer embeddedMutex.Unlock()
+        if embeddedRunning {
+            return "smtp-to-gotify is running inside this process (no init system detected)", nil
+        }
+        return "smtp-to-gotify is stopped (no init system detected)", nil
+    }
+}
+
+// startEmbeddedServer loads the saved config and runs the server in a goroutine
+func startEmbeddedServer() (string, error) {
+    embeddedMutex.Lock()
+    defer embeddedMutex.Unlock()
+    if embeddedRunning {
+        return "", fmt.Errorf("embedded server is already running")
+    }
+    config, err := loadConfig()
+    if err != nil {
+        return "", err
+    }
+    done := make(chan error, 1)
+    go func() {
+        done <- startServer(config)
+        embeddedMutex.Lock()
+        embeddedRunning = false
+        embeddedMutex.Unlock()
+    }()
+    // Listener errors (e.g. port in use) surface immediately
+    select {
+    case err := <-done:
+        return "", err
+    case <-time.After(500 * time.Millisecond):
+    }
+    embeddedRunning = true
+    embeddedDone = done
+    return fmt.Sprintf("Embedded SMTP server listening on %s", config.SMTP.Addr), nil
+}
+
+// stopEmbeddedServer shuts the embedded server down gracefully
+func stopEmbeddedServer() (string, error) {
+    embeddedMutex.Lock()
+    running, done := embeddedRunning, embeddedDone
+    embeddedMutex.Unlock()
+    if !running {
+        return "embedded server is not running", nil
+    }
+    if stopServer != nil {
+        stopServer()
+    }
+    <-done
+    return "embedded server stopped", nil
+}
+
+// detectInitSystem returns the service manager supervising smtp-to-gotify: "windows",
+// "launchd", "systemd", "openrc", "rc" (FreeBSD/pfSense), "runit" or "none". The service.manager
+// config key overrides detection.
+func detectInitSystem() string {
+    if manager := viper.GetString("service.manager"); manager != "" && manager != "auto" {
+        return manager
+    }
+    switch runtime.GOOS {
+    case "windows":
+        return "windows"
+    case "freebsd":
+        return "rc"
+    case "darwin":
+        return "launchd"
+    }
+    if _, err := os.Stat("/run/systemd/system"); err == nil {
+        return "systemd"
+    }
+    if _, err := os.Stat("/run/openrc"); err == nil {
+        return "openrc"
+    }
+    if _, err := exec.LookPath("sv"); err == nil {
+        for _, dir := range []string{"/etc/service", "/var/service", "/run/runit/service"} {
+            if _, err := os.Stat(filepath.Join(dir, "smtp-to-gotify")); err == nil {
+                return "runit"
+            }
+        }
+    }
+    return "none"
+}
+
+// initServiceCommand builds the command that performs a service action with the given init system
+func initServiceCommand(initSystem, action string) (*exec.Cmd, error) {
+    switch initSystem {
+    case "systemd":
+        return exec.Command("systemctl", action, "smtp-to-gotify"), nil
+    case "openrc":
+        return exec.Command("rc-service", "smtp-to-gotify", action), nil
+    case "rc":
+        return exec.Command("service", "smtp_to_gotify", action), nil
+    case "runit":
+        if action == "reload" {
+            return exec.Command("sv", "hup", "smtp-to-gotify"), nil
+        }
+        return exec.Command("sv", action, "smtp-to-gotify"), nil
+    case "launchd":
+        target := launchdDomain() + "/" + LaunchdLabel
+        switch action {
+        case "start":
+            return exec.Command("launchctl", "kickstart", target), nil
+        case "stop":
+            return exec.Command("launchctl", "kill", "SIGTERM", target), nil
+        case "restart":
+            return exec.Command("launchctl", "kickstart", "-k", target), nil
+        case "reload":
+            return exec.Command("launchctl", "kill", "SIGHUP", target), nil
+        default:
+            return exec.Command("launchctl", "print", target), nil
+        }
+    case "none":
+        return nil, fmt.Errorf("no supported init system detected, run 'smtp-to-gotify start' to run the server directly")
+    default:
+        return nil, fmt.Errorf("unsupported service manager %q", initSystem)
+    }
+}
+
+// launchdDomain returns the launchctl domain: system daemons for root, the GUI session otherwise
+func launchdDomain() string {
+    if os.Geteuid() == 0 {
+        return "system"
     }
-    serviceItems = sortMenuItems(serviceItems)
-    defaultWidth, defaultHeight := 80, 24
-    return AppModel{
-        CurrentScreen:  "MainMenu",
-        Width:          defaultWidth,
-        Height:         defaultHeight,
-        MainMenu:       list.New(mainItems, list.NewDefaultDelegate(), defaultWidth-2, defaultHeight-10),
-        LoggingMenu:    list.New(loggingItems, list.NewDefaultDelegate(), defaultWidth-2, defaultHeight-10),
-        ProgramConfigs: list.New(programItems, list.NewDefaultDelegate(), defaultWidth-2, defaultHeight-10),
-        SMTPConfigs:    list.New(smtpItems, list.NewDefaultDelegate(), defaultWidth-2, defaultHeight-10),
-        GotifyConfigs:  list.New(gotifyItems, list.NewDefaultDelegate(), defaultWidth-2, defaultHeight-10),
-        ServiceMenu:    list.New(serviceItems, list.NewDefaultDelegate(), defaultWidth-2, defaultHeight-10),
-        LogViewer:      LogViewerModel{Viewport: viewport.New(defaultWidth-2, defaultHeight-10), PageSize: 20, Width: defaultWidth - 2, Height: defaultHeight - 10},
-        StatusViewport: viewport.New(defaultWidth-2, FixedStatusHeight),
-        StatusText:     "Status Panel: SMTP server events will appear here.",
-        Help:           help.New(),
-        Keys:           DefaultKeyMap,
-        Banner:         newBannerModel(defaultWidth/2, defaultHeight/3),
+    return fmt.Sprintf("gui/%d", os.Geteuid())
+}
+
+// launchdPlistPath returns where the launchd job definition is installed
+func launchdPlistPath() string {
+    dir := LaunchdDaemonDir
+    if os.Geteuid() != 0 {
+        home, _ := os.UserHomeDir()
+        dir = filepath.Join(home, LaunchdAgentDir)
     }
+    return filepath.Join(dir, LaunchdLabel+".plist")
 }
 
-// interactiveConfig runs the BubbleTea UI
-func interactiveConfig() error {
-    model := NewAppModel()
-    p := tea.NewProgram(model, tea.WithAltScreen())
-    initStatusUpdater(p)
-    finalModel, err := p.Run()
-    if err != nil {
-        return fmt.Errorf("failed to run bubbletea app: %v", err)
+// launchdPlist generates the launchd job definition for the given binary. KeepAlive only
+// restarts on failure so a stop from the service menu (clean exit) is honoured.
+func launchdPlist(binary string) string {
+    logPath := filepath.Join(stateDirPath, "launchd.log")
+    return fmt.Sprintf(`<?xml version="1.0" encoding="UTF-8"?>
+<!DOCTYPE plist PUBLIC "-//Apple//DTD PLIST 1.0//EN" "http://www.apple.com/DTDs/PropertyList-1.0.dtd">
+<plist version="1.0">
+<dict>
+    <key>Label</key>
+    <string>%s</string>
+    <key>ProgramArguments</key>
+    <array>
+        <string>%s</string>
+        <string>start</string>
+        <string>--config-dir</string>
+        <string>%s</string>
+    </array>
+    <key>EnvironmentVariables</key>
+    <dict>
+        <key>RUN_AS_SERVICE</key>
+        <string>true</string>
+    </dict>
+    <key>WorkingDirectory</key>
+    <string>%s</string>
+    <key>RunAtLoad</key>
+    <true/>
+    <key>KeepAlive</key>
+    <dict>
+        <key>SuccessfulExit</key>
+        <false/>
+    </dict>
+    <key>StandardOutPath</key>
+    <string>%s</string>
+    <key>StandardErrorPath</key>
+    <string>%s</string>
+</dict>
+</plist>
+`, LaunchdLabel, binary, configDirPath, configDirPath, logPath, logPath)
+}
+
+// installService registers smtp-to-gotify with the platform service manager
+func installService() (string, error) {
+    switch runtime.GOOS {
+    case "windows":
+        s, err := newWindowsService(AppConfig{})
+        if err != nil {
+            return "", err
+        }
+        if err := s.Install(); err != nil {
+            return "", err
+        }
+        return fmt.Sprintf("Service %s installed", WindowsServiceName), nil
+    case "darwin":
+        binary, err := os.Executable()
+        if err != nil {
+            return "", fmt.Errorf("failed to locate executable: %v", err)
+        }
+        path := launchdPlistPath()
+        if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+            return "", fmt.Errorf("failed to create %s: %v", filepath.Dir(path), err)
+        }
+        if err := os.WriteFile(path, []byte(launchdPlist(binary)), 0644); err != nil {
+            return "", fmt.Errorf("failed to write launchd plist: %v", err)
+        }
+        if output, err := exec.Command("launchctl", "bootstrap", launchdDomain(), path).CombinedOutput(); err != nil {
+            return "", fmt.Errorf("launchctl bootstrap failed: %v, output: %s", err, string(output))
+        }
+        return fmt.Sprintf("launchd job %s installed at %s", LaunchdLabel, path), nil
+    default:
+        return "", fmt.Errorf("the install command supports Windows and macOS; use install_STG.sh on other platforms")
     }
-    appModel := finalModel.(AppModel)
-    if appModel.Quit && !appModel.StartServer {
-        os.Exit(0)
+}
+
+// uninstallService removes smtp-to-gotify from the platform service manager
+func uninstallService() (string, error) {
+    switch runtime.GOOS {
+    case "windows":
+        s, err := newWindowsService(AppConfig{})
+        if err != nil {
+            return "", err
+        }
+        if err := s.Uninstall(); err != nil {
+            return "", err
+        }
+        return fmt.Sprintf("Service %s removed", WindowsServiceName), nil
+    case "darwin":
+        path := launchdPlistPath()
+        if output, err := exec.Command("launchctl", "bootout", launchdDomain()+"/"+LaunchdLabel).CombinedOutput(); err != nil {
+            appendToStatus(fmt.Sprintf("launchctl bootout failed: %v, output: %s", err, string(output)))
+        }
+        if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+            return "", fmt.Errorf("failed to remove %s: %v", path, err)
+        }
+        return fmt.Sprintf("launchd job %s removed", LaunchdLabel), nil
+    default:
+        return "", fmt.Errorf("the uninstall command supports Windows and macOS; use install_STG.sh --uninstall on other platforms")
     }
-    return nil
 }
 
 // Recommendation 14: Modified startServer for graceful shutdown and specific IP binding
 func startServer(config AppConfig) error {
+    atomic.StoreInt32(&shuttingDown, 0)
+    // The previous list, if the server is restarted from the UI, writes its new bans first
+    ipBans.Close()
+    ipBans = newBanList(config.Ban, banListPath)
+    if err := config.HTTPAuth.validate(); err != nil {
+        logEvent("error", fmt.Sprintf("Invalid configuration: %v", err), fmt.Sprintf("The http_auth section is invalid, the SMTP server was not started: %v", err))
+        return err
+    }
+    connectionLimiter = newRateLimiter(config.RateLimit.Enabled, config.RateLimit.ConnectionsPerMinute)
+    messageLimiter = newRateLimiter(config.RateLimit.Enabled, config.RateLimit.MessagesPerMinute)
+    duplicates = newDuplicateFilter(config.Dedup)
+    authLockout = newAuthLockout(config.AuthLockout)
+    authTarpit = newAuthTarpit(config.AuthTarpit)
+    dataBandwidth = newBandwidthLimiter(config.Limits.MaxBandwidth)
+    // sessionSlots bounds the number of handler goroutines, nil when the cap is disabled
+    var sessionSlots chan struct{}
+    if config.SMTP.MaxSessions > 0 {
+        sessionSlots = make(chan struct{}, config.SMTP.MaxSessions)
+    }
+    state, err := newServerState(config)
+    if err != nil {
+        logEvent("error", fmt.Sprintf("Invalid configuration: %v", err), fmt.Sprintf("The access rules or address lists could not be parsed, the SMTP server was not started: %v", err))
+        return err
+    }
+    setServerState(state)
+    tlsConfig, err := buildTLSConfig(config.TLS)
+    if err != nil {
+        logEvent("error", fmt.Sprintf("Failed to configure TLS: %v", err), fmt.Sprintf("Unable to set up STARTTLS for the SMTP server: %v", err))
+        return fmt.Errorf("failed to configure TLS: %v", err)
+    }
+    serverTLSConfig = tlsConfig
+    store, err := newAttachmentStore(config.Attachments, config.HTTPAuth)
+    if err != nil {
+        logEvent("error", fmt.Sprintf("Failed to set up the attachment store: %v", err), fmt.Sprintf("The attachment store could not be set up, the SMTP server was not started: %v", err))
+        return err
+    }
+    attachmentStore = store
+    // Bound before the SMTP listeners so it is still taken as root when run_as_user is set
+    var attachmentListener net.Listener
+    if store != nil {
+        attachmentListener, err = net.Listen("tcp", config.Attachments.HTTPAddr)
+        if err != nil {
+            logEvent("error", fmt.Sprintf("Failed to start attachment listener on %s: %v", config.Attachments.HTTPAddr, err), fmt.Sprintf("Unable to bind the HTTP listener serving stored attachments on %s: %v", config.Attachments.HTTPAddr, err))
+            return fmt.Errorf("failed to start attachment listener on %s: %v", config.Attachments.HTTPAddr, err)
+        }
+        go func() {
+            if err := http.Serve(attachmentListener, store); err != nil && atomic.LoadInt32(&shuttingDown) == 0 {
+                logEvent("error", fmt.Sprintf("Attachment listener on %s failed: %v", config.Attachments.HTTPAddr, err), fmt.Sprintf("The HTTP listener serving stored attachments on %s stopped, attachment links will not open: %v", config.Attachments.HTTPAddr, err))
+            }
+        }()
+        logEvent("connection", fmt.Sprintf("Serving attachments on %s", config.Attachments.HTTPAddr), fmt.Sprintf("Attachments are stored in %s for %v and served on %s, notifications link to them below %s.", store.config.Dir, config.Attachments.Retention, config.Attachments.HTTPAddr, config.Attachments.BaseURL))
+    }
+    // closeAttachmentListener stops serving attachments when the server stops or fails to start
+    closeAttachmentListener := func() {
+        if attachmentListener != nil {
+            attachmentListener.Close()
+        }
+    }
+    if debugSMTP || config.SMTP.DebugTrace {
+        logEvent("warning", "SMTP debug trace enabled", "Every SMTP command and reply is written to the log with credentials redacted; message headers such as sender and recipient addresses are logged too. Disable it once the client is diagnosed.")
+    }
+    if config.SMTP.RequireTLSForAuth && tlsConfig == nil {
+        logEvent("warning", "AUTH requires TLS but TLS is disabled", "smtp.require_tls_for_auth is enabled while STARTTLS is not configured, so every AUTH attempt will be rejected with 538.")
+    }
+    if config.SMTP.RequireTLS && tlsConfig == nil {
+        logEvent("warning", "Mail requires TLS but TLS is disabled", "smtp.require_tls is enabled while STARTTLS is not configured, so every MAIL command will be rejected with 530.")
+    }
     // Resolve the IP address from Domain (could be a hostname or direct IP)
     bindIP := config.SMTP.Domain
     // If Domain is not a direct IP, attempt to resolve it
     if net.ParseIP(bindIP) == nil {
         ips, err := net.LookupIP(bindIP)
         if err != nil || len(ips) == 0 {
+            closeAttachmentListener()
             logEvent("error", fmt.Sprintf("Failed to resolve IP for domain %s: %v", bindIP, err), fmt.Sprintf("Unable to resolve IP address for binding SMTP server from domain %s: %v", bindIP, err))
             return fmt.Errorf("failed to resolve IP for domain %s: %v", bindIP, err)
         }
@@ -1767,46 +9606,422 @@ func startServer(config AppConfig) error {
     // Start the TCP listener with the constructed address
     listener, err := net.Listen("tcp", bindAddr)
     if err != nil {
+        closeAttachmentListener()
         logEvent("error", fmt.Sprintf("Failed to start TCP listener on %s: %v", bindAddr, err), fmt.Sprintf("Unable to bind TCP listener to address %s for SMTP server startup: %v", bindAddr, err))
         return fmt.Errorf("failed to start TCP listener on %s: %v", bindAddr, err)
     }
     appendToStatus(fmt.Sprintf("SMTP server started on %s (bound to IP %s), forwarding to Gotify at %s", bindAddr, bindIP, config.Gotify.GotifyHost))
     logEvent("connection", fmt.Sprintf("SMTP server started on %s, forwarding to Gotify at %s", bindAddr, config.Gotify.GotifyHost), fmt.Sprintf("SMTP server successfully started and listening on %s, configured to forward incoming emails as notifications to Gotify server at %s.", bindAddr, config.Gotify.GotifyHost))
+    var extraListeners []net.Listener
+    for _, listenerConfig := range config.SMTP.Listeners {
+        extra, err := net.Listen("tcp", listenerConfig.Addr)
+        if err != nil {
+            listener.Close()
+            for _, opened := range extraListeners {
+                opened.Close()
+            }
+            closeAttachmentListener()
+            logEvent("error", fmt.Sprintf("Failed to start TCP listener on %s: %v", listenerConfig.Addr, err), fmt.Sprintf("Unable to bind the additional TCP listener on %s from smtp.listeners: %v", listenerConfig.Addr, err))
+            return fmt.Errorf("failed to start TCP listener on %s: %v", listenerConfig.Addr, err)
+        }
+        extraListeners = append(extraListeners, extra)
+        extraConfig := listenerConfig.apply(config)
+        appendToStatus(fmt.Sprintf("Additional SMTP listener started on %s", listenerConfig.Addr))
+        logEvent("connection", fmt.Sprintf("Additional SMTP listener started on %s", listenerConfig.Addr), fmt.Sprintf("Additional SMTP listener on %s started with auth required: %t, TLS required: %t, TLS required for auth: %t, maximum message size: %d bytes.", listenerConfig.Addr, extraConfig.SMTP.AuthRequired, extraConfig.SMTP.RequireTLS, extraConfig.SMTP.RequireTLSForAuth, extraConfig.SMTP.MaxMessageSize))
+        listenerConfig := listenerConfig
+        go serveListener(extra, &listenerConfig, sessionSlots)
+    }
+    if err := dropPrivileges(config.RunAsUser); err != nil {
+        listener.Close()
+        for _, extra := range extraListeners {
+            extra.Close()
+        }
+        closeAttachmentListener()
+        logEvent("error", fmt.Sprintf("Failed to switch to user %s: %v", config.RunAsUser, err), fmt.Sprintf("The listeners were bound but the server could not drop its privileges to run_as_user %s, so it was stopped instead of handling mail as root: %v", config.RunAsUser, err))
+        return err
+    }
     sigChan := make(chan os.Signal, 1)
     signal.Notify(sigChan, os.Interrupt, syscall.SIGTERM)
+    publishDone := make(chan struct{})
+    go sessions.publish(publishDone)
+    if tlsReloader != nil {
+        go tlsReloader.watch(publishDone)
+    }
+    go watchReload(publishDone)
+    if store != nil {
+        go store.expire(publishDone)
+    }
+    if duplicates != nil {
+        go duplicates.sweep(publishDone)
+    }
+    var shutdownOnce sync.Once
+    stopServer = func() {
+        shutdownOnce.Do(func() {
+            close(publishDone)
+            // Keep accepting briefly so new clients get a 421 instead of a reset, and
+            // close idle sessions; the second pass catches sessions that were mid-command
+            atomic.StoreInt32(&shuttingDown, 1)
+            sessions.InterruptIdle()
+            time.Sleep(ShutdownDrainTime)
+            sessions.InterruptIdle()
+            if err := listener.Close(); err != nil {
+                logEvent("error", fmt.Sprintf("Error closing listener: %v", err), fmt.Sprintf("Failed to close TCP listener on %s during shutdown: %v", bindAddr, err))
+            }
+            for _, extra := range extraListeners {
+                if err := extra.Close(); err != nil {
+                    logEvent("error", fmt.Sprintf("Error closing listener: %v", err), fmt.Sprintf("Failed to close TCP listener on %s during shutdown: %v", extra.Addr(), err))
+                }
+            }
+            closeAttachmentListener()
+            // Recommendation 14: Wait for active connections to complete with timeout
+            shutdownTimeout := 30 * time.Second
+            shutdownChan := make(chan struct{})
+            go func() {
+                activeConnections.Wait()
+                close(shutdownChan)
+            }()
+            logEvent("overload", fmt.Sprintf("Shed load: %d connections, %d MAIL commands", atomic.LoadInt64(&metrics.ShedConnections), atomic.LoadInt64(&metrics.ShedMail)), fmt.Sprintf("Over the lifetime of the SMTP server on %s, %d connections were refused with 421 and %d MAIL commands were deferred with 452 because of overload.", config.SMTP.Addr, atomic.LoadInt64(&metrics.ShedConnections), atomic.LoadInt64(&metrics.ShedMail)))
+            select {
+            case <-shutdownChan:
+                logEvent("connection", "All active connections closed, shutdown complete.", fmt.Sprintf("Graceful shutdown completed, all SMTP connections on %s have been closed.", bindAddr))
+            case <-time.After(shutdownTimeout):
+                logEvent("warning", "Shutdown timeout reached, forcing exit with active connections.", fmt.Sprintf("Graceful shutdown timeout of %v reached, forcing exit while connections may still be active on %s.", shutdownTimeout, bindAddr))
+            }
+        })
+    }
     go func() {
         <-sigChan
         logEvent("connection", "Received shutdown signal, closing listener...", fmt.Sprintf("Received system signal to terminate (SIGTERM or SIGINT), initiating graceful shutdown of SMTP server by closing listener on %s.", bindAddr))
-        if err := listener.Close(); err != nil {
-            logEvent("error", fmt.Sprintf("Error closing listener: %v", err), fmt.Sprintf("Failed to close TCP listener on %s during shutdown: %v", bindAddr, err))
+        stopServer()
+        ipBans.Close()
+        os.Exit(0)
+    }()
+    serveListener(listener, nil, sessionSlots)
+    return nil
+}
+
+// setProcessIdentity switches the process to a user ID, group ID and supplementary groups.
+// privdrop_unix.go sets it; it stays nil when the binary was built without that file.
+var setProcessIdentity func(uid, gid int, groups []int) error
+
+// dropPrivileges switches the process to the named account. It is called once every
+// listener is bound, so low ports can be used without handling traffic as root.
+func dropPrivileges(name string) error {
+    if name == "" {
+        return nil
+    }
+    if setProcessIdentity == nil {
+        return fmt.Errorf("run_as_user is not supported by this build on %s", runtime.GOOS)
+    }
+    account, err := user.Lookup(name)
+    if err != nil {
+        return fmt.Errorf("failed to look up user %s: %v", name, err)
+    }
+    uid, err := strconv.Atoi(account.Uid)
+    if err != nil {
+        return fmt.Errorf("invalid user ID %s for %s: %v", account.Uid, name, err)
+    }
+    gid, err := strconv.Atoi(account.Gid)
+    if err != nil {
+        return fmt.Errorf("invalid group ID %s for %s: %v", account.Gid, name, err)
+    }
+    if os.Geteuid() == uid {
+        return nil
+    }
+    if os.Geteuid() != 0 {
+        return fmt.Errorf("switching to user %s requires starting as root, running as user ID %d", name, os.Geteuid())
+    }
+    groups := []int{gid}
+    if ids, err := account.GroupIds(); err == nil {
+        for _, id := range ids {
+            if n, err := strconv.Atoi(id); err == nil && n != gid {
+                groups = append(groups, n)
+            }
         }
-        // Recommendation 14: Wait for active connections to complete with timeout
-        shutdownTimeout := 30 * time.Second
-        shutdownChan := make(chan struct{})
-        go func() {
-            activeConnections.Wait()
-            close(shutdownChan)
-        }()
+    }
+    if err := setProcessIdentity(uid, gid, groups); err != nil {
+        return err
+    }
+    appendToStatus(fmt.Sprintf("Running as user %s", name))
+    logEvent("config", fmt.Sprintf("Dropped privileges to user %s", name), fmt.Sprintf("All listeners are bound, the server now runs as %s (uid %d, gid %d). The state directory %s and data directory %s must be writable, and the configuration and certificate files readable, by this user for logging, bans, reloads and certificate renewal to keep working.", name, uid, gid, stateDirPath, dataDirPath))
+    return nil
+}
+
+// serverState is what new sessions are started with. A reload replaces it as a whole,
+// so sessions already running keep the settings they were accepted with.
+type serverState struct {
+    config            AppConfig
+    access            *AccessList
+    allowedRecipients *AddressFilter
+    allowedSenders    *AddressFilter
+    deniedSenders     *AddressFilter
+    authExempt        []*net.IPNet
+    xclientTrusted    []*net.IPNet
+    transforms        []transform
+    priorityRules     []priorityRule
+}
+
+// newServerState builds the access rules and address lists derived from config
+func newServerState(config AppConfig) (*serverState, error) {
+    access, err := newAccessList(config.Access)
+    if err != nil {
+        return nil, fmt.Errorf("invalid access rules: %v", err)
+    }
+    authExempt, err := parseNetworks(config.SMTP.AuthExemptNetworks)
+    if err != nil {
+        return nil, fmt.Errorf("invalid smtp.auth_exempt_networks: %v", err)
+    }
+    for i, listener := range config.SMTP.Listeners {
+        if !validListenerProfile(listener.Profile) {
+            return nil, fmt.Errorf("smtp.listeners entry %d: unknown profile %q, use \"submission\" or leave it empty", i+1, listener.Profile)
+        }
+    }
+    xclientTrusted, err := parseNetworks(config.SMTP.XClientTrusted)
+    if err != nil {
+        return nil, fmt.Errorf("invalid smtp.xclient_trusted: %v", err)
+    }
+    if !validTruncateAt(config.Gotify.TruncateAt) {
+        return nil, fmt.Errorf("unknown gotify.truncate_at %q, use \"char\", \"word\" or \"line\"", config.Gotify.TruncateAt)
+    }
+    if backend := config.SpamFilter.Backend; backend != "rspamd" && backend != "spamd" {
+        return nil, fmt.Errorf("unknown spam_filter.backend %q, use \"rspamd\" or \"spamd\"", backend)
+    }
+    if action := config.SpamFilter.Action; action != "drop" && action != "priority" && action != "tag" {
+        return nil, fmt.Errorf("unknown spam_filter.action %q, use \"drop\", \"priority\" or \"tag\"", action)
+    }
+    if action := config.SPF.Action; action != "log" && action != "tag" && action != "reject" {
+        return nil, fmt.Errorf("unknown spf.action %q, use \"log\", \"tag\" or \"reject\"", action)
+    }
+    if show := config.Gotify.ShowHeaders; show != "" && show != "none" && show != "body" && show != "extras" {
+        return nil, fmt.Errorf("unknown gotify.show_headers %q, use \"none\", \"body\" or \"extras\"", show)
+    }
+    templates := map[string]string{"gotify.title_template": config.Gotify.TitleTemplate, "gotify.message_template": config.Gotify.MessageTemplate, "gotify.click_url": config.Gotify.ClickURL}
+    for i, user := range config.SMTP.Users {
+        templates[fmt.Sprintf("click_url of smtp.users entry %d", i+1)] = user.ClickURL
+    }
+    for name, text := range templates {
+        if _, err := template.New(name).Parse(text); err != nil {
+            return nil, fmt.Errorf("invalid %s: %v", name, err)
+        }
+    }
+    if err := compileClickPattern(&config.Gotify); err != nil {
+        return nil, err
+    }
+    if mode := config.Gotify.JSONBody; mode != "" && mode != "none" && mode != "pretty" && mode != "fields" {
+        return nil, fmt.Errorf("unknown gotify.json_body %q, use \"none\", \"pretty\" or \"fields\"", mode)
+    }
+    if mode := config.Gotify.Sanitize; mode != "" && mode != "none" && mode != "strip" && mode != "escape" {
+        return nil, fmt.Errorf("unknown gotify.sanitize %q, use \"none\", \"strip\" or \"escape\"", mode)
+    }
+    if !validBodyPreference(config.Gotify.BodyPreference) {
+        return nil, fmt.Errorf("unknown gotify.body_preference %q, use \"plain\", \"html\" or \"plain_fallback\"", config.Gotify.BodyPreference)
+    }
+    for i, user := range config.SMTP.Users {
+        if !validTruncateAt(user.TruncateAt) {
+            return nil, fmt.Errorf("smtp.users entry %d: unknown truncate_at %q, use \"char\", \"word\" or \"line\"", i+1, user.TruncateAt)
+        }
+        if !validBodyPreference(user.BodyPreference) {
+            return nil, fmt.Errorf("smtp.users entry %d: unknown body_preference %q, use \"plain\", \"html\" or \"plain_fallback\"", i+1, user.BodyPreference)
+        }
+    }
+    state := &serverState{config: config, access: access, authExempt: authExempt, xclientTrusted: xclientTrusted}
+    for _, list := range []struct {
+        key     string
+        entries []string
+        filter  **AddressFilter
+    }{
+        {"smtp.allowed_recipients", config.SMTP.AllowedRecipients, &state.allowedRecipients},
+        {"smtp.allowed_senders", config.SMTP.AllowedSenders, &state.allowedSenders},
+        {"smtp.denied_senders", config.SMTP.DeniedSenders, &state.deniedSenders},
+    } {
+        filter, err := newAddressFilter(list.entries)
+        if err != nil {
+            return nil, fmt.Errorf("invalid %s: %v", list.key, err)
+        }
+        *list.filter = filter
+    }
+    if state.transforms, err = compileTransforms(config.Transforms); err != nil {
+        return nil, err
+    }
+    if state.priorityRules, err = compilePriorityRules(config.PriorityRules); err != nil {
+        return nil, err
+    }
+    for i, rule := range config.SubjectPrefixes {
+        if strings.TrimSpace(rule.Prefix) == "" {
+            return nil, fmt.Errorf("subject_prefixes entry %d needs a prefix", i+1)
+        }
+    }
+    return state, nil
+}
+
+// networksContain reports whether addr lies in one of networks
+func networksContain(networks []*net.IPNet, addr string) bool {
+    ip := net.ParseIP(addr)
+    if ip == nil {
+        return false
+    }
+    for _, network := range networks {
+        if network.Contains(ip) {
+            return true
+        }
+    }
+    return false
+}
+
+// exemptFromAuth reports whether addr is in smtp.auth_exempt_networks
+func (s *serverState) exemptFromAuth(addr string) bool {
+    return networksContain(s.authExempt, addr)
+}
+
+// trustsXClient reports whether addr is a front-end proxy listed in smtp.xclient_trusted
+func (s *serverState) trustsXClient(addr string) bool {
+    return networksContain(s.xclientTrusted, addr)
+}
+
+// forListener returns the state for sessions on an additional listener. The listener's
+// current policy is looked up by address, so a reload can change it; a listener no
+// longer in the config keeps the policy it was started with.
+func (s *serverState) forListener(started ListenerConfig) *serverState {
+    policy := started
+    for _, listenerConfig := range s.config.SMTP.Listeners {
+        if listenerConfig.Addr == started.Addr {
+            policy = listenerConfig
+            break
+        }
+    }
+    state := *s
+    state.config = policy.apply(s.config)
+    return &state
+}
+
+// currentServerState returns the settings for a new session
+func currentServerState() *serverState {
+    liveStateMutex.RLock()
+    defer liveStateMutex.RUnlock()
+    return liveState
+}
+
+// setServerState replaces the settings for new sessions
+func setServerState(state *serverState) {
+    liveStateMutex.Lock()
+    liveState = state
+    liveStateMutex.Unlock()
+}
+
+// reloadConfig re-reads the configuration and applies it to new sessions. Listen
+// addresses, TLS, the session cap and the ban, rate limit and lockout trackers keep
+// their startup settings until the next restart.
+func reloadConfig() error {
+    config, err := loadConfig()
+    var state *serverState
+    if err == nil {
+        state, err = newServerState(config)
+    }
+    if err != nil {
+        logEvent("error", fmt.Sprintf("Configuration reload failed: %v", err), fmt.Sprintf("The configuration could not be reloaded, new sessions keep using the previous settings: %v", err))
+        return err
+    }
+    previous := currentServerState()
+    setServerState(state)
+    appendToStatus("Configuration reloaded")
+    logEvent("config", "Configuration reloaded", "The configuration was re-read; new SMTP sessions use the new Gotify, authentication and filtering settings while running sessions finish with the old ones.")
+    if previous == nil {
+        return nil
+    }
+    var restart []string
+    if config.SMTP.Addr != previous.config.SMTP.Addr || fmt.Sprint(config.SMTP.Listeners) != fmt.Sprint(previous.config.SMTP.Listeners) {
+        restart = append(restart, "listen addresses")
+    }
+    if fmt.Sprint(config.TLS) != fmt.Sprint(previous.config.TLS) {
+        restart = append(restart, "tls")
+    }
+    if config.SMTP.MaxSessions != previous.config.SMTP.MaxSessions {
+        restart = append(restart, "smtp.max_sessions")
+    }
+    if config.Ban != previous.config.Ban || config.RateLimit != previous.config.RateLimit || config.AuthLockout != previous.config.AuthLockout || config.AuthTarpit != previous.config.AuthTarpit {
+        restart = append(restart, "ban, rate_limit, auth_lockout and auth_tarpit")
+    }
+    if config.Limits.MaxBandwidth != previous.config.Limits.MaxBandwidth {
+        restart = append(restart, "limits.max_bandwidth")
+    }
+    if config.Attachments != previous.config.Attachments || config.HTTPAuth != previous.config.HTTPAuth {
+        restart = append(restart, "attachments and http_auth")
+    }
+    if config.Dedup != previous.config.Dedup {
+        restart = append(restart, "dedup")
+    }
+    if config.RunAsUser != previous.config.RunAsUser {
+        restart = append(restart, "run_as_user")
+    }
+    if len(restart) > 0 {
+        logEvent("warning", "Some changed settings need a restart", fmt.Sprintf("The changes to %s only take effect after the service is restarted.", strings.Join(restart, ", ")))
+    }
+    return nil
+}
+
+// watchReload reloads the configuration on SIGHUP until done is closed
+func watchReload(done <-chan struct{}) {
+    hupChan := make(chan os.Signal, 1)
+    signal.Notify(hupChan, syscall.SIGHUP)
+    defer signal.Stop(hupChan)
+    for {
         select {
-        case <-shutdownChan:
-            logEvent("connection", "All active connections closed, shutdown complete.", fmt.Sprintf("Graceful shutdown completed, all SMTP connections on %s have been closed.", bindAddr))
-        case <-time.After(shutdownTimeout):
-            logEvent("warning", "Shutdown timeout reached, forcing exit with active connections.", fmt.Sprintf("Graceful shutdown timeout of %v reached, forcing exit while connections may still be active on %s.", shutdownTimeout, bindAddr))
+        case <-done:
+            return
+        case <-hupChan:
+            reloadConfig()
         }
-        os.Exit(0)
-    }()
+    }
+}
+
+// serveListener accepts connections until the listener is closed, applying the access
+// rules and the session cap shared by all listeners before starting a handler. extra is
+// the policy of an additional listener, nil for the primary one.
+func serveListener(listener net.Listener, extra *ListenerConfig, sessionSlots chan struct{}) {
     for {
         conn, err := listener.Accept()
         if err != nil {
             if opErr, ok := err.(*net.OpError); ok && opErr.Op == "accept" {
-                break
+                return
             }
-            logEvent("error", fmt.Sprintf("Error accepting connection: %v", err), fmt.Sprintf("Failed to accept incoming TCP connection on %s: %v", bindAddr, err))
+            logEvent("error", fmt.Sprintf("Error accepting connection: %v", err), fmt.Sprintf("Failed to accept incoming TCP connection on %s: %v", listener.Addr(), err))
+            continue
+        }
+        remoteAddr := conn.RemoteAddr().String()
+        state := currentServerState()
+        if extra != nil {
+            state = state.forListener(*extra)
+        }
+        if atomic.LoadInt32(&shuttingDown) == 1 {
+            conn.SetWriteDeadline(time.Now().Add(SessionLimitReplyTimeout))
+            fmt.Fprintf(conn, "421 4.3.2 %s Service shutting down\r\n", state.config.SMTP.Domain)
+            conn.Close()
+            logEvent("connection", fmt.Sprintf("Refused connection from %s: shutting down", remoteAddr), fmt.Sprintf("Connection from %s arrived during graceful shutdown and was answered with 421.", remoteAddr))
+            continue
+        }
+        if allowed, reason := state.access.Check(remoteIP(remoteAddr)); !allowed {
+            conn.Close()
+            logEvent("access_denied", fmt.Sprintf("Refused connection from %s: %s", remoteAddr, reason), fmt.Sprintf("Connection from %s was closed before the SMTP greeting because the address is %s by the access rules.", remoteAddr, reason))
+            continue
+        }
+        if sessionSlots == nil {
+            go handleConnection(conn, state)
             continue
         }
-        go handleConnection(conn, config)
+        select {
+        case sessionSlots <- struct{}{}:
+            go func() {
+                defer func() { <-sessionSlots }()
+                handleConnection(conn, state)
+            }()
+        default:
+            shed := atomic.AddInt64(&metrics.ShedConnections, 1)
+            conn.SetWriteDeadline(time.Now().Add(SessionLimitReplyTimeout))
+            fmt.Fprintf(conn, "421 4.7.0 %s Too many connections, try again later\r\n", state.config.SMTP.Domain)
+            conn.Close()
+            logEvent("overload", fmt.Sprintf("Refused connection from %s: session limit reached", remoteAddr), fmt.Sprintf("Connection from %s was answered with 421 because all %d session slots are in use. Connections shed so far: %d, total shed: %d.", remoteAddr, cap(sessionSlots), shed, metrics.ShedTotal()))
+        }
     }
-    return nil
 }
 
 func main() {
@@ -1814,11 +10029,30 @@ func main() {
         Use:   "smtp-to-gotify",
         Short: "A local SMTP server that forwards emails to Gotify",
     }
-    if err := initLogger(); err != nil {
-        fmt.Fprintf(os.Stderr, "Failed to initialize logger: %v\n", err)
-        os.Exit(1)
+    rootCmd.PersistentPreRun = func(cmd *cobra.Command, args []string) {
+        if cmd.Flags().Changed("config-dir") {
+            setConfigDir(configDirPath)
+        }
+        if !containerMode {
+            containerMode = detectContainer()
+        }
+        // Terminals without cursor addressing or colors get the plain UI automatically
+        if !plainMode && os.Getenv("TERM") == "dumb" {
+            plainMode = true
+        }
+        if plainMode {
+            applyPlainStyles()
+        }
+        if err := initLogger(); err != nil {
+            fmt.Fprintf(os.Stderr, "Failed to initialize logger: %v\n", err)
+            os.Exit(1)
+        }
     }
-    defer zapLogger.Sync()
+    defer func() {
+        if zapLogger != nil {
+            zapLogger.Sync()
+        }
+    }()
     var startCmd = &cobra.Command{
         Use:   "start",
         Short: "Start the SMTP server directly",
@@ -1829,6 +10063,17 @@ func main() {
                 logEvent("error", fmt.Sprintf("Failed to load config: %v", err), fmt.Sprintf("Failed to load application configuration from file or environment variables: %v", err))
                 os.Exit(1)
             }
+            if runningAsWindowsService() {
+                s, err := newWindowsService(config)
+                if err == nil {
+                    err = s.Run()
+                }
+                if err != nil {
+                    logEvent("error", fmt.Sprintf("Windows service failed: %v", err), fmt.Sprintf("Running under the Windows service manager failed: %v", err))
+                    os.Exit(1)
+                }
+                return
+            }
             if err := startServer(config); err != nil {
                 fmt.Fprintf(os.Stderr, "Failed to start SMTP server: %v\n", err)
                 logEvent("error", fmt.Sprintf("Failed to start SMTP server: %v", err), fmt.Sprintf("SMTP server failed to start due to configuration or network issues: %v", err))
@@ -1840,6 +10085,10 @@ func main() {
         Use:   "config",
         Short: "Run interactive configuration UI",
         Run: func(cmd *cobra.Command, args []string) {
+            if !stdinIsTerminal() {
+                fmt.Fprintf(os.Stderr, "The interactive configuration UI needs a terminal; use 'start' or SMTP_TO_GOTIFY_* environment variables instead\n")
+                os.Exit(1)
+            }
             config, err := loadConfig()
             if err != nil {
                 fmt.Fprintf(os.Stderr, "Failed to load config: %v\n", err)
@@ -1866,7 +10115,68 @@ func main() {
     }
     rootCmd.PersistentFlags().StringVar(&configDirPath, "config-dir", configDirPath, "Directory for configuration files")
     viper.BindPFlag("config_dir", rootCmd.PersistentFlags().Lookup("config-dir"))
-    rootCmd.AddCommand(startCmd, configCmd)
+    rootCmd.PersistentFlags().BoolVar(&containerMode, "container", false, "Run in container mode (log to stdout, no interactive UI, settings from environment)")
+    rootCmd.PersistentFlags().BoolVar(&debugSMTP, "debug-smtp", false, "Log every SMTP command and reply (credentials redacted) to diagnose clients that fail mid-handshake")
+    rootCmd.PersistentFlags().BoolVar(&plainMode, "plain", false, "Use a plain line-oriented UI without alt-screen, animation, colors or box drawing (for screen readers and dumb terminals)")
+    var installCmd = &cobra.Command{
+        Use:   "install",
+        Short: "Register smtp-to-gotify as a Windows service or launchd job",
+        Run: func(cmd *cobra.Command, args []string) {
+            result, err := installService()
+            auditEvent("service_install", auditResult(err))
+            if err != nil {
+                fmt.Fprintf(os.Stderr, "Failed to install service: %v\n", err)
+                os.Exit(1)
+            }
+            fmt.Println(result)
+        },
+    }
+    var uninstallCmd = &cobra.Command{
+        Use:   "uninstall",
+        Short: "Remove the smtp-to-gotify Windows service or launchd job",
+        Run: func(cmd *cobra.Command, args []string) {
+            result, err := uninstallService()
+            auditEvent("service_uninstall", auditResult(err))
+            if err != nil {
+                fmt.Fprintf(os.Stderr, "Failed to uninstall service: %v\n", err)
+                os.Exit(1)
+            }
+            fmt.Println(result)
+        },
+    }
+    var reloadCmd = &cobra.Command{
+        Use:   "reload",
+        Short: "Make the running service re-read its configuration (same as SIGHUP)",
+        Run: func(cmd *cobra.Command, args []string) {
+            output, err := serviceControl("reload")
+            auditEvent("service_reload", auditResult(err))
+            if err != nil {
+                fmt.Fprintf(os.Stderr, "Failed to reload service: %v\n%s", err, output)
+                os.Exit(1)
+            }
+            fmt.Println(strings.TrimSpace(output))
+        },
+    }
+    var sendmailCmd = &cobra.Command{
+        Use:   "sendmail [-t] [-i] [-f sender] [recipient...]",
+        Short: "Send a message read from stdin to Gotify, like /usr/sbin/sendmail",
+        Long:  "Reads an RFC 822 message from standard input and forwards it to Gotify without going through the SMTP listener, so cron and local scripts can use it as their sendmail. Use SMTP_TO_GOTIFY_CONFIG_DIR to choose the configuration, since sendmail options are parsed instead of the usual flags.",
+        // sendmail options such as -t, -oi and -f are not cobra flags
+        DisableFlagParsing: true,
+        Run: func(cmd *cobra.Command, args []string) {
+            config, err := loadConfig()
+            if err != nil {
+                fmt.Fprintf(os.Stderr, "Failed to load config: %v\n", err)
+                logEvent("error", fmt.Sprintf("Failed to load config: %v", err), fmt.Sprintf("Failed to load application configuration for the sendmail command: %v", err))
+                os.Exit(1)
+            }
+            if err := runSendmail(config, args, os.Stdin); err != nil {
+                fmt.Fprintf(os.Stderr, "sendmail: %v\n", err)
+                os.Exit(1)
+            }
+        },
+    }
+    rootCmd.AddCommand(startCmd, configCmd, reloadCmd, sendmailCmd, installCmd, uninstallCmd)
     rootCmd.Run = func(cmd *cobra.Command, args []string) {
         config, err := loadConfig()
         if err != nil {
@@ -1874,7 +10184,7 @@ func main() {
             logEvent("error", fmt.Sprintf("Failed to load config: %v", err), fmt.Sprintf("Failed to load application configuration on default run: %v", err))
             os.Exit(1)
         }
-        if os.Getenv("RUN_AS_SERVICE") == "true" {
+        if os.Getenv("RUN_AS_SERVICE") == "true" || containerMode || !stdinIsTerminal() {
             if err := startServer(config); err != nil {
                 fmt.Fprintf(os.Stderr, "Failed to start SMTP server: %v\n", err)
                 logEvent("error", fmt.Sprintf("Failed to start SMTP server: %v", err), fmt.Sprintf("SMTP server failed to start when running as a service: %v", err))
@@ -0,0 +1,163 @@
+package main
+
+// Tests of the SPF evaluation against a stub resolver. Like protocol_test.go they are
+// run with one of the two builds named explicitly:
+//
+//     go test main.go privdrop_unix.go spf_test.go
+//     go test sc_debian.go privdrop_unix.go spf_test.go
+
+import (
+    "context"
+    "net"
+    "testing"
+)
+
+// stubResolver answers SPF lookups from maps; names in fail answer with a server failure,
+// other names missing from a map do not exist
+type stubResolver struct {
+    txt   map[string][]string
+    mx    map[string][]*net.MX
+    hosts map[string][]string
+    fail  map[string]bool
+}
+
+func (r stubResolver) lookup(name string, found bool) error {
+    if r.fail[name] {
+        return &net.DNSError{Err: "server misbehaving", Name: name, IsTemporary: true}
+    }
+    if !found {
+        return &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+    }
+    return nil
+}
+
+func (r stubResolver) LookupTXT(ctx context.Context, name string) ([]string, error) {
+    records, ok := r.txt[name]
+    return records, r.lookup(name, ok)
+}
+
+func (r stubResolver) LookupMX(ctx context.Context, name string) ([]*net.MX, error) {
+    mxs, ok := r.mx[name]
+    return mxs, r.lookup(name, ok)
+}
+
+func (r stubResolver) LookupHost(ctx context.Context, host string) ([]string, error) {
+    addrs, ok := r.hosts[host]
+    return addrs, r.lookup(host, ok)
+}
+
+func (r stubResolver) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+    addrs, err := r.LookupHost(ctx, host)
+    var ips []net.IPAddr
+    for _, addr := range addrs {
+        ips = append(ips, net.IPAddr{IP: net.ParseIP(addr)})
+    }
+    return ips, err
+}
+
+// The examples of RFC 7208 section 7.4
+func TestSPFExpand(t *testing.T) {
+    tests := []struct {
+        ip, spec, want string
+    }{
+        {"192.0.2.3", "%{s}", "strong-bad@email.example.com"},
+        {"192.0.2.3", "%{o}", "email.example.com"},
+        {"192.0.2.3", "%{d}", "email.example.com"},
+        {"192.0.2.3", "%{d4}", "email.example.com"},
+        {"192.0.2.3", "%{d3}", "email.example.com"},
+        {"192.0.2.3", "%{d2}", "example.com"},
+        {"192.0.2.3", "%{d1}", "com"},
+        {"192.0.2.3", "%{dr}", "com.example.email"},
+        {"192.0.2.3", "%{d2r}", "example.email"},
+        {"192.0.2.3", "%{l}", "strong-bad"},
+        {"192.0.2.3", "%{l-}", "strong.bad"},
+        {"192.0.2.3", "%{lr}", "strong-bad"},
+        {"192.0.2.3", "%{lr-}", "bad.strong"},
+        {"192.0.2.3", "%{l1r-}", "strong"},
+        {"192.0.2.3", "%{ir}.%{v}._spf.%{d2}", "3.2.0.192.in-addr._spf.example.com"},
+        {"192.0.2.3", "%{lr-}.lp._spf.%{d2}", "bad.strong.lp._spf.example.com"},
+        {"192.0.2.3", "%{lr-}.lp.%{ir}.%{v}._spf.%{d2}", "bad.strong.lp.3.2.0.192.in-addr._spf.example.com"},
+        {"192.0.2.3", "%{ir}.%{v}.%{l1r-}.lp._spf.%{d2}", "3.2.0.192.in-addr.strong.lp._spf.example.com"},
+        {"192.0.2.3", "%{d2}.trusted-domains.example.net", "example.com.trusted-domains.example.net"},
+        {"2001:db8::cb01", "%{ir}.%{v}._spf.%{d2}", "1.0.b.c.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2.ip6._spf.example.com"},
+        {"192.0.2.3", "%%%_%-", "% %20"},
+    }
+    for _, test := range tests {
+        check := &spfCheck{ip: net.ParseIP(test.ip), sender: "strong-bad@email.example.com"}
+        got, ok := check.expand(test.spec, "email.example.com")
+        if !ok || got != test.want {
+            t.Errorf("expand(%q) for %s = %q, %v, want %q", test.spec, test.ip, got, ok, test.want)
+        }
+    }
+    for _, spec := range []string{"%", "%{", "%{x}", "%{}", "%a"} {
+        check := &spfCheck{ip: net.ParseIP("192.0.2.3"), sender: "strong-bad@email.example.com"}
+        if got, ok := check.expand(spec, "email.example.com"); ok {
+            t.Errorf("expand(%q) = %q, want an invalid macro", spec, got)
+        }
+    }
+}
+
+func TestSPFMechanism(t *testing.T) {
+    resolver := stubResolver{
+        txt: map[string][]string{
+            "relay.example.net":  {"v=spf1 ip4:192.0.2.0/24 -all"},
+            "broken.example.net": {"v=spf1 -all", "v=spf1 +all"},
+        },
+        mx: map[string][]*net.MX{
+            "example.com": {{Host: "mx.example.com", Pref: 10}},
+        },
+        hosts: map[string][]string{
+            "example.com":                         {"198.51.100.1"},
+            "mx.example.com":                      {"192.0.2.3", "2001:db8::25"},
+            "v6.example.com":                      {"2001:db8::cb01"},
+            "3.2.0.192.in-addr.allow.example.com": {"127.0.0.2"},
+        },
+        fail: map[string]bool{
+            "down.example.com":                   true,
+            "3.2.0.192.in-addr.down.example.com": true,
+        },
+    }
+    tests := []struct {
+        ip, term string
+        lookups  int
+        matched  bool
+        result   string
+    }{
+        {"192.0.2.3", "all", 0, true, ""},
+        {"192.0.2.3", "ip4:192.0.2.0/24", 0, true, ""},
+        {"192.0.2.3", "ip4:192.0.2.4", 0, false, ""},
+        {"192.0.2.3", "ip4:192.0.2.0/33", 0, false, "permerror"},
+        {"2001:db8::cb01", "ip6:2001:db8::/32", 0, true, ""},
+        {"192.0.2.3", "ip6:2001:db8::/32", 0, false, ""},
+        {"192.0.2.3", "a", 0, false, ""},
+        {"198.51.100.1", "a", 0, true, ""},
+        {"198.51.100.7", "a/24", 0, true, ""},
+        {"192.0.2.3", "a:mx.example.com", 0, true, ""},
+        {"2001:db8::cb02", "a:v6.example.com//64", 0, true, ""},
+        {"192.0.2.3", "a:missing.example.com", 0, false, ""},
+        {"192.0.2.3", "a:down.example.com", 0, false, "temperror"},
+        {"192.0.2.3", "mx", 0, true, ""},
+        {"2001:db8::25", "mx", 0, true, ""},
+        {"192.0.2.3", "mx:down.example.com", 0, false, "temperror"},
+        {"192.0.2.3", "mx", SPFMaxLookups, false, "permerror"},
+        {"192.0.2.3", "include:relay.example.net", 0, true, ""},
+        {"198.51.100.1", "include:relay.example.net", 0, false, ""},
+        {"192.0.2.3", "include:broken.example.net", 0, false, "permerror"},
+        {"192.0.2.3", "include:missing.example.net", 0, false, "permerror"},
+        {"192.0.2.3", "exists:%{ir}.%{v}.allow.%{d}", 0, true, ""},
+        {"192.0.2.4", "exists:%{ir}.%{v}.allow.%{d}", 0, false, ""},
+        {"192.0.2.3", "exists:%{ir}.%{v}.down.%{d}", 0, false, "temperror"},
+        {"192.0.2.3", "exists:%{ir}.%{v}.allow.%{d}", SPFMaxLookups, false, "permerror"},
+        {"192.0.2.3", "ptr", 0, false, ""},
+        {"192.0.2.3", "ptr:example.com", SPFMaxLookups, false, "permerror"},
+        {"192.0.2.3", "exists:%{x}", 0, false, "permerror"},
+        {"192.0.2.3", "unknown", 0, false, "permerror"},
+    }
+    for _, test := range tests {
+        check := &spfCheck{ctx: context.Background(), resolver: resolver, ip: net.ParseIP(test.ip), sender: "alerts@example.com", lookups: test.lookups}
+        matched, result := check.mechanism(test.term, "example.com")
+        if matched != test.matched || result != test.result {
+            t.Errorf("mechanism(%q) for %s after %d lookups = %v, %q, want %v, %q", test.term, test.ip, test.lookups, matched, result, test.matched, test.result)
+        }
+    }
+}